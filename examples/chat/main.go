@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -15,7 +17,7 @@ import (
 // Listen P2P messages
 func listen(peer *p2p.Peer) {
 	for {
-		message, err := peer.Listen()
+		message, err := peer.Listen(context.Background())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -24,10 +26,25 @@ func listen(peer *p2p.Peer) {
 	}
 }
 
+// Waits until the given peer joins the network
+func waitFor(peer *p2p.Peer, peername string) error {
+	if err := peer.Watch(context.Background(), peername); err != nil {
+		return err
+	}
+	defer peer.Unwatch(context.Background())
+
+	for event := range peer.Events() {
+		if event.Peername == peername && event.Presence != p2p.PRESENCE_LEFT {
+			return nil
+		}
+	}
+	return nil
+}
+
 // Disconnect from stun server on ctrl^C
 func onSigterm(peer *p2p.Peer, sigs chan os.Signal) {
 	<-sigs
-	if err := peer.Disconnect(); err != nil {
+	if err := peer.Disconnect(context.Background()); err != nil {
 		fmt.Println(err)
 	}
 	fmt.Println("\nDisconnected")
@@ -56,7 +73,10 @@ func main() {
 	// register peer and initialize it into the
 	// network
 	fmt.Println("Connecting peer to network... ")
-	err = peer.Init()
+	err = peer.Init(context.Background())
+	if errors.Is(err, p2p.ErrNameTaken) {
+		log.Fatal("Peer name ", peername, " is already taken")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -72,7 +92,14 @@ func main() {
 		peername := make([]byte, 2048)
 		fmt.Scanln(&peername)
 
-		writer, err = peer.Connect(string(peername))
+		writer, err = peer.Connect(context.Background(), string(peername))
+		if errors.Is(err, p2p.ErrPeerNotFound) {
+			fmt.Println("Peer", string(peername), "is not connected, waiting for him...")
+			if err := waitFor(peer, string(peername)); err != nil {
+				log.Fatal(err)
+			}
+			writer, err = peer.Connect(context.Background(), string(peername))
+		}
 		if err != nil {
 			fmt.Println(err)
 		}
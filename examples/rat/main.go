@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -13,7 +15,7 @@ import (
 // Disconnect from stun server on ctrl^C
 func onSigterm(peer *p2p.Peer, sigs chan os.Signal) {
 	<-sigs
-	if err := peer.Disconnect(); err != nil {
+	if err := peer.Disconnect(context.Background()); err != nil {
 		fmt.Println(err)
 	}
 	fmt.Println("\nDisconnected")
@@ -49,7 +51,10 @@ func main() {
 	// register peer and initialize it into the
 	// network
 	fmt.Println("Connecting peer to network... ")
-	err = peer.Init()
+	err = peer.Init(context.Background())
+	if errors.Is(err, p2p.ErrNameTaken) {
+		log.Fatal("Peer name ", peername, " is already taken")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -57,17 +62,21 @@ func main() {
 
 	// Handle connections
 	for {
-		message, err := peer.Listen()
+		message, err := peer.Listen(context.Background())
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		command := message.Message
-		writer, err := peer.Connect(message.Peername)
-		if err != nil {
+		writer, err := peer.Connect(context.Background(), message.Peername)
+		if errors.Is(err, p2p.ErrPeerNotFound) {
 			log.Println("Requested peer ", message.Peername, " is now offline")
 			continue
 		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 
 		go handle(command, writer)
 	}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/alvarogf97/fox/pkg/stun"
@@ -35,7 +39,20 @@ func PrintConnectedPeers(stun *stun.Stun) {
 }
 
 func main() {
-	server, err := stun.NewStun(DEFAULT_ADDR, stun.NewMemoryPeerConnectionStore(), stun.DefaultStunOptions())
+	// registrations are kept on disk if a
+	// directory is given, so they survive
+	// server restarts
+	var store stun.PeerConnectionStore = stun.NewMemoryPeerConnectionStore()
+	if len(os.Args) > 1 {
+		fileStore, err := stun.NewFilePeerConnectionStore(os.Args[1], 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fileStore.Close()
+		store = fileStore
+	}
+
+	server, err := stun.NewStun(DEFAULT_ADDR, store, stun.DefaultStunOptions())
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -43,6 +60,11 @@ func main() {
 	// Prints connected peers to the network
 	go PrintConnectedPeers(server)
 
-	// starts server
-	server.Serve()
+	// serves until the process is interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := server.Serve(ctx); err != nil && err != context.Canceled {
+		fmt.Println(err)
+	}
 }
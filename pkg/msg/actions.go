@@ -5,8 +5,93 @@ const (
 	STUN_ACTION_NEW        = "SNew"
 	STUN_ACTION_GET        = "SGet"
 	STUN_ACTION_DISCONNECT = "SDisconnect"
+	STUN_ACTION_REFRESH    = "SRefresh"
 
 	PEER_ACTION_NEW        = "PNew"
 	PEER_ACTION_GET        = "PGet"
 	PEER_ACTION_DISCONNECT = "PDisconnect"
+	PEER_ACTION_REFRESH    = "PRefresh"
+	PEER_ACTION_INTRODUCE  = "PIntroduce"
+	PEER_ACTION_SHUTDOWN   = "PShutdown"
+)
+
+// Peer to Stun actions used to watch the
+// registrations of other peers and Stun to
+// Peer action used to tell they changed
+const (
+	STUN_ACTION_WATCH    = "SWatch"
+	STUN_ACTION_UNWATCH  = "SUnwatch"
+	PEER_ACTION_WATCH    = "PWatch"
+	PEER_ACTION_UNWATCH  = "PUnwatch"
+	PEER_ACTION_PRESENCE = "PPresence"
+)
+
+// Peer to Stun action used to list and
+// search the peers registered into the
+// server, one page at a time
+const (
+	STUN_ACTION_LIST = "SList"
+	PEER_ACTION_LIST = "PList"
+)
+
+// Stun to Stun actions used to look up the
+// peers registered into sibling servers
+const (
+	STUN_ACTION_LOOKUP = "SLookup"
+	PEER_ACTION_LOOKUP = "PLookup"
+)
+
+// Stun action used to check the stun
+// server is alive and how long it takes
+// to answer, no registration is needed
+const (
+	STUN_ACTION_PROBE = "SProbe"
+	PEER_ACTION_PROBE = "PProbe"
+)
+
+// Peer to Peer actions used to open
+// the NAT mappings between two peers
+const (
+	PEER_ACTION_PUNCH     = "PPunch"
+	PEER_ACTION_PUNCH_ACK = "PPunchAck"
+)
+
+// Peer to Peer actions used to establish
+// and use an encrypted session
+const (
+	PEER_ACTION_HANDSHAKE_INIT     = "PHandshakeInit"
+	PEER_ACTION_HANDSHAKE_RESPONSE = "PHandshakeResponse"
+	PEER_ACTION_HANDSHAKE_FINAL    = "PHandshakeFinal"
+	PEER_ACTION_HANDSHAKE_DONE     = "PHandshakeDone"
+	PEER_ACTION_SEALED             = "PSealed"
+)
+
+// Peer to Peer actions used to deliver
+// messages reliably and in order
+const (
+	PEER_ACTION_RELIABLE     = "PReliable"
+	PEER_ACTION_RELIABLE_ACK = "PReliableAck"
+)
+
+// Peer to Peer actions used to send messages
+// that do not fit into a single datagram and
+// to ask for the fragments that were lost
+const (
+	PEER_ACTION_FRAGMENT      = "PFragment"
+	PEER_ACTION_FRAGMENT_NACK = "PFragmentNack"
+)
+
+// Peer to Peer actions used to open, close and
+// grant credits to logical channels between peers
+const (
+	PEER_ACTION_CHANNEL_OPEN   = "PChannelOpen"
+	PEER_ACTION_CHANNEL_CLOSE  = "PChannelClose"
+	PEER_ACTION_CHANNEL_CREDIT = "PChannelCredit"
+)
+
+// Peer to Peer actions used to open and
+// feed byte streams carried by channels
+const (
+	PEER_ACTION_STREAM_OPEN = "PStreamOpen"
+	PEER_ACTION_STREAM_DATA = "PStreamData"
 )
@@ -0,0 +1,382 @@
+package msg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Kinds of values written by the binary codec
+const (
+	binaryKindMessage  = 'M'
+	binaryKindFragment = 'F'
+	binaryKindNack     = 'N'
+)
+
+// Codec that serializes messages as a kind byte
+// followed by their fields, strings and bytes
+// prefixed by their varint encoded length.
+// Requests and responses share the same layout
+// so a request can be read as a response
+type BinaryCodec struct{}
+
+// Returns the id of the binary codec
+func (BinaryCodec) Id() byte {
+	return CODEC_BINARY
+}
+
+// Fields of requests and responses in
+// the order they are written
+type binaryMessage struct {
+	id        string
+	action    string
+	hasError  bool
+	code      string
+	peername  string
+	message   string
+	token     string
+	key       string
+	signature string
+	channel   string
+	body      []byte
+	headers   map[string]string
+	version   int
+	features  []string
+	timestamp int64
+}
+
+// Serializes the given message, fragment or
+// negative acknowledgement of fragments
+func (codec BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case MsgRequest:
+		return writeBinaryMessage(binaryMessage{
+			value.Id, value.Action, false, "", value.Peername, value.Message, value.Token,
+			value.Key, value.Signature, value.Channel, value.Body, value.Headers,
+			value.Version, value.Features, value.Timestamp,
+		}), nil
+	case *MsgRequest:
+		return codec.Marshal(*value)
+	case MsgResponse:
+		return writeBinaryMessage(binaryMessage{
+			value.Id, value.Action, value.HasError, value.Code, value.Peername, value.Message, value.Token,
+			value.Key, "", value.Channel, value.Body, value.Headers,
+			value.Version, value.Features, 0,
+		}), nil
+	case *MsgResponse:
+		return codec.Marshal(*value)
+	case MsgFragment:
+		writer := binaryWriter{[]byte{binaryKindFragment}}
+		writer.string(value.Id)
+		writer.int(value.Index)
+		writer.int(value.Count)
+		writer.bytes(value.Data)
+		return writer.buff, nil
+	case *MsgFragment:
+		return codec.Marshal(*value)
+	case MsgFragmentNack:
+		writer := binaryWriter{[]byte{binaryKindNack}}
+		writer.string(value.Id)
+		writer.uint(uint64(len(value.Missing)))
+		for _, index := range value.Missing {
+			writer.int(index)
+		}
+		return writer.buff, nil
+	case *MsgFragmentNack:
+		return codec.Marshal(*value)
+	default:
+		return nil, fmt.Errorf("binary codec cannot serialize `%T`", v)
+	}
+}
+
+// Deserializes the given data into a message, a
+// fragment or a negative acknowledgement of fragments
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty binary message")
+	}
+	reader := binaryReader{data: data[1:]}
+
+	switch value := v.(type) {
+	case *MsgRequest:
+		message, err := readBinaryMessage(data[0], &reader)
+		if err != nil {
+			return err
+		}
+		*value = MsgRequest{
+			Id: message.id, Action: message.action, Peername: message.peername,
+			Message: message.message, Token: message.token, Key: message.key,
+			Signature: message.signature, Channel: message.channel,
+			Body: message.body, Headers: message.headers,
+			Version: message.version, Features: message.features,
+			Timestamp: message.timestamp,
+		}
+	case *MsgResponse:
+		message, err := readBinaryMessage(data[0], &reader)
+		if err != nil {
+			return err
+		}
+		*value = MsgResponse{
+			Id: message.id, Action: message.action, HasError: message.hasError, Code: message.code,
+			Peername: message.peername, Message: message.message, Token: message.token,
+			Key: message.key, Channel: message.channel,
+			Body: message.body, Headers: message.headers,
+			Version: message.version, Features: message.features,
+		}
+	case *MsgFragment:
+		if data[0] != binaryKindFragment {
+			return fmt.Errorf("binary data is not a fragment")
+		}
+		fragment := MsgFragment{
+			Id:    reader.string(),
+			Index: reader.int(),
+			Count: reader.int(),
+			Data:  reader.bytes(),
+		}
+		if reader.err != nil {
+			return reader.err
+		}
+		*value = fragment
+	case *MsgFragmentNack:
+		if data[0] != binaryKindNack {
+			return fmt.Errorf("binary data is not a fragment nack")
+		}
+		nack := MsgFragmentNack{Id: reader.string()}
+		if count := reader.count(1); count > 0 {
+			nack.Missing = make([]int, count)
+			for i := range nack.Missing {
+				nack.Missing[i] = reader.int()
+			}
+		}
+		if reader.err != nil {
+			return reader.err
+		}
+		*value = nack
+	default:
+		return fmt.Errorf("binary codec cannot deserialize `%T`", v)
+	}
+	return nil
+}
+
+// Serializes the fields of a message
+func writeBinaryMessage(message binaryMessage) []byte {
+	writer := binaryWriter{[]byte{binaryKindMessage}}
+	writer.string(message.id)
+	writer.string(message.action)
+	writer.bool(message.hasError)
+	writer.string(message.code)
+	writer.string(message.peername)
+	writer.string(message.message)
+	writer.string(message.token)
+	writer.string(message.key)
+	writer.string(message.signature)
+	writer.string(message.channel)
+	writer.bytes(message.body)
+	writer.uint(uint64(len(message.headers)))
+	for key, value := range message.headers {
+		writer.string(key)
+		writer.string(value)
+	}
+	writer.int(message.version)
+	writer.uint(uint64(len(message.features)))
+	for _, feature := range message.features {
+		writer.string(feature)
+	}
+	writer.int64(message.timestamp)
+	return writer.buff
+}
+
+// Deserializes the fields of a message
+func readBinaryMessage(kind byte, reader *binaryReader) (binaryMessage, error) {
+	if kind != binaryKindMessage {
+		return binaryMessage{}, fmt.Errorf("binary data is not a message")
+	}
+
+	message := binaryMessage{
+		id:        reader.string(),
+		action:    reader.string(),
+		hasError:  reader.bool(),
+		code:      reader.string(),
+		peername:  reader.string(),
+		message:   reader.string(),
+		token:     reader.string(),
+		key:       reader.string(),
+		signature: reader.string(),
+		channel:   reader.string(),
+		body:      reader.bytes(),
+	}
+
+	// every header takes two bytes at least
+	if count := reader.count(2); count > 0 {
+		message.headers = make(map[string]string, count)
+		for i := 0; i < count; i++ {
+			key := reader.string()
+			message.headers[key] = reader.string()
+		}
+	}
+
+	message.version = reader.int()
+	if count := reader.count(1); count > 0 {
+		message.features = make([]string, count)
+		for i := range message.features {
+			message.features[i] = reader.string()
+		}
+	}
+
+	// messages written before requests were
+	// timestamped end right after the features
+	if len(reader.data) > 0 {
+		message.timestamp = reader.int64()
+	}
+
+	if reader.err != nil {
+		return binaryMessage{}, reader.err
+	}
+	return message, nil
+}
+
+// Appends length prefixed fields to a buffer
+type binaryWriter struct {
+	buff []byte
+}
+
+// Appends a varint encoded unsigned integer
+func (writer *binaryWriter) uint(value uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], value)
+	writer.buff = append(writer.buff, scratch[:n]...)
+}
+
+// Appends a varint encoded integer
+func (writer *binaryWriter) int(value int) {
+	writer.int64(int64(value))
+}
+
+// Appends a varint encoded 64 bits integer
+func (writer *binaryWriter) int64(value int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(scratch[:], value)
+	writer.buff = append(writer.buff, scratch[:n]...)
+}
+
+// Appends a boolean as a single byte
+func (writer *binaryWriter) bool(value bool) {
+	if value {
+		writer.buff = append(writer.buff, 1)
+	} else {
+		writer.buff = append(writer.buff, 0)
+	}
+}
+
+// Appends length prefixed bytes
+func (writer *binaryWriter) bytes(value []byte) {
+	writer.uint(uint64(len(value)))
+	writer.buff = append(writer.buff, value...)
+}
+
+// Appends a length prefixed string
+func (writer *binaryWriter) string(value string) {
+	writer.uint(uint64(len(value)))
+	writer.buff = append(writer.buff, value...)
+}
+
+// Reads length prefixed fields from a buffer.
+// The first error is kept and every following
+// read returns a zero value
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+// Marks the buffer as truncated
+func (reader *binaryReader) fail() {
+	if reader.err == nil {
+		reader.err = fmt.Errorf("binary message truncated")
+	}
+	reader.data = nil
+}
+
+// Reads a varint encoded unsigned integer
+func (reader *binaryReader) uint() uint64 {
+	value, n := binary.Uvarint(reader.data)
+	if n <= 0 {
+		reader.fail()
+		return 0
+	}
+	reader.data = reader.data[n:]
+	return value
+}
+
+// Reads the number of items of a list whose
+// items take the given bytes at least, so
+// counts beyond the buffer are rejected
+func (reader *binaryReader) count(size int) int {
+	count := reader.uint()
+	if count > uint64(len(reader.data)/size) {
+		reader.fail()
+		return 0
+	}
+	return int(count)
+}
+
+// Reads a varint encoded integer
+func (reader *binaryReader) int() int {
+	value := reader.int64()
+	if int64(int(value)) != value {
+		reader.fail()
+		return 0
+	}
+	return int(value)
+}
+
+// Reads a varint encoded 64 bits integer
+func (reader *binaryReader) int64() int64 {
+	value, n := binary.Varint(reader.data)
+	if n <= 0 {
+		reader.fail()
+		return 0
+	}
+	reader.data = reader.data[n:]
+	return value
+}
+
+// Reads a boolean written as a single byte
+func (reader *binaryReader) bool() bool {
+	if len(reader.data) == 0 {
+		reader.fail()
+		return false
+	}
+	value := reader.data[0] != 0
+	reader.data = reader.data[1:]
+	return value
+}
+
+// Returns a copy of the next bytes so they
+// outlive the buffer they were read from
+func (reader *binaryReader) bytes() []byte {
+	length := reader.uint()
+	if reader.err != nil || length > uint64(len(reader.data)) {
+		reader.fail()
+		return nil
+	}
+	if length == 0 {
+		return nil
+	}
+
+	value := make([]byte, length)
+	copy(value, reader.data)
+	reader.data = reader.data[length:]
+	return value
+}
+
+// Reads a length prefixed string
+func (reader *binaryReader) string() string {
+	length := reader.uint()
+	if reader.err != nil || length > uint64(len(reader.data)) {
+		reader.fail()
+		return ""
+	}
+
+	value := string(reader.data[:length])
+	reader.data = reader.data[length:]
+	return value
+}
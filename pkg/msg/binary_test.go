@@ -0,0 +1,153 @@
+package msg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryCodec(t *testing.T) {
+	assert := require.New(t)
+	codec := BinaryCodec{}
+
+	t.Run("test_binary_request_round_trip", func(t *testing.T) {
+		request := NewMsgRequestBody("FakeAction", "Dog", []byte{0, 1, 255}, map[string]string{
+			HEADER_CONTENT_TYPE:   "application/octet-stream",
+			HEADER_CORRELATION_ID: "id",
+		})
+		request.Id = "FakeId"
+		request.Token = "FakeToken"
+		request.Key = "FakeKey"
+		request.Signature = "FakeSignature"
+		request.Channel = "FakeChannel"
+		request.Hello([]string{FEATURE_ENCRYPTION, FEATURE_RELIABILITY})
+		request.Timestamp = 1700000000000000000
+
+		data, err := codec.Marshal(&request)
+		assert.NoError(err)
+
+		var decoded MsgRequest
+		assert.NoError(codec.Unmarshal(data, &decoded))
+		assert.Equal(request, decoded)
+	})
+
+	t.Run("test_binary_response_round_trip", func(t *testing.T) {
+		response := NewMsgResponse("FakeAction", true, "Dog", "Guau")
+		response.Channel = "FakeChannel"
+		response.Code = ERROR_CODE_PEER_NOT_FOUND
+
+		data, err := codec.Marshal(response)
+		assert.NoError(err)
+
+		var decoded MsgResponse
+		assert.NoError(codec.Unmarshal(data, &decoded))
+		assert.Equal(response, decoded)
+	})
+
+	t.Run("test_binary_request_read_as_response", func(t *testing.T) {
+		request := NewMsgRequestBody("FakeAction", "Dog", []byte{1}, nil)
+		request.Key = "FakeKey"
+
+		data, _ := codec.Marshal(request)
+
+		var response MsgResponse
+		assert.NoError(codec.Unmarshal(data, &response))
+		assert.Equal("FakeAction", response.Action)
+		assert.Equal("Dog", response.Peername)
+		assert.Equal("FakeKey", response.Key)
+		assert.Equal([]byte{1}, response.Body)
+		assert.False(response.HasError)
+	})
+
+	t.Run("test_binary_request_without_timestamp", func(t *testing.T) {
+		request := NewMsgRequest("FakeAction", "Dog", "Guau")
+		data, _ := codec.Marshal(request)
+
+		// requests written before they were
+		// timestamped lack the last field
+		var decoded MsgRequest
+		assert.NoError(codec.Unmarshal(data[:len(data)-1], &decoded))
+		assert.Equal(request, decoded)
+	})
+
+	t.Run("test_binary_fragment_round_trip", func(t *testing.T) {
+		fragment := MsgFragment{Id: "FakeId", Index: 2, Count: 3, Data: []byte("Guau")}
+
+		data, err := codec.Marshal(&fragment)
+		assert.NoError(err)
+
+		var decoded MsgFragment
+		assert.NoError(codec.Unmarshal(data, &decoded))
+		assert.Equal(fragment, decoded)
+	})
+
+	t.Run("test_binary_fragment_nack_round_trip", func(t *testing.T) {
+		nack := MsgFragmentNack{Id: "FakeId", Missing: []int{0, 2, 300}}
+
+		data, err := codec.Marshal(&nack)
+		assert.NoError(err)
+
+		var decoded MsgFragmentNack
+		assert.NoError(codec.Unmarshal(data, &decoded))
+		assert.Equal(nack, decoded)
+
+		var fragment MsgFragment
+		assert.Error(codec.Unmarshal(data, &fragment))
+	})
+
+	t.Run("test_binary_smaller_than_json", func(t *testing.T) {
+		request := NewMsgRequestBody("FakeAction", "Dog", make([]byte, 64), nil)
+
+		binary, _ := codec.Marshal(request)
+		json, _ := JSONCodec{}.Marshal(request)
+
+		assert.Less(len(binary), len(json))
+	})
+
+	t.Run("test_binary_unmarshal_fail_truncated", func(t *testing.T) {
+		data, _ := codec.Marshal(NewMsgRequest("FakeAction", "Dog", "Guau"))
+
+		for i := 0; i < len(data)-1; i++ {
+			var request MsgRequest
+			assert.Error(codec.Unmarshal(data[:i], &request))
+		}
+	})
+
+	t.Run("test_binary_unmarshal_fail_wrong_kind", func(t *testing.T) {
+		data, _ := codec.Marshal(MsgFragment{Id: "FakeId"})
+
+		var request MsgRequest
+		assert.Error(codec.Unmarshal(data, &request))
+
+		data, _ = codec.Marshal(NewMsgRequest("FakeAction", "Dog", "Guau"))
+		var fragment MsgFragment
+		assert.Error(codec.Unmarshal(data, &fragment))
+	})
+
+	t.Run("test_binary_unmarshal_fail_oversized_headers", func(t *testing.T) {
+		data, _ := codec.Marshal(NewMsgRequest("FakeAction", "Dog", "Guau"))
+		// headers count followed by the version,
+		// the features count and the timestamp
+		data[len(data)-4] = 0x7f
+
+		var request MsgRequest
+		assert.Error(codec.Unmarshal(data, &request))
+	})
+
+	t.Run("test_binary_unmarshal_fail_oversized_features", func(t *testing.T) {
+		data, _ := codec.Marshal(NewMsgRequest("FakeAction", "Dog", "Guau"))
+		// features count followed by the timestamp
+		data[len(data)-2] = 0x7f
+
+		var request MsgRequest
+		assert.Error(codec.Unmarshal(data, &request))
+	})
+
+	t.Run("test_binary_fail_unsupported_type", func(t *testing.T) {
+		_, err := codec.Marshal("Guau")
+		assert.Error(err)
+
+		var value string
+		assert.Error(codec.Unmarshal([]byte{binaryKindMessage}, &value))
+	})
+}
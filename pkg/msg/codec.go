@@ -0,0 +1,135 @@
+package msg
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+const (
+	// Version of the wire format. It is written in
+	// the high bits of the first byte of every
+	// datagram followed by the codec id
+	WIRE_VERSION = 1
+
+	// Ids of the codecs shipped with fox, custom
+	// codecs can take any other id up to 15
+	CODEC_JSON   = 1
+	CODEC_BINARY = 2
+)
+
+// Codec serializes the messages exchanged by
+// the stun server and the peers. Every codec
+// is identified by an id written into the
+// datagrams so the receiver knows how to
+// read them
+type Codec interface {
+	Id() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codec that serializes messages as JSON
+type JSONCodec struct{}
+
+// Returns the id of the JSON codec
+func (JSONCodec) Id() byte {
+	return CODEC_JSON
+}
+
+// Serializes the given value as JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Deserializes the given JSON data
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Codecs that can be read from the datagrams
+var codecs = struct {
+	sync.RWMutex
+	byId map[byte]Codec
+}{byId: map[byte]Codec{
+	CODEC_JSON:   JSONCodec{},
+	CODEC_BINARY: BinaryCodec{},
+}}
+
+// Registers the given codec so the datagrams
+// written with it can be read
+func RegisterCodec(codec Codec) error {
+	id := codec.Id()
+	if id == 0 || id > 0x0f {
+		return fmt.Errorf("codec id `%d` out of range", id)
+	}
+
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	if _, exists := codecs.byId[id]; exists {
+		return fmt.Errorf("codec `%d` already registered", id)
+	}
+	codecs.byId[id] = codec
+	return nil
+}
+
+// Serializes the given value with the given codec
+// prefixed by the wire version and codec id
+func Encode(codec Codec, v interface{}) ([]byte, error) {
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	datagram := make([]byte, 0, len(payload)+1)
+	datagram = append(datagram, WIRE_VERSION<<4|codec.Id()&0x0f)
+	return append(datagram, payload...), nil
+}
+
+// Returns the codec the given datagram was
+// written with. Datagrams written before the
+// wire version existed are plain JSON
+func CodecOf(data []byte) (Codec, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty datagram")
+	}
+
+	if data[0] == '{' {
+		return JSONCodec{}, nil
+	}
+
+	if version := data[0] >> 4; version != WIRE_VERSION {
+		return nil, fmt.Errorf("unsupported wire version `%d`", version)
+	}
+
+	codecs.RLock()
+	codec, exists := codecs.byId[data[0]&0x0f]
+	codecs.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown codec `%d`", data[0]&0x0f)
+	}
+	return codec, nil
+}
+
+// Deserializes the given datagram with the codec
+// it was written with
+func Decode(data []byte, v interface{}) error {
+	codec, err := CodecOf(data)
+	if err != nil {
+		return err
+	}
+
+	if data[0] == '{' {
+		return codec.Unmarshal(data, v)
+	}
+	return codec.Unmarshal(data[1:], v)
+}
+
+// Returns a function that serializes
+// values with the given codec
+func NewEncoder(codec Codec) func(v interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) {
+		return Encode(codec, v)
+	}
+}
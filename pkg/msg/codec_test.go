@@ -0,0 +1,147 @@
+package msg
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Codec that cannot serialize anything
+type FailCodec struct{}
+
+// Returns an id no other codec takes
+func (FailCodec) Id() byte {
+	return 0x0f
+}
+
+// Fails serializing the given value
+func (FailCodec) Marshal(v interface{}) ([]byte, error) {
+	return nil, json.Unmarshal([]byte("{"), v)
+}
+
+// Fails deserializing the given data
+func (FailCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal([]byte("{"), v)
+}
+
+func TestCodec(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_encode_prefixes_version_and_codec", func(t *testing.T) {
+		datagram, err := Encode(JSONCodec{}, NewMsgRequest("FakeAction", "Dog", "Guau"))
+
+		assert.NoError(err)
+		assert.Equal(byte(WIRE_VERSION<<4|CODEC_JSON), datagram[0])
+		assert.Equal(byte('{'), datagram[1])
+	})
+
+	t.Run("test_encode_decode_json", func(t *testing.T) {
+		request := NewMsgRequestBody("FakeAction", "Dog", []byte{0, 1, 255}, nil)
+		datagram, _ := Encode(JSONCodec{}, request)
+
+		var decoded MsgRequest
+		err := Decode(datagram, &decoded)
+
+		assert.NoError(err)
+		assert.Equal(request, decoded)
+	})
+
+	t.Run("test_encode_decode_binary", func(t *testing.T) {
+		request := NewMsgRequestBody("FakeAction", "Dog", []byte{0, 1, 255}, nil)
+		datagram, _ := Encode(BinaryCodec{}, request)
+
+		var decoded MsgRequest
+		err := Decode(datagram, &decoded)
+
+		assert.NoError(err)
+		assert.Equal(request, decoded)
+	})
+
+	t.Run("test_decode_legacy_json", func(t *testing.T) {
+		datagram, _ := json.Marshal(NewMsgResponse("FakeAction", true, "Dog", "Guau"))
+
+		var response MsgResponse
+		err := Decode(datagram, &response)
+
+		assert.NoError(err)
+		assert.True(response.HasError)
+		assert.Equal("Guau", response.Message)
+	})
+
+	t.Run("test_codec_of", func(t *testing.T) {
+		binary, _ := Encode(BinaryCodec{}, NewMsgRequest("FakeAction", "Dog", "Guau"))
+		legacy, _ := json.Marshal(NewMsgRequest("FakeAction", "Dog", "Guau"))
+
+		codec, err := CodecOf(binary)
+		assert.NoError(err)
+		assert.Equal(BinaryCodec{}, codec)
+
+		codec, err = CodecOf(legacy)
+		assert.NoError(err)
+		assert.Equal(JSONCodec{}, codec)
+	})
+
+	t.Run("test_codec_of_fail_unknown_codec", func(t *testing.T) {
+		_, err := CodecOf([]byte{WIRE_VERSION<<4 | 0x0e, 'M'})
+
+		assert.Error(err)
+	})
+
+	t.Run("test_decode_fail_empty", func(t *testing.T) {
+		var response MsgResponse
+
+		assert.Error(Decode(nil, &response))
+	})
+
+	t.Run("test_decode_fail_unsupported_version", func(t *testing.T) {
+		var response MsgResponse
+
+		assert.Error(Decode([]byte{(WIRE_VERSION+1)<<4 | CODEC_BINARY}, &response))
+	})
+
+	t.Run("test_decode_fail_unknown_codec", func(t *testing.T) {
+		var response MsgResponse
+
+		assert.Error(Decode([]byte{WIRE_VERSION<<4 | 0x0e, 'M'}, &response))
+	})
+
+	t.Run("test_encode_fail_marshal", func(t *testing.T) {
+		_, err := NewEncoder(FailCodec{})(NewMsgRequest("FakeAction", "Dog", "Guau"))
+
+		assert.Error(err)
+	})
+
+	t.Run("test_register_codec", func(t *testing.T) {
+		assert.NoError(RegisterCodec(FailCodec{}))
+		defer func() {
+			codecs.Lock()
+			delete(codecs.byId, FailCodec{}.Id())
+			codecs.Unlock()
+		}()
+
+		var response MsgResponse
+		err := Decode([]byte{WIRE_VERSION<<4 | FailCodec{}.Id(), '{'}, &response)
+
+		assert.Error(err)
+		assert.Error(RegisterCodec(FailCodec{}))
+	})
+
+	t.Run("test_register_codec_fail_taken_id", func(t *testing.T) {
+		assert.Error(RegisterCodec(JSONCodec{}))
+	})
+
+	t.Run("test_register_codec_fail_out_of_range", func(t *testing.T) {
+		assert.Error(RegisterCodec(outOfRangeCodec{}))
+	})
+}
+
+// Codec whose id cannot be written into a datagram
+type outOfRangeCodec struct {
+	JSONCodec
+}
+
+// Returns an id beyond the codec bits
+func (outOfRangeCodec) Id() byte {
+	return 0x10
+}
@@ -0,0 +1,14 @@
+package msg
+
+// Codes of the errors answered by the stun server
+// so peers can tell them apart without parsing
+// the human readable message
+const (
+	ERROR_CODE_INTERNAL            = "EInternal"
+	ERROR_CODE_PEER_NOT_FOUND      = "EPeerNotFound"
+	ERROR_CODE_NAME_TAKEN          = "ENameTaken"
+	ERROR_CODE_UNAUTHORIZED        = "EUnauthorized"
+	ERROR_CODE_UNSUPPORTED_VERSION = "EUnsupportedVersion"
+	ERROR_CODE_UNKNOWN_ACTION      = "EUnknownAction"
+	ERROR_CODE_STANDBY             = "EStandby"
+)
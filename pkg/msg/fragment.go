@@ -0,0 +1,99 @@
+package msg
+
+import "fmt"
+
+const (
+	// Max size of the datagrams written by peers.
+	// Larger messages are split into fragments
+	MAX_DATAGRAM_SIZE = 1200
+	// Size of the data carried by every fragment,
+	// it leaves room for his encoding overhead
+	FRAGMENT_DATA_SIZE = 768
+	// Max number of fragments of a single message
+	MAX_FRAGMENTS = (MAX_MESSAGE_SIZE + FRAGMENT_DATA_SIZE - 1) / FRAGMENT_DATA_SIZE
+	// Max number of missing fragments asked
+	// for by a single negative acknowledgement,
+	// so it fits into a single datagram
+	MAX_FRAGMENT_NACK_SIZE = 128
+)
+
+// Piece of a message that does not fit into a
+// single datagram. Every fragment of the same
+// message shares his id
+type MsgFragment struct {
+	Id    string `json:"id"`
+	Index int    `json:"index"`
+	Count int    `json:"count"`
+	Data  []byte `json:"data"`
+}
+
+// Negative acknowledgement sent by the receiver
+// of a fragmented message to ask his sender
+// for the fragments that did not arrive
+type MsgFragmentNack struct {
+	Id      string `json:"id"`
+	Missing []int  `json:"missing"`
+}
+
+// Checks the negative acknowledgement is well formed
+func (nack MsgFragmentNack) Validate() error {
+	if nack.Id == "" {
+		return fmt.Errorf("fragment nack without id")
+	}
+
+	if len(nack.Missing) == 0 || len(nack.Missing) > MAX_FRAGMENT_NACK_SIZE {
+		return fmt.Errorf("invalid fragment nack size %d", len(nack.Missing))
+	}
+
+	for _, index := range nack.Missing {
+		if index < 0 || index >= MAX_FRAGMENTS {
+			return fmt.Errorf("invalid fragment index %d", index)
+		}
+	}
+	return nil
+}
+
+// Checks the fragment is well formed
+func (fragment MsgFragment) Validate() error {
+	if fragment.Id == "" {
+		return fmt.Errorf("fragment without id")
+	}
+
+	if fragment.Count <= 0 || fragment.Count > MAX_FRAGMENTS {
+		return fmt.Errorf("invalid fragment count %d", fragment.Count)
+	}
+
+	if fragment.Index < 0 || fragment.Index >= fragment.Count {
+		return fmt.Errorf("invalid fragment index %d", fragment.Index)
+	}
+
+	if len(fragment.Data) > FRAGMENT_DATA_SIZE {
+		return fmt.Errorf("fragment data too large")
+	}
+	return nil
+}
+
+// Splits the given serialized message into
+// fragments with the given id
+func SplitMessage(id string, payload []byte) ([]MsgFragment, error) {
+	if len(payload) > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("message too large: %d bytes", len(payload))
+	}
+
+	count := (len(payload) + FRAGMENT_DATA_SIZE - 1) / FRAGMENT_DATA_SIZE
+	fragments := make([]MsgFragment, 0, count)
+	for index := 0; index < count; index++ {
+		end := (index + 1) * FRAGMENT_DATA_SIZE
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		fragments = append(fragments, MsgFragment{
+			Id:    id,
+			Index: index,
+			Count: count,
+			Data:  payload[index*FRAGMENT_DATA_SIZE : end],
+		})
+	}
+	return fragments, nil
+}
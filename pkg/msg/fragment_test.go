@@ -0,0 +1,76 @@
+package msg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitMessage(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_split_message", func(t *testing.T) {
+		payload := bytes.Repeat([]byte("a"), 2*FRAGMENT_DATA_SIZE+1)
+
+		fragments, err := SplitMessage("id", payload)
+
+		assert.NoError(err)
+		assert.Len(fragments, 3)
+		for index, fragment := range fragments {
+			assert.Equal("id", fragment.Id)
+			assert.Equal(index, fragment.Index)
+			assert.Equal(3, fragment.Count)
+			assert.NoError(fragment.Validate())
+		}
+		assert.Len(fragments[2].Data, 1)
+	})
+
+	t.Run("test_split_message_fail_too_large", func(t *testing.T) {
+		_, err := SplitMessage("id", make([]byte, MAX_MESSAGE_SIZE+1))
+
+		assert.Error(err)
+	})
+}
+
+func TestMsgFragmentValidate(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_validate_fail_without_id", func(t *testing.T) {
+		assert.Error(MsgFragment{Count: 1}.Validate())
+	})
+
+	t.Run("test_validate_fail_invalid_count", func(t *testing.T) {
+		assert.Error(MsgFragment{Id: "id", Count: MAX_FRAGMENTS + 1}.Validate())
+	})
+
+	t.Run("test_validate_fail_invalid_index", func(t *testing.T) {
+		assert.Error(MsgFragment{Id: "id", Index: 1, Count: 1}.Validate())
+	})
+
+	t.Run("test_validate_fail_data_too_large", func(t *testing.T) {
+		assert.Error(MsgFragment{Id: "id", Count: 1, Data: make([]byte, FRAGMENT_DATA_SIZE+1)}.Validate())
+	})
+}
+
+func TestMsgFragmentNackValidate(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_validate", func(t *testing.T) {
+		assert.NoError(MsgFragmentNack{Id: "id", Missing: []int{0, MAX_FRAGMENTS - 1}}.Validate())
+	})
+
+	t.Run("test_validate_fail_without_id", func(t *testing.T) {
+		assert.Error(MsgFragmentNack{Missing: []int{0}}.Validate())
+	})
+
+	t.Run("test_validate_fail_invalid_size", func(t *testing.T) {
+		assert.Error(MsgFragmentNack{Id: "id"}.Validate())
+		assert.Error(MsgFragmentNack{Id: "id", Missing: make([]int, MAX_FRAGMENT_NACK_SIZE+1)}.Validate())
+	})
+
+	t.Run("test_validate_fail_invalid_index", func(t *testing.T) {
+		assert.Error(MsgFragmentNack{Id: "id", Missing: []int{-1}}.Validate())
+		assert.Error(MsgFragmentNack{Id: "id", Missing: []int{MAX_FRAGMENTS}}.Validate())
+	})
+}
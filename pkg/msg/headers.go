@@ -0,0 +1,23 @@
+package msg
+
+// Well known message headers, any
+// other key can be used as well
+const (
+	HEADER_CONTENT_TYPE   = "content-type"
+	HEADER_CORRELATION_ID = "correlation-id"
+	HEADER_TIMESTAMP      = "timestamp"
+
+	// Public address of the peer a request
+	// is forwarded on behalf of
+	HEADER_REMOTE_ADDR = "remote-addr"
+
+	// Change of the registration of a watched
+	// peer told by `PEER_ACTION_PRESENCE`,
+	// see `PRESENCE_*`
+	HEADER_PRESENCE = "presence"
+
+	// Stream and sequence number of the frames
+	// exchanged by the reliable delivery
+	HEADER_STREAM   = "stream"
+	HEADER_SEQUENCE = "sequence"
+)
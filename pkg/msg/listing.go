@@ -0,0 +1,126 @@
+package msg
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// What a peer tells about himself when he
+// registers into the stun server
+type PeerProfile struct {
+	// Free form information other peers
+	// can filter the peer list with
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Private peers are never listed nor watched
+	// by peers that watch everybody, they are
+	// only found by their names
+	Private bool `json:"private,omitempty"`
+}
+
+// Search of the peers registered into the
+// stun server, one page at a time
+type PeerQuery struct {
+	// Only the peers whose names start with it
+	Prefix string `json:"prefix,omitempty"`
+	// Only the peers whose metadata has
+	// every one of these entries
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Max number of peers of the page, the
+	// server default one if zero
+	Limit int `json:"limit,omitempty"`
+	// Cursor of the previous page,
+	// empty for the first one
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Peer found by a peer query
+type PeerListing struct {
+	Peername string            `json:"peername"`
+	Key      string            `json:"key,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Page of the peers found by a peer query,
+// sorted by their names
+type PeerPage struct {
+	Peers []PeerListing `json:"peers"`
+	// Cursor the next page starts after,
+	// empty once there are no more peers
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Encodes the given profile into the message of
+// a registration. Public peers without metadata
+// send an empty message, as legacy peers do
+func EncodeProfile(profile PeerProfile) (string, error) {
+	if !profile.Private && len(profile.Metadata) == 0 {
+		return "", nil
+	}
+
+	encoded, err := json.Marshal(profile)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Decodes the profile of the given
+// registration message
+func DecodeProfile(message string) (PeerProfile, error) {
+	var profile PeerProfile
+	if message == "" {
+		return profile, nil
+	}
+
+	if err := json.Unmarshal([]byte(message), &profile); err != nil {
+		return PeerProfile{}, fmt.Errorf("malformed peer profile: %s", err)
+	}
+	return profile, nil
+}
+
+// Encodes the given query into the
+// message of a list request
+func EncodeQuery(query PeerQuery) (string, error) {
+	encoded, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Decodes the query of the given list request
+// message. An empty message lists every peer
+func DecodeQuery(message string) (PeerQuery, error) {
+	var query PeerQuery
+	if message == "" {
+		return query, nil
+	}
+
+	if err := json.Unmarshal([]byte(message), &query); err != nil {
+		return PeerQuery{}, fmt.Errorf("malformed peer query: %s", err)
+	}
+	if query.Limit < 0 {
+		return PeerQuery{}, fmt.Errorf("malformed peer query: negative limit `%d`", query.Limit)
+	}
+	return query, nil
+}
+
+// Encodes the given page into the
+// message of a list response
+func EncodePage(page PeerPage) (string, error) {
+	encoded, err := json.Marshal(page)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Decodes the page of the given
+// list response message
+func DecodePage(message string) (PeerPage, error) {
+	var page PeerPage
+	if err := json.Unmarshal([]byte(message), &page); err != nil {
+		return PeerPage{}, fmt.Errorf("malformed peer page: %s", err)
+	}
+	return page, nil
+}
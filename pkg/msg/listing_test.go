@@ -0,0 +1,79 @@
+package msg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerProfile(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_encode_decode_profile", func(t *testing.T) {
+		profile := PeerProfile{Metadata: map[string]string{"room": "lobby"}, Private: true}
+		message, err := EncodeProfile(profile)
+		assert.NoError(err)
+
+		decoded, err := DecodeProfile(message)
+
+		assert.NoError(err)
+		assert.Equal(profile, decoded)
+	})
+
+	t.Run("test_encode_public_profile_without_metadata", func(t *testing.T) {
+		message, err := EncodeProfile(PeerProfile{})
+		assert.NoError(err)
+		assert.Empty(message)
+
+		profile, err := DecodeProfile(message)
+		assert.NoError(err)
+		assert.Equal(PeerProfile{}, profile)
+	})
+
+	t.Run("test_decode_profile_fail_malformed", func(t *testing.T) {
+		_, err := DecodeProfile("bonks")
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "malformed")
+	})
+}
+
+func TestPeerQuery(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_encode_decode_query", func(t *testing.T) {
+		query := PeerQuery{Prefix: "al", Metadata: map[string]string{"room": "lobby"}, Limit: 10, Cursor: "alice"}
+		message, err := EncodeQuery(query)
+		assert.NoError(err)
+
+		decoded, err := DecodeQuery(message)
+
+		assert.NoError(err)
+		assert.Equal(query, decoded)
+	})
+
+	t.Run("test_decode_empty_query", func(t *testing.T) {
+		query, err := DecodeQuery("")
+
+		assert.NoError(err)
+		assert.Equal(PeerQuery{}, query)
+	})
+
+	t.Run("test_decode_query_fail_negative_limit", func(t *testing.T) {
+		_, err := DecodeQuery(`{"limit":-1}`)
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "malformed")
+	})
+
+	t.Run("test_encode_decode_page", func(t *testing.T) {
+		page := PeerPage{Peers: []PeerListing{{Peername: "alice", Key: "key"}}, Cursor: "alice"}
+		message, err := EncodePage(page)
+		assert.NoError(err)
+
+		decoded, err := DecodePage(message)
+
+		assert.NoError(err)
+		assert.Equal(page, decoded)
+	})
+}
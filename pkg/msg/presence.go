@@ -0,0 +1,47 @@
+package msg
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Changes of the registration of a
+// watched peer
+const (
+	// The peer registered into the network
+	PRESENCE_JOINED = "joined"
+	// The peer disconnected or his
+	// registration expired
+	PRESENCE_LEFT = "left"
+	// The peer is registered from
+	// another address
+	PRESENCE_MOVED = "moved"
+)
+
+// Encodes the given peer names into the message
+// of a watch request. No names means every peer
+func EncodeNames(names []string) (string, error) {
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	encoded, err := json.Marshal(names)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Decodes the peer names of the given
+// watch request message
+func DecodeNames(message string) ([]string, error) {
+	if message == "" {
+		return nil, nil
+	}
+
+	var names []string
+	if err := json.Unmarshal([]byte(message), &names); err != nil {
+		return nil, fmt.Errorf("malformed peer names: %s", err)
+	}
+	return names, nil
+}
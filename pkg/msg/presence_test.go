@@ -0,0 +1,38 @@
+package msg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresenceNames(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_encode_decode_names", func(t *testing.T) {
+		message, err := EncodeNames([]string{"Dog", "Cat,Mouse"})
+		assert.NoError(err)
+
+		names, err := DecodeNames(message)
+
+		assert.NoError(err)
+		assert.Equal([]string{"Dog", "Cat,Mouse"}, names)
+	})
+
+	t.Run("test_encode_no_names", func(t *testing.T) {
+		message, err := EncodeNames(nil)
+		assert.NoError(err)
+		assert.Empty(message)
+
+		names, err := DecodeNames(message)
+		assert.NoError(err)
+		assert.Empty(names)
+	})
+
+	t.Run("test_decode_names_fail_malformed", func(t *testing.T) {
+		_, err := DecodeNames("Dog")
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "malformed")
+	})
+}
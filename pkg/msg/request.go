@@ -3,9 +3,43 @@ package msg
 // Stun to Peer, Peer to Stun and
 // Peer to Peer message request interface
 type MsgRequest struct {
+	// Identifier echoed back by the stun
+	// server in the request's response
+	Id       string `json:"id"`
 	Action   string `json:"action"`
 	Peername string `json:"peername"`
 	Message  string `json:"message"`
+
+	// Session token issued by the stun server
+	// that authenticates the peer requests
+	Token string `json:"token"`
+
+	// Hex encoded public key that identifies the
+	// peer and the signature of the request made
+	// with his private key
+	Key       string `json:"key"`
+	Signature string `json:"signature"`
+
+	// Logical channel between two peers the
+	// message belongs to, empty for the default one
+	Channel string `json:"channel,omitempty"`
+
+	// Binary payload of the message and the
+	// headers that describe it. String based
+	// actions keep using the message instead
+	Body    []byte            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Protocol version of the sender and the
+	// optional features he supports. Legacy
+	// senders leave them empty
+	Version  int      `json:"version,omitempty"`
+	Features []string `json:"features,omitempty"`
+
+	// Time the request was signed at, in unix
+	// nanoseconds, so servers can tell captured
+	// requests played again apart
+	Timestamp int64 `json:"timestamp,omitempty"`
 }
 
 // Creates a new msg request
@@ -16,3 +50,14 @@ func NewMsgRequest(action string, peername string, message string) MsgRequest {
 		Message:  message,
 	}
 }
+
+// Creates a new msg request carrying
+// the given binary body and headers
+func NewMsgRequestBody(action string, peername string, body []byte, headers map[string]string) MsgRequest {
+	return MsgRequest{
+		Action:   action,
+		Peername: peername,
+		Body:     body,
+		Headers:  headers,
+	}
+}
@@ -1,6 +1,7 @@
 package msg
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -20,4 +21,45 @@ func TestMsgRequest(t *testing.T) {
 		assert.Equal(peername, request.Peername)
 		assert.Equal(message, request.Message)
 	})
+
+	t.Run("test_constructor_msg_request_body", func(t *testing.T) {
+		action := "FakeAction"
+		peername := "Dog"
+		body := []byte{0, 1, 2}
+		headers := map[string]string{HEADER_CONTENT_TYPE: "application/octet-stream"}
+
+		request := NewMsgRequestBody(action, peername, body, headers)
+
+		assert.Equal(action, request.Action)
+		assert.Equal(peername, request.Peername)
+		assert.Equal(body, request.Body)
+		assert.Equal(headers, request.Headers)
+		assert.Empty(request.Message)
+	})
+}
+
+func TestMsgRequestBodyWireFormat(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_body_and_headers_reach_response", func(t *testing.T) {
+		body := []byte{0, 255, 10}
+		headers := map[string]string{HEADER_CORRELATION_ID: "id"}
+		request := NewMsgRequestBody("FakeAction", "Dog", body, headers)
+
+		data, err := json.Marshal(request)
+		assert.NoError(err)
+
+		var response MsgResponse
+		assert.NoError(json.Unmarshal(data, &response))
+		assert.Equal(body, response.Body)
+		assert.Equal(headers, response.Headers)
+	})
+
+	t.Run("test_string_messages_omit_body_and_headers", func(t *testing.T) {
+		data, err := json.Marshal(NewMsgRequest("FakeAction", "Dog", "Guau"))
+
+		assert.NoError(err)
+		assert.NotContains(string(data), "body")
+		assert.NotContains(string(data), "headers")
+	})
 }
@@ -1,5 +1,7 @@
 package msg
 
+import "net"
+
 const (
 	// Max buffer size to deserialize response
 	MAX_MESSAGE_SIZE = 5242880 // 5Mb
@@ -8,10 +10,46 @@ const (
 // Stun to Peer, Peer to Stun and
 // Peer to Peer message response interface
 type MsgResponse struct {
+	// Identifier of the request this
+	// response belongs to
+	Id       string `json:"id"`
 	Action   string `json:"action"`
 	HasError bool   `json:"has_error"`
 	Peername string `json:"peername"`
 	Message  string `json:"message"`
+
+	// Code of the error the response carries,
+	// see `ERROR_CODE_*`. Legacy servers leave
+	// it empty and only send the message
+	Code string `json:"code,omitempty"`
+
+	// Session token issued to the peer
+	// when he registers into the network
+	Token string `json:"token"`
+
+	// Hex encoded public key of the peer
+	// the response is talking about
+	Key string `json:"key"`
+
+	// Logical channel between two peers the
+	// message belongs to, empty for the default one
+	Channel string `json:"channel,omitempty"`
+
+	// Binary payload of the message and the
+	// headers that describe it
+	Body    []byte            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Protocol version of the sender and the
+	// optional features he supports. Legacy
+	// senders leave them empty
+	Version  int      `json:"version,omitempty"`
+	Features []string `json:"features,omitempty"`
+
+	// Address the response was read from.
+	// It is filled by the receiver and
+	// never serialized
+	Addr *net.UDPAddr `json:"-"`
 }
 
 // Creates a new msg response
@@ -23,3 +61,19 @@ func NewMsgResponse(action string, hasError bool, peername string, message strin
 		Message:  message,
 	}
 }
+
+// Returns the payload of the message, that is
+// his body or his string message for the
+// senders that write string based actions
+func (response MsgResponse) Payload() []byte {
+	if response.Body != nil {
+		return response.Body
+	}
+	return []byte(response.Message)
+}
+
+// Returns the value of the given header or
+// an empty string if it is not present
+func (response MsgResponse) Header(key string) string {
+	return response.Headers[key]
+}
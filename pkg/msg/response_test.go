@@ -22,4 +22,25 @@ func TestMsgResponse(t *testing.T) {
 		assert.Equal(peername, response.Peername)
 		assert.Equal(message, response.Message)
 	})
+
+	t.Run("test_response_payload_body", func(t *testing.T) {
+		response := NewMsgResponse("FakeAction", false, "Dog", "Guau")
+		response.Body = []byte{0, 1, 2}
+
+		assert.Equal([]byte{0, 1, 2}, response.Payload())
+	})
+
+	t.Run("test_response_payload_message", func(t *testing.T) {
+		response := NewMsgResponse("FakeAction", false, "Dog", "Guau")
+
+		assert.Equal([]byte("Guau"), response.Payload())
+	})
+
+	t.Run("test_response_header", func(t *testing.T) {
+		response := NewMsgResponse("FakeAction", false, "Dog", "Guau")
+		response.Headers = map[string]string{HEADER_TIMESTAMP: "1"}
+
+		assert.Equal("1", response.Header(HEADER_TIMESTAMP))
+		assert.Empty(response.Header(HEADER_CONTENT_TYPE))
+	})
 }
@@ -0,0 +1,88 @@
+package msg
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// Prefix of every signed payload so request
+	// signatures cannot be reused elsewhere
+	SIGNATURE_DOMAIN = "fox-request"
+)
+
+// Returns the bytes covered by the request
+// signature, i.e. every field but the signature
+// itself. Fields are length prefixed so they
+// cannot be shifted into each other. The hello
+// and the timestamp are only covered when there
+// are any, so legacy requests keep their signatures
+func (request MsgRequest) SigningPayload() []byte {
+	payload := []byte(SIGNATURE_DOMAIN)
+	fields := []string{
+		request.Id,
+		request.Action,
+		request.Peername,
+		request.Message,
+		request.Token,
+		request.Key,
+	}
+	if request.Version != LEGACY_PROTOCOL_VERSION {
+		fields = append(fields, strconv.Itoa(request.Version))
+		fields = append(fields, request.Features...)
+	}
+	if request.Timestamp != 0 {
+		fields = append(fields, strconv.FormatInt(request.Timestamp, 10))
+	}
+
+	for _, field := range fields {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(field)))
+		payload = append(payload, size[:]...)
+		payload = append(payload, field...)
+	}
+	return payload
+}
+
+// Attaches the public key of the given identity
+// to the request and signs it along with the
+// current time
+func (request *MsgRequest) Sign(identity ed25519.PrivateKey) {
+	request.Timestamp = time.Now().UnixNano()
+	request.Key = EncodeKey(identity.Public().(ed25519.PublicKey))
+	request.Signature = hex.EncodeToString(ed25519.Sign(identity, request.SigningPayload()))
+}
+
+// Checks the request has been signed by
+// the owner of the given public key
+func (request MsgRequest) Verify(key string) error {
+	public, err := DecodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	signature, err := hex.DecodeString(request.Signature)
+	if err != nil || !ed25519.Verify(public, request.SigningPayload(), signature) {
+		return fmt.Errorf("invalid signature for peer `%s`", request.Peername)
+	}
+	return nil
+}
+
+// Encodes the given public key so it
+// can travel into a message
+func EncodeKey(key ed25519.PublicKey) string {
+	return hex.EncodeToString(key)
+}
+
+// Decodes a public key encoded by `EncodeKey`
+func DecodeKey(key string) (ed25519.PublicKey, error) {
+	public, err := hex.DecodeString(key)
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key `%s`", key)
+	}
+	return ed25519.PublicKey(public), nil
+}
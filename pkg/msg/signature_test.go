@@ -0,0 +1,93 @@
+package msg
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgRequestSignature(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_sign_and_verify", func(t *testing.T) {
+		public, identity, _ := ed25519.GenerateKey(nil)
+		request := NewMsgRequest(STUN_ACTION_NEW, "Dog", "Guau")
+
+		request.Sign(identity)
+
+		assert.Equal(EncodeKey(public), request.Key)
+		assert.NoError(request.Verify(request.Key))
+	})
+
+	t.Run("test_verify_fail_tampered_request", func(t *testing.T) {
+		_, identity, _ := ed25519.GenerateKey(nil)
+		request := NewMsgRequest(STUN_ACTION_NEW, "Dog", "Guau")
+		request.Sign(identity)
+
+		request.Peername = "Cat"
+
+		assert.Error(request.Verify(request.Key))
+	})
+
+	t.Run("test_verify_fail_tampered_hello", func(t *testing.T) {
+		_, identity, _ := ed25519.GenerateKey(nil)
+		request := NewMsgRequest(STUN_ACTION_NEW, "Dog", "Guau")
+		request.Hello([]string{FEATURE_ENCRYPTION})
+		request.Sign(identity)
+		assert.NoError(request.Verify(request.Key))
+
+		request.Features = nil
+
+		assert.Error(request.Verify(request.Key))
+	})
+
+	t.Run("test_verify_fail_tampered_timestamp", func(t *testing.T) {
+		_, identity, _ := ed25519.GenerateKey(nil)
+		request := NewMsgRequest(STUN_ACTION_REFRESH, "Dog", "")
+		request.Sign(identity)
+		assert.NotZero(request.Timestamp)
+
+		request.Timestamp++
+
+		assert.Error(request.Verify(request.Key))
+	})
+
+	t.Run("test_signing_payload_legacy_request", func(t *testing.T) {
+		request := NewMsgRequest(STUN_ACTION_NEW, "Dog", "Guau")
+		hello := request
+		hello.Hello(nil)
+
+		assert.NotEqual(request.SigningPayload(), hello.SigningPayload())
+		assert.Equal(request.SigningPayload(), MsgRequest{Action: STUN_ACTION_NEW, Peername: "Dog", Message: "Guau", Features: []string{"ignored"}}.SigningPayload())
+	})
+
+	t.Run("test_verify_fail_other_key", func(t *testing.T) {
+		_, identity, _ := ed25519.GenerateKey(nil)
+		other, _, _ := ed25519.GenerateKey(nil)
+		request := NewMsgRequest(STUN_ACTION_NEW, "Dog", "Guau")
+		request.Sign(identity)
+
+		assert.Error(request.Verify(EncodeKey(other)))
+	})
+
+	t.Run("test_verify_fail_unsigned", func(t *testing.T) {
+		public, _, _ := ed25519.GenerateKey(nil)
+		request := NewMsgRequest(STUN_ACTION_NEW, "Dog", "Guau")
+
+		assert.Error(request.Verify(EncodeKey(public)))
+	})
+
+	t.Run("test_signing_payload_is_unambiguous", func(t *testing.T) {
+		first := NewMsgRequest(STUN_ACTION_NEW, "Dog", "Guau")
+		second := NewMsgRequest(STUN_ACTION_NEW, "DogG", "uau")
+
+		assert.NotEqual(first.SigningPayload(), second.SigningPayload())
+	})
+
+	t.Run("test_decode_key_fail_invalid_size", func(t *testing.T) {
+		_, err := DecodeKey("abcd")
+
+		assert.Error(err)
+	})
+}
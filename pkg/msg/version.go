@@ -0,0 +1,65 @@
+package msg
+
+const (
+	// Version of the protocol spoken by this
+	// release. It changes whenever actions or
+	// fields change in an incompatible way
+	PROTOCOL_VERSION = 1
+
+	// Version of the messages written by peers
+	// and servers released before the protocol
+	// was versioned. They do not send any version
+	LEGACY_PROTOCOL_VERSION = 0
+)
+
+// Optional features a peer can advertise
+// in his hello so the remote side knows
+// what it can expect from him
+const (
+	FEATURE_ENCRYPTION  = "encryption"
+	FEATURE_RELIABILITY = "reliability"
+	FEATURE_COMPRESSION = "compression"
+)
+
+// Protocol version and optional features
+// advertised by a peer in his hello
+type Capabilities struct {
+	Version  int
+	Features []string
+}
+
+// Checks if the given feature has been advertised
+func (capabilities Capabilities) Supports(feature string) bool {
+	for _, advertised := range capabilities.Features {
+		if advertised == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the capabilities belong to a peer
+// released before the protocol was versioned,
+// whose features are unknown
+func (capabilities Capabilities) IsLegacy() bool {
+	return capabilities.Version == LEGACY_PROTOCOL_VERSION
+}
+
+// Checks if the given protocol version can be
+// understood by this release
+func SupportsVersion(version int) bool {
+	return version >= LEGACY_PROTOCOL_VERSION && version <= PROTOCOL_VERSION
+}
+
+// Attaches the protocol version and the given
+// features to the request so it says hello
+func (request *MsgRequest) Hello(features []string) {
+	request.Version = PROTOCOL_VERSION
+	request.Features = features
+}
+
+// Returns the capabilities advertised
+// by the sender of the response
+func (response MsgResponse) Capabilities() Capabilities {
+	return Capabilities{Version: response.Version, Features: response.Features}
+}
@@ -0,0 +1,46 @@
+package msg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_supports_version", func(t *testing.T) {
+		assert.True(SupportsVersion(LEGACY_PROTOCOL_VERSION))
+		assert.True(SupportsVersion(PROTOCOL_VERSION))
+		assert.False(SupportsVersion(PROTOCOL_VERSION + 1))
+		assert.False(SupportsVersion(-1))
+	})
+
+	t.Run("test_request_hello", func(t *testing.T) {
+		request := NewMsgRequest(PEER_ACTION_PUNCH, "Dog", "")
+
+		request.Hello([]string{FEATURE_RELIABILITY})
+
+		assert.Equal(PROTOCOL_VERSION, request.Version)
+		assert.Equal([]string{FEATURE_RELIABILITY}, request.Features)
+	})
+
+	t.Run("test_response_capabilities", func(t *testing.T) {
+		response := NewMsgResponse(PEER_ACTION_PUNCH, false, "Dog", "")
+		response.Version = PROTOCOL_VERSION
+		response.Features = []string{FEATURE_ENCRYPTION}
+
+		capabilities := response.Capabilities()
+
+		assert.Equal(PROTOCOL_VERSION, capabilities.Version)
+		assert.False(capabilities.IsLegacy())
+		assert.True(capabilities.Supports(FEATURE_ENCRYPTION))
+		assert.False(capabilities.Supports(FEATURE_COMPRESSION))
+	})
+
+	t.Run("test_response_capabilities_legacy", func(t *testing.T) {
+		response := NewMsgResponse(PEER_ACTION_PUNCH, false, "Dog", "")
+
+		assert.True(response.Capabilities().IsLegacy())
+	})
+}
@@ -0,0 +1,90 @@
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	// Size of the symmetric keys
+	KEY_SIZE = 32
+	// Size of the authentication tag appended
+	// to every encrypted message
+	TAG_SIZE = 16
+)
+
+// Cipher state that encrypts and decrypts
+// messages with AES-256-GCM and a counter
+// based nonce
+type CipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+// Builds the 96 bits nonce for the given counter
+func buildNonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+// Encrypts the given plaintext with the given
+// nonce authenticating the additional data
+func (state *CipherState) EncryptWithNonce(n uint64, ad []byte, plaintext []byte) ([]byte, error) {
+	if n == math.MaxUint64 {
+		return nil, fmt.Errorf("nonce exhausted")
+	}
+	return state.aead.Seal(nil, buildNonce(n), plaintext, ad), nil
+}
+
+// Decrypts the given ciphertext with the given
+// nonce authenticating the additional data
+func (state *CipherState) DecryptWithNonce(n uint64, ad []byte, ciphertext []byte) ([]byte, error) {
+	if n == math.MaxUint64 {
+		return nil, fmt.Errorf("nonce exhausted")
+	}
+	return state.aead.Open(nil, buildNonce(n), ciphertext, ad)
+}
+
+// Encrypts the given plaintext with the
+// next nonce of the cipher state
+func (state *CipherState) Encrypt(ad []byte, plaintext []byte) ([]byte, error) {
+	ciphertext, err := state.EncryptWithNonce(state.nonce, ad, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	state.nonce++
+	return ciphertext, nil
+}
+
+// Decrypts the given ciphertext with the
+// next nonce of the cipher state
+func (state *CipherState) Decrypt(ad []byte, ciphertext []byte) ([]byte, error) {
+	plaintext, err := state.DecryptWithNonce(state.nonce, ad, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	state.nonce++
+	return plaintext, nil
+}
+
+// Creates a new cipher state with the given key
+func NewCipherState(key []byte) (*CipherState, error) {
+	if len(key) != KEY_SIZE {
+		return nil, fmt.Errorf("invalid key size %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &CipherState{aead: aead}, nil
+}
@@ -0,0 +1,65 @@
+package noise
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCipherState(t *testing.T) {
+	assert := require.New(t)
+	key := make([]byte, KEY_SIZE)
+
+	t.Run("test_new_cipher_state_fail_key_size", func(t *testing.T) {
+		_, err := NewCipherState([]byte("short"))
+
+		assert.Error(err)
+	})
+
+	t.Run("test_encrypt_decrypt", func(t *testing.T) {
+		sender, _ := NewCipherState(key)
+		receiver, _ := NewCipherState(key)
+		ad := []byte("ad")
+		plaintext := []byte("Guau")
+
+		ciphertext, err := sender.Encrypt(ad, plaintext)
+		assert.NoError(err)
+		assert.Len(ciphertext, len(plaintext)+TAG_SIZE)
+
+		result, err := receiver.Decrypt(ad, ciphertext)
+		assert.NoError(err)
+		assert.Equal(plaintext, result)
+		assert.Equal(uint64(1), sender.nonce)
+		assert.Equal(uint64(1), receiver.nonce)
+	})
+
+	t.Run("test_decrypt_fail_tampered", func(t *testing.T) {
+		sender, _ := NewCipherState(key)
+		receiver, _ := NewCipherState(key)
+
+		ciphertext, _ := sender.Encrypt(nil, []byte("Guau"))
+		ciphertext[0] ^= 0xff
+
+		_, err := receiver.Decrypt(nil, ciphertext)
+		assert.Error(err)
+		assert.Equal(uint64(0), receiver.nonce)
+	})
+
+	t.Run("test_decrypt_fail_additional_data", func(t *testing.T) {
+		sender, _ := NewCipherState(key)
+		receiver, _ := NewCipherState(key)
+
+		ciphertext, _ := sender.Encrypt([]byte("ad"), []byte("Guau"))
+
+		_, err := receiver.Decrypt([]byte("another"), ciphertext)
+		assert.Error(err)
+	})
+
+	t.Run("test_encrypt_fail_nonce_exhausted", func(t *testing.T) {
+		sender, _ := NewCipherState(key)
+
+		_, err := sender.EncryptWithNonce(math.MaxUint64, nil, []byte("Guau"))
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,347 @@
+package noise
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+const (
+	// Name of the implemented protocol. It is
+	// mixed into the handshake hash so peers
+	// using another protocol cannot complete it
+	PROTOCOL_NAME = "Noise_XX_P256_AESGCM_SHA256"
+)
+
+// Derives two keys from the given chaining
+// key and input key material
+func hkdf(ck []byte, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+// Symmetric state shared by both sides of
+// the handshake. It keeps the chaining key,
+// the handshake hash and the current cipher
+type symmetricState struct {
+	ck     []byte
+	h      []byte
+	cipher *CipherState
+}
+
+// Mixes the given data into the handshake hash
+func (state *symmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(state.h)
+	hash.Write(data)
+	state.h = hash.Sum(nil)
+}
+
+// Mixes the given key material into the
+// chaining key and rekeys the cipher
+func (state *symmetricState) mixKey(ikm []byte) error {
+	ck, key := hkdf(state.ck, ikm)
+	cipher, err := NewCipherState(key)
+	if err != nil {
+		return err
+	}
+
+	state.ck = ck
+	state.cipher = cipher
+	return nil
+}
+
+// Encrypts the given plaintext if there's a key
+// already and mixes the result into the hash
+func (state *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext := plaintext
+	if state.cipher != nil {
+		encrypted, err := state.cipher.Encrypt(state.h, plaintext)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext = encrypted
+	}
+
+	state.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+// Decrypts the given ciphertext if there's a key
+// already and mixes it into the hash
+func (state *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if state.cipher != nil {
+		decrypted, err := state.cipher.Decrypt(state.h, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		plaintext = decrypted
+	}
+
+	state.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// Derives the two transport cipher states
+func (state *symmetricState) split() (*CipherState, *CipherState, error) {
+	k1, k2 := hkdf(state.ck, []byte{})
+	c1, err := NewCipherState(k1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c2, err := NewCipherState(k2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+// Creates a new symmetric state for the
+// protocol and the given prologue
+func newSymmetricState(prologue []byte) *symmetricState {
+	h := make([]byte, sha256.Size)
+	copy(h, PROTOCOL_NAME)
+
+	state := &symmetricState{ck: h, h: h}
+	state.mixHash(prologue)
+	return state
+}
+
+// Handshake that follows the Noise XX pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// Both peers authenticate their static keys
+// and end up sharing two transport keys, one
+// for each direction
+type Handshake struct {
+	initiator bool
+	step      int
+	static    *Keypair
+	ephemeral *Keypair
+	rs        []byte
+	re        []byte
+	state     *symmetricState
+}
+
+// Mixes the shared secret between the given
+// keypair and public key into the state
+func (hs *Handshake) mixDH(keypair *Keypair, public []byte) error {
+	secret, err := keypair.DH(public)
+	if err != nil {
+		return err
+	}
+	return hs.state.mixKey(secret)
+}
+
+// Generates the ephemeral key and writes it
+func (hs *Handshake) writeEphemeral() ([]byte, error) {
+	ephemeral, err := GenerateKeypair()
+	if err != nil {
+		return nil, err
+	}
+
+	hs.ephemeral = ephemeral
+	hs.state.mixHash(ephemeral.Public)
+	return ephemeral.Public, nil
+}
+
+// Reads the remote ephemeral key from the
+// beginning of the given message
+func (hs *Handshake) readEphemeral(message []byte) ([]byte, error) {
+	if len(message) < PUBLIC_KEY_SIZE {
+		return nil, fmt.Errorf("handshake message too short")
+	}
+
+	hs.re = message[:PUBLIC_KEY_SIZE]
+	hs.state.mixHash(hs.re)
+	return message[PUBLIC_KEY_SIZE:], nil
+}
+
+// Reads the encrypted remote static key from
+// the beginning of the given message
+func (hs *Handshake) readStatic(message []byte) ([]byte, error) {
+	if len(message) < PUBLIC_KEY_SIZE+TAG_SIZE {
+		return nil, fmt.Errorf("handshake message too short")
+	}
+
+	rs, err := hs.state.decryptAndHash(message[:PUBLIC_KEY_SIZE+TAG_SIZE])
+	if err != nil {
+		return nil, err
+	}
+
+	hs.rs = rs
+	return message[PUBLIC_KEY_SIZE+TAG_SIZE:], nil
+}
+
+// Writes the next handshake message with
+// the given payload
+func (hs *Handshake) WriteMessage(payload []byte) ([]byte, error) {
+	var message []byte
+
+	switch {
+	case hs.initiator && hs.step == 0:
+		// -> e
+		e, err := hs.writeEphemeral()
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, e...)
+	case !hs.initiator && hs.step == 1:
+		// <- e, ee, s, es
+		e, err := hs.writeEphemeral()
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, e...)
+
+		if err := hs.mixDH(hs.ephemeral, hs.re); err != nil {
+			return nil, err
+		}
+
+		s, err := hs.state.encryptAndHash(hs.static.Public)
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, s...)
+
+		if err := hs.mixDH(hs.static, hs.re); err != nil {
+			return nil, err
+		}
+	case hs.initiator && hs.step == 2:
+		// -> s, se
+		s, err := hs.state.encryptAndHash(hs.static.Public)
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, s...)
+
+		if err := hs.mixDH(hs.static, hs.re); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected handshake write at step %d", hs.step)
+	}
+
+	encrypted, err := hs.state.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.step++
+	return append(message, encrypted...), nil
+}
+
+// Reads the next handshake message and
+// returns his payload
+func (hs *Handshake) ReadMessage(message []byte) ([]byte, error) {
+	var err error
+
+	switch {
+	case !hs.initiator && hs.step == 0:
+		// -> e
+		if message, err = hs.readEphemeral(message); err != nil {
+			return nil, err
+		}
+	case hs.initiator && hs.step == 1:
+		// <- e, ee, s, es
+		if message, err = hs.readEphemeral(message); err != nil {
+			return nil, err
+		}
+
+		if err := hs.mixDH(hs.ephemeral, hs.re); err != nil {
+			return nil, err
+		}
+
+		if message, err = hs.readStatic(message); err != nil {
+			return nil, err
+		}
+
+		if err := hs.mixDH(hs.ephemeral, hs.rs); err != nil {
+			return nil, err
+		}
+	case !hs.initiator && hs.step == 2:
+		// -> s, se
+		if message, err = hs.readStatic(message); err != nil {
+			return nil, err
+		}
+
+		if err := hs.mixDH(hs.ephemeral, hs.rs); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected handshake read at step %d", hs.step)
+	}
+
+	payload, err := hs.state.decryptAndHash(message)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.step++
+	return payload, nil
+}
+
+// Returns whether every handshake
+// message has been processed
+func (hs *Handshake) Complete() bool {
+	return hs.step == 3
+}
+
+// Returns the static key of the remote peer
+// once it has been received
+func (hs *Handshake) RemoteStatic() []byte {
+	return hs.rs
+}
+
+// Returns the current handshake hash, which
+// uniquely identifies the handshake once it
+// is complete
+func (hs *Handshake) Hash() []byte {
+	return hs.state.h
+}
+
+// Builds the transport session once
+// the handshake is complete
+func (hs *Handshake) Session() (*Session, error) {
+	if !hs.Complete() {
+		return nil, fmt.Errorf("handshake is not complete")
+	}
+
+	c1, c2, err := hs.state.split()
+	if err != nil {
+		return nil, err
+	}
+
+	if hs.initiator {
+		return NewSession(c1, c2), nil
+	}
+	return NewSession(c2, c1), nil
+}
+
+// Creates a new handshake for the given role
+// with the given static keypair. Both peers
+// must use the same prologue
+func NewHandshake(initiator bool, static *Keypair, prologue []byte) *Handshake {
+	return &Handshake{
+		initiator: initiator,
+		static:    static,
+		state:     newSymmetricState(prologue),
+	}
+}
@@ -0,0 +1,148 @@
+package noise
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Runs a complete handshake between two
+// new peers and returns both sides
+func runHandshake(prologue []byte) (*Handshake, *Handshake, error) {
+	initiatorStatic, _ := GenerateKeypair()
+	responderStatic, _ := GenerateKeypair()
+	initiator := NewHandshake(true, initiatorStatic, prologue)
+	responder := NewHandshake(false, responderStatic, prologue)
+
+	m1, err := initiator.WriteMessage([]byte("one"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := responder.ReadMessage(m1); err != nil {
+		return nil, nil, err
+	}
+
+	m2, err := responder.WriteMessage([]byte("two"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := initiator.ReadMessage(m2); err != nil {
+		return nil, nil, err
+	}
+
+	m3, err := initiator.WriteMessage([]byte("three"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := responder.ReadMessage(m3); err != nil {
+		return nil, nil, err
+	}
+	return initiator, responder, nil
+}
+
+func TestHandshake(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_handshake_success", func(t *testing.T) {
+		initiator, responder, err := runHandshake([]byte("fox"))
+
+		assert.NoError(err)
+		assert.True(initiator.Complete())
+		assert.True(responder.Complete())
+		assert.Equal(initiator.static.Public, responder.RemoteStatic())
+		assert.Equal(responder.static.Public, initiator.RemoteStatic())
+		assert.Equal(initiator.Hash(), responder.Hash())
+	})
+
+	t.Run("test_handshake_payloads", func(t *testing.T) {
+		initiatorStatic, _ := GenerateKeypair()
+		responderStatic, _ := GenerateKeypair()
+		initiator := NewHandshake(true, initiatorStatic, nil)
+		responder := NewHandshake(false, responderStatic, nil)
+
+		m1, _ := initiator.WriteMessage([]byte("one"))
+		p1, _ := responder.ReadMessage(m1)
+		m2, _ := responder.WriteMessage([]byte("two"))
+		p2, _ := initiator.ReadMessage(m2)
+		m3, _ := initiator.WriteMessage([]byte("three"))
+		p3, _ := responder.ReadMessage(m3)
+
+		assert.Equal([]byte("one"), p1)
+		assert.Equal([]byte("two"), p2)
+		assert.Equal([]byte("three"), p3)
+		assert.NotContains(string(m2), "two")
+		assert.NotContains(string(m3), "three")
+	})
+
+	t.Run("test_handshake_sessions", func(t *testing.T) {
+		initiator, responder, _ := runHandshake(nil)
+
+		initiatorSession, err := initiator.Session()
+		assert.NoError(err)
+		responderSession, err := responder.Session()
+		assert.NoError(err)
+
+		frame, _ := initiatorSession.Seal([]byte("Guau"))
+		plaintext, err := responderSession.Open(frame)
+		assert.NoError(err)
+		assert.Equal([]byte("Guau"), plaintext)
+
+		frame, _ = responderSession.Seal([]byte("Miau"))
+		plaintext, err = initiatorSession.Open(frame)
+		assert.NoError(err)
+		assert.Equal([]byte("Miau"), plaintext)
+	})
+
+	t.Run("test_handshake_fail_prologue_mismatch", func(t *testing.T) {
+		initiatorStatic, _ := GenerateKeypair()
+		responderStatic, _ := GenerateKeypair()
+		initiator := NewHandshake(true, initiatorStatic, []byte("dog"))
+		responder := NewHandshake(false, responderStatic, []byte("cat"))
+
+		m1, _ := initiator.WriteMessage(nil)
+		responder.ReadMessage(m1)
+		m2, _ := responder.WriteMessage(nil)
+
+		_, err := initiator.ReadMessage(m2)
+		assert.Error(err)
+	})
+
+	t.Run("test_handshake_fail_tampered_message", func(t *testing.T) {
+		initiatorStatic, _ := GenerateKeypair()
+		responderStatic, _ := GenerateKeypair()
+		initiator := NewHandshake(true, initiatorStatic, nil)
+		responder := NewHandshake(false, responderStatic, nil)
+
+		m1, _ := initiator.WriteMessage(nil)
+		responder.ReadMessage(m1)
+		m2, _ := responder.WriteMessage(nil)
+		m2[len(m2)-1] ^= 0xff
+
+		_, err := initiator.ReadMessage(m2)
+		assert.Error(err)
+	})
+
+	t.Run("test_handshake_fail_short_message", func(t *testing.T) {
+		responderStatic, _ := GenerateKeypair()
+		responder := NewHandshake(false, responderStatic, nil)
+
+		_, err := responder.ReadMessage([]byte("short"))
+		assert.Error(err)
+	})
+
+	t.Run("test_handshake_fail_unexpected_step", func(t *testing.T) {
+		responderStatic, _ := GenerateKeypair()
+		responder := NewHandshake(false, responderStatic, nil)
+
+		_, err := responder.WriteMessage(nil)
+		assert.Error(err)
+	})
+
+	t.Run("test_handshake_fail_session_not_complete", func(t *testing.T) {
+		initiatorStatic, _ := GenerateKeypair()
+		initiator := NewHandshake(true, initiatorStatic, nil)
+
+		_, err := initiator.Session()
+		assert.Error(err)
+	})
+}
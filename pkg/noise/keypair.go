@@ -0,0 +1,50 @@
+package noise
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+)
+
+const (
+	// Size of the serialized public keys
+	PUBLIC_KEY_SIZE = 65
+	// Size of the Diffie-Hellman shared secrets
+	DH_SIZE = 32
+)
+
+// Curve used for every Diffie-Hellman operation
+var curve = elliptic.P256()
+
+// Diffie-Hellman keypair
+type Keypair struct {
+	Private []byte
+	Public  []byte
+}
+
+// Computes the shared secret between the
+// keypair and the given public key
+func (keypair *Keypair) DH(public []byte) ([]byte, error) {
+	x, y := elliptic.Unmarshal(curve, public)
+	if x == nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	sx, _ := curve.ScalarMult(x, y, keypair.Private)
+	secret := make([]byte, DH_SIZE)
+	sx.FillBytes(secret)
+	return secret, nil
+}
+
+// Generates a new random keypair
+func GenerateKeypair() (*Keypair, error) {
+	private, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keypair{
+		Private: private,
+		Public:  elliptic.Marshal(curve, x, y),
+	}, nil
+}
@@ -0,0 +1,40 @@
+package noise
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeypair(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_generate_keypair", func(t *testing.T) {
+		keypair, err := GenerateKeypair()
+
+		assert.NoError(err)
+		assert.Len(keypair.Public, PUBLIC_KEY_SIZE)
+	})
+
+	t.Run("test_dh_agreement", func(t *testing.T) {
+		alice, _ := GenerateKeypair()
+		bob, _ := GenerateKeypair()
+
+		aliceSecret, err := alice.DH(bob.Public)
+		assert.NoError(err)
+
+		bobSecret, err := bob.DH(alice.Public)
+		assert.NoError(err)
+
+		assert.Len(aliceSecret, DH_SIZE)
+		assert.Equal(aliceSecret, bobSecret)
+	})
+
+	t.Run("test_dh_fail_invalid_public_key", func(t *testing.T) {
+		alice, _ := GenerateKeypair()
+
+		_, err := alice.DH([]byte("fake"))
+
+		assert.Error(err)
+	})
+}
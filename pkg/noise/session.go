@@ -0,0 +1,143 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// Number of nonces below the highest received
+	// one that are still accepted if they arrive
+	// out of order
+	REPLAY_WINDOW_SIZE = 64
+	// Size of the nonce that prefixes every
+	// sealed frame
+	NONCE_SIZE = 8
+)
+
+// Error returned when a sealed frame
+// was already opened or it is too old
+var ErrReplayed = errors.New("replayed frame")
+
+// Sliding window of received nonces
+// that rejects replayed frames
+type replayWindow struct {
+	highest uint64
+	bitmap  uint64
+	started bool
+}
+
+// Returns whether the given nonce
+// has not been received yet
+func (window *replayWindow) check(n uint64) bool {
+	if !window.started || n > window.highest {
+		return true
+	}
+
+	diff := window.highest - n
+	if diff >= REPLAY_WINDOW_SIZE {
+		return false
+	}
+	return window.bitmap&(1<<diff) == 0
+}
+
+// Marks the given nonce as received
+func (window *replayWindow) mark(n uint64) {
+	if !window.started {
+		window.started = true
+		window.highest = n
+		window.bitmap = 1
+		return
+	}
+
+	if n > window.highest {
+		shift := n - window.highest
+		if shift >= REPLAY_WINDOW_SIZE {
+			window.bitmap = 0
+		} else {
+			window.bitmap <<= shift
+		}
+		window.bitmap |= 1
+		window.highest = n
+		return
+	}
+
+	window.bitmap |= 1 << (window.highest - n)
+}
+
+// Transport session established once the
+// handshake is complete. Every sealed frame
+// is prefixed by his nonce so frames can be
+// opened even if they arrive out of order,
+// but never twice
+type Session struct {
+	sendLock sync.Mutex
+	send     *CipherState
+	recvLock sync.Mutex
+	recv     *CipherState
+	window   replayWindow
+}
+
+// Encrypts the given plaintext into a frame
+func (session *Session) Seal(plaintext []byte) ([]byte, error) {
+	session.sendLock.Lock()
+	defer session.sendLock.Unlock()
+
+	n := session.send.nonce
+	frame := make([]byte, NONCE_SIZE)
+	binary.BigEndian.PutUint64(frame, n)
+
+	ciphertext, err := session.send.Encrypt(frame, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(frame, ciphertext...), nil
+}
+
+// Decrypts the given frame rejecting the
+// forged and replayed ones
+func (session *Session) Open(frame []byte) ([]byte, error) {
+	if len(frame) < NONCE_SIZE+TAG_SIZE {
+		return nil, fmt.Errorf("sealed frame too short")
+	}
+
+	session.recvLock.Lock()
+	defer session.recvLock.Unlock()
+
+	n := binary.BigEndian.Uint64(frame[:NONCE_SIZE])
+	if !session.window.check(n) {
+		return nil, fmt.Errorf("%w %d", ErrReplayed, n)
+	}
+
+	plaintext, err := session.recv.DecryptWithNonce(n, frame[:NONCE_SIZE], frame[NONCE_SIZE:])
+	if err != nil {
+		return nil, err
+	}
+
+	session.window.mark(n)
+	return plaintext, nil
+}
+
+// Decrypts the given frame even if it was opened
+// before, so retransmitted frames can be told apart
+// from forged ones. Callers must never deliver
+// the plaintext of a replayed frame twice
+func (session *Session) Reopen(frame []byte) ([]byte, error) {
+	if len(frame) < NONCE_SIZE+TAG_SIZE {
+		return nil, fmt.Errorf("sealed frame too short")
+	}
+
+	session.recvLock.Lock()
+	defer session.recvLock.Unlock()
+
+	n := binary.BigEndian.Uint64(frame[:NONCE_SIZE])
+	return session.recv.DecryptWithNonce(n, frame[:NONCE_SIZE], frame[NONCE_SIZE:])
+}
+
+// Creates a new session with the given
+// sending and receiving cipher states
+func NewSession(send *CipherState, recv *CipherState) *Session {
+	return &Session{send: send, recv: recv}
+}
@@ -0,0 +1,149 @@
+package noise
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Creates two connected sessions
+func newSessionPair() (*Session, *Session) {
+	k1 := make([]byte, KEY_SIZE)
+	k2 := make([]byte, KEY_SIZE)
+	k2[0] = 1
+
+	c1, _ := NewCipherState(k1)
+	c2, _ := NewCipherState(k2)
+	r1, _ := NewCipherState(k1)
+	r2, _ := NewCipherState(k2)
+	return NewSession(c1, r2), NewSession(c2, r1)
+}
+
+func TestReplayWindow(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_replay_window_rejects_duplicates", func(t *testing.T) {
+		window := replayWindow{}
+
+		assert.True(window.check(5))
+		window.mark(5)
+		assert.False(window.check(5))
+	})
+
+	t.Run("test_replay_window_accepts_out_of_order", func(t *testing.T) {
+		window := replayWindow{}
+
+		window.mark(10)
+		assert.True(window.check(7))
+		window.mark(7)
+		assert.False(window.check(7))
+		assert.True(window.check(8))
+	})
+
+	t.Run("test_replay_window_rejects_too_old", func(t *testing.T) {
+		window := replayWindow{}
+
+		window.mark(REPLAY_WINDOW_SIZE + 10)
+
+		assert.False(window.check(5))
+	})
+
+	t.Run("test_replay_window_slides", func(t *testing.T) {
+		window := replayWindow{}
+
+		window.mark(1)
+		window.mark(2)
+		window.mark(1000)
+
+		assert.True(window.check(999))
+		assert.False(window.check(1000))
+	})
+}
+
+func TestSession(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_session_seal_open", func(t *testing.T) {
+		alice, bob := newSessionPair()
+
+		frame, err := alice.Seal([]byte("Guau"))
+		assert.NoError(err)
+
+		plaintext, err := bob.Open(frame)
+		assert.NoError(err)
+		assert.Equal([]byte("Guau"), plaintext)
+	})
+
+	t.Run("test_session_open_out_of_order", func(t *testing.T) {
+		alice, bob := newSessionPair()
+
+		first, _ := alice.Seal([]byte("first"))
+		second, _ := alice.Seal([]byte("second"))
+
+		plaintext, err := bob.Open(second)
+		assert.NoError(err)
+		assert.Equal([]byte("second"), plaintext)
+
+		plaintext, err = bob.Open(first)
+		assert.NoError(err)
+		assert.Equal([]byte("first"), plaintext)
+	})
+
+	t.Run("test_session_open_fail_replayed", func(t *testing.T) {
+		alice, bob := newSessionPair()
+
+		frame, _ := alice.Seal([]byte("Guau"))
+		bob.Open(frame)
+
+		_, err := bob.Open(frame)
+		assert.ErrorIs(err, ErrReplayed)
+	})
+
+	t.Run("test_session_reopen_replayed", func(t *testing.T) {
+		alice, bob := newSessionPair()
+
+		frame, _ := alice.Seal([]byte("Guau"))
+		bob.Open(frame)
+
+		plaintext, err := bob.Reopen(frame)
+		assert.NoError(err)
+		assert.Equal([]byte("Guau"), plaintext)
+	})
+
+	t.Run("test_session_reopen_fail_forged", func(t *testing.T) {
+		alice, bob := newSessionPair()
+
+		frame, _ := alice.Seal([]byte("Guau"))
+		bob.Open(frame)
+		frame[len(frame)-1] ^= 1
+
+		_, err := bob.Reopen(frame)
+		assert.Error(err)
+	})
+
+	t.Run("test_session_open_fail_forged_nonce", func(t *testing.T) {
+		alice, bob := newSessionPair()
+
+		frame, _ := alice.Seal([]byte("Guau"))
+		frame[NONCE_SIZE-1] = 9
+
+		_, err := bob.Open(frame)
+		assert.Error(err)
+	})
+
+	t.Run("test_session_open_fail_wrong_direction", func(t *testing.T) {
+		alice, _ := newSessionPair()
+
+		frame, _ := alice.Seal([]byte("Guau"))
+
+		_, err := alice.Open(frame)
+		assert.Error(err)
+	})
+
+	t.Run("test_session_open_fail_short_frame", func(t *testing.T) {
+		_, bob := newSessionPair()
+
+		_, err := bob.Open([]byte("short"))
+		assert.Error(err)
+	})
+}
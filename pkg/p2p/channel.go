@@ -0,0 +1,458 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+const (
+	// Max number of messages a channel writes
+	// before the remote peer reads them. It is
+	// kept below the reliable window so a busy
+	// channel does not starve the rest of them
+	CHANNEL_WINDOW_SIZE = 16
+)
+
+// Identifies a channel by the name of the remote
+// peer and the id given by the one who opened it
+type channelKey struct {
+	peername string
+	id       string
+}
+
+// Logical channel with another peer. Every channel
+// has his own queue of received messages and the
+// remote peer only writes as many messages as the
+// queue has room for, so a busy channel does not
+// block the others
+type Channel struct {
+	sync.Mutex
+	key           channelKey
+	writer        *P2PWriter
+	table         *channelTable
+	messages      chan *msg.MsgResponse
+	notify        chan struct{}
+	credits       int
+	consumed      int
+	closed        bool
+	finished      bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Returns the id of the channel
+func (channel *Channel) Id() string {
+	return channel.key.id
+}
+
+// Returns the name of the remote peer
+func (channel *Channel) Peername() string {
+	return channel.key.peername
+}
+
+// Wakes up everyone waiting for the channel.
+// It must be called with the channel locked
+func (channel *Channel) signal() {
+	close(channel.notify)
+	channel.notify = make(chan struct{})
+}
+
+// Sends the given request through the channel
+// reliably giving up once the deadline is exceeded
+func (channel *Channel) send(request msg.MsgRequest, deadline time.Time) (int, error) {
+	request.Channel = channel.key.id
+	return channel.writer.sender.pushBefore(request, deadline)
+}
+
+// Writes the given message into the channel. It
+// blocks until the remote peer has room for it
+func (channel *Channel) Write(action string, message string) (int, error) {
+	return channel.write(msg.NewMsgRequest(action, channel.writer.name, message))
+}
+
+// Writes a message carrying the given binary body
+// and headers into the channel. It blocks until
+// the remote peer has room for it
+func (channel *Channel) WriteBody(action string, body []byte, headers map[string]string) (int, error) {
+	return channel.write(msg.NewMsgRequestBody(action, channel.writer.name, body, headers))
+}
+
+// Writes the given request into the channel
+// once the remote peer has room for it
+func (channel *Channel) write(request msg.MsgRequest) (int, error) {
+	for {
+		channel.Lock()
+		switch {
+		case channel.closed:
+			channel.Unlock()
+			return 0, net.ErrClosed
+		case channel.finished:
+			channel.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+
+		deadline := channel.writeDeadline
+		if channel.credits > 0 {
+			channel.credits--
+			channel.Unlock()
+
+			n, err := channel.send(request, deadline)
+			if err != nil {
+				channel.grant(1)
+			}
+			return n, err
+		}
+		notify := channel.notify
+		channel.Unlock()
+
+		if err := waitUntil(notify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Returns the next message written by the remote
+// peer into the channel. It returns `io.EOF` once
+// the remote peer closed it and every message
+// has been read
+func (channel *Channel) Listen() (*msg.MsgResponse, error) {
+	for {
+		select {
+		case response := <-channel.messages:
+			channel.consume()
+			return response, nil
+		default:
+		}
+
+		channel.Lock()
+		switch {
+		case channel.closed:
+			channel.Unlock()
+			return nil, net.ErrClosed
+		case channel.finished && len(channel.messages) == 0:
+			channel.Unlock()
+			return nil, io.EOF
+		}
+		notify, deadline := channel.notify, channel.readDeadline
+		channel.Unlock()
+
+		if err := waitUntil(notify, deadline); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Counts a read message and gives the remote peer
+// credits to write more once half of the window
+// has been read
+func (channel *Channel) consume() {
+	channel.Lock()
+	channel.consumed++
+	if channel.consumed < CHANNEL_WINDOW_SIZE/2 || channel.closed || channel.finished {
+		channel.Unlock()
+		return
+	}
+	credits := channel.consumed
+	channel.consumed = 0
+	channel.Unlock()
+
+	channel.send(msg.NewMsgRequest(msg.PEER_ACTION_CHANNEL_CREDIT, channel.writer.name, strconv.Itoa(credits)), time.Time{})
+}
+
+// Adds credits to write messages
+func (channel *Channel) grant(credits int) {
+	channel.Lock()
+	defer channel.Unlock()
+
+	channel.credits += credits
+	channel.signal()
+}
+
+// Closes the channel, the remote peer reads
+// the pending messages and then `io.EOF`
+func (channel *Channel) Close() error {
+	channel.Lock()
+	if channel.closed {
+		channel.Unlock()
+		return net.ErrClosed
+	}
+	channel.closed = true
+	finished := channel.finished
+	channel.signal()
+	channel.Unlock()
+
+	channel.table.remove(channel)
+	if finished {
+		return nil
+	}
+
+	_, err := channel.send(msg.NewMsgRequest(msg.PEER_ACTION_CHANNEL_CLOSE, channel.writer.name, ""), time.Time{})
+	return err
+}
+
+// Closes the channel without telling the remote peer
+func (channel *Channel) abort() {
+	channel.Lock()
+	defer channel.Unlock()
+
+	if !channel.closed {
+		channel.closed = true
+		channel.signal()
+	}
+}
+
+// Queues the message written by the remote peer.
+// Messages beyond the window are dropped as the
+// remote peer had no credits to write them
+func (channel *Channel) receive(response *msg.MsgResponse) {
+	channel.Lock()
+	defer channel.Unlock()
+
+	if channel.closed || channel.finished {
+		return
+	}
+
+	select {
+	case channel.messages <- response:
+		channel.signal()
+	default:
+	}
+}
+
+// Marks the channel as closed by the remote peer
+func (channel *Channel) finish() {
+	channel.Lock()
+	defer channel.Unlock()
+
+	if !channel.finished {
+		channel.finished = true
+		channel.signal()
+	}
+}
+
+// Channels opened with other peers and the ones
+// opened by them waiting to be accepted
+type channelTable struct {
+	sync.Mutex
+	channels map[channelKey]*Channel
+	accepts  chan *Channel
+	streams  chan *Channel
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Creates a channel with the given key and saves it.
+// It returns nil if the channel already exists
+func (table *channelTable) open(key channelKey, writer *P2PWriter) *Channel {
+	table.Lock()
+	defer table.Unlock()
+
+	if _, exists := table.channels[key]; exists {
+		return nil
+	}
+
+	channel := &Channel{
+		key:      key,
+		writer:   writer,
+		table:    table,
+		messages: make(chan *msg.MsgResponse, CHANNEL_WINDOW_SIZE),
+		notify:   make(chan struct{}),
+		credits:  CHANNEL_WINDOW_SIZE,
+	}
+	table.channels[key] = channel
+	return channel
+}
+
+// Returns the channel with the given key or nil
+func (table *channelTable) get(key channelKey) *Channel {
+	table.Lock()
+	defer table.Unlock()
+	return table.channels[key]
+}
+
+// Removes the given channel
+func (table *channelTable) remove(channel *Channel) {
+	table.Lock()
+	defer table.Unlock()
+
+	if current, exists := table.channels[channel.key]; exists && current == channel {
+		delete(table.channels, channel.key)
+	}
+}
+
+// Closes every channel and stops accepting new ones
+func (table *channelTable) shutdown() {
+	table.once.Do(func() {
+		close(table.done)
+	})
+
+	table.Lock()
+	defer table.Unlock()
+	for key, channel := range table.channels {
+		channel.abort()
+		delete(table.channels, key)
+	}
+}
+
+// Waits for the next channel queued into the given
+// accept queue. It fails once the table is shut down
+func (table *channelTable) accept(queue chan *Channel) (*Channel, error) {
+	select {
+	case channel := <-queue:
+		return channel, nil
+	case <-table.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Creates a new channel table that keeps up to the
+// given number of channels waiting to be accepted
+func newChannelTable(backlog int) *channelTable {
+	return &channelTable{
+		channels: map[channelKey]*Channel{},
+		accepts:  make(chan *Channel, backlog),
+		streams:  make(chan *Channel, backlog),
+		done:     make(chan struct{}),
+	}
+}
+
+// Opens a channel with the connected peer. The
+// action tells the remote peer which accept
+// queue the channel goes to
+func (writer P2PWriter) openChannel(action string) (*Channel, error) {
+	if writer.sender == nil || writer.channels == nil {
+		return nil, fmt.Errorf("writer does not support channels")
+	}
+
+	id, err := newStreamId()
+	if err != nil {
+		return nil, err
+	}
+
+	channel := writer.channels.open(channelKey{writer.peername, id}, &writer)
+	if channel == nil {
+		return nil, fmt.Errorf("channel `%s` already exists", id)
+	}
+
+	if _, err := channel.send(msg.NewMsgRequest(action, writer.name, ""), time.Time{}); err != nil {
+		writer.channels.remove(channel)
+		return nil, err
+	}
+	return channel, nil
+}
+
+// Opens a new logical channel with the connected
+// peer. The remote peer gets it through `AcceptChannel`
+func (writer P2PWriter) OpenChannel() (*Channel, error) {
+	return writer.openChannel(msg.PEER_ACTION_CHANNEL_OPEN)
+}
+
+// Connects to the given peer and opens
+// a new logical channel with him
+func (peer *Peer) OpenChannel(ctx context.Context, peername string) (*Channel, error) {
+	writer, err := peer.Connect(ctx, peername)
+	if err != nil {
+		return nil, err
+	}
+	return writer.OpenChannel()
+}
+
+// Waits for the next channel opened by another
+// peer. It fails once the peer is closed
+func (peer *Peer) AcceptChannel() (*Channel, error) {
+	if !peer.isInitialized() {
+		return nil, ErrNotInitialized
+	}
+	return peer.channels.accept(peer.channels.accepts)
+}
+
+// Handles a channel opened by another peer queueing
+// it until it is accepted. Channels that do not fit
+// into the queue are refused
+func (peer *Peer) handleChannelOpen(response *msg.MsgResponse) {
+	if response.Channel == "" || response.Addr == nil {
+		return
+	}
+
+	writer, err := peer.reliableWriterTo(response.Peername, response.Addr)
+	if err != nil {
+		return
+	}
+
+	channel := peer.channels.open(channelKey{response.Peername, response.Channel}, writer)
+	if channel == nil {
+		return
+	}
+
+	queue := peer.channels.accepts
+	if response.Action == msg.PEER_ACTION_STREAM_OPEN {
+		queue = peer.channels.streams
+	}
+
+	select {
+	case queue <- channel:
+	default:
+		// sending may block on the reliable window
+		// whose room is made by the dispatcher
+		go channel.Close()
+	}
+}
+
+// Handles a message written by another peer into a channel
+func (peer *Peer) handleChannelMessage(response *msg.MsgResponse) {
+	if channel := peer.channels.get(channelKey{response.Peername, response.Channel}); channel != nil {
+		channel.receive(response)
+	}
+}
+
+// Handles the credits granted by another peer
+func (peer *Peer) handleChannelCredit(response *msg.MsgResponse) {
+	credits, err := strconv.Atoi(response.Message)
+	if err != nil || credits <= 0 || credits > CHANNEL_WINDOW_SIZE {
+		return
+	}
+
+	if channel := peer.channels.get(channelKey{response.Peername, response.Channel}); channel != nil {
+		channel.grant(credits)
+	}
+}
+
+// Handles a channel closed by another peer
+func (peer *Peer) handleChannelClose(response *msg.MsgResponse) {
+	if channel := peer.channels.get(channelKey{response.Peername, response.Channel}); channel != nil {
+		channel.finish()
+		peer.channels.remove(channel)
+	}
+}
+
+// Waits until the given channel is closed or
+// the given deadline is exceeded. A zero
+// deadline waits forever
+func waitUntil(notify chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-notify
+		return nil
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-notify:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
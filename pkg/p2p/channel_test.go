@@ -0,0 +1,363 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates a channel that writes into a mocked
+// connection and returns it with his sender
+func newMockedChannel() (*Channel, *reliableSender) {
+	writer := NewP2PWriter("dog", &P2PConnMock{}, &net.UDPAddr{})
+	writer.sender, _ = newReliableSender(writer)
+	table := newChannelTable(DEFAULT_MAX_MSG_IN_QUEUE)
+	return table.open(channelKey{"cat", "id"}, writer), writer.sender
+}
+
+// Builds a message written into the given channel
+func newChannelMessage(channel string, action string, message string) *msg.MsgResponse {
+	response := msg.NewMsgResponse(action, false, "cat", message)
+	response.Channel = channel
+	response.Addr = &net.UDPAddr{}
+	return &response
+}
+
+func TestChannelTable(t *testing.T) {
+	assert := require.New(t)
+	writer := NewP2PWriter("dog", &P2PConnMock{}, &net.UDPAddr{})
+
+	t.Run("test_channel_table_open", func(t *testing.T) {
+		table := newChannelTable(DEFAULT_MAX_MSG_IN_QUEUE)
+		key := channelKey{"cat", "id"}
+
+		channel := table.open(key, writer)
+
+		assert.NotNil(channel)
+		assert.Equal("id", channel.Id())
+		assert.Equal("cat", channel.Peername())
+		assert.Equal(CHANNEL_WINDOW_SIZE, channel.credits)
+		assert.Equal(channel, table.get(key))
+		assert.Nil(table.open(key, writer))
+	})
+
+	t.Run("test_channel_table_remove", func(t *testing.T) {
+		table := newChannelTable(DEFAULT_MAX_MSG_IN_QUEUE)
+		key := channelKey{"cat", "id"}
+		channel := table.open(key, writer)
+
+		table.remove(channel)
+
+		assert.Nil(table.get(key))
+	})
+
+	t.Run("test_channel_table_shutdown", func(t *testing.T) {
+		table := newChannelTable(DEFAULT_MAX_MSG_IN_QUEUE)
+		channel := table.open(channelKey{"cat", "id"}, writer)
+
+		table.shutdown()
+		table.shutdown()
+
+		_, err := channel.Listen()
+		assert.ErrorIs(err, net.ErrClosed)
+		assert.Empty(table.channels)
+		_, err = table.accept(table.accepts)
+		assert.ErrorIs(err, net.ErrClosed)
+	})
+}
+
+func TestChannel(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_channel_write_consumes_credits", func(t *testing.T) {
+		channel, sender := newMockedChannel()
+
+		_, err := channel.Write("FakeAction", "FakeMessage")
+
+		assert.NoError(err)
+		assert.Equal(CHANNEL_WINDOW_SIZE-1, channel.credits)
+		assert.Equal(uint64(1), sender.next)
+		for _, frame := range sender.unacked {
+			var request msg.MsgRequest
+			assert.NoError(msg.Decode(frame.datagrams[0], &request))
+			assert.Equal(msg.PEER_ACTION_RELIABLE, request.Action)
+		}
+	})
+
+	t.Run("test_channel_write_waits_for_credits", func(t *testing.T) {
+		channel, _ := newMockedChannel()
+		channel.credits = 0
+		result := make(chan error)
+		go func() {
+			_, err := channel.Write("FakeAction", "FakeMessage")
+			result <- err
+		}()
+
+		select {
+		case <-result:
+			assert.Fail("write without credits")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		channel.grant(1)
+
+		select {
+		case err := <-result:
+			assert.NoError(err)
+		case <-time.After(2 * time.Second):
+			assert.Fail("write not woken up")
+		}
+	})
+
+	t.Run("test_channel_write_deadline", func(t *testing.T) {
+		channel, _ := newMockedChannel()
+		channel.credits = 0
+		channel.writeDeadline = time.Now().Add(10 * time.Millisecond)
+
+		_, err := channel.Write("FakeAction", "FakeMessage")
+
+		netErr, ok := err.(net.Error)
+		assert.True(ok)
+		assert.True(netErr.Timeout())
+	})
+
+	t.Run("test_channel_write_fail_finished", func(t *testing.T) {
+		channel, _ := newMockedChannel()
+		channel.finish()
+
+		_, err := channel.Write("FakeAction", "FakeMessage")
+
+		assert.ErrorIs(err, io.ErrClosedPipe)
+	})
+
+	t.Run("test_channel_listen_received_messages", func(t *testing.T) {
+		channel, _ := newMockedChannel()
+		channel.receive(newChannelMessage("id", "FakeAction", "FakeMessage"))
+
+		response, err := channel.Listen()
+
+		assert.NoError(err)
+		assert.Equal("FakeMessage", response.Message)
+	})
+
+	t.Run("test_channel_listen_eof_once_drained", func(t *testing.T) {
+		channel, _ := newMockedChannel()
+		channel.receive(newChannelMessage("id", "FakeAction", "FakeMessage"))
+		channel.finish()
+
+		_, err := channel.Listen()
+		assert.NoError(err)
+		_, err = channel.Listen()
+		assert.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("test_channel_receive_drops_beyond_window", func(t *testing.T) {
+		channel, _ := newMockedChannel()
+
+		for i := 0; i <= CHANNEL_WINDOW_SIZE; i++ {
+			channel.receive(newChannelMessage("id", "FakeAction", strconv.Itoa(i)))
+		}
+
+		assert.Len(channel.messages, CHANNEL_WINDOW_SIZE)
+	})
+
+	t.Run("test_channel_listen_grants_credits", func(t *testing.T) {
+		channel, sender := newMockedChannel()
+		for i := 0; i < CHANNEL_WINDOW_SIZE/2; i++ {
+			channel.receive(newChannelMessage("id", "FakeAction", strconv.Itoa(i)))
+		}
+
+		for i := 0; i < CHANNEL_WINDOW_SIZE/2; i++ {
+			channel.Listen()
+		}
+
+		assert.Equal(0, channel.consumed)
+		assert.Equal(uint64(1), sender.next)
+	})
+
+	t.Run("test_channel_close", func(t *testing.T) {
+		channel, sender := newMockedChannel()
+
+		assert.NoError(channel.Close())
+
+		_, err := channel.Listen()
+		assert.ErrorIs(err, net.ErrClosed)
+		_, err = channel.Write("FakeAction", "FakeMessage")
+		assert.ErrorIs(err, net.ErrClosed)
+		assert.Error(channel.Close())
+		assert.Nil(channel.table.get(channel.key))
+		assert.Equal(uint64(1), sender.next)
+	})
+}
+
+func TestPeerChannels(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_channel_exchange_messages", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1))
+		defer alice.Close()
+		defer bob.Close()
+
+		writer, _ := alice.reliableWriterTo("bob", bob.conn.LocalAddr().(*net.UDPAddr))
+		opened, err := writer.OpenChannel()
+		assert.NoError(err)
+
+		accepted, err := bob.AcceptChannel()
+		assert.NoError(err)
+		assert.Equal(opened.Id(), accepted.Id())
+		assert.Equal("alice", accepted.Peername())
+
+		_, err = opened.Write("FakeAction", "FakeMessage")
+		assert.NoError(err)
+		response, err := accepted.Listen()
+		assert.NoError(err)
+		assert.Equal("FakeAction", response.Action)
+		assert.Equal("FakeMessage", response.Message)
+
+		_, err = accepted.Write("FakeAction", "FakeAnswer")
+		assert.NoError(err)
+		response, err = opened.Listen()
+		assert.NoError(err)
+		assert.Equal("FakeAnswer", response.Message)
+
+		assert.NoError(opened.Close())
+		_, err = accepted.Listen()
+		assert.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("test_channel_exchange_bodies", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1).WithEncryption(nil))
+		defer alice.Close()
+		defer bob.Close()
+
+		baddr := bob.conn.LocalAddr().(*net.UDPAddr)
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", baddr))
+		writer, _ := alice.reliableWriterTo("bob", baddr)
+		opened, _ := writer.OpenChannel()
+		accepted, _ := bob.AcceptChannel()
+
+		body := []byte{0, 1, 255}
+		headers := map[string]string{msg.HEADER_CONTENT_TYPE: "application/octet-stream"}
+		_, err := opened.WriteBody("FakeAction", body, headers)
+		assert.NoError(err)
+
+		response, err := accepted.Listen()
+		assert.NoError(err)
+		assert.Equal(body, response.Body)
+		assert.Equal(headers, response.Headers)
+	})
+
+	t.Run("test_channel_exchange_mixed_codecs", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1))
+		defer alice.Close()
+		defer bob.Close()
+		alice.options.codec = msg.JSONCodec{}
+
+		writer, _ := alice.reliableWriterTo("bob", bob.conn.LocalAddr().(*net.UDPAddr))
+		opened, err := writer.OpenChannel()
+		assert.NoError(err)
+		accepted, err := bob.AcceptChannel()
+		assert.NoError(err)
+
+		_, err = opened.WriteBody("FakeAction", []byte{0, 1, 255}, nil)
+		assert.NoError(err)
+		response, err := accepted.Listen()
+		assert.NoError(err)
+		assert.Equal([]byte{0, 1, 255}, response.Body)
+
+		_, err = accepted.Write("FakeAction", "FakeAnswer")
+		assert.NoError(err)
+		response, err = opened.Listen()
+		assert.NoError(err)
+		assert.Equal("FakeAnswer", response.Message)
+	})
+
+	t.Run("test_channel_busy_does_not_block_others", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1))
+		defer alice.Close()
+		defer bob.Close()
+
+		writer, _ := alice.reliableWriterTo("bob", bob.conn.LocalAddr().(*net.UDPAddr))
+		bulk, _ := writer.OpenChannel()
+		chat, _ := writer.OpenChannel()
+		bob.AcceptChannel()
+		chatted, _ := bob.AcceptChannel()
+
+		// nobody reads the bulk channel so
+		// his writer runs out of credits
+		for i := 0; i < CHANNEL_WINDOW_SIZE; i++ {
+			_, err := bulk.Write("Bulk", strconv.Itoa(i))
+			assert.NoError(err)
+		}
+
+		_, err := chat.Write("Chat", "Hello")
+		assert.NoError(err)
+
+		chatted.readDeadline = time.Now().Add(2 * time.Second)
+		response, err := chatted.Listen()
+		assert.NoError(err)
+		assert.Equal(chat.Id(), response.Channel)
+		assert.Equal("Hello", response.Message)
+		assert.Equal(0, bulk.credits)
+	})
+
+	t.Run("test_channel_messages_skip_listen", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+
+		peer.deliverInOrder(newChannelMessage("unknown", "FakeAction", "FakeMessage"))
+		peer.deliver(newChannelMessage("unknown", "FakeAction", "FakeMessage"))
+		peer.deliver(newChannelMessage("", msg.PEER_ACTION_CHANNEL_OPEN, ""))
+
+		assert.Empty(peer.messages)
+		assert.Empty(peer.channels.accepts)
+	})
+
+	t.Run("test_channel_refused_when_backlog_full", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(1, 1))
+		defer alice.Close()
+		defer bob.Close()
+
+		writer, _ := alice.reliableWriterTo("bob", bob.conn.LocalAddr().(*net.UDPAddr))
+		writer.OpenChannel()
+		refused, err := writer.OpenChannel()
+		assert.NoError(err)
+
+		refused.readDeadline = time.Now().Add(5 * time.Second)
+		_, err = refused.Listen()
+		assert.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("test_channel_open_fail_unconnected_writer", func(t *testing.T) {
+		writer := NewP2PWriter("dog", &P2PConnMock{}, &net.UDPAddr{})
+
+		_, err := writer.OpenChannel()
+
+		assert.Error(err)
+	})
+
+	t.Run("test_channel_accept_fail_not_initialized", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+
+		_, err := peer.AcceptChannel()
+
+		assert.True(errors.Is(err, ErrNotInitialized))
+	})
+
+	t.Run("test_channel_open_fail_not_initialized", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+
+		_, err := peer.OpenChannel(context.Background(), "cat")
+
+		assert.True(errors.Is(err, ErrNotInitialized))
+	})
+}
@@ -0,0 +1,35 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/stun"
+)
+
+// Errors returned by the peer. Callers
+// can branch on them with `errors.Is`
+var (
+	ErrNotInitialized = errors.New("peer needs to be initialized first")
+	ErrTimeout        = stun.ErrTimeout
+	ErrPeerNotFound   = stun.ErrPeerNotFound
+	ErrNameTaken      = stun.ErrNameTaken
+	ErrServerShutdown = errors.New("stun server is shutting down")
+)
+
+// Returns the error of the given done context.
+// Expired contexts return `ErrTimeout`
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// Returns a copy of the given context that
+// expires once the peer timeout is reached
+// unless it is done earlier
+func (peer *Peer) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(peer.options.timeout)*time.Second)
+}
@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/alvarogf97/fox/pkg/stun"
+)
+
+const (
+	// Number of fragments written in a row
+	// before the writer pauses, so the socket
+	// buffer of the receiver is not overrun
+	FRAGMENT_BURST = 32
+	// Pause between two bursts of fragments
+	FRAGMENT_PACING = time.Millisecond
+	// How long the fragments of a message are
+	// kept to answer the negative acknowledgements
+	// of his receiver, as long as he waits for them
+	SENT_FRAGMENTS_TIMEOUT = stun.DEFAULT_REASSEMBLY_TIMEOUT
+	// Max number of fragmented messages kept,
+	// the oldest one is forgotten beyond it
+	MAX_SENT_MESSAGES = 16
+	// Max number of times every fragment of a
+	// message can be written again on average
+	MAX_FRAGMENT_RESENDS = 2
+)
+
+// Fragments of a message sent to a peer
+type sentMessage struct {
+	datagrams  [][]byte
+	addr       string
+	expiration time.Time
+	budget     int
+}
+
+// Fragments of the messages recently sent indexed
+// by the message id, so the ones lost on the way can
+// be written again when the receiver asks for them.
+// Every message can only be written again a limited
+// number of times and only towards his receiver
+type fragmentTable struct {
+	sync.Mutex
+	messages map[string]*sentMessage
+	order    []string
+}
+
+// Keeps the datagrams of the fragments of the
+// message with the given id sent to the given address
+func (table *fragmentTable) keep(id string, datagrams [][]byte, addr *net.UDPAddr, now time.Time) {
+	table.Lock()
+	defer table.Unlock()
+	table.expire(now)
+
+	for len(table.order) >= MAX_SENT_MESSAGES {
+		delete(table.messages, table.order[0])
+		table.order = table.order[1:]
+	}
+
+	table.messages[id] = &sentMessage{
+		datagrams:  datagrams,
+		addr:       addr.String(),
+		expiration: now.Add(SENT_FRAGMENTS_TIMEOUT),
+		budget:     MAX_FRAGMENT_RESENDS * len(datagrams),
+	}
+	table.order = append(table.order, id)
+}
+
+// Forgets the messages whose timeout
+// expired before the given time
+func (table *fragmentTable) expire(now time.Time) {
+	for len(table.order) > 0 {
+		id := table.order[0]
+		if message, exists := table.messages[id]; exists && !message.expiration.Before(now) {
+			return
+		}
+		delete(table.messages, id)
+		table.order = table.order[1:]
+	}
+}
+
+// Returns the datagrams of the fragments asked for
+// by the given negative acknowledgement sent from
+// the given address. Nothing is returned if the
+// message is unknown, was sent somewhere else or
+// was already written again too many times
+func (table *fragmentTable) missing(nack msg.MsgFragmentNack, addr *net.UDPAddr, now time.Time) [][]byte {
+	table.Lock()
+	defer table.Unlock()
+	table.expire(now)
+
+	message, exists := table.messages[nack.Id]
+	if !exists || addr == nil || message.addr != addr.String() {
+		return nil
+	}
+
+	datagrams := [][]byte{}
+	for _, index := range nack.Missing {
+		if index >= len(message.datagrams) || message.budget == 0 {
+			continue
+		}
+		datagrams = append(datagrams, message.datagrams[index])
+		message.budget--
+	}
+	return datagrams
+}
+
+// Creates a new fragment table
+func newFragmentTable() *fragmentTable {
+	return &fragmentTable{messages: map[string]*sentMessage{}}
+}
+
+// Writes again the fragments the receiver of a
+// message asked for. Negative acknowledgements are
+// not sealed, they can only make the peer write
+// again what he already sent to the same address
+func (peer *Peer) handleFragmentNack(response *msg.MsgResponse) {
+	var nack msg.MsgFragmentNack
+	if err := msg.Decode([]byte(response.Message), &nack); err != nil || nack.Validate() != nil {
+		return
+	}
+
+	datagrams := peer.fragments.missing(nack, response.Addr, time.Now())
+	if len(datagrams) > 0 {
+		peer.newWriter(response.Addr).transmit(datagrams)
+	}
+}
@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFragmentTable(t *testing.T) {
+	assert := require.New(t)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50000")
+	other, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+	datagrams := [][]byte{[]byte("zero"), []byte("one"), []byte("two")}
+
+	t.Run("test_fragment_table_missing", func(t *testing.T) {
+		table := newFragmentTable()
+		now := time.Now()
+		table.keep("id", datagrams, addr, now)
+
+		missing := table.missing(msg.MsgFragmentNack{Id: "id", Missing: []int{0, 2, 3}}, addr, now)
+
+		assert.Equal([][]byte{[]byte("zero"), []byte("two")}, missing)
+	})
+
+	t.Run("test_fragment_table_missing_ignores_strangers", func(t *testing.T) {
+		table := newFragmentTable()
+		now := time.Now()
+		table.keep("id", datagrams, addr, now)
+
+		assert.Empty(table.missing(msg.MsgFragmentNack{Id: "id", Missing: []int{0}}, other, now))
+		assert.Empty(table.missing(msg.MsgFragmentNack{Id: "id", Missing: []int{0}}, nil, now))
+		assert.Empty(table.missing(msg.MsgFragmentNack{Id: "unknown", Missing: []int{0}}, addr, now))
+	})
+
+	t.Run("test_fragment_table_missing_bounded", func(t *testing.T) {
+		table := newFragmentTable()
+		now := time.Now()
+		table.keep("id", datagrams, addr, now)
+
+		nack := msg.MsgFragmentNack{Id: "id", Missing: []int{0, 1, 2}}
+		for i := 0; i < MAX_FRAGMENT_RESENDS; i++ {
+			assert.Len(table.missing(nack, addr, now), len(datagrams))
+		}
+		assert.Empty(table.missing(nack, addr, now))
+	})
+
+	t.Run("test_fragment_table_expire", func(t *testing.T) {
+		table := newFragmentTable()
+		now := time.Now()
+		table.keep("id", datagrams, addr, now)
+
+		later := now.Add(SENT_FRAGMENTS_TIMEOUT + time.Second)
+		assert.Empty(table.missing(msg.MsgFragmentNack{Id: "id", Missing: []int{0}}, addr, later))
+		assert.Empty(table.messages)
+		assert.Empty(table.order)
+	})
+
+	t.Run("test_fragment_table_forgets_oldest", func(t *testing.T) {
+		table := newFragmentTable()
+		now := time.Now()
+
+		for i := 0; i <= MAX_SENT_MESSAGES; i++ {
+			table.keep(fmt.Sprint(i), datagrams, addr, now)
+		}
+
+		assert.Len(table.messages, MAX_SENT_MESSAGES)
+		assert.Empty(table.missing(msg.MsgFragmentNack{Id: "0", Missing: []int{0}}, addr, now))
+		assert.Len(table.missing(msg.MsgFragmentNack{Id: "1", Missing: []int{0}}, addr, now), 1)
+	})
+}
+
+func TestPeerHandleFragmentNack(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_handle_fragment_nack_writes_missing_fragments", func(t *testing.T) {
+		peer, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+		remote, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		defer remote.Close()
+		raddr := remote.LocalAddr().(*net.UDPAddr)
+		peer.fragments.keep("id", [][]byte{[]byte("zero"), []byte("one")}, raddr, time.Now())
+
+		serialized, _ := msg.Encode(msg.BinaryCodec{}, msg.MsgFragmentNack{Id: "id", Missing: []int{1}})
+		response := msg.NewMsgResponse(msg.PEER_ACTION_FRAGMENT_NACK, false, "", string(serialized))
+		response.Addr = raddr
+		peer.route(&response)
+
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		buff := make([]byte, msg.MAX_DATAGRAM_SIZE)
+		n, _, err := remote.ReadFromUDP(buff)
+		assert.NoError(err)
+		assert.Equal("one", string(buff[:n]))
+	})
+
+	t.Run("test_handle_fragment_nack_ignores_invalid", func(t *testing.T) {
+		peer, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+		raddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		peer.fragments.keep("id", [][]byte{[]byte("zero")}, raddr, time.Now())
+
+		response := msg.NewMsgResponse(msg.PEER_ACTION_FRAGMENT_NACK, false, "", "garbage")
+		response.Addr = raddr
+		peer.route(&response)
+
+		assert.Equal(MAX_FRAGMENT_RESENDS, peer.fragments.messages["id"].budget)
+	})
+}
@@ -0,0 +1,97 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+// Capabilities advertised by other peers
+// in their hellos indexed by their names
+type capabilityTable struct {
+	sync.RWMutex
+	peers map[string]msg.Capabilities
+}
+
+// Returns the capabilities of the given peer and
+// whether he said hello to us
+func (table *capabilityTable) get(peername string) (msg.Capabilities, bool) {
+	table.RLock()
+	defer table.RUnlock()
+	capabilities, exists := table.peers[peername]
+	return capabilities, exists
+}
+
+// Saves the capabilities of the given peer
+// replacing the ones he advertised before
+func (table *capabilityTable) set(peername string, capabilities msg.Capabilities) {
+	table.Lock()
+	table.peers[peername] = capabilities
+	table.Unlock()
+}
+
+// Creates a new capability table
+func newCapabilityTable() *capabilityTable {
+	return &capabilityTable{peers: map[string]msg.Capabilities{}}
+}
+
+// Returns the optional features a peer built
+// with the given options advertises. Every peer
+// can deliver messages reliably
+func advertisedFeatures(options PeerOptions) []string {
+	features := []string{msg.FEATURE_RELIABILITY}
+	if options.encryption {
+		features = append(features, msg.FEATURE_ENCRYPTION)
+	}
+	return append(features, options.features...)
+}
+
+// Writes the given first contact action through
+// the given writer saying hello with the protocol
+// version and the features of the peer
+func (peer *Peer) hello(writer *P2PWriter, action string) (int, error) {
+	request := msg.NewMsgRequest(action, peer.name, "")
+	request.Hello(advertisedFeatures(peer.options))
+	return writer.write(request)
+}
+
+// Remembers the capabilities the sender of
+// the given first contact message advertised
+func (peer *Peer) greet(response *msg.MsgResponse) {
+	peer.capabilities.set(response.Peername, response.Capabilities())
+}
+
+// Checks the given peer speaks a protocol version
+// we understand and supports the features the
+// connection needs. Legacy peers are trusted
+// since they cannot advertise anything
+func (peer *Peer) checkCapabilities(peername string) error {
+	capabilities, exists := peer.capabilities.get(peername)
+	if !exists || capabilities.IsLegacy() {
+		return nil
+	}
+
+	if !msg.SupportsVersion(capabilities.Version) {
+		return fmt.Errorf(
+			"peer `%s` speaks unsupported protocol version `%d`, supported versions are `%d` to `%d`",
+			peername, capabilities.Version, msg.LEGACY_PROTOCOL_VERSION, msg.PROTOCOL_VERSION,
+		)
+	}
+
+	if peer.options.encryption && !capabilities.Supports(msg.FEATURE_ENCRYPTION) {
+		return fmt.Errorf("peer `%s` does not support encryption", peername)
+	}
+	return nil
+}
+
+// Returns the protocol version and the features
+// advertised by the given peer the first time
+// both of us got in touch
+func (peer *Peer) Capabilities(peername string) (msg.Capabilities, error) {
+	capabilities, exists := peer.capabilities.get(peername)
+	if !exists {
+		return msg.Capabilities{}, fmt.Errorf("peer `%s` has not said hello yet", peername)
+	}
+	return capabilities, nil
+}
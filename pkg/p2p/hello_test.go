@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilityTable(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_capability_table_set_and_get", func(t *testing.T) {
+		table := newCapabilityTable()
+		capabilities := msg.Capabilities{Version: msg.PROTOCOL_VERSION}
+
+		table.set("dog", capabilities)
+
+		saved, exists := table.get("dog")
+		assert.True(exists)
+		assert.Equal(capabilities, saved)
+	})
+
+	t.Run("test_capability_table_get_unknown", func(t *testing.T) {
+		table := newCapabilityTable()
+
+		_, exists := table.get("dog")
+
+		assert.False(exists)
+	})
+}
+
+func TestAdvertisedFeatures(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_advertised_features_default", func(t *testing.T) {
+		features := advertisedFeatures(DefaultPeerOptions())
+
+		assert.Equal([]string{msg.FEATURE_RELIABILITY}, features)
+	})
+
+	t.Run("test_advertised_features_encryption_and_custom", func(t *testing.T) {
+		options := DefaultPeerOptions().WithEncryption(nil).WithFeatures(msg.FEATURE_COMPRESSION)
+
+		features := advertisedFeatures(options)
+
+		assert.Equal([]string{msg.FEATURE_RELIABILITY, msg.FEATURE_ENCRYPTION, msg.FEATURE_COMPRESSION}, features)
+	})
+}
+
+func TestPeerCapabilities(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_check_capabilities", func(t *testing.T) {
+		peer, _ := NewPeer("cat", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions().WithEncryption(nil))
+		defer peer.Close()
+
+		peer.capabilities.set("unsupported", msg.Capabilities{Version: msg.PROTOCOL_VERSION + 1})
+		peer.capabilities.set("plaintext", msg.Capabilities{Version: msg.PROTOCOL_VERSION})
+		peer.capabilities.set("legacy", msg.Capabilities{Version: msg.LEGACY_PROTOCOL_VERSION})
+		peer.capabilities.set("dog", msg.Capabilities{
+			Version:  msg.PROTOCOL_VERSION,
+			Features: []string{msg.FEATURE_ENCRYPTION},
+		})
+
+		assert.Contains(peer.checkCapabilities("unsupported").Error(), "unsupported protocol version")
+		assert.Contains(peer.checkCapabilities("plaintext").Error(), "does not support encryption")
+		assert.NoError(peer.checkCapabilities("legacy"))
+		assert.NoError(peer.checkCapabilities("unknown"))
+		assert.NoError(peer.checkCapabilities("dog"))
+	})
+
+	t.Run("test_capabilities_fail_unknown_peer", func(t *testing.T) {
+		peer, _ := NewPeer("cat", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+
+		_, err := peer.Capabilities("dog")
+
+		assert.Error(err)
+	})
+
+	t.Run("test_punch_exchanges_hellos", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1).WithFeatures(msg.FEATURE_COMPRESSION))
+		defer alice.Close()
+		defer bob.Close()
+
+		assert.NoError(alice.punch(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr)))
+
+		capabilities, err := alice.Capabilities("bob")
+		assert.NoError(err)
+		assert.Equal(msg.PROTOCOL_VERSION, capabilities.Version)
+		assert.True(capabilities.Supports(msg.FEATURE_COMPRESSION))
+
+		capabilities, err = bob.Capabilities("alice")
+		assert.NoError(err)
+		assert.True(capabilities.Supports(msg.FEATURE_RELIABILITY))
+	})
+}
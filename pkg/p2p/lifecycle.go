@@ -0,0 +1,142 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+const (
+	// The peer is registered into the network
+	LIFECYCLE_CONNECTED = "Connected"
+	// The peer lost his registration and
+	// is trying to register again
+	LIFECYCLE_RECONNECTING = "Reconnecting"
+	// The peer is no longer registered
+	LIFECYCLE_DISCONNECTED = "Disconnected"
+)
+
+// Change of the peer registration state
+type LifecycleEvent struct {
+	State string
+	// Reconnection attempt the event belongs
+	// to, zero outside reconnections
+	Attempt int
+	// Why the registration was lost or why
+	// the last attempt failed, if any
+	Err error
+}
+
+// Calls the lifecycle handler, if any,
+// with the given event
+func (peer *Peer) notify(state string, attempt int, err error) {
+	if peer.options.lifecycle != nil {
+		peer.options.lifecycle(LifecycleEvent{State: state, Attempt: attempt, Err: err})
+	}
+}
+
+// Tells the keepalive the registration was
+// lost. Pending signals are not repeated
+func (peer *Peer) signalLost(err error) {
+	select {
+	case peer.lost <- err:
+	default:
+	}
+}
+
+// Requests the stun server to register the
+// peer name into the network with his profile
+func (peer *Peer) register(ctx context.Context) error {
+	profile, err := peer.profile()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := peer.withTimeout(ctx)
+	defer cancel()
+	_, err = peer.client.Request(ctx, peer.name, msg.STUN_ACTION_NEW, profile)
+	return err
+}
+
+// Returns a context that is cancelled
+// once the given stop channel is closed
+func stopContext(stop chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Marks the peer as no longer initialized once the
+// keepalive with the given stop channel gave up, so
+// a later `Init` starts keeping him alive again
+func (peer *Peer) giveUp(stop chan struct{}) {
+	peer.lifecycle.Lock()
+	defer peer.lifecycle.Unlock()
+
+	peer.initialized = false
+	if peer.keepalives == stop {
+		peer.keepalives = nil
+	}
+}
+
+// Registers the peer again once his registration was
+// lost, and watches again the peers he watched,
+// doubling the backoff after every failed attempt.
+// Every attempt waits the reconnect timeout at most
+// and it is cancelled once the peer is closed. It gives
+// up once another peer took the name or the attempts
+// run out, so the peer is no longer initialized.
+// Returns whether the peer is registered again
+func (peer *Peer) reconnect(stop chan struct{}, cause error) bool {
+	if peer.options.reconnectMinBackoff <= 0 {
+		return true
+	}
+
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+
+	backoff := peer.options.reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		peer.notify(LIFECYCLE_RECONNECTING, attempt, cause)
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+		if timeout := peer.options.reconnectTimeout; timeout > 0 {
+			attemptCtx, cancelAttempt = context.WithTimeout(ctx, timeout)
+		}
+		cause = peer.register(attemptCtx)
+		cancelAttempt()
+		if ctx.Err() != nil {
+			return false
+		}
+		if cause == nil {
+			// watches are lost with the registration
+			peer.rewatch()
+			peer.notify(LIFECYCLE_CONNECTED, attempt, nil)
+			return true
+		}
+
+		if errors.Is(cause, ErrNameTaken) || (peer.options.reconnectAttempts > 0 && attempt >= peer.options.reconnectAttempts) {
+			peer.giveUp(stop)
+			peer.notify(LIFECYCLE_DISCONNECTED, attempt, cause)
+			return false
+		}
+
+		select {
+		case <-stop:
+			return false
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if limit := peer.options.reconnectMaxBackoff; limit > 0 && backoff > limit {
+			backoff = limit
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/alvarogf97/fox/pkg/stun"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates an initialized peer that refreshes his
+// registration through the given scripted client
+// and sends his lifecycle events to the returned
+// channel
+func newLifecyclePeer(client *ScriptedStunClient, options PeerOptions) (*Peer, chan LifecycleEvent) {
+	events := make(chan LifecycleEvent, 32)
+	options = options.
+		WithKeepalive(10 * time.Millisecond).
+		WithLifecycle(func(event LifecycleEvent) {
+			events <- event
+		})
+
+	peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", options)
+	peer.client = client
+	peer.Init(context.Background())
+	return peer, events
+}
+
+// Reads the next lifecycle event or
+// fails after one second
+func nextEvent(events chan LifecycleEvent) (LifecycleEvent, error) {
+	select {
+	case event := <-events:
+		return event, nil
+	case <-time.After(time.Second):
+		return LifecycleEvent{}, errors.New("no lifecycle event")
+	}
+}
+
+func TestPeerLifecycle(t *testing.T) {
+	assert := require.New(t)
+	notFound := &stun.ResponseError{Code: msg.ERROR_CODE_PEER_NOT_FOUND, Message: "peer `dog` not found"}
+
+	t.Run("test_lifecycle_reregisters_lost_registration", func(t *testing.T) {
+		client := &ScriptedStunClient{errs: map[string][]error{
+			msg.STUN_ACTION_REFRESH: {notFound},
+		}}
+		peer, events := newLifecyclePeer(client, DefaultPeerOptions().WithReconnect(time.Millisecond, time.Millisecond, 0))
+		defer peer.Close()
+
+		event, err := nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LifecycleEvent{State: LIFECYCLE_CONNECTED}, event)
+
+		event, err = nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LIFECYCLE_RECONNECTING, event.State)
+		assert.Equal(1, event.Attempt)
+		assert.True(errors.Is(event.Err, ErrPeerNotFound))
+
+		event, err = nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LifecycleEvent{State: LIFECYCLE_CONNECTED, Attempt: 1}, event)
+		assert.Equal([]string{msg.STUN_ACTION_NEW, msg.STUN_ACTION_REFRESH, msg.STUN_ACTION_NEW}, client.requested()[:3])
+		assert.True(peer.isInitialized())
+	})
+
+	t.Run("test_lifecycle_backs_off_until_server_is_back", func(t *testing.T) {
+		client := &ScriptedStunClient{errs: map[string][]error{
+			msg.STUN_ACTION_NEW:     {nil, ErrTimeout, ErrTimeout},
+			msg.STUN_ACTION_REFRESH: {ErrTimeout},
+		}}
+		peer, events := newLifecyclePeer(client, DefaultPeerOptions().WithReconnect(10*time.Millisecond, 20*time.Millisecond, 0))
+		defer peer.Close()
+
+		nextEvent(events)
+		for attempt := 1; attempt <= 3; attempt++ {
+			event, err := nextEvent(events)
+			assert.NoError(err)
+			assert.Equal(LIFECYCLE_RECONNECTING, event.State)
+			assert.Equal(attempt, event.Attempt)
+			assert.True(errors.Is(event.Err, ErrTimeout))
+		}
+
+		event, err := nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LifecycleEvent{State: LIFECYCLE_CONNECTED, Attempt: 3}, event)
+	})
+
+	t.Run("test_lifecycle_reconnects_on_server_shutdown", func(t *testing.T) {
+		client := &ScriptedStunClient{errs: map[string][]error{}}
+		peer, events := newLifecyclePeer(client, DefaultPeerOptions().WithKeepalive(time.Hour))
+		defer peer.Close()
+		nextEvent(events)
+
+		shutdown := msg.NewMsgResponse(msg.PEER_ACTION_SHUTDOWN, false, "dog", "")
+		shutdown.Addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 60001}
+		peer.route(&shutdown)
+		shutdown.Addr = peer.saddr
+		peer.route(&shutdown)
+
+		event, err := nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LIFECYCLE_RECONNECTING, event.State)
+		assert.True(errors.Is(event.Err, ErrServerShutdown))
+
+		event, err = nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LIFECYCLE_CONNECTED, event.State)
+	})
+
+	t.Run("test_lifecycle_gives_up_when_name_taken", func(t *testing.T) {
+		taken := &stun.ResponseError{Code: msg.ERROR_CODE_NAME_TAKEN, Message: "peer `dog` already exists"}
+		client := &ScriptedStunClient{errs: map[string][]error{
+			msg.STUN_ACTION_NEW:     {nil, taken},
+			msg.STUN_ACTION_REFRESH: {notFound},
+		}}
+		peer, events := newLifecyclePeer(client, DefaultPeerOptions().WithReconnect(time.Millisecond, time.Millisecond, 0))
+		defer peer.Close()
+
+		nextEvent(events)
+		nextEvent(events)
+		event, err := nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LIFECYCLE_DISCONNECTED, event.State)
+		assert.True(errors.Is(event.Err, ErrNameTaken))
+
+		// stops refreshing the lost registration
+		requested := len(client.requested())
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(requested, len(client.requested()))
+		assert.False(peer.isInitialized())
+
+		// a later init keeps him alive again
+		peer.lifecycle.Lock()
+		assert.Nil(peer.keepalives)
+		peer.lifecycle.Unlock()
+	})
+
+	t.Run("test_lifecycle_gives_up_after_max_attempts", func(t *testing.T) {
+		client := &ScriptedStunClient{errs: map[string][]error{
+			msg.STUN_ACTION_NEW:     {nil, ErrTimeout, ErrTimeout},
+			msg.STUN_ACTION_REFRESH: {ErrTimeout},
+		}}
+		peer, events := newLifecyclePeer(client, DefaultPeerOptions().WithReconnect(time.Millisecond, time.Millisecond, 2))
+		defer peer.Close()
+
+		nextEvent(events)
+		nextEvent(events)
+		nextEvent(events)
+		event, err := nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LifecycleEvent{State: LIFECYCLE_DISCONNECTED, Attempt: 2, Err: ErrTimeout}, event)
+		assert.False(peer.isInitialized())
+	})
+
+	t.Run("test_lifecycle_attempts_wait_the_reconnect_timeout", func(t *testing.T) {
+		client := &ScriptedStunClient{
+			errs:  map[string][]error{msg.STUN_ACTION_NEW: {nil}, msg.STUN_ACTION_REFRESH: {notFound}},
+			hangs: map[string]bool{msg.STUN_ACTION_NEW: true},
+		}
+		options := DefaultPeerOptions().WithReconnect(time.Millisecond, time.Millisecond, 2).WithReconnectTimeout(50 * time.Millisecond)
+		peer, events := newLifecyclePeer(client, options)
+		defer peer.Close()
+
+		nextEvent(events)
+		nextEvent(events)
+		nextEvent(events)
+		event, err := nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LIFECYCLE_DISCONNECTED, event.State)
+		assert.Equal(2, event.Attempt)
+		assert.True(errors.Is(event.Err, context.DeadlineExceeded))
+	})
+
+	t.Run("test_lifecycle_close_cancels_attempt", func(t *testing.T) {
+		client := &ScriptedStunClient{
+			errs:      map[string][]error{msg.STUN_ACTION_NEW: {nil}, msg.STUN_ACTION_REFRESH: {notFound}},
+			hangs:     map[string]bool{msg.STUN_ACTION_NEW: true},
+			cancelled: make(chan error, 1),
+		}
+		peer, events := newLifecyclePeer(client, DefaultPeerOptions().WithReconnect(time.Millisecond, time.Millisecond, 0))
+
+		nextEvent(events)
+		event, err := nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LIFECYCLE_RECONNECTING, event.State)
+
+		peer.Close()
+
+		select {
+		case err := <-client.cancelled:
+			assert.True(errors.Is(err, context.Canceled))
+		case <-time.After(time.Second):
+			assert.Fail("reconnection attempt not cancelled")
+		}
+	})
+
+	t.Run("test_lifecycle_reconnect_disabled", func(t *testing.T) {
+		client := &ScriptedStunClient{errs: map[string][]error{
+			msg.STUN_ACTION_REFRESH: {notFound},
+		}}
+		peer, events := newLifecyclePeer(client, DefaultPeerOptions().WithReconnect(0, 0, 0))
+		defer peer.Close()
+
+		nextEvent(events)
+		time.Sleep(50 * time.Millisecond)
+
+		assert.Empty(events)
+		assert.NotContains(client.requested()[1:], msg.STUN_ACTION_NEW)
+	})
+
+	t.Run("test_lifecycle_disconnect", func(t *testing.T) {
+		client := &ScriptedStunClient{errs: map[string][]error{}}
+		peer, events := newLifecyclePeer(client, DefaultPeerOptions())
+		defer peer.Close()
+		nextEvent(events)
+
+		assert.NoError(peer.Disconnect(context.Background()))
+
+		event, err := nextEvent(events)
+		assert.NoError(err)
+		assert.Equal(LifecycleEvent{State: LIFECYCLE_DISCONNECTED}, event)
+		assert.False(peer.isInitialized())
+	})
+
+}
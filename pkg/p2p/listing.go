@@ -0,0 +1,50 @@
+package p2p
+
+import (
+	"context"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+// Search of the peers registered into the stun
+// server, see `ListPeers`
+type PeerQuery = msg.PeerQuery
+
+// Peer found by a peer query
+type PeerListing = msg.PeerListing
+
+// Page of the peers found by a peer query
+type PeerPage = msg.PeerPage
+
+// Encodes what the peer tells the stun
+// server about himself when he registers
+func (peer *Peer) profile() (string, error) {
+	return msg.EncodeProfile(msg.PeerProfile{
+		Metadata: peer.options.metadata,
+		Private:  peer.options.private,
+	})
+}
+
+// Lists the public peers registered into the stun
+// server that match the given query, sorted by
+// their names. Pages are limited by the server, so
+// the cursor of the returned page must be set into
+// the query to get the next one until it is empty
+func (peer *Peer) ListPeers(ctx context.Context, query PeerQuery) (PeerPage, error) {
+	if !peer.isInitialized() {
+		return PeerPage{}, ErrNotInitialized
+	}
+
+	message, err := msg.EncodeQuery(query)
+	if err != nil {
+		return PeerPage{}, err
+	}
+
+	ctx, cancel := peer.withTimeout(ctx)
+	defer cancel()
+	response, err := peer.client.Request(ctx, peer.name, msg.STUN_ACTION_LIST, message)
+	if err != nil {
+		return PeerPage{}, err
+	}
+	return msg.DecodePage(response.Message)
+}
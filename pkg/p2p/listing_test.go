@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerListPeers(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_peer_list_peers_success", func(t *testing.T) {
+		page := PeerPage{Peers: []PeerListing{{Peername: "alice", Key: "key"}}, Cursor: "alice"}
+		message, _ := msg.EncodePage(page)
+		response := msg.NewMsgResponse(msg.PEER_ACTION_LIST, false, "FakePeer", message)
+		client := &MockStunClient{requestMock: RequestMock{response: &response}}
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		listed, err := peer.ListPeers(context.Background(), PeerQuery{Prefix: "al", Limit: 1})
+
+		assert.NoError(err)
+		assert.Equal(page, listed)
+		assert.Equal(msg.STUN_ACTION_LIST, client.lastRequest().action)
+		assert.Equal(`{"prefix":"al","limit":1}`, client.lastRequest().message)
+	})
+
+	t.Run("test_peer_list_peers_fail_request", func(t *testing.T) {
+		client := &MockStunClient{requestMock: RequestMock{err: errors.New("Error")}}
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		_, err := peer.ListPeers(context.Background(), PeerQuery{})
+
+		assert.Error(err)
+	})
+
+	t.Run("test_peer_list_peers_fail_malformed_page", func(t *testing.T) {
+		response := msg.NewMsgResponse(msg.PEER_ACTION_LIST, false, "FakePeer", "bonks")
+		client := &MockStunClient{requestMock: RequestMock{response: &response}}
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		_, err := peer.ListPeers(context.Background(), PeerQuery{})
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "malformed")
+	})
+
+	t.Run("test_peer_list_peers_fail_not_initialized", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		defer peer.Close()
+
+		_, err := peer.ListPeers(context.Background(), PeerQuery{})
+
+		assert.True(errors.Is(err, ErrNotInitialized))
+	})
+}
+
+func TestPeerProfile(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_peer_registers_with_profile", func(t *testing.T) {
+		client := &MockStunClient{requestMock: RequestMock{}}
+		options := DefaultPeerOptions().WithMetadata(map[string]string{"room": "lobby"}).WithPrivate(true)
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", options)
+		peer.client = client
+		defer peer.Close()
+
+		assert.NoError(peer.register(context.Background()))
+
+		assert.Equal(msg.STUN_ACTION_NEW, client.lastRequest().action)
+		assert.Equal(`{"metadata":{"room":"lobby"},"private":true}`, client.lastRequest().message)
+
+		assert.NoError(peer.refresh())
+		assert.Equal(msg.STUN_ACTION_REFRESH, client.lastRequest().action)
+		assert.Equal(`{"metadata":{"room":"lobby"},"private":true}`, client.lastRequest().message)
+	})
+
+	t.Run("test_peer_registers_without_profile", func(t *testing.T) {
+		client := &MockStunClient{requestMock: RequestMock{}}
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		defer peer.Close()
+
+		assert.NoError(peer.register(context.Background()))
+
+		assert.Empty(client.lastRequest().message)
+	})
+}
@@ -1,22 +1,76 @@
 package p2p
 
 import (
+	"context"
 	"net"
+	"sync"
+	"testing"
+	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
 )
 
 // P2P connection mock
 type P2PConnMock struct {
+	sync.Mutex
 	writeToUDPMock P2PWriteToUDPMock
+	history        [][]byte
 }
 
 func (p2pConnMock *P2PConnMock) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	p2pConnMock.Lock()
+	defer p2pConnMock.Unlock()
+
+	p2pConnMock.history = append(p2pConnMock.history, b)
 	p2pConnMock.writeToUDPMock.b = b
 	p2pConnMock.writeToUDPMock.addr = addr
 	return p2pConnMock.writeToUDPMock.send, p2pConnMock.writeToUDPMock.err
 }
 
+// Returns the last datagram written
+func (p2pConnMock *P2PConnMock) written() P2PWriteToUDPMock {
+	p2pConnMock.Lock()
+	defer p2pConnMock.Unlock()
+	return p2pConnMock.writeToUDPMock
+}
+
+// Returns every datagram written so far
+func (p2pConnMock *P2PConnMock) datagrams() [][]byte {
+	p2pConnMock.Lock()
+	defer p2pConnMock.Unlock()
+	return append([][]byte{}, p2pConnMock.history...)
+}
+
+// Connection that loses the datagrams
+// whose index matches the drop function
+type LossyConnMock struct {
+	sync.Mutex
+	conn    P2PConn
+	drop    func(i int) bool
+	written int
+	lost    int
+}
+
+func (lossy *LossyConnMock) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	lossy.Lock()
+	i := lossy.written
+	lossy.written++
+	if lossy.drop(i) {
+		lossy.lost++
+		lossy.Unlock()
+		return len(b), nil
+	}
+	lossy.Unlock()
+	return lossy.conn.WriteToUDP(b, addr)
+}
+
+// Returns the number of datagrams lost
+func (lossy *LossyConnMock) dropped() int {
+	lossy.Lock()
+	defer lossy.Unlock()
+	return lossy.lost
+}
+
 type P2PWriteToUDPMock struct {
 	b    []byte
 	addr *net.UDPAddr
@@ -32,27 +86,134 @@ func FailMarshal(err error) func(v interface{}) ([]byte, error) {
 	}
 }
 
-// Stun mock client
+// Stun mock client. Peers request and listen
+// from their own goroutines, so the state of
+// the mocks is guarded
 type MockStunClient struct {
+	sync.Mutex
 	collectMock CollectMock
 	requestMock RequestMock
 	listenMock  ListenMock
 }
 
 func (client *MockStunClient) Collect() error {
+	client.Lock()
+	defer client.Unlock()
 	return client.collectMock.err
 }
 
-func (client *MockStunClient) Request(peername string, action string, message string, timeout int) (*msg.MsgResponse, error) {
+func (client *MockStunClient) Request(ctx context.Context, peername string, action string, message string) (*msg.MsgResponse, error) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.requestMock.ctx = ctx
 	client.requestMock.peername = peername
 	client.requestMock.action = action
 	client.requestMock.message = message
-	client.requestMock.timeout = timeout
 	return client.requestMock.response, client.requestMock.err
 }
 
-func (client MockStunClient) Listen() *msg.MsgResponse {
-	return client.listenMock.response
+// Returns the mocked message, or blocks forever
+// if there's none so dispatchers do not spin
+func (client *MockStunClient) Listen() *msg.MsgResponse {
+	client.Lock()
+	response := client.listenMock.response
+	client.Unlock()
+
+	if response == nil {
+		select {}
+	}
+	return response
+}
+
+// Returns the last request made
+func (client *MockStunClient) lastRequest() RequestMock {
+	client.Lock()
+	defer client.Unlock()
+	return client.requestMock
+}
+
+// Stun client mock that keeps track of the
+// health of his servers and tells when he
+// starts and stops monitoring them
+type MonitoredStunClient struct {
+	MockStunClient
+	health  []ServerHealth
+	started chan struct{}
+	stopped chan struct{}
+}
+
+func (client *MonitoredStunClient) Probe(ctx context.Context) []ServerHealth {
+	return client.health
+}
+
+func (client *MonitoredStunClient) Monitor(ctx context.Context) {
+	close(client.started)
+	<-ctx.Done()
+	close(client.stopped)
+}
+
+func (client *MonitoredStunClient) Health() []ServerHealth {
+	return client.health
+}
+
+// Stun client mock that fails the requests
+// of every action with the errors scripted
+// for it in order, the rest of them succeed
+type ScriptedStunClient struct {
+	sync.Mutex
+	errs    map[string][]error
+	actions []string
+
+	// actions whose unscripted requests hang until
+	// their context is done, which is told to the
+	// cancelled channel if any
+	hangs     map[string]bool
+	cancelled chan error
+}
+
+func (client *ScriptedStunClient) Collect() error {
+	return nil
+}
+
+func (client *ScriptedStunClient) Request(ctx context.Context, peername string, action string, message string) (*msg.MsgResponse, error) {
+	client.Lock()
+	client.actions = append(client.actions, action)
+	if errs := client.errs[action]; len(errs) > 0 {
+		client.errs[action] = errs[1:]
+		client.Unlock()
+		if errs[0] != nil {
+			return nil, errs[0]
+		}
+		response := msg.NewMsgResponse(action, false, peername, "")
+		return &response, nil
+	}
+	hangs, cancelled := client.hangs[action], client.cancelled
+	client.Unlock()
+
+	if hangs {
+		<-ctx.Done()
+		if cancelled != nil {
+			cancelled <- ctx.Err()
+		}
+		return nil, ctx.Err()
+	}
+
+	response := msg.NewMsgResponse(action, false, peername, "")
+	return &response, nil
+}
+
+// Blocks forever, the scripted client
+// never receives any message
+func (client *ScriptedStunClient) Listen() *msg.MsgResponse {
+	select {}
+}
+
+// Returns the actions requested so far
+func (client *ScriptedStunClient) requested() []string {
+	client.Lock()
+	defer client.Unlock()
+	return append([]string{}, client.actions...)
 }
 
 type CollectMock struct {
@@ -63,7 +224,7 @@ type RequestMock struct {
 	peername string
 	action   string
 	message  string
-	timeout  int
+	ctx      context.Context
 
 	response *msg.MsgResponse
 	err      error
@@ -72,3 +233,11 @@ type RequestMock struct {
 type ListenMock struct {
 	response *msg.MsgResponse
 }
+
+// Returns a context that expires after the given
+// seconds and is cancelled once the test ends
+func timeoutContext(t *testing.T, seconds int) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(seconds)*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
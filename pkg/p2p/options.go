@@ -1,19 +1,194 @@
 package p2p
 
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/alvarogf97/fox/pkg/noise"
+	"github.com/alvarogf97/fox/pkg/stun"
+)
+
 const (
-	DEFAULT_MAX_MSG_IN_QUEUE = 10
-	DEFAULT_SECONDS_TIMEOUT  = 10
+	DEFAULT_MAX_MSG_IN_QUEUE   = 10
+	DEFAULT_SECONDS_TIMEOUT    = 10
+	DEFAULT_KEEPALIVE_INTERVAL = 10 * time.Second
+
+	DEFAULT_RECONNECT_MIN_BACKOFF = 500 * time.Millisecond
+	DEFAULT_RECONNECT_MAX_BACKOFF = 30 * time.Second
+	DEFAULT_RECONNECT_TIMEOUT     = 2 * time.Second
 )
 
+// Strategies the peer chooses the stun
+// servers his requests are sent to with
+const (
+	SERVER_STRATEGY_FAILOVER   = stun.SERVER_STRATEGY_FAILOVER
+	SERVER_STRATEGY_HEALTHIEST = stun.SERVER_STRATEGY_HEALTHIEST
+	SERVER_STRATEGY_ALL        = stun.SERVER_STRATEGY_ALL
+)
+
+// Health of a stun server as seen by the peer
+type ServerHealth = stun.ServerHealth
+
 // Peer options struct
 type PeerOptions struct {
 	maxMsgInQueue int
 	timeout       int
+	keepalive     time.Duration
+	encryption    bool
+	static        *noise.Keypair
+	identity      ed25519.PrivateKey
+	codec         msg.Codec
+	features      []string
+	fallbacks     []string
+	strategy      string
+	probeInterval time.Duration
+	health        func(health ServerHealth)
+	metadata      map[string]string
+	private       bool
+
+	reconnectMinBackoff time.Duration
+	reconnectMaxBackoff time.Duration
+	reconnectAttempts   int
+	reconnectTimeout    time.Duration
+	lifecycle           func(event LifecycleEvent)
 }
 
 // Creates a new peer options
 func NewPeerOptions(maxMsgInQueue int, timeout int) PeerOptions {
-	return PeerOptions{maxMsgInQueue: maxMsgInQueue, timeout: timeout}
+	return PeerOptions{
+		maxMsgInQueue: maxMsgInQueue,
+		timeout:       timeout,
+		keepalive:     DEFAULT_KEEPALIVE_INTERVAL,
+		codec:         msg.BinaryCodec{},
+		strategy:      SERVER_STRATEGY_FAILOVER,
+
+		reconnectMinBackoff: DEFAULT_RECONNECT_MIN_BACKOFF,
+		reconnectMaxBackoff: DEFAULT_RECONNECT_MAX_BACKOFF,
+		reconnectTimeout:    DEFAULT_RECONNECT_TIMEOUT,
+	}
+}
+
+// Returns a copy of the options that refreshes
+// the peer registration every given interval.
+// Keepalives are disabled if the interval is zero
+func (options PeerOptions) WithKeepalive(interval time.Duration) PeerOptions {
+	options.keepalive = interval
+	return options
+}
+
+// Returns a copy of the options that encrypts every
+// message exchanged with other peers. The given static
+// keypair identifies the peer during the handshakes,
+// a random one is generated by `NewPeer` if it is nil
+func (options PeerOptions) WithEncryption(static *noise.Keypair) PeerOptions {
+	options.encryption = true
+	options.static = static
+	return options
+}
+
+// Returns a copy of the options whose peer
+// registers his name with the given private key.
+// A random one is generated by `NewPeer` if it is
+// nil, so the name can only be reclaimed by the
+// same peer instance
+func (options PeerOptions) WithIdentity(identity ed25519.PrivateKey) PeerOptions {
+	options.identity = identity
+	return options
+}
+
+// Returns a copy of the options whose peer writes
+// every message with the given codec, both to the
+// stun server and to other peers. Messages are read
+// with the codec they were written with, so peers
+// using different codecs understand each other as
+// long as both of them know every codec
+func (options PeerOptions) WithCodec(codec msg.Codec) PeerOptions {
+	options.codec = codec
+	return options
+}
+
+// Returns a copy of the options whose peer
+// advertises the given optional features, i.e.
+// `msg.FEATURE_COMPRESSION`, besides the ones
+// he supports out of the box
+func (options PeerOptions) WithFeatures(features ...string) PeerOptions {
+	options.features = features
+	return options
+}
+
+// Returns a copy of the options whose peer registers
+// again once his registration is lost, waiting from
+// min to max backoff between failed attempts. It gives
+// up after the given attempts, or never if they are
+// zero. Reconnections are disabled if min backoff is zero
+func (options PeerOptions) WithReconnect(minBackoff time.Duration, maxBackoff time.Duration, maxAttempts int) PeerOptions {
+	options.reconnectMinBackoff = minBackoff
+	options.reconnectMaxBackoff = maxBackoff
+	options.reconnectAttempts = maxAttempts
+	return options
+}
+
+// Returns a copy of the options whose peer waits
+// the given timeout for every reconnection attempt,
+// bounded by the peer timeout, which is the only
+// bound if it is zero
+func (options PeerOptions) WithReconnectTimeout(timeout time.Duration) PeerOptions {
+	options.reconnectTimeout = timeout
+	return options
+}
+
+// Returns a copy of the options whose peer calls
+// the given handler every time his registration
+// state changes, i.e. he is reconnecting
+func (options PeerOptions) WithLifecycle(handler func(event LifecycleEvent)) PeerOptions {
+	options.lifecycle = handler
+	return options
+}
+
+// Returns a copy of the options whose peer fails
+// over to the stun servers listening on the given
+// addresses, in order, once his server does not
+// answer, i.e. the standbys of his primary
+func (options PeerOptions) WithFallbackServers(addrs ...string) PeerOptions {
+	options.fallbacks = addrs
+	return options
+}
+
+// Returns a copy of the options whose peer chooses
+// the stun servers, his own and the fallbacks, his
+// requests are sent to with the given strategy, i.e.
+// `SERVER_STRATEGY_ALL` registers him into every one
+func (options PeerOptions) WithServerStrategy(strategy string) PeerOptions {
+	options.strategy = strategy
+	return options
+}
+
+// Returns a copy of the options whose peer probes
+// his stun servers every given interval while he
+// is initialized and calls the given handler, if
+// any, once one of them becomes healthy or unhealthy
+func (options PeerOptions) WithServerHealth(interval time.Duration, handler func(health ServerHealth)) PeerOptions {
+	options.probeInterval = interval
+	options.health = handler
+	return options
+}
+
+// Returns a copy of the options whose peer tells
+// the stun server the given metadata, so other
+// peers can find him by it with `ListPeers`
+func (options PeerOptions) WithMetadata(metadata map[string]string) PeerOptions {
+	options.metadata = metadata
+	return options
+}
+
+// Returns a copy of the options whose peer is
+// private or not. Private peers are never listed
+// by `ListPeers`, nor watched by the peers that
+// watch everybody, they are only found by name
+func (options PeerOptions) WithPrivate(private bool) PeerOptions {
+	options.private = private
+	return options
 }
 
 // Creates a new default peer options
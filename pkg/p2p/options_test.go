@@ -1,8 +1,11 @@
 package p2p
 
 import (
+	"crypto/ed25519"
 	"testing"
+	"time"
 
+	"github.com/alvarogf97/fox/pkg/msg"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,6 +20,115 @@ func TestPeerOptions(t *testing.T) {
 
 		assert.Equal(maxMsgInQueue, options.maxMsgInQueue)
 		assert.Equal(timeout, options.timeout)
+		assert.Equal(DEFAULT_KEEPALIVE_INTERVAL, options.keepalive)
+	})
+
+	t.Run("test_peer_options_with_keepalive", func(t *testing.T) {
+		interval := time.Second
+
+		options := DefaultPeerOptions().WithKeepalive(interval)
+
+		assert.Equal(interval, options.keepalive)
+	})
+
+	t.Run("test_peer_options_with_encryption", func(t *testing.T) {
+		options := DefaultPeerOptions().WithEncryption(nil)
+
+		assert.True(options.encryption)
+		assert.Nil(options.static)
+	})
+
+	t.Run("test_peer_options_with_identity", func(t *testing.T) {
+		_, identity, _ := ed25519.GenerateKey(nil)
+
+		options := DefaultPeerOptions().WithIdentity(identity)
+
+		assert.Equal(identity, options.identity)
+	})
+
+	t.Run("test_peer_options_with_codec", func(t *testing.T) {
+		options := DefaultPeerOptions().WithCodec(msg.JSONCodec{})
+
+		assert.Equal(msg.JSONCodec{}, options.codec)
+	})
+
+	t.Run("test_peer_options_with_features", func(t *testing.T) {
+		options := DefaultPeerOptions().WithFeatures(msg.FEATURE_COMPRESSION)
+
+		assert.Equal([]string{msg.FEATURE_COMPRESSION}, options.features)
+	})
+
+	t.Run("test_peer_options_default_reconnect", func(t *testing.T) {
+		options := DefaultPeerOptions()
+
+		assert.Equal(DEFAULT_RECONNECT_MIN_BACKOFF, options.reconnectMinBackoff)
+		assert.Equal(DEFAULT_RECONNECT_MAX_BACKOFF, options.reconnectMaxBackoff)
+		assert.Equal(0, options.reconnectAttempts)
+		assert.Equal(DEFAULT_RECONNECT_TIMEOUT, options.reconnectTimeout)
+		assert.Nil(options.lifecycle)
+	})
+
+	t.Run("test_peer_options_with_reconnect", func(t *testing.T) {
+		options := DefaultPeerOptions().WithReconnect(time.Second, time.Minute, 3)
+
+		assert.Equal(time.Second, options.reconnectMinBackoff)
+		assert.Equal(time.Minute, options.reconnectMaxBackoff)
+		assert.Equal(3, options.reconnectAttempts)
+	})
+
+	t.Run("test_peer_options_with_reconnect_timeout", func(t *testing.T) {
+		options := DefaultPeerOptions().WithReconnectTimeout(time.Second)
+
+		assert.Equal(time.Second, options.reconnectTimeout)
+	})
+
+	t.Run("test_peer_options_with_lifecycle", func(t *testing.T) {
+		var received LifecycleEvent
+		options := DefaultPeerOptions().WithLifecycle(func(event LifecycleEvent) {
+			received = event
+		})
+
+		options.lifecycle(LifecycleEvent{State: LIFECYCLE_CONNECTED})
+
+		assert.Equal(LIFECYCLE_CONNECTED, received.State)
+	})
+
+	t.Run("test_peer_options_with_fallback_servers", func(t *testing.T) {
+		options := DefaultPeerOptions().WithFallbackServers("127.0.0.1:60002", "127.0.0.1:60003")
+
+		assert.Equal([]string{"127.0.0.1:60002", "127.0.0.1:60003"}, options.fallbacks)
+		assert.Empty(DefaultPeerOptions().fallbacks)
+	})
+
+	t.Run("test_peer_options_with_server_strategy", func(t *testing.T) {
+		options := DefaultPeerOptions().WithServerStrategy(SERVER_STRATEGY_HEALTHIEST)
+
+		assert.Equal(SERVER_STRATEGY_HEALTHIEST, options.strategy)
+		assert.Equal(SERVER_STRATEGY_FAILOVER, DefaultPeerOptions().strategy)
+	})
+
+	t.Run("test_peer_options_with_server_health", func(t *testing.T) {
+		var received ServerHealth
+		options := DefaultPeerOptions().WithServerHealth(time.Second, func(health ServerHealth) {
+			received = health
+		})
+
+		options.health(ServerHealth{Healthy: true})
+
+		assert.Equal(time.Second, options.probeInterval)
+		assert.True(received.Healthy)
+		assert.Zero(DefaultPeerOptions().probeInterval)
+	})
+
+	t.Run("test_peer_options_with_profile", func(t *testing.T) {
+		metadata := map[string]string{"room": "lobby"}
+
+		options := DefaultPeerOptions().WithMetadata(metadata).WithPrivate(true)
+
+		assert.Equal(metadata, options.metadata)
+		assert.True(options.private)
+		assert.Empty(DefaultPeerOptions().metadata)
+		assert.False(DefaultPeerOptions().private)
 	})
 
 	t.Run("test_new_peer_default_options", func(t *testing.T) {
@@ -24,5 +136,6 @@ func TestPeerOptions(t *testing.T) {
 
 		assert.Equal(DEFAULT_MAX_MSG_IN_QUEUE, options.maxMsgInQueue)
 		assert.Equal(DEFAULT_SECONDS_TIMEOUT, options.timeout)
+		assert.Equal(msg.BinaryCodec{}, options.codec)
 	})
 }
@@ -1,10 +1,18 @@
 package p2p
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/alvarogf97/fox/pkg/noise"
 	"github.com/alvarogf97/fox/pkg/stun"
 )
 
@@ -12,81 +20,489 @@ import (
 // it can send messages to other peers and
 // listen the incoming ones
 type Peer struct {
-	name        string
-	options     PeerOptions
+	name    string
+	options PeerOptions
+
+	// registration state, shared with the
+	// keepalive and guarded by the lifecycle
+	lifecycle   sync.Mutex
 	initialized bool
-	conn        *net.UDPConn
-	client      stun.StunClient
+	dispatching bool
+	keepalives  chan struct{}
+	monitoring  context.CancelFunc
+
+	// closed once the peer is closed
+	done    chan struct{}
+	closing sync.Once
+
+	conn         *net.UDPConn
+	saddr        *net.UDPAddr
+	fallbacks    []*net.UDPAddr
+	client       stun.StunClient
+	messages     chan *msg.MsgResponse
+	events       chan PresenceEvent
+	watching     *watchState
+	punches      *punchTable
+	sessions     *sessionTable
+	handshakes   *handshakeTable
+	identities   *identityTable
+	reliability  *reliableTable
+	channels     *channelTable
+	capabilities *capabilityTable
+	fragments    *fragmentTable
+	lost         chan error
+}
+
+// Reads every message collected by the stun
+// client, handles the ones that belong to the
+// peer protocol and queues the rest of them
+// so they can be recovered by `Listen`. It
+// returns once the peer is closed
+func (peer *Peer) dispatch() {
+	messages := peer.incoming()
+	for {
+		select {
+		case <-peer.done:
+			return
+		case response := <-messages:
+			if response != nil {
+				peer.route(response)
+			}
+		}
+	}
+}
+
+// Returns the queue of the messages collected by
+// the stun client. Clients that cannot be waited
+// for are read by a goroutine that stops after
+// the first message read once the peer is closed
+func (peer *Peer) incoming() <-chan *msg.MsgResponse {
+	if source, ok := peer.client.(stun.MessageSource); ok {
+		return source.Messages()
+	}
+
+	messages := make(chan *msg.MsgResponse)
+	go func() {
+		for {
+			response := peer.client.Listen()
+			select {
+			case messages <- response:
+			case <-peer.done:
+				return
+			}
+		}
+	}()
+	return messages
+}
+
+// Handles the given message depending on his action
+func (peer *Peer) route(response *msg.MsgResponse) {
+	switch response.Action {
+	case msg.PEER_ACTION_INTRODUCE:
+		go peer.handleIntroduction(response)
+	case msg.PEER_ACTION_PUNCH:
+		peer.handlePunch(response)
+	case msg.PEER_ACTION_PUNCH_ACK:
+		peer.handlePunchAck(response)
+	case msg.PEER_ACTION_HANDSHAKE_INIT:
+		peer.handleHandshakeInit(response)
+	case msg.PEER_ACTION_HANDSHAKE_FINAL:
+		peer.handleHandshakeFinal(response)
+	case msg.PEER_ACTION_HANDSHAKE_RESPONSE, msg.PEER_ACTION_HANDSHAKE_DONE:
+		peer.handshakes.reply(response)
+	case msg.PEER_ACTION_PRESENCE:
+		// only the stun server knows who
+		// joins or leaves the network
+		if peer.isServer(response.Addr) {
+			peer.handlePresence(response)
+		}
+	case msg.PEER_ACTION_SHUTDOWN:
+		// only the stun server can tell
+		// it is going away
+		if peer.isServer(response.Addr) {
+			peer.signalLost(ErrServerShutdown)
+			peer.enqueue(response)
+		}
+	case msg.PEER_ACTION_FRAGMENT_NACK:
+		peer.handleFragmentNack(response)
+	case msg.PEER_ACTION_SEALED:
+		// messages that cannot be opened are dropped
+		// and replayed ones are only acknowledged again
+		inner, err := peer.open(response)
+		if err == nil {
+			peer.deliver(inner)
+		} else if errors.Is(err, noise.ErrReplayed) && inner.Action == msg.PEER_ACTION_RELIABLE {
+			peer.handleReliableReplay(inner)
+		}
+	default:
+		// plaintext messages cannot be trusted
+		// once encryption is enabled
+		if !peer.options.encryption {
+			peer.deliver(response)
+		}
+	}
+}
+
+// Delivers the given message sent by another
+// peer, reliable frames are delivered in order
+func (peer *Peer) deliver(response *msg.MsgResponse) {
+	switch response.Action {
+	case msg.PEER_ACTION_RELIABLE:
+		peer.handleReliable(response)
+	case msg.PEER_ACTION_RELIABLE_ACK:
+		peer.handleReliableAck(response)
+	default:
+		// channels only accept messages
+		// delivered reliably and in order
+		if isApplicationMessage(response) {
+			peer.enqueue(response)
+		}
+	}
+}
+
+// Delivers the given message received in order,
+// channel messages are handed to their channel
+func (peer *Peer) deliverInOrder(response *msg.MsgResponse) {
+	switch response.Action {
+	case msg.PEER_ACTION_CHANNEL_OPEN, msg.PEER_ACTION_STREAM_OPEN:
+		peer.handleChannelOpen(response)
+	case msg.PEER_ACTION_CHANNEL_CREDIT:
+		peer.handleChannelCredit(response)
+	case msg.PEER_ACTION_CHANNEL_CLOSE:
+		peer.handleChannelClose(response)
+	default:
+		if response.Channel != "" {
+			peer.handleChannelMessage(response)
+		} else {
+			peer.enqueue(response)
+		}
+	}
+}
+
+// Queues the given message so it can be recovered
+// by `Listen`. Messages are dropped once the queue
+// is full, as the network drops datagrams, so a
+// slow reader never stalls the dispatcher and the
+// protocol messages behind his ones
+func (peer *Peer) enqueue(response *msg.MsgResponse) bool {
+	select {
+	case peer.messages <- response:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the room left into the queue of `Listen`
+func (peer *Peer) room() int {
+	return cap(peer.messages) - len(peer.messages)
+}
+
+// Checks the given message is queued for
+// `Listen` instead of handed to a channel
+func isApplicationMessage(response *msg.MsgResponse) bool {
+	return response.Channel == "" && !isChannelAction(response.Action)
+}
+
+// Checks if the given action manages channels
+func isChannelAction(action string) bool {
+	switch action {
+	case msg.PEER_ACTION_CHANNEL_OPEN, msg.PEER_ACTION_CHANNEL_CREDIT, msg.PEER_ACTION_CHANNEL_CLOSE, msg.PEER_ACTION_STREAM_OPEN:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns a writer towards the given address
+// that serializes messages with the peer codec
+// and keeps the fragments it sends
+func (peer *Peer) newWriter(paddr *net.UDPAddr) *P2PWriter {
+	writer := NewP2PWriter(peer.name, peer.conn, paddr)
+	writer.marshal = msg.NewEncoder(peer.options.codec)
+	writer.sent = peer.fragments
+	return writer
+}
+
+// Returns a writer towards the given peer that
+// seals the messages if encryption is enabled
+func (peer *Peer) writerTo(peername string, paddr *net.UDPAddr) *P2PWriter {
+	writer := peer.newWriter(paddr)
+	if peer.options.encryption {
+		writer.seal = peer.sealer(peername)
+	}
+	return writer
+}
+
+// Returns a writer towards the given peer that can
+// deliver messages reliably through the sender
+// shared by every writer connected to the peer
+// and open channels with him
+func (peer *Peer) reliableWriterTo(peername string, paddr *net.UDPAddr) (*P2PWriter, error) {
+	writer := peer.writerTo(peername, paddr)
+	sender, err := peer.reliability.sender(peername, peer.writerTo(peername, paddr))
+	if err != nil {
+		return nil, err
+	}
+	writer.sender = sender
+	writer.peername = peername
+	writer.channels = peer.channels
+	return writer, nil
 }
 
 // Register the current peer into the stun
 // server and starts listening for incoming
-// messages
-func (peer *Peer) Init() error {
+// messages. It fails with `ErrNameTaken` if
+// another peer owns the name and `ErrTimeout`
+// if the server does not answer in time
+func (peer *Peer) Init(ctx context.Context) error {
 	// starts listening incoming messages by
 	// using stun client
 	go peer.client.Collect()
+	peer.lifecycle.Lock()
+	if !peer.dispatching {
+		peer.dispatching = true
+		go peer.dispatch()
+	}
+	peer.lifecycle.Unlock()
 
 	// requests stun server in order to register
 	// the current peer in the p2p network
-	_, err := peer.client.Request(peer.name, msg.STUN_ACTION_NEW, "", peer.options.timeout)
-	if err != nil {
+	if err := peer.register(ctx); err != nil {
 		return err
 	}
+
+	peer.lifecycle.Lock()
 	peer.initialized = true
+
+	// keeps the registration alive in background
+	if peer.keepalives == nil && peer.options.keepalive > 0 {
+		peer.keepalives = make(chan struct{})
+		go peer.keepalive(peer.keepalives)
+	}
+
+	// probes the stun servers in background
+	monitor, monitored := peer.client.(stun.HealthMonitor)
+	if peer.monitoring == nil && monitored && peer.options.probeInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		peer.monitoring = cancel
+		go monitor.Monitor(ctx)
+	}
+	peer.lifecycle.Unlock()
+
+	peer.notify(LIFECYCLE_CONNECTED, 0, nil)
 	return nil
 }
 
+// Checks the peer is registered into the network
+func (peer *Peer) isInitialized() bool {
+	peer.lifecycle.Lock()
+	defer peer.lifecycle.Unlock()
+	return peer.initialized
+}
+
+// Stops probing the stun servers
+func (peer *Peer) stopMonitoring() {
+	peer.lifecycle.Lock()
+	defer peer.lifecycle.Unlock()
+
+	if peer.monitoring != nil {
+		peer.monitoring()
+		peer.monitoring = nil
+	}
+}
+
+// Returns the health of the stun servers of the
+// peer, his own first and the fallbacks after
+func (peer *Peer) ServerHealth() []ServerHealth {
+	if monitor, monitored := peer.client.(stun.HealthMonitor); monitored {
+		return monitor.Health()
+	}
+	return nil
+}
+
+// Refreshes the peer registration every keepalive
+// interval so the stun server does not expire it.
+// The requests keep the NAT mapping towards the
+// stun server open too. Failed refreshes and
+// shutdown notices mean the registration was
+// lost, i.e. the server restarted, so the peer
+// registers again
+func (peer *Peer) keepalive(stop chan struct{}) {
+	ticker := time.NewTicker(peer.options.keepalive)
+	defer ticker.Stop()
+
+	for {
+		var lost error
+		select {
+		case <-stop:
+			return
+		case lost = <-peer.lost:
+		case <-ticker.C:
+			lost = peer.refresh()
+		}
+
+		if lost != nil && !peer.reconnect(stop, lost) {
+			return
+		}
+	}
+}
+
+// Requests the stun server to extend the peer
+// registration lease, telling his profile again
+// in case the server lost it
+func (peer *Peer) refresh() error {
+	profile, err := peer.profile()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := peer.withTimeout(context.Background())
+	defer cancel()
+	_, err = peer.client.Request(ctx, peer.name, msg.STUN_ACTION_REFRESH, profile)
+	return err
+}
+
+// Stops refreshing the peer registration
+func (peer *Peer) stopKeepalive() {
+	peer.lifecycle.Lock()
+	defer peer.lifecycle.Unlock()
+
+	if peer.keepalives != nil {
+		close(peer.keepalives)
+		peer.keepalives = nil
+	}
+}
+
 // Connects to a peer by givin his name.
 // If the peer does no exist in the P2P
-// network an error will be raised
-func (peer Peer) Connect(peername string) (*P2PWriter, error) {
-	if !peer.initialized {
-		return nil, fmt.Errorf("Peer needs to be initialized first")
+// network `ErrPeerNotFound` will be raised.
+// This method returns once both peers can
+// reach each other through their NATs, the
+// given context bounds the whole attempt
+func (peer *Peer) Connect(ctx context.Context, peername string) (*P2PWriter, error) {
+	if !peer.isInitialized() {
+		return nil, ErrNotInitialized
 	}
+	ctx, cancel := peer.withTimeout(ctx)
+	defer cancel()
+
 	// requests server about the given peername
-	response, err := peer.client.Request(peer.name, msg.STUN_ACTION_GET, peername, peer.options.timeout)
+	response, err := peer.client.Request(ctx, peer.name, msg.STUN_ACTION_GET, peername)
 	if err != nil {
 		return nil, err
 	}
 
+	// remembers the key the requested peer registered
+	// his name with so his identity can be verified
+	peer.identities.set(peername, response.Key)
+
 	// tries to resolve given udp address
 	paddr, err := net.ResolveUDPAddr("udp4", response.Message)
 	if err != nil {
 		return nil, fmt.Errorf("resolve peer address failed %s", err)
 	}
 
+	// punches our NAT until the requested peer
+	// acknowledges one of our probes
+	if err := peer.punch(ctx, peername, paddr); err != nil {
+		return nil, err
+	}
+
+	// both peers said hello while punching so
+	// we know if we understand each other
+	if err := peer.checkCapabilities(peername); err != nil {
+		return nil, err
+	}
+
+	// establishes an encrypted session so every
+	// message written is sealed for the peer
+	if peer.options.encryption {
+		if err := peer.handshake(ctx, peername, paddr); err != nil {
+			return nil, err
+		}
+	}
+
+	writer, err := peer.reliableWriterTo(peername, paddr)
+	if err != nil {
+		return nil, err
+	}
+
 	// return a P2P wirter through the one you can write
 	// messages to the connected peer
-	return NewP2PWriter(peer.name, peer.conn, paddr), nil
+	return writer, nil
 }
 
 // Disconnects from the P2P network
 // so initialized will be back to false
-func (peer *Peer) Disconnect() error {
-	if !peer.initialized {
-		return fmt.Errorf("Peer needs to be initialized first")
+func (peer *Peer) Disconnect(ctx context.Context) error {
+	if !peer.isInitialized() {
+		return ErrNotInitialized
 	}
 
-	_, err := peer.client.Request(peer.name, msg.STUN_ACTION_DISCONNECT, "", peer.options.timeout)
-	return err
+	ctx, cancel := peer.withTimeout(ctx)
+	defer cancel()
+	_, err := peer.client.Request(ctx, peer.name, msg.STUN_ACTION_DISCONNECT, "")
+	if err != nil {
+		return err
+	}
+
+	peer.stopKeepalive()
+	peer.stopMonitoring()
+	peer.watching.clear()
+	peer.lifecycle.Lock()
+	peer.initialized = false
+	peer.lifecycle.Unlock()
+	peer.notify(LIFECYCLE_DISCONNECTED, 0, nil)
+	return nil
 }
 
 // Recover P2P messages from the stun server
 // queue. This function shoudl be used by a
-// goroutine in order to handle the incoming messages
-func (peer Peer) Listen() (*msg.MsgResponse, error) {
-	if !peer.initialized {
-		return nil, fmt.Errorf("Peer needs to be initialized first")
+// goroutine in order to handle the incoming
+// messages. It returns the context error once
+// the given context is done, expired contexts
+// return `os.ErrDeadlineExceeded` as the
+// channel reads do
+func (peer *Peer) Listen(ctx context.Context) (*msg.MsgResponse, error) {
+	if !peer.isInitialized() {
+		return nil, ErrNotInitialized
+	}
+
+	select {
+	case message := <-peer.messages:
+		return message, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, os.ErrDeadlineExceeded
+		}
+		return nil, ctx.Err()
 	}
-	return peer.client.Listen(), nil
 }
 
 // Closes peer connection
-func (peer Peer) Close() error {
+func (peer *Peer) Close() error {
+	peer.closing.Do(func() { close(peer.done) })
+	peer.stopKeepalive()
+	peer.stopMonitoring()
+	peer.channels.shutdown()
 	return peer.conn.Close()
 }
 
+// Checks the given address belongs to
+// one of the stun servers of the peer
+func (peer *Peer) isServer(addr *net.UDPAddr) bool {
+	if addr == nil {
+		return false
+	}
+	for _, server := range append([]*net.UDPAddr{peer.saddr}, peer.fallbacks...) {
+		if addr.String() == server.String() {
+			return true
+		}
+	}
+	return false
+}
+
 // Creates a new peer
 func NewPeer(name string, stunaddr string, addr string, options PeerOptions) (*Peer, error) {
 	saddr, err := net.ResolveUDPAddr("udp4", stunaddr)
@@ -94,6 +510,15 @@ func NewPeer(name string, stunaddr string, addr string, options PeerOptions) (*P
 		return nil, fmt.Errorf("cannot resolve server address: %s", err)
 	}
 
+	fallbacks := []*net.UDPAddr{}
+	for _, fallback := range options.fallbacks {
+		faddr, err := net.ResolveUDPAddr("udp4", fallback)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve fallback server address: %s", err)
+		}
+		fallbacks = append(fallbacks, faddr)
+	}
+
 	laddr, err := net.ResolveUDPAddr("udp4", addr)
 	if err != nil {
 		return nil, fmt.Errorf("cannot resolver local address: %s", err)
@@ -104,13 +529,56 @@ func NewPeer(name string, stunaddr string, addr string, options PeerOptions) (*P
 		return nil, fmt.Errorf("address already in use: %s", err)
 	}
 
-	client := stun.NewDefaultStunClient(conn, saddr, stun.NewClientStunOptions(true, options.maxMsgInQueue))
+	// generates the static keypair which
+	// identifies the peer in the handshakes
+	if options.encryption && options.static == nil {
+		static, err := noise.GenerateKeypair()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot generate peer keypair: %s", err)
+		}
+		options.static = static
+	}
+
+	// generates the identity the peer
+	// registers his name with
+	if options.identity == nil {
+		_, identity, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot generate peer identity: %s", err)
+		}
+		options.identity = identity
+	}
+
+	clientOptions := stun.NewClientStunOptions(true, options.maxMsgInQueue).
+		WithIdentity(options.identity).
+		WithCodec(options.codec).
+		WithFeatures(advertisedFeatures(options)...).
+		WithFallbacks(fallbacks...).
+		WithStrategy(options.strategy).
+		WithHealthCheck(options.probeInterval, options.health)
+	client := stun.NewDefaultStunClient(conn, saddr, clientOptions)
 
 	return &Peer{
-		name:        name,
-		options:     options,
-		initialized: false,
-		conn:        conn,
-		client:      client,
+		name:         name,
+		options:      options,
+		conn:         conn,
+		saddr:        saddr,
+		fallbacks:    fallbacks,
+		client:       client,
+		messages:     make(chan *msg.MsgResponse, options.maxMsgInQueue),
+		events:       make(chan PresenceEvent, options.maxMsgInQueue),
+		watching:     &watchState{},
+		punches:      newPunchTable(),
+		sessions:     newSessionTable(),
+		handshakes:   newHandshakeTable(),
+		identities:   newIdentityTable(),
+		reliability:  newReliableTable(),
+		channels:     newChannelTable(options.maxMsgInQueue),
+		capabilities: newCapabilityTable(),
+		fragments:    newFragmentTable(),
+		lost:         make(chan error, 1),
+		done:         make(chan struct{}),
 	}, nil
 }
@@ -1,11 +1,16 @@
 package p2p
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/alvarogf97/fox/pkg/stun"
 	"github.com/stretchr/testify/require"
 )
 
@@ -25,6 +30,14 @@ func TestPeerConstructors(t *testing.T) {
 		assert.Equal(name, peer.name)
 	})
 
+	t.Run("test_peer_constructor_generates_identity", func(t *testing.T) {
+		peer, err := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		defer peer.Close()
+
+		assert.NoError(err)
+		assert.NotNil(peer.options.identity)
+	})
+
 	t.Run("test_peer_constructor_fail_resolve_stunaddr", func(t *testing.T) {
 		name := "FakePeer"
 		stunAddr := "malformedaddr"
@@ -35,6 +48,30 @@ func TestPeerConstructors(t *testing.T) {
 		assert.Error(err)
 	})
 
+	t.Run("test_peer_constructor_fail_resolve_fallback", func(t *testing.T) {
+		options := DefaultPeerOptions().WithFallbackServers("malformedaddr")
+
+		_, err := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", options)
+		assert.Error(err)
+		assert.Contains(err.Error(), "fallback")
+	})
+
+	t.Run("test_peer_trusts_fallback_servers", func(t *testing.T) {
+		options := DefaultPeerOptions().WithFallbackServers("127.0.0.1:60002")
+		peer, err := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", options)
+		assert.NoError(err)
+		defer peer.Close()
+
+		primary, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60001")
+		fallback, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60002")
+		stranger, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+
+		assert.True(peer.isServer(primary))
+		assert.True(peer.isServer(fallback))
+		assert.False(peer.isServer(stranger))
+		assert.False(peer.isServer(nil))
+	})
+
 	t.Run("test_peer_constructor_fail_resolve_laddr", func(t *testing.T) {
 		name := "FakePeer"
 		stunAddr := "127.0.0.1:60001"
@@ -75,14 +112,15 @@ func TestPeerInit(t *testing.T) {
 		peer.client = client
 		defer peer.Close()
 
-		err := peer.Init()
+		err := peer.Init(context.Background())
 
 		assert.NoError(err)
-		assert.True(peer.initialized)
-		assert.Equal(name, client.requestMock.peername)
-		assert.Equal(msg.STUN_ACTION_NEW, client.requestMock.action)
-		assert.Equal("", client.requestMock.message)
-		assert.Equal(options.timeout, client.requestMock.timeout)
+		assert.True(peer.isInitialized())
+		assert.Equal(name, client.lastRequest().peername)
+		assert.Equal(msg.STUN_ACTION_NEW, client.lastRequest().action)
+		assert.Equal("", client.lastRequest().message)
+		_, bounded := client.lastRequest().ctx.Deadline()
+		assert.True(bounded)
 	})
 
 	t.Run("test_peer_init_fail_register", func(t *testing.T) {
@@ -97,11 +135,138 @@ func TestPeerInit(t *testing.T) {
 		peer.client = &client
 		defer peer.Close()
 
-		err := peer.Init()
+		err := peer.Init(context.Background())
 
 		assert.Error(err, expectedError.Error())
 	})
 
+	t.Run("test_peer_init_fail_name_taken", func(t *testing.T) {
+		rerr := &stun.ResponseError{Code: msg.ERROR_CODE_NAME_TAKEN, Message: "peer `FakePeer` already exists"}
+		client := &MockStunClient{requestMock: RequestMock{err: rerr}}
+
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		defer peer.Close()
+
+		err := peer.Init(context.Background())
+
+		assert.True(errors.Is(err, ErrNameTaken))
+		assert.False(peer.isInitialized())
+	})
+
+}
+
+func TestPeerKeepalive(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_peer_keepalive_refreshes_registration", func(t *testing.T) {
+		name := "FakePeer"
+		stunAddr := "127.0.0.1:60001"
+		addr := ":50000"
+		options := DefaultPeerOptions().WithKeepalive(10 * time.Millisecond)
+		client := &MockStunClient{requestMock: RequestMock{}}
+
+		peer, _ := NewPeer(name, stunAddr, addr, options)
+		peer.client = client
+		defer peer.Close()
+
+		err := peer.Init(context.Background())
+		time.Sleep(100 * time.Millisecond)
+
+		assert.NoError(err)
+		assert.NotNil(peer.keepalives)
+		assert.Equal(name, client.lastRequest().peername)
+		assert.Equal(msg.STUN_ACTION_REFRESH, client.lastRequest().action)
+	})
+
+	t.Run("test_peer_keepalive_disabled", func(t *testing.T) {
+		name := "FakePeer"
+		stunAddr := "127.0.0.1:60001"
+		addr := ":50000"
+		options := DefaultPeerOptions().WithKeepalive(0)
+		client := &MockStunClient{requestMock: RequestMock{}}
+
+		peer, _ := NewPeer(name, stunAddr, addr, options)
+		peer.client = client
+		defer peer.Close()
+
+		err := peer.Init(context.Background())
+
+		assert.NoError(err)
+		assert.Nil(peer.keepalives)
+	})
+
+	t.Run("test_peer_disconnect_stops_keepalive", func(t *testing.T) {
+		name := "FakePeer"
+		stunAddr := "127.0.0.1:60001"
+		addr := ":50000"
+		options := DefaultPeerOptions()
+		client := &MockStunClient{requestMock: RequestMock{}}
+
+		peer, _ := NewPeer(name, stunAddr, addr, options)
+		peer.client = client
+		defer peer.Close()
+
+		peer.Init(context.Background())
+		err := peer.Disconnect(context.Background())
+
+		assert.NoError(err)
+		assert.Nil(peer.keepalives)
+	})
+
+}
+
+func TestPeerServerHealth(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_peer_server_health_reports_every_server", func(t *testing.T) {
+		options := DefaultPeerOptions().WithFallbackServers("127.0.0.1:60002")
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", options)
+		defer peer.Close()
+
+		health := peer.ServerHealth()
+
+		assert.Len(health, 2)
+		assert.Equal("127.0.0.1:60001", health[0].Addr.String())
+		assert.Equal("127.0.0.1:60002", health[1].Addr.String())
+		assert.True(health[0].Healthy)
+	})
+
+	t.Run("test_peer_server_health_unknown_without_monitor", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = &MockStunClient{}
+		defer peer.Close()
+
+		assert.Nil(peer.ServerHealth())
+	})
+
+	t.Run("test_peer_monitors_servers_while_initialized", func(t *testing.T) {
+		options := DefaultPeerOptions().WithKeepalive(0).WithServerHealth(time.Second, nil)
+		client := &MonitoredStunClient{started: make(chan struct{}), stopped: make(chan struct{})}
+
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", options)
+		peer.client = client
+		defer peer.Close()
+
+		assert.NoError(peer.Init(context.Background()))
+		<-client.started
+		assert.NotNil(peer.monitoring)
+
+		assert.NoError(peer.Disconnect(context.Background()))
+		<-client.stopped
+		assert.Nil(peer.monitoring)
+	})
+
+	t.Run("test_peer_monitoring_disabled", func(t *testing.T) {
+		client := &MonitoredStunClient{started: make(chan struct{}), stopped: make(chan struct{})}
+
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions().WithKeepalive(0))
+		peer.client = client
+		defer peer.Close()
+
+		assert.NoError(peer.Init(context.Background()))
+		assert.Nil(peer.monitoring)
+	})
 }
 
 func TestPeerConnect(t *testing.T) {
@@ -115,21 +280,27 @@ func TestPeerConnect(t *testing.T) {
 		options := DefaultPeerOptions()
 		expectedMsg := ":50000"
 		response := msg.NewMsgResponse("", false, name, expectedMsg)
-		client := &MockStunClient{requestMock: RequestMock{response: &response}}
+		response.Key = "key"
+		ack := msg.NewMsgResponse(msg.PEER_ACTION_PUNCH_ACK, false, peername, "")
+		ack.Addr, _ = net.ResolveUDPAddr("udp4", expectedMsg)
+		client := &MockStunClient{requestMock: RequestMock{response: &response}, listenMock: ListenMock{response: &ack}}
 
 		peer, _ := NewPeer(name, stunAddr, addr, options)
 		peer.client = client
 		peer.initialized = true
 		defer peer.Close()
+		go peer.dispatch()
 
-		writer, err := peer.Connect(peername)
+		writer, err := peer.Connect(context.Background(), peername)
 
 		assert.NoError(err)
 		assert.Equal(name, writer.name)
-		assert.Equal(name, client.requestMock.peername)
-		assert.Equal(msg.STUN_ACTION_GET, client.requestMock.action)
-		assert.Equal(peername, client.requestMock.message)
-		assert.Equal(options.timeout, client.requestMock.timeout)
+		assert.Equal(response.Key, peer.identities.get(peername))
+		assert.Equal(name, client.lastRequest().peername)
+		assert.Equal(msg.STUN_ACTION_GET, client.lastRequest().action)
+		assert.Equal(peername, client.lastRequest().message)
+		_, bounded := client.lastRequest().ctx.Deadline()
+		assert.True(bounded)
 	})
 
 	t.Run("test_peer_connect_fail_not_initialized", func(t *testing.T) {
@@ -146,9 +317,40 @@ func TestPeerConnect(t *testing.T) {
 		peer.client = client
 		defer peer.Close()
 
-		_, err := peer.Connect(peername)
+		_, err := peer.Connect(context.Background(), peername)
 
-		assert.Error(err)
+		assert.True(errors.Is(err, ErrNotInitialized))
+	})
+
+	t.Run("test_peer_connect_fail_peer_not_found", func(t *testing.T) {
+		rerr := &stun.ResponseError{Code: msg.ERROR_CODE_PEER_NOT_FOUND, Message: "peer `anotherPeer` not found"}
+		client := &MockStunClient{requestMock: RequestMock{err: rerr}}
+
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		_, err := peer.Connect(context.Background(), "anotherPeer")
+
+		assert.True(errors.Is(err, ErrPeerNotFound))
+	})
+
+	t.Run("test_peer_connect_fail_punch_timeout", func(t *testing.T) {
+		response := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "FakePeer", "127.0.0.1:50011")
+		client := &MockStunClient{requestMock: RequestMock{response: &response}}
+
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, err := peer.Connect(ctx, "anotherPeer")
+
+		assert.True(errors.Is(err, ErrTimeout))
+		assert.True(errors.Is(err, context.DeadlineExceeded))
 	})
 
 	t.Run("test_peer_connect_fail_get_peer_addr", func(t *testing.T) {
@@ -165,7 +367,27 @@ func TestPeerConnect(t *testing.T) {
 		peer.initialized = true
 		defer peer.Close()
 
-		_, err := peer.Connect(peername)
+		_, err := peer.Connect(context.Background(), peername)
+
+		assert.Error(err)
+	})
+
+	t.Run("test_peer_connect_fail_punch_timeout", func(t *testing.T) {
+		peername := "anotherPeer"
+		name := "FakePeer"
+		stunAddr := "127.0.0.1:60001"
+		addr := ":50000"
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1)
+		expectedMsg := "127.0.0.1:50001"
+		response := msg.NewMsgResponse("", false, name, expectedMsg)
+		client := &MockStunClient{requestMock: RequestMock{response: &response}}
+
+		peer, _ := NewPeer(name, stunAddr, addr, options)
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		_, err := peer.Connect(context.Background(), peername)
 
 		assert.Error(err)
 	})
@@ -185,7 +407,7 @@ func TestPeerConnect(t *testing.T) {
 		peer.initialized = true
 		defer peer.Close()
 
-		_, err := peer.Connect(peername)
+		_, err := peer.Connect(context.Background(), peername)
 
 		assert.Error(err)
 	})
@@ -209,13 +431,14 @@ func TestPeerDisconnect(t *testing.T) {
 		peer.initialized = true
 		defer peer.Close()
 
-		err := peer.Disconnect()
+		err := peer.Disconnect(context.Background())
 
 		assert.NoError(err)
-		assert.Equal(name, client.requestMock.peername)
-		assert.Equal(msg.STUN_ACTION_DISCONNECT, client.requestMock.action)
-		assert.Equal("", client.requestMock.message)
-		assert.Equal(options.timeout, client.requestMock.timeout)
+		assert.Equal(name, client.lastRequest().peername)
+		assert.Equal(msg.STUN_ACTION_DISCONNECT, client.lastRequest().action)
+		assert.Equal("", client.lastRequest().message)
+		_, bounded := client.lastRequest().ctx.Deadline()
+		assert.True(bounded)
 	})
 
 	t.Run("test_peer_diconnect_fail_not_initialized", func(t *testing.T) {
@@ -230,9 +453,9 @@ func TestPeerDisconnect(t *testing.T) {
 		peer.initialized = false
 		defer peer.Close()
 
-		err := peer.Disconnect()
+		err := peer.Disconnect(context.Background())
 
-		assert.Error(err)
+		assert.True(errors.Is(err, ErrNotInitialized))
 	})
 
 }
@@ -252,8 +475,9 @@ func TestPeerListen(t *testing.T) {
 		peer.client = client
 		peer.initialized = true
 		defer peer.Close()
+		go peer.dispatch()
 
-		msg, err := peer.Listen()
+		msg, err := peer.Listen(context.Background())
 
 		assert.NoError(err)
 		assert.Equal(response.Action, msg.Action)
@@ -262,6 +486,34 @@ func TestPeerListen(t *testing.T) {
 		assert.Equal(response.Message, msg.Message)
 	})
 
+	t.Run("test_peer_listen_server_shutdown", func(t *testing.T) {
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1).WithEncryption(nil)
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", options)
+		defer peer.Close()
+
+		shutdown := msg.NewMsgResponse(msg.PEER_ACTION_SHUTDOWN, false, "FakePeer", "")
+		shutdown.Addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 60001}
+		peer.route(&shutdown)
+		assert.Empty(peer.messages)
+
+		shutdown.Addr = peer.saddr
+		peer.route(&shutdown)
+		assert.Len(peer.messages, 1)
+	})
+
+	t.Run("test_peer_listen_full_queue_drops_messages", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", NewPeerOptions(1, 1))
+		defer peer.Close()
+
+		first := msg.NewMsgResponse("FakeAction", false, "dog", "first")
+		second := msg.NewMsgResponse("FakeAction", false, "dog", "second")
+		peer.route(&first)
+		peer.route(&second)
+
+		assert.Len(peer.messages, 1)
+		assert.Equal(&first, <-peer.messages)
+	})
+
 	t.Run("test_peer_listen_fail_not_initialized", func(t *testing.T) {
 		name := "FakePeer"
 		stunAddr := "127.0.0.1:60001"
@@ -274,9 +526,84 @@ func TestPeerListen(t *testing.T) {
 		peer.initialized = false
 		defer peer.Close()
 
-		_, err := peer.Listen()
+		_, err := peer.Listen(context.Background())
 
-		assert.Error(err)
+		assert.True(errors.Is(err, ErrNotInitialized))
+	})
+
+	t.Run("test_peer_listen_fail_context_done", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.initialized = true
+		defer peer.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := peer.Listen(ctx)
+
+		assert.True(errors.Is(err, context.Canceled))
 	})
 
+	t.Run("test_peer_listen_fail_deadline_exceeded", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.initialized = true
+		defer peer.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := peer.Listen(ctx)
+
+		assert.True(errors.Is(err, os.ErrDeadlineExceeded))
+		assert.False(errors.Is(err, ErrTimeout))
+	})
+
+}
+
+func TestPeerClose(t *testing.T) {
+	assert := require.New(t)
+
+	// Runs the dispatcher of the given peer and
+	// tells once it returns
+	dispatched := func(peer *Peer) chan struct{} {
+		returned := make(chan struct{})
+		go func() {
+			peer.dispatch()
+			close(returned)
+		}()
+		return returned
+	}
+
+	t.Run("test_peer_close_stops_dispatcher", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", "127.0.0.1:0", DefaultPeerOptions())
+		returned := dispatched(peer)
+
+		assert.NoError(peer.Close())
+
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			assert.Fail("dispatcher kept running after close")
+		}
+	})
+
+	t.Run("test_peer_close_stops_dispatcher_of_blocking_client", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", "127.0.0.1:0", DefaultPeerOptions())
+		peer.client = &MockStunClient{}
+		returned := dispatched(peer)
+
+		assert.NoError(peer.Close())
+
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			assert.Fail("dispatcher kept running after close")
+		}
+	})
+
+	t.Run("test_peer_close_twice", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", "127.0.0.1:0", DefaultPeerOptions())
+
+		peer.Close()
+
+		assert.NotPanics(func() { peer.Close() })
+	})
 }
@@ -0,0 +1,142 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+// Changes of the registration of
+// the peers a peer watches
+const (
+	PRESENCE_JOINED = msg.PRESENCE_JOINED
+	PRESENCE_LEFT   = msg.PRESENCE_LEFT
+	PRESENCE_MOVED  = msg.PRESENCE_MOVED
+)
+
+// Change of the registration of a watched peer
+type PresenceEvent struct {
+	Peername string
+	// What happened to the peer,
+	// see `PRESENCE_*`
+	Presence string
+	// Address and key the peer is registered
+	// with, empty once he left
+	Addr string
+	Key  string
+}
+
+// Names the peer watches, so they are
+// watched again once he registers again
+type watchState struct {
+	sync.Mutex
+	active bool
+	names  []string
+}
+
+// Remembers the peer watches the given names
+func (state *watchState) set(names []string) {
+	state.Lock()
+	state.active = true
+	state.names = names
+	state.Unlock()
+}
+
+// Forgets the names the peer watches
+func (state *watchState) clear() {
+	state.Lock()
+	state.active = false
+	state.names = nil
+	state.Unlock()
+}
+
+// Returns the names the peer watches and
+// whether he watches anybody at all
+func (state *watchState) get() ([]string, bool) {
+	state.Lock()
+	defer state.Unlock()
+	return state.names, state.active
+}
+
+// Queues the presence told by the stun server.
+// Events nobody reads are dropped once the
+// queue is full, so they never block the
+// rest of the messages
+func (peer *Peer) handlePresence(response *msg.MsgResponse) {
+	event := PresenceEvent{
+		Peername: response.Peername,
+		Presence: response.Header(msg.HEADER_PRESENCE),
+		Addr:     response.Message,
+		Key:      response.Key,
+	}
+
+	select {
+	case peer.events <- event:
+	default:
+	}
+}
+
+// Requests the stun server to watch the
+// given names, or every name if none
+func (peer *Peer) requestWatch(ctx context.Context, names []string) error {
+	message, err := msg.EncodeNames(names)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := peer.withTimeout(ctx)
+	defer cancel()
+	_, err = peer.client.Request(ctx, peer.name, msg.STUN_ACTION_WATCH, message)
+	return err
+}
+
+// Watches the registrations of the peers with
+// the given names, or every peer if there's no
+// name, replacing the ones watched before. Their
+// changes are delivered by `Events`, the peers
+// already registered as if they had just joined.
+// Names are watched again after reconnections
+func (peer *Peer) Watch(ctx context.Context, names ...string) error {
+	if !peer.isInitialized() {
+		return ErrNotInitialized
+	}
+
+	if err := peer.requestWatch(ctx, names); err != nil {
+		return err
+	}
+	peer.watching.set(names)
+	return nil
+}
+
+// Stops watching the registrations of other peers
+func (peer *Peer) Unwatch(ctx context.Context) error {
+	if !peer.isInitialized() {
+		return ErrNotInitialized
+	}
+
+	ctx, cancel := peer.withTimeout(ctx)
+	defer cancel()
+	if _, err := peer.client.Request(ctx, peer.name, msg.STUN_ACTION_UNWATCH, ""); err != nil {
+		return err
+	}
+	peer.watching.clear()
+	return nil
+}
+
+// Watches again the names watched before
+// the registration was lost, if any
+func (peer *Peer) rewatch() error {
+	names, active := peer.watching.get()
+	if !active {
+		return nil
+	}
+	return peer.requestWatch(context.Background(), names)
+}
+
+// Returns the channel the changes of the
+// watched peers are delivered through,
+// apart from the messages of `Listen`
+func (peer *Peer) Events() <-chan PresenceEvent {
+	return peer.events
+}
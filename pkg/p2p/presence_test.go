@@ -0,0 +1,160 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Builds a presence notification of the given
+// peer sent from the given address
+func newPresenceMessage(peername string, presence string, from string) *msg.MsgResponse {
+	addr, _ := net.ResolveUDPAddr("udp4", from)
+	response := msg.NewMsgResponse(msg.PEER_ACTION_PRESENCE, false, peername, "127.0.0.1:50011")
+	response.Key = "key"
+	response.Headers = map[string]string{msg.HEADER_PRESENCE: presence}
+	response.Addr = addr
+	return &response
+}
+
+func TestPeerWatch(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_peer_watch_success", func(t *testing.T) {
+		client := &MockStunClient{requestMock: RequestMock{}}
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		err := peer.Watch(context.Background(), "alice", "bob")
+
+		names, active := peer.watching.get()
+		assert.NoError(err)
+		assert.Equal(msg.STUN_ACTION_WATCH, client.lastRequest().action)
+		assert.Equal(`["alice","bob"]`, client.lastRequest().message)
+		assert.True(active)
+		assert.Equal([]string{"alice", "bob"}, names)
+	})
+
+	t.Run("test_peer_watch_everybody", func(t *testing.T) {
+		client := &MockStunClient{requestMock: RequestMock{}}
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		err := peer.Watch(context.Background())
+
+		_, active := peer.watching.get()
+		assert.NoError(err)
+		assert.Empty(client.lastRequest().message)
+		assert.True(active)
+	})
+
+	t.Run("test_peer_watch_fail_request", func(t *testing.T) {
+		client := &MockStunClient{requestMock: RequestMock{err: errors.New("Error")}}
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		defer peer.Close()
+
+		err := peer.Watch(context.Background(), "alice")
+
+		_, active := peer.watching.get()
+		assert.Error(err)
+		assert.False(active)
+	})
+
+	t.Run("test_peer_watch_fail_not_initialized", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		defer peer.Close()
+
+		assert.True(errors.Is(peer.Watch(context.Background(), "alice"), ErrNotInitialized))
+		assert.True(errors.Is(peer.Unwatch(context.Background()), ErrNotInitialized))
+	})
+
+	t.Run("test_peer_unwatch", func(t *testing.T) {
+		client := &MockStunClient{requestMock: RequestMock{}}
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		peer.client = client
+		peer.initialized = true
+		peer.watching.set(nil)
+		defer peer.Close()
+
+		err := peer.Unwatch(context.Background())
+
+		_, active := peer.watching.get()
+		assert.NoError(err)
+		assert.Equal(msg.STUN_ACTION_UNWATCH, client.lastRequest().action)
+		assert.False(active)
+	})
+
+	t.Run("test_peer_watches_again_after_reconnecting", func(t *testing.T) {
+		client := &ScriptedStunClient{errs: map[string][]error{}}
+		options := DefaultPeerOptions().WithReconnect(time.Millisecond, time.Millisecond, 0)
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", options)
+		peer.client = client
+		peer.watching.set([]string{"alice"})
+		defer peer.Close()
+
+		assert.True(peer.reconnect(make(chan struct{}), ErrPeerNotFound))
+		assert.Equal([]string{msg.STUN_ACTION_NEW, msg.STUN_ACTION_WATCH}, client.requested())
+	})
+
+	t.Run("test_peer_does_not_watch_after_reconnecting_if_he_did_not", func(t *testing.T) {
+		client := &ScriptedStunClient{errs: map[string][]error{}}
+		options := DefaultPeerOptions().WithReconnect(time.Millisecond, time.Millisecond, 0)
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", options)
+		peer.client = client
+		defer peer.Close()
+
+		assert.True(peer.reconnect(make(chan struct{}), ErrPeerNotFound))
+		assert.Equal([]string{msg.STUN_ACTION_NEW}, client.requested())
+	})
+}
+
+func TestPeerEvents(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_peer_events_from_server", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		defer peer.Close()
+
+		peer.route(newPresenceMessage("alice", msg.PRESENCE_JOINED, "127.0.0.1:60001"))
+
+		select {
+		case event := <-peer.Events():
+			assert.Equal(PresenceEvent{Peername: "alice", Presence: PRESENCE_JOINED, Addr: "127.0.0.1:50011", Key: "key"}, event)
+		default:
+			t.Fatal("presence not delivered")
+		}
+		assert.Len(peer.messages, 0)
+	})
+
+	t.Run("test_peer_events_from_stranger_are_dropped", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", DefaultPeerOptions())
+		defer peer.Close()
+
+		peer.route(newPresenceMessage("alice", msg.PRESENCE_LEFT, "127.0.0.1:50012"))
+
+		assert.Len(peer.Events(), 0)
+		assert.Len(peer.messages, 0)
+	})
+
+	t.Run("test_peer_events_dropped_once_queue_is_full", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", ":50000", NewPeerOptions(1, DEFAULT_SECONDS_TIMEOUT))
+		defer peer.Close()
+
+		peer.route(newPresenceMessage("alice", msg.PRESENCE_JOINED, "127.0.0.1:60001"))
+		peer.route(newPresenceMessage("alice", msg.PRESENCE_LEFT, "127.0.0.1:60001"))
+
+		assert.Equal(PRESENCE_JOINED, (<-peer.Events()).Presence)
+		assert.Len(peer.Events(), 0)
+	})
+}
@@ -0,0 +1,165 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+const (
+	// Time between two consecutive punch probes
+	PUNCH_INTERVAL = 100 * time.Millisecond
+)
+
+// Hole punching attempt to a remote peer and
+// the addresses it sends probes to
+type punchAttempt struct {
+	done  chan struct{}
+	addrs map[string]bool
+}
+
+// Hole punching attempts in progress indexed
+// by the name of the remote peer. Every attempt
+// is resolved once the remote peer acknowledges
+// one of our probes from an address we punched
+type punchTable struct {
+	sync.Mutex
+	pending map[string]*punchAttempt
+}
+
+// Opens a punching attempt for the given peer
+// through the given address. Concurrent attempts
+// to the same peer share the returned channel
+func (table *punchTable) open(peername string, addr *net.UDPAddr) chan struct{} {
+	table.Lock()
+	defer table.Unlock()
+
+	attempt, exists := table.pending[peername]
+	if !exists {
+		attempt = &punchAttempt{done: make(chan struct{}), addrs: map[string]bool{}}
+		table.pending[peername] = attempt
+	}
+	attempt.addrs[addr.String()] = true
+	return attempt.done
+}
+
+// Checks there's a punching attempt in progress
+// for the given peer through the given address
+func (table *punchTable) punched(peername string, addr *net.UDPAddr) bool {
+	table.Lock()
+	defer table.Unlock()
+
+	attempt, exists := table.pending[peername]
+	return exists && addr != nil && attempt.addrs[addr.String()]
+}
+
+// Resolves the punching attempt for the given
+// peer if there's any in progress through the
+// given address
+func (table *punchTable) resolve(peername string, addr *net.UDPAddr) {
+	table.Lock()
+	defer table.Unlock()
+
+	if attempt, exists := table.pending[peername]; exists && addr != nil && attempt.addrs[addr.String()] {
+		close(attempt.done)
+		delete(table.pending, peername)
+	}
+}
+
+// Discards the given punching attempt if it
+// is still the one in progress for the peer
+func (table *punchTable) discard(peername string, done chan struct{}) {
+	table.Lock()
+	defer table.Unlock()
+
+	if current, exists := table.pending[peername]; exists && current.done == done {
+		delete(table.pending, peername)
+	}
+}
+
+// Creates a new punch table
+func newPunchTable() *punchTable {
+	return &punchTable{pending: map[string]*punchAttempt{}}
+}
+
+// Sends punch probes to the given address until
+// the remote peer acknowledges one of them or the
+// given context is done
+func (peer *Peer) punch(ctx context.Context, peername string, paddr *net.UDPAddr) error {
+	done := peer.punches.open(peername, paddr)
+	defer peer.punches.discard(peername, done)
+
+	writer := peer.newWriter(paddr)
+	ticker := time.NewTicker(PUNCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if _, err := peer.hello(writer, msg.PEER_ACTION_PUNCH); err != nil {
+			return fmt.Errorf("punch probe to `%s` failed: %s", peername, err)
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("hole punching with `%s` failed: %w", peername, contextError(ctx))
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handles the introduction of a peer that wants
+// to connect to us by punching our own NAT towards
+// his public address. Only introductions sent by
+// the stun servers are trusted, so the key they
+// carry identifies the introduced peer
+func (peer *Peer) handleIntroduction(response *msg.MsgResponse) {
+	if !peer.isServer(response.Addr) {
+		return
+	}
+
+	if response.Key != "" {
+		peer.identities.set(response.Peername, response.Key)
+	}
+
+	paddr, err := net.ResolveUDPAddr("udp4", response.Message)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := peer.withTimeout(context.Background())
+	defer cancel()
+	peer.punch(ctx, response.Peername, paddr)
+}
+
+// Acknowledges the punch probe sent by
+// another peer so he knows the path to
+// us is open. Probes and acknowledgements
+// say hello, so both peers learn the
+// capabilities of each other
+func (peer *Peer) handlePunch(response *msg.MsgResponse) {
+	if response.Addr == nil {
+		return
+	}
+
+	peer.greet(response)
+	writer := peer.newWriter(response.Addr)
+	peer.hello(writer, msg.PEER_ACTION_PUNCH_ACK)
+}
+
+// Resolves the punching attempt acknowledged
+// by the sender of the given message. Names are
+// not authenticated, so acks are only trusted
+// when they come from an address we punched
+func (peer *Peer) handlePunchAck(response *msg.MsgResponse) {
+	if !peer.punches.punched(response.Peername, response.Addr) {
+		return
+	}
+
+	peer.greet(response)
+	peer.punches.resolve(response.Peername, response.Addr)
+}
@@ -0,0 +1,217 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Reads the next request written to the given
+// connection or fails after one second
+func readRequest(conn *net.UDPConn) (*msg.MsgRequest, error) {
+	buff := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, _, err := conn.ReadFromUDP(buff)
+	if err != nil {
+		return nil, err
+	}
+
+	var request msg.MsgRequest
+	if err := msg.Decode(buff[:n], &request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func TestPunchTable(t *testing.T) {
+	assert := require.New(t)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+	stranger, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50012")
+
+	t.Run("test_punch_table_resolve", func(t *testing.T) {
+		table := newPunchTable()
+
+		done := table.open("dog", addr)
+		assert.True(table.punched("dog", addr))
+		table.resolve("dog", addr)
+
+		_, open := <-done
+		assert.False(open)
+		assert.Empty(table.pending)
+	})
+
+	t.Run("test_punch_table_ignores_other_addresses", func(t *testing.T) {
+		table := newPunchTable()
+
+		done := table.open("dog", addr)
+		table.resolve("dog", stranger)
+		table.resolve("dog", nil)
+
+		assert.False(table.punched("dog", stranger))
+		assert.False(table.punched("cat", addr))
+		select {
+		case <-done:
+			t.Fatal("attempt resolved from an address that was not punched")
+		default:
+		}
+	})
+
+	t.Run("test_punch_table_shared_attempt", func(t *testing.T) {
+		table := newPunchTable()
+
+		first := table.open("dog", addr)
+		second := table.open("dog", stranger)
+
+		assert.Equal(first, second)
+		assert.True(table.punched("dog", stranger))
+	})
+
+	t.Run("test_punch_table_discard", func(t *testing.T) {
+		table := newPunchTable()
+
+		done := table.open("dog", addr)
+		table.discard("dog", done)
+
+		assert.Empty(table.pending)
+	})
+
+	t.Run("test_punch_table_discard_other_attempt", func(t *testing.T) {
+		table := newPunchTable()
+
+		old := table.open("dog", addr)
+		table.resolve("dog", addr)
+		current := table.open("dog", addr)
+		table.discard("dog", old)
+
+		assert.Equal(current, table.pending["dog"].done)
+	})
+}
+
+func TestPeerHandleIntroduction(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_handle_introduction_punches_requester", func(t *testing.T) {
+		name := "FakePeer"
+		stunAddr := "127.0.0.1:60001"
+		addr := "127.0.0.1:50010"
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1)
+
+		raddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		remote, _ := net.ListenUDP("udp", raddr)
+		defer remote.Close()
+
+		peer, _ := NewPeer(name, stunAddr, addr, options)
+		defer peer.Close()
+
+		introduction := msg.NewMsgResponse(msg.PEER_ACTION_INTRODUCE, false, "dog", raddr.String())
+		introduction.Key = "key"
+		introduction.Addr = peer.saddr
+		go peer.handleIntroduction(&introduction)
+
+		request, err := readRequest(remote)
+
+		assert.NoError(err)
+		assert.Equal(introduction.Key, peer.identities.get("dog"))
+		assert.Equal(msg.PEER_ACTION_PUNCH, request.Action)
+		assert.Equal(name, request.Peername)
+	})
+
+	t.Run("test_handle_introduction_ignores_unknown_sender", func(t *testing.T) {
+		name := "FakePeer"
+		stunAddr := "127.0.0.1:60001"
+		addr := "127.0.0.1:50010"
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1)
+
+		raddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		remote, _ := net.ListenUDP("udp", raddr)
+		defer remote.Close()
+
+		peer, _ := NewPeer(name, stunAddr, addr, options)
+		defer peer.Close()
+
+		introduction := msg.NewMsgResponse(msg.PEER_ACTION_INTRODUCE, false, "dog", raddr.String())
+		introduction.Addr = raddr
+		go peer.handleIntroduction(&introduction)
+
+		_, err := readRequest(remote)
+
+		assert.Error(err)
+	})
+}
+
+func TestPeerHandlePunch(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_handle_punch_ack_resolves_punched_address", func(t *testing.T) {
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+		raddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		stranger, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50012")
+		done := peer.punches.open("dog", raddr)
+
+		// spoofed acks from other addresses are ignored
+		ack := msg.NewMsgResponse(msg.PEER_ACTION_PUNCH_ACK, false, "dog", "")
+		ack.Addr = stranger
+		peer.handlePunchAck(&ack)
+		assert.True(peer.punches.punched("dog", raddr))
+
+		ack.Addr = raddr
+		peer.handlePunchAck(&ack)
+
+		_, open := <-done
+		assert.False(open)
+	})
+
+	t.Run("test_handle_punch_acknowledges", func(t *testing.T) {
+		name := "FakePeer"
+		stunAddr := "127.0.0.1:60001"
+		addr := "127.0.0.1:50010"
+		options := DefaultPeerOptions()
+
+		raddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		remote, _ := net.ListenUDP("udp", raddr)
+		defer remote.Close()
+
+		peer, _ := NewPeer(name, stunAddr, addr, options)
+		defer peer.Close()
+
+		probe := msg.NewMsgResponse(msg.PEER_ACTION_PUNCH, false, "dog", "")
+		probe.Addr = raddr
+		peer.handlePunch(&probe)
+
+		request, err := readRequest(remote)
+
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_PUNCH_ACK, request.Action)
+		assert.Equal(name, request.Peername)
+	})
+
+	t.Run("test_handle_punch_says_hello", func(t *testing.T) {
+		options := DefaultPeerOptions().WithEncryption(nil)
+
+		raddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		remote, _ := net.ListenUDP("udp", raddr)
+		defer remote.Close()
+
+		peer, _ := NewPeer("FakePeer", "127.0.0.1:60001", "127.0.0.1:50010", options)
+		defer peer.Close()
+
+		probe := msg.NewMsgResponse(msg.PEER_ACTION_PUNCH, false, "dog", "")
+		probe.Addr = raddr
+		probe.Version = msg.PROTOCOL_VERSION
+		probe.Features = []string{msg.FEATURE_RELIABILITY}
+		peer.handlePunch(&probe)
+
+		request, err := readRequest(remote)
+
+		assert.NoError(err)
+		assert.Equal(msg.PROTOCOL_VERSION, request.Version)
+		assert.Equal([]string{msg.FEATURE_RELIABILITY, msg.FEATURE_ENCRYPTION}, request.Features)
+		capabilities, err := peer.Capabilities("dog")
+		assert.NoError(err)
+		assert.Equal(probe.Capabilities(), capabilities)
+	})
+}
@@ -0,0 +1,495 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+const (
+	// Retransmission timeout used until the
+	// first round trip time is measured
+	INITIAL_RTO = 1 * time.Second
+	// Bounds of the retransmission timeout
+	MIN_RTO = 100 * time.Millisecond
+	MAX_RTO = 10 * time.Second
+	// Interval between retransmission checks
+	RETRANSMIT_INTERVAL = 25 * time.Millisecond
+	// Times a message is retransmitted before
+	// the reliable delivery is given up
+	MAX_RETRANSMISSIONS = 10
+	// Max number of messages in flight, writers
+	// block until there's room for their message
+	RELIABLE_WINDOW_SIZE = 64
+)
+
+// Frame exchanged by the reliable delivery. Data
+// frames carry the serialized request and his
+// sequence number while acknowledgements carry
+// the last sequence number delivered in order.
+// Every sender starts a new stream so receivers
+// know when sequence numbers start again
+type reliableFrame struct {
+	Stream  string
+	Seq     uint64
+	Payload []byte
+}
+
+// Builds the request with the given action that
+// carries the frame. The payload travels as his
+// body and the rest of the frame as his headers,
+// so the frame is written with the peer codec
+func (frame reliableFrame) request(action string, peername string) msg.MsgRequest {
+	return msg.NewMsgRequestBody(action, peername, frame.Payload, map[string]string{
+		msg.HEADER_STREAM:   frame.Stream,
+		msg.HEADER_SEQUENCE: strconv.FormatUint(frame.Seq, 10),
+	})
+}
+
+// Reads the frame carried by the given message
+func readReliableFrame(response *msg.MsgResponse) (reliableFrame, error) {
+	seq, err := strconv.ParseUint(response.Header(msg.HEADER_SEQUENCE), 10, 64)
+	if err != nil {
+		return reliableFrame{}, fmt.Errorf("invalid reliable frame sequence: %s", err)
+	}
+	return reliableFrame{Stream: response.Header(msg.HEADER_STREAM), Seq: seq, Payload: response.Body}, nil
+}
+
+// Retransmission timeout estimator as
+// described in RFC 6298
+type rtoEstimator struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	sampled bool
+}
+
+// Updates the estimation with the given
+// round trip time measurement
+func (estimator *rtoEstimator) sample(rtt time.Duration) {
+	if !estimator.sampled {
+		estimator.sampled = true
+		estimator.srtt = rtt
+		estimator.rttvar = rtt / 2
+	} else {
+		delta := estimator.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		estimator.rttvar = (3*estimator.rttvar + delta) / 4
+		estimator.srtt = (7*estimator.srtt + rtt) / 8
+	}
+	estimator.set(estimator.srtt + 4*estimator.rttvar)
+}
+
+// Doubles the timeout after a retransmission
+func (estimator *rtoEstimator) backoff() {
+	estimator.set(2 * estimator.rto)
+}
+
+// Sets the timeout within the bounds
+func (estimator *rtoEstimator) set(rto time.Duration) {
+	switch {
+	case rto < MIN_RTO:
+		rto = MIN_RTO
+	case rto > MAX_RTO:
+		rto = MAX_RTO
+	}
+	estimator.rto = rto
+}
+
+// Creates a new estimator
+func newRtoEstimator() *rtoEstimator {
+	return &rtoEstimator{rto: INITIAL_RTO}
+}
+
+// Message waiting to be acknowledged. His
+// datagrams are kept so retransmissions are
+// the same sealed fragments under the same id
+type outgoingFrame struct {
+	datagrams     [][]byte
+	sentAt        time.Time
+	retransmitted bool
+	retries       int
+}
+
+// Reliable sending side of the connection
+// with a peer. Messages are numbered and kept
+// until they are acknowledged, retransmitting
+// them every time their timeout expires
+type reliableSender struct {
+	sync.Mutex
+	stream    string
+	next      uint64
+	unacked   map[uint64]*outgoingFrame
+	estimator *rtoEstimator
+	window    chan struct{}
+	writer    *P2PWriter
+	running   bool
+	err       error
+}
+
+// Generates a random stream id
+func newStreamId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Wraps the given request into a data frame with
+// the given sequence number and returns the
+// datagrams that carry it
+func (sender *reliableSender) frame(seq uint64, request msg.MsgRequest) ([][]byte, error) {
+	payload, err := sender.writer.marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := reliableFrame{Stream: sender.stream, Seq: seq, Payload: payload}
+	return sender.writer.datagrams(frame.request(msg.PEER_ACTION_RELIABLE, request.Peername))
+}
+
+// Numbers the given request and sends it. It blocks
+// while the window of messages in flight is full
+func (sender *reliableSender) push(request msg.MsgRequest) (int, error) {
+	return sender.pushBefore(request, time.Time{})
+}
+
+// Same as `push` but it gives up waiting for room
+// in the window once the given deadline is
+// exceeded. A zero deadline waits forever
+func (sender *reliableSender) pushBefore(request msg.MsgRequest, deadline time.Time) (int, error) {
+	if deadline.IsZero() {
+		sender.window <- struct{}{}
+	} else {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case sender.window <- struct{}{}:
+			timer.Stop()
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	sender.Lock()
+	defer sender.Unlock()
+
+	if sender.err != nil {
+		<-sender.window
+		return 0, sender.err
+	}
+
+	sender.next++
+	datagrams, err := sender.frame(sender.next, request)
+	if err != nil {
+		sender.next--
+		<-sender.window
+		return 0, err
+	}
+
+	sender.unacked[sender.next] = &outgoingFrame{datagrams: datagrams, sentAt: time.Now()}
+	if !sender.running {
+		sender.running = true
+		go sender.retransmit()
+	}
+
+	// lost datagrams are retransmitted later
+	// so write errors are not fatal here
+	n, _ := sender.writer.transmit(datagrams)
+	return n, nil
+}
+
+// Handles the acknowledgement of every message
+// up to the given sequence number
+func (sender *reliableSender) acknowledge(stream string, ack uint64) {
+	sender.Lock()
+	defer sender.Unlock()
+
+	if stream != sender.stream {
+		return
+	}
+
+	for seq, frame := range sender.unacked {
+		if seq > ack {
+			continue
+		}
+
+		// Karn's algorithm, retransmitted messages
+		// are ambiguous so they are not measured
+		if seq == ack && !frame.retransmitted {
+			sender.estimator.sample(time.Since(frame.sentAt))
+		}
+		delete(sender.unacked, seq)
+		<-sender.window
+	}
+}
+
+// Retransmits the messages whose timeout expired
+// until every message is acknowledged. Delivery is
+// given up if a message is retransmitted too many
+// times, failing the following writes
+func (sender *reliableSender) retransmit() {
+	ticker := time.NewTicker(RETRANSMIT_INTERVAL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sender.Lock()
+		if len(sender.unacked) == 0 {
+			sender.running = false
+			sender.Unlock()
+			return
+		}
+
+		expired := false
+		for _, frame := range sender.unacked {
+			if now.Sub(frame.sentAt) < sender.estimator.rto {
+				continue
+			}
+
+			if frame.retries >= MAX_RETRANSMISSIONS {
+				sender.fail(fmt.Errorf("reliable delivery to `%s` failed", sender.writer.paddr))
+				break
+			}
+
+			expired = true
+			frame.retries++
+			frame.retransmitted = true
+			frame.sentAt = now
+			sender.writer.transmit(frame.datagrams)
+		}
+
+		if expired {
+			sender.estimator.backoff()
+		}
+		sender.Unlock()
+	}
+}
+
+// Drops every message in flight and fails
+// the following writes with the given error
+func (sender *reliableSender) fail(err error) {
+	sender.err = err
+	for seq := range sender.unacked {
+		delete(sender.unacked, seq)
+		<-sender.window
+	}
+}
+
+// Creates a new reliable sender that sends
+// his frames through the given writer
+func newReliableSender(writer *P2PWriter) (*reliableSender, error) {
+	stream, err := newStreamId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reliableSender{
+		stream:    stream,
+		unacked:   map[uint64]*outgoingFrame{},
+		estimator: newRtoEstimator(),
+		window:    make(chan struct{}, RELIABLE_WINDOW_SIZE),
+		writer:    writer,
+	}, nil
+}
+
+// Reliable receiving side of the connection with
+// a peer. Messages received out of order are kept
+// until the missing ones arrive
+type reliableReceiver struct {
+	stream   string
+	expected uint64
+	pending  map[uint64]*msg.MsgResponse
+}
+
+// Accepts the given frame and returns the messages
+// that can be delivered in order and the sequence
+// number to acknowledge. At most the given room of
+// messages for `Listen` are delivered, the rest of
+// them wait unacknowledged so they are retransmitted
+// until there's room for them
+func (receiver *reliableReceiver) receive(frame reliableFrame, message *msg.MsgResponse, room int) ([]*msg.MsgResponse, uint64) {
+	// the remote peer started sending again
+	if frame.Stream != receiver.stream {
+		receiver.stream = frame.Stream
+		receiver.expected = 1
+		receiver.pending = map[uint64]*msg.MsgResponse{}
+	}
+
+	// duplicates are acknowledged again and messages
+	// far beyond the window are dropped
+	if frame.Seq >= receiver.expected && frame.Seq < receiver.expected+RELIABLE_WINDOW_SIZE {
+		receiver.pending[frame.Seq] = message
+	}
+
+	delivered := []*msg.MsgResponse{}
+	for {
+		next, exists := receiver.pending[receiver.expected]
+		if !exists {
+			break
+		}
+		if isApplicationMessage(next) {
+			if room <= 0 {
+				break
+			}
+			room--
+		}
+		delete(receiver.pending, receiver.expected)
+		delivered = append(delivered, next)
+		receiver.expected++
+	}
+	return delivered, receiver.expected - 1
+}
+
+// Returns the sequence number acknowledged last
+// in the given stream, false if the remote peer
+// is not sending in that stream
+func (receiver *reliableReceiver) acknowledged(stream string) (uint64, bool) {
+	if stream != receiver.stream {
+		return 0, false
+	}
+	return receiver.expected - 1, true
+}
+
+// Reliable delivery state with every peer
+type reliableTable struct {
+	sync.Mutex
+	senders   map[string]*reliableSender
+	receivers map[string]*reliableReceiver
+}
+
+// Returns the sender towards the given peer. It
+// is created the first time, afterwards his writer
+// is replaced as the peer address could change.
+// A sender whose delivery failed is returned one
+// last time, so the write tells the delivery
+// failed, and the following writes start a new
+// stream with a new sender
+func (table *reliableTable) sender(peername string, writer *P2PWriter) (*reliableSender, error) {
+	table.Lock()
+	defer table.Unlock()
+
+	if sender, exists := table.senders[peername]; exists {
+		sender.Lock()
+		defer sender.Unlock()
+
+		if sender.err != nil {
+			delete(table.senders, peername)
+		} else {
+			sender.writer = writer
+		}
+		return sender, nil
+	}
+
+	sender, err := newReliableSender(writer)
+	if err != nil {
+		return nil, err
+	}
+	table.senders[peername] = sender
+	return sender, nil
+}
+
+// Returns the receiver for the given peer
+func (table *reliableTable) receiver(peername string) *reliableReceiver {
+	receiver, exists := table.receivers[peername]
+	if !exists {
+		receiver = &reliableReceiver{pending: map[uint64]*msg.MsgResponse{}}
+		table.receivers[peername] = receiver
+	}
+	return receiver
+}
+
+// Creates a new reliable table
+func newReliableTable() *reliableTable {
+	return &reliableTable{
+		senders:   map[string]*reliableSender{},
+		receivers: map[string]*reliableReceiver{},
+	}
+}
+
+// Handles a reliable frame sent by another peer by
+// delivering the messages that are now in order
+// and acknowledging them
+func (peer *Peer) handleReliable(response *msg.MsgResponse) {
+	if response.Addr == nil {
+		return
+	}
+
+	frame, err := readReliableFrame(response)
+	if err != nil {
+		return
+	}
+
+	var message msg.MsgResponse
+	if err := msg.Decode(frame.Payload, &message); err != nil || message.Peername != response.Peername {
+		return
+	}
+	message.Addr = response.Addr
+
+	// only the dispatcher fills the queue of
+	// `Listen`, so the room can only grow
+	peer.reliability.Lock()
+	delivered, ack := peer.reliability.receiver(response.Peername).receive(frame, &message, peer.room())
+	peer.reliability.Unlock()
+
+	for _, message := range delivered {
+		peer.deliverInOrder(message)
+	}
+
+	acknowledgement := reliableFrame{Stream: frame.Stream, Seq: ack}
+	peer.writerTo(response.Peername, response.Addr).send(acknowledgement.request(msg.PEER_ACTION_RELIABLE_ACK, peer.name))
+}
+
+// Handles a reliable frame sent by another peer that
+// was opened before. His acknowledgement could be
+// lost, so it is acknowledged again, but only if it
+// belongs to the current stream so replayed frames
+// never start the stream again
+func (peer *Peer) handleReliableReplay(response *msg.MsgResponse) {
+	if response.Addr == nil {
+		return
+	}
+
+	frame, err := readReliableFrame(response)
+	if err != nil {
+		return
+	}
+
+	peer.reliability.Lock()
+	ack, current := peer.reliability.receiver(response.Peername).acknowledged(frame.Stream)
+	peer.reliability.Unlock()
+	if !current {
+		return
+	}
+
+	acknowledgement := reliableFrame{Stream: frame.Stream, Seq: ack}
+	peer.writerTo(response.Peername, response.Addr).send(acknowledgement.request(msg.PEER_ACTION_RELIABLE_ACK, peer.name))
+}
+
+// Handles the acknowledgement sent by another peer
+func (peer *Peer) handleReliableAck(response *msg.MsgResponse) {
+	frame, err := readReliableFrame(response)
+	if err != nil {
+		return
+	}
+
+	peer.reliability.Lock()
+	sender, exists := peer.reliability.senders[response.Peername]
+	peer.reliability.Unlock()
+
+	if exists {
+		sender.acknowledge(frame.Stream, frame.Seq)
+	}
+}
@@ -0,0 +1,455 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// P2P connection that drops the
+// first datagrams written to it
+type lossyConn struct {
+	sync.Mutex
+	conn  *net.UDPConn
+	drops int
+}
+
+func (conn *lossyConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.drops > 0 {
+		conn.drops--
+		return len(b), nil
+	}
+	return conn.conn.WriteToUDP(b, addr)
+}
+
+// Builds a data frame with the given sequence number
+func newReliableFrame(stream string, seq uint64) reliableFrame {
+	return reliableFrame{Stream: stream, Seq: seq}
+}
+
+func TestRtoEstimator(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_rto_estimator_initial", func(t *testing.T) {
+		estimator := newRtoEstimator()
+
+		assert.Equal(INITIAL_RTO, estimator.rto)
+	})
+
+	t.Run("test_rto_estimator_first_sample", func(t *testing.T) {
+		estimator := newRtoEstimator()
+
+		estimator.sample(200 * time.Millisecond)
+
+		assert.Equal(200*time.Millisecond, estimator.srtt)
+		assert.Equal(100*time.Millisecond, estimator.rttvar)
+		assert.Equal(600*time.Millisecond, estimator.rto)
+	})
+
+	t.Run("test_rto_estimator_following_samples", func(t *testing.T) {
+		estimator := newRtoEstimator()
+
+		estimator.sample(200 * time.Millisecond)
+		estimator.sample(200 * time.Millisecond)
+
+		assert.Equal(200*time.Millisecond, estimator.srtt)
+		assert.Equal(75*time.Millisecond, estimator.rttvar)
+		assert.Equal(500*time.Millisecond, estimator.rto)
+	})
+
+	t.Run("test_rto_estimator_bounds", func(t *testing.T) {
+		estimator := newRtoEstimator()
+
+		estimator.sample(time.Millisecond)
+		assert.Equal(MIN_RTO, estimator.rto)
+
+		estimator.sample(time.Minute)
+		assert.Equal(MAX_RTO, estimator.rto)
+	})
+
+	t.Run("test_rto_estimator_backoff", func(t *testing.T) {
+		estimator := newRtoEstimator()
+
+		estimator.backoff()
+
+		assert.Equal(2*INITIAL_RTO, estimator.rto)
+	})
+}
+
+func TestReliableFrame(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_reliable_frame_round_trip", func(t *testing.T) {
+		frame := reliableFrame{Stream: "stream", Seq: 7, Payload: []byte{0, 1, 255}}
+		data, _ := msg.Encode(msg.BinaryCodec{}, frame.request(msg.PEER_ACTION_RELIABLE, "dog"))
+
+		var response msg.MsgResponse
+		assert.NoError(msg.Decode(data, &response))
+		decoded, err := readReliableFrame(&response)
+
+		assert.NoError(err)
+		assert.Equal(frame, decoded)
+	})
+
+	t.Run("test_read_reliable_frame_fail_invalid_sequence", func(t *testing.T) {
+		response := msg.NewMsgResponse(msg.PEER_ACTION_RELIABLE, false, "dog", "")
+		response.Headers = map[string]string{msg.HEADER_STREAM: "stream", msg.HEADER_SEQUENCE: "bonks"}
+
+		_, err := readReliableFrame(&response)
+
+		assert.Error(err)
+	})
+}
+
+func TestReliableReceiver(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_receive_in_order", func(t *testing.T) {
+		receiver := &reliableReceiver{}
+		first := &msg.MsgResponse{Message: "first"}
+		second := &msg.MsgResponse{Message: "second"}
+
+		delivered, ack := receiver.receive(newReliableFrame("stream", 1), first, RELIABLE_WINDOW_SIZE)
+		assert.Equal([]*msg.MsgResponse{first}, delivered)
+		assert.Equal(uint64(1), ack)
+
+		delivered, ack = receiver.receive(newReliableFrame("stream", 2), second, RELIABLE_WINDOW_SIZE)
+		assert.Equal([]*msg.MsgResponse{second}, delivered)
+		assert.Equal(uint64(2), ack)
+	})
+
+	t.Run("test_receive_out_of_order", func(t *testing.T) {
+		receiver := &reliableReceiver{}
+		first := &msg.MsgResponse{Message: "first"}
+		second := &msg.MsgResponse{Message: "second"}
+
+		delivered, ack := receiver.receive(newReliableFrame("stream", 2), second, RELIABLE_WINDOW_SIZE)
+		assert.Empty(delivered)
+		assert.Equal(uint64(0), ack)
+
+		delivered, ack = receiver.receive(newReliableFrame("stream", 1), first, RELIABLE_WINDOW_SIZE)
+		assert.Equal([]*msg.MsgResponse{first, second}, delivered)
+		assert.Equal(uint64(2), ack)
+	})
+
+	t.Run("test_receive_duplicate", func(t *testing.T) {
+		receiver := &reliableReceiver{}
+		first := &msg.MsgResponse{Message: "first"}
+
+		receiver.receive(newReliableFrame("stream", 1), first, RELIABLE_WINDOW_SIZE)
+		delivered, ack := receiver.receive(newReliableFrame("stream", 1), first, RELIABLE_WINDOW_SIZE)
+
+		assert.Empty(delivered)
+		assert.Equal(uint64(1), ack)
+	})
+
+	t.Run("test_receive_beyond_window", func(t *testing.T) {
+		receiver := &reliableReceiver{}
+
+		receiver.receive(newReliableFrame("stream", 1), &msg.MsgResponse{}, RELIABLE_WINDOW_SIZE)
+		delivered, ack := receiver.receive(newReliableFrame("stream", RELIABLE_WINDOW_SIZE+2), &msg.MsgResponse{}, RELIABLE_WINDOW_SIZE)
+
+		assert.Empty(delivered)
+		assert.Equal(uint64(1), ack)
+		assert.Empty(receiver.pending)
+	})
+
+	t.Run("test_receive_without_room", func(t *testing.T) {
+		receiver := &reliableReceiver{}
+		first := &msg.MsgResponse{Message: "first"}
+		second := &msg.MsgResponse{Message: "second"}
+
+		delivered, ack := receiver.receive(newReliableFrame("stream", 1), first, 1)
+		assert.Equal([]*msg.MsgResponse{first}, delivered)
+		assert.Equal(uint64(1), ack)
+
+		// the message waits unacknowledged
+		// until it is retransmitted
+		delivered, ack = receiver.receive(newReliableFrame("stream", 2), second, 0)
+		assert.Empty(delivered)
+		assert.Equal(uint64(1), ack)
+
+		delivered, ack = receiver.receive(newReliableFrame("stream", 2), second, 1)
+		assert.Equal([]*msg.MsgResponse{second}, delivered)
+		assert.Equal(uint64(2), ack)
+	})
+
+	t.Run("test_receive_channel_messages_without_room", func(t *testing.T) {
+		receiver := &reliableReceiver{}
+		message := &msg.MsgResponse{Channel: "id", Message: "first"}
+
+		delivered, ack := receiver.receive(newReliableFrame("stream", 1), message, 0)
+
+		assert.Equal([]*msg.MsgResponse{message}, delivered)
+		assert.Equal(uint64(1), ack)
+	})
+
+	t.Run("test_receive_new_stream", func(t *testing.T) {
+		receiver := &reliableReceiver{}
+		first := &msg.MsgResponse{Message: "first"}
+
+		receiver.receive(newReliableFrame("stream", 1), first, RELIABLE_WINDOW_SIZE)
+		receiver.receive(newReliableFrame("stream", 2), first, RELIABLE_WINDOW_SIZE)
+		delivered, ack := receiver.receive(newReliableFrame("restarted", 1), first, RELIABLE_WINDOW_SIZE)
+
+		assert.Equal([]*msg.MsgResponse{first}, delivered)
+		assert.Equal(uint64(1), ack)
+	})
+}
+
+func TestReliableSender(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_push_numbers_messages", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+		sender, _ := newReliableSender(NewP2PWriter("dog", &p2pConn, addr))
+
+		_, err := sender.push(msg.NewMsgRequest("FakeAction", "dog", "FakeMessage"))
+		assert.NoError(err)
+
+		var response msg.MsgResponse
+		msg.Decode(p2pConn.written().b, &response)
+		frame, err := readReliableFrame(&response)
+		assert.NoError(err)
+
+		var inner msg.MsgRequest
+		assert.NoError(msg.Decode(frame.Payload, &inner))
+		assert.Equal(msg.PEER_ACTION_RELIABLE, response.Action)
+		assert.Empty(response.Message)
+		assert.Equal(sender.stream, frame.Stream)
+		assert.Equal(uint64(1), frame.Seq)
+		assert.Equal("FakeMessage", inner.Message)
+		assert.Len(sender.unacked, 1)
+	})
+
+	t.Run("test_acknowledge", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+		sender, _ := newReliableSender(NewP2PWriter("dog", &p2pConn, addr))
+
+		sender.push(msg.NewMsgRequest("FakeAction", "dog", "first"))
+		sender.push(msg.NewMsgRequest("FakeAction", "dog", "second"))
+		sender.acknowledge(sender.stream, 1)
+
+		assert.Len(sender.unacked, 1)
+		assert.Len(sender.window, 1)
+		assert.True(sender.estimator.sampled)
+	})
+
+	t.Run("test_acknowledge_other_stream", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+		sender, _ := newReliableSender(NewP2PWriter("dog", &p2pConn, addr))
+
+		sender.push(msg.NewMsgRequest("FakeAction", "dog", "first"))
+		sender.acknowledge("other", 1)
+
+		assert.Len(sender.unacked, 1)
+	})
+
+	t.Run("test_retransmit_expired", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+		sender, _ := newReliableSender(NewP2PWriter("dog", &p2pConn, addr))
+		sender.estimator.set(MIN_RTO)
+
+		sender.push(msg.NewMsgRequest("FakeAction", "dog", "first"))
+
+		assert.Eventually(func() bool {
+			sender.Lock()
+			defer sender.Unlock()
+			return sender.unacked[1].retransmitted
+		}, time.Second, RETRANSMIT_INTERVAL)
+
+		sender.Lock()
+		defer sender.Unlock()
+		assert.GreaterOrEqual(sender.estimator.rto, 2*MIN_RTO)
+	})
+
+	t.Run("test_retransmit_resends_same_fragments", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+		sender, _ := newReliableSender(NewP2PWriter("dog", &p2pConn, addr))
+		sender.estimator.set(MIN_RTO)
+
+		sender.push(msg.NewMsgRequest("FakeAction", "dog", strings.Repeat("a", 3*msg.MAX_DATAGRAM_SIZE)))
+		sent := p2pConn.datagrams()
+		assert.Greater(len(sent), 1)
+
+		assert.Eventually(func() bool {
+			return len(p2pConn.datagrams()) >= 2*len(sent)
+		}, time.Second, RETRANSMIT_INTERVAL)
+
+		assert.Equal(sent, p2pConn.datagrams()[len(sent):2*len(sent)])
+	})
+
+	t.Run("test_retransmit_fail", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+		sender, _ := newReliableSender(NewP2PWriter("dog", &p2pConn, addr))
+
+		sender.push(msg.NewMsgRequest("FakeAction", "dog", "first"))
+		sender.Lock()
+		sender.unacked[1].retries = MAX_RETRANSMISSIONS
+		sender.unacked[1].sentAt = time.Now().Add(-INITIAL_RTO)
+		sender.Unlock()
+
+		assert.Eventually(func() bool {
+			sender.Lock()
+			defer sender.Unlock()
+			return sender.err != nil
+		}, time.Second, RETRANSMIT_INTERVAL)
+
+		_, err := sender.push(msg.NewMsgRequest("FakeAction", "dog", "second"))
+		assert.Error(err)
+		assert.Empty(sender.window)
+	})
+}
+
+func TestReliableTable(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_sender_reused", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		table := newReliableTable()
+
+		first, err := table.sender("dog", NewP2PWriter("dog", &P2PConnMock{}, addr))
+		assert.NoError(err)
+		second, err := table.sender("dog", NewP2PWriter("dog", &P2PConnMock{}, addr))
+		assert.NoError(err)
+
+		assert.Equal(first, second)
+	})
+
+	t.Run("test_failed_sender_replaced", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		p2pConn := P2PConnMock{}
+		table := newReliableTable()
+
+		failed, _ := table.sender("dog", NewP2PWriter("dog", &p2pConn, addr))
+		failed.Lock()
+		failed.fail(fmt.Errorf("Error"))
+		failed.Unlock()
+
+		// the failure is told once
+		sender, _ := table.sender("dog", NewP2PWriter("dog", &p2pConn, addr))
+		_, err := sender.push(msg.NewMsgRequest("FakeAction", "dog", "first"))
+		assert.Error(err)
+
+		sender, _ = table.sender("dog", NewP2PWriter("dog", &p2pConn, addr))
+		_, err = sender.push(msg.NewMsgRequest("FakeAction", "dog", "second"))
+		assert.NoError(err)
+		assert.NotEqual(failed.stream, sender.stream)
+	})
+}
+
+func TestPeerReliableDelivery(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_reliable_delivery_in_order_with_losses", func(t *testing.T) {
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1)
+		alice, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", options)
+		bob, _ := NewPeer("bob", "127.0.0.1:60001", "127.0.0.1:50011", options)
+		defer alice.Close()
+		defer bob.Close()
+		go pump(alice)
+		go pump(bob)
+
+		baddr := bob.conn.LocalAddr().(*net.UDPAddr)
+		transport := NewP2PWriter(alice.name, &lossyConn{conn: alice.conn, drops: 2}, baddr)
+		sender, _ := alice.reliability.sender("bob", transport)
+		sender.estimator.set(MIN_RTO)
+		writer := alice.writerTo("bob", baddr)
+		writer.sender = sender
+
+		messages := []string{"first", "second", "third"}
+		for _, message := range messages {
+			_, err := writer.Reliable().Write("FakeAction", message)
+			assert.NoError(err)
+		}
+
+		for _, message := range messages {
+			select {
+			case response := <-bob.messages:
+				assert.Equal("FakeAction", response.Action)
+				assert.Equal("alice", response.Peername)
+				assert.Equal(message, response.Message)
+			case <-time.After(2 * time.Second):
+				assert.Fail("reliable message not delivered")
+			}
+		}
+	})
+
+	t.Run("test_reliable_delivery_encrypted", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		baddr := bob.conn.LocalAddr().(*net.UDPAddr)
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", baddr))
+
+		sender, _ := alice.reliability.sender("bob", alice.writerTo("bob", baddr))
+		writer := alice.writerTo("bob", baddr)
+		writer.sender = sender
+
+		_, err := writer.WriteReliable("FakeAction", "FakeMessage")
+		assert.NoError(err)
+
+		select {
+		case response := <-bob.messages:
+			assert.Equal("FakeMessage", response.Message)
+		case <-time.After(2 * time.Second):
+			assert.Fail("reliable message not delivered")
+		}
+
+		// waits for the acknowledgement
+		assert.Eventually(func() bool {
+			sender.Lock()
+			defer sender.Unlock()
+			return len(sender.unacked) == 0
+		}, 2*time.Second, RETRANSMIT_INTERVAL)
+	})
+
+	t.Run("test_reliable_delivery_encrypted_acknowledges_retransmissions", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		baddr := bob.conn.LocalAddr().(*net.UDPAddr)
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", baddr))
+
+		writer := alice.writerTo("bob", baddr)
+		sender, _ := alice.reliability.sender("bob", writer)
+		payload, _ := writer.marshal(msg.NewMsgRequest("FakeAction", "alice", "FakeMessage"))
+		frame := reliableFrame{Stream: sender.stream, Seq: 1, Payload: payload}
+		datagrams, _ := writer.datagrams(frame.request(msg.PEER_ACTION_RELIABLE, "alice"))
+
+		// the same sealed datagrams are sent twice as
+		// if the first acknowledgement was lost
+		for i := 0; i < 2; i++ {
+			sender.window <- struct{}{}
+			sender.Lock()
+			sender.unacked[1] = &outgoingFrame{datagrams: datagrams, sentAt: time.Now()}
+			sender.Unlock()
+			writer.transmit(datagrams)
+
+			assert.Eventually(func() bool {
+				sender.Lock()
+				defer sender.Unlock()
+				return len(sender.unacked) == 0
+			}, 2*time.Second, RETRANSMIT_INTERVAL)
+		}
+
+		assert.Len(bob.messages, 1)
+	})
+}
@@ -0,0 +1,455 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/alvarogf97/fox/pkg/noise"
+)
+
+const (
+	// Time a handshake answered to a remote
+	// initiator waits for his final message
+	HANDSHAKE_RESPONDER_TIMEOUT = 30 * time.Second
+	// Max number of handshakes answered at once,
+	// new initiators are ignored while it is full
+	MAX_RESPONDING_HANDSHAKES = 256
+)
+
+// Encrypted sessions established with
+// other peers indexed by their names
+type sessionTable struct {
+	sync.RWMutex
+	sessions map[string]*noise.Session
+}
+
+// Returns the session established with the
+// given peer or nil if there's none
+func (table *sessionTable) get(peername string) *noise.Session {
+	table.RLock()
+	defer table.RUnlock()
+	return table.sessions[peername]
+}
+
+// Saves the session established with the given
+// peer replacing the previous one
+func (table *sessionTable) set(peername string, session *noise.Session) {
+	table.Lock()
+	table.sessions[peername] = session
+	table.Unlock()
+}
+
+// Creates a new session table
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: map[string]*noise.Session{}}
+}
+
+// Public keys that identify other peers indexed
+// by their names as told by the stun server
+type identityTable struct {
+	sync.RWMutex
+	keys map[string]string
+}
+
+// Returns the key of the given peer or an
+// empty string if it is unknown
+func (table *identityTable) get(peername string) string {
+	table.RLock()
+	defer table.RUnlock()
+	return table.keys[peername]
+}
+
+// Saves the key of the given peer
+func (table *identityTable) set(peername string, key string) {
+	table.Lock()
+	table.keys[peername] = key
+	table.Unlock()
+}
+
+// Creates a new identity table
+func newIdentityTable() *identityTable {
+	return &identityTable{keys: map[string]string{}}
+}
+
+// Handshake answered to a remote initiator.
+// The exchanged messages are kept so the
+// retransmitted ones get the same answer
+type responderHandshake struct {
+	handshake *noise.Handshake
+	init      []byte
+	response  []byte
+	expires   time.Time
+}
+
+// Handshakes in progress indexed by the name of
+// the remote peer and the final messages of the
+// ones completed as responder, so retransmitted
+// final messages are confirmed again
+type handshakeTable struct {
+	sync.Mutex
+	initiated  map[string]chan *msg.MsgResponse
+	responding map[string]*responderHandshake
+	confirmed  map[string][]byte
+}
+
+// Opens a handshake initiated by us and returns
+// the channel where the remote replies are queued
+func (table *handshakeTable) open(peername string) chan *msg.MsgResponse {
+	table.Lock()
+	defer table.Unlock()
+
+	replies := make(chan *msg.MsgResponse, 2)
+	table.initiated[peername] = replies
+	return replies
+}
+
+// Queues the given reply to the handshake initiated
+// with his sender. Replies nobody waits for or that
+// do not fit into the queue are dropped
+func (table *handshakeTable) reply(response *msg.MsgResponse) {
+	table.Lock()
+	defer table.Unlock()
+
+	if replies, exists := table.initiated[response.Peername]; exists {
+		select {
+		case replies <- response:
+		default:
+		}
+	}
+}
+
+// Discards the given handshake initiated by us
+func (table *handshakeTable) discard(peername string, replies chan *msg.MsgResponse) {
+	table.Lock()
+	defer table.Unlock()
+
+	if current, exists := table.initiated[peername]; exists && current == replies {
+		delete(table.initiated, peername)
+	}
+}
+
+// Forgets the handshakes answered to remote
+// initiators that expired before the given
+// time. The table must be locked
+func (table *handshakeTable) expire(now time.Time) {
+	for peername, state := range table.responding {
+		if now.After(state.expires) {
+			delete(table.responding, peername)
+		}
+	}
+}
+
+// Creates a new handshake table
+func newHandshakeTable() *handshakeTable {
+	return &handshakeTable{
+		initiated:  map[string]chan *msg.MsgResponse{},
+		responding: map[string]*responderHandshake{},
+		confirmed:  map[string][]byte{},
+	}
+}
+
+// Prologue both peers mix into the handshake
+// so it is bound to their names
+func prologue(initiator string, responder string) []byte {
+	return []byte(fmt.Sprintf("fox\x00%s\x00%s", initiator, responder))
+}
+
+// Bytes signed by a peer to bind his static
+// key to his identity for a given handshake
+func identityPayload(prologue []byte, static []byte) []byte {
+	payload := append([]byte("fox-identity\x00"), prologue...)
+	return append(payload, static...)
+}
+
+// Proves the peer owns his identity by signing
+// his static key for the given handshake
+func (peer *Peer) proveIdentity(prologue []byte) []byte {
+	public := peer.options.identity.Public().(ed25519.PublicKey)
+	signature := ed25519.Sign(peer.options.identity, identityPayload(prologue, peer.options.static.Public))
+	return append(append([]byte{}, public...), signature...)
+}
+
+// Checks the given proof was made by the owner of
+// the expected key for the given remote static key
+func verifyIdentity(proof []byte, prologue []byte, static []byte, expected string) error {
+	if len(proof) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return fmt.Errorf("invalid identity proof")
+	}
+
+	public := ed25519.PublicKey(proof[:ed25519.PublicKeySize])
+	if expected == "" || msg.EncodeKey(public) != expected {
+		return fmt.Errorf("unexpected identity key")
+	}
+
+	if !ed25519.Verify(public, identityPayload(prologue, static), proof[ed25519.PublicKeySize:]) {
+		return fmt.Errorf("invalid identity signature")
+	}
+	return nil
+}
+
+// Encodes the given binary data so it can
+// travel into a message
+func encodeBinary(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// Decodes binary data encoded by `encodeBinary`
+func decodeBinary(message string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(message)
+}
+
+// Sends the given binary payload to the given address
+// every punch interval until the remote peer answers
+// with the expected action or the given context is done
+func (peer *Peer) exchange(ctx context.Context, peername string, paddr *net.UDPAddr, action string, payload []byte, replies chan *msg.MsgResponse, expected string) ([]byte, error) {
+	writer := peer.newWriter(paddr)
+	ticker := time.NewTicker(PUNCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if _, err := writer.Write(action, encodeBinary(payload)); err != nil {
+			return nil, fmt.Errorf("handshake with `%s` failed: %s", peername, err)
+		}
+
+		select {
+		case reply := <-replies:
+			if reply.Action != expected {
+				continue
+			}
+			return decodeBinary(reply.Message)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("handshake with `%s` failed: %w", peername, contextError(ctx))
+		case <-ticker.C:
+		}
+	}
+}
+
+// Performs the handshake with the given peer as
+// initiator and saves the resulting session. The
+// remote peer must prove he owns the key the stun
+// server registered for his name
+func (peer *Peer) handshake(ctx context.Context, peername string, paddr *net.UDPAddr) error {
+	replies := peer.handshakes.open(peername)
+	defer peer.handshakes.discard(peername, replies)
+
+	bound := prologue(peer.name, peername)
+	handshake := noise.NewHandshake(true, peer.options.static, bound)
+
+	// -> e
+	init, err := handshake.WriteMessage(nil)
+	if err != nil {
+		return err
+	}
+
+	// <- e, ee, s, es
+	response, err := peer.exchange(ctx, peername, paddr, msg.PEER_ACTION_HANDSHAKE_INIT, init, replies, msg.PEER_ACTION_HANDSHAKE_RESPONSE)
+	if err != nil {
+		return err
+	}
+
+	proof, err := handshake.ReadMessage(response)
+	if err != nil {
+		return fmt.Errorf("handshake with `%s` failed: %s", peername, err)
+	}
+
+	if err := verifyIdentity(proof, bound, handshake.RemoteStatic(), peer.identities.get(peername)); err != nil {
+		return fmt.Errorf("cannot verify identity of `%s`: %s", peername, err)
+	}
+
+	// -> s, se
+	final, err := handshake.WriteMessage(peer.proveIdentity(bound))
+	if err != nil {
+		return err
+	}
+
+	session, err := handshake.Session()
+	if err != nil {
+		return err
+	}
+
+	// waits until the remote peer confirms
+	// the session is established on his side
+	if _, err := peer.exchange(ctx, peername, paddr, msg.PEER_ACTION_HANDSHAKE_FINAL, final, replies, msg.PEER_ACTION_HANDSHAKE_DONE); err != nil {
+		return err
+	}
+
+	peer.sessions.set(peername, session)
+	return nil
+}
+
+// Answers the first handshake message sent
+// by a remote initiator
+func (peer *Peer) handleHandshakeInit(response *msg.MsgResponse) {
+	if !peer.options.encryption || response.Addr == nil {
+		return
+	}
+
+	init, err := decodeBinary(response.Message)
+	if err != nil {
+		return
+	}
+
+	peer.handshakes.Lock()
+	defer peer.handshakes.Unlock()
+
+	// retransmitted messages get the same answer
+	now := time.Now()
+	peer.handshakes.expire(now)
+	state, exists := peer.handshakes.responding[response.Peername]
+	if !exists || !bytes.Equal(state.init, init) {
+		if !exists && len(peer.handshakes.responding) >= MAX_RESPONDING_HANDSHAKES {
+			return
+		}
+
+		bound := prologue(response.Peername, peer.name)
+		handshake := noise.NewHandshake(false, peer.options.static, bound)
+		if _, err := handshake.ReadMessage(init); err != nil {
+			return
+		}
+
+		answer, err := handshake.WriteMessage(peer.proveIdentity(bound))
+		if err != nil {
+			return
+		}
+
+		state = &responderHandshake{
+			handshake: handshake,
+			init:      init,
+			response:  answer,
+			expires:   now.Add(HANDSHAKE_RESPONDER_TIMEOUT),
+		}
+		peer.handshakes.responding[response.Peername] = state
+	}
+
+	writer := peer.newWriter(response.Addr)
+	writer.Write(msg.PEER_ACTION_HANDSHAKE_RESPONSE, encodeBinary(state.response))
+}
+
+// Completes the handshake started by a remote
+// initiator and saves the resulting session once
+// he proves he owns the key the stun server
+// introduced him with
+func (peer *Peer) handleHandshakeFinal(response *msg.MsgResponse) {
+	if !peer.options.encryption || response.Addr == nil {
+		return
+	}
+
+	final, err := decodeBinary(response.Message)
+	if err != nil {
+		return
+	}
+
+	peer.handshakes.Lock()
+	defer peer.handshakes.Unlock()
+
+	writer := peer.newWriter(response.Addr)
+
+	// retransmitted messages are confirmed again
+	state, exists := peer.handshakes.responding[response.Peername]
+	if !exists {
+		if confirmed := peer.handshakes.confirmed[response.Peername]; len(confirmed) > 0 && bytes.Equal(confirmed, final) {
+			writer.Write(msg.PEER_ACTION_HANDSHAKE_DONE, "")
+		}
+		return
+	}
+
+	if time.Now().After(state.expires) {
+		delete(peer.handshakes.responding, response.Peername)
+		return
+	}
+
+	// waits for the introduction if it did not
+	// arrive yet, the initiator will retry
+	expected := peer.identities.get(response.Peername)
+	if expected == "" {
+		return
+	}
+
+	proof, err := state.handshake.ReadMessage(final)
+	if err != nil {
+		delete(peer.handshakes.responding, response.Peername)
+		return
+	}
+
+	bound := prologue(response.Peername, peer.name)
+	if err := verifyIdentity(proof, bound, state.handshake.RemoteStatic(), expected); err != nil {
+		delete(peer.handshakes.responding, response.Peername)
+		return
+	}
+
+	session, err := state.handshake.Session()
+	if err != nil {
+		delete(peer.handshakes.responding, response.Peername)
+		return
+	}
+
+	// the handshake is over, only his final
+	// message is kept to confirm it again
+	delete(peer.handshakes.responding, response.Peername)
+	peer.handshakes.confirmed[response.Peername] = final
+	peer.sessions.set(response.Peername, session)
+
+	writer.Write(msg.PEER_ACTION_HANDSHAKE_DONE, "")
+}
+
+// Returns a function that seals messages with
+// the session established with the given peer
+func (peer *Peer) sealer(peername string) func(payload []byte) ([]byte, error) {
+	return func(payload []byte) ([]byte, error) {
+		session := peer.sessions.get(peername)
+		if session == nil {
+			return nil, fmt.Errorf("there's no session established with `%s`", peername)
+		}
+		return session.Seal(payload)
+	}
+}
+
+// Opens the sealed message sent by another peer
+// and returns the message it wraps. Messages
+// that cannot be authenticated are rejected and
+// replayed ones are returned along with
+// `noise.ErrReplayed`, so they can be told
+// apart but never delivered twice
+func (peer *Peer) open(response *msg.MsgResponse) (*msg.MsgResponse, error) {
+	session := peer.sessions.get(response.Peername)
+	if session == nil {
+		return nil, fmt.Errorf("there's no session established with `%s`", response.Peername)
+	}
+
+	frame, err := decodeBinary(response.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := session.Open(frame)
+	replayed := errors.Is(err, noise.ErrReplayed)
+	if replayed {
+		plaintext, err = session.Reopen(frame)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var inner msg.MsgResponse
+	if err := msg.Decode(plaintext, &inner); err != nil {
+		return nil, err
+	}
+
+	if inner.Peername != response.Peername {
+		return nil, fmt.Errorf("sealed message from `%s` claims to be sent by `%s`", response.Peername, inner.Peername)
+	}
+
+	inner.Addr = response.Addr
+	if replayed {
+		return &inner, noise.ErrReplayed
+	}
+	return &inner, nil
+}
@@ -0,0 +1,364 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/alvarogf97/fox/pkg/noise"
+	"github.com/stretchr/testify/require"
+)
+
+// Routes every message read from the peer
+// connection until it is closed
+func pump(peer *Peer) {
+	buff := make([]byte, 2048)
+	for {
+		n, addr, err := peer.conn.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+
+		var response msg.MsgResponse
+		if err := msg.Decode(buff[:n], &response); err != nil {
+			continue
+		}
+		response.Addr = addr
+		peer.route(&response)
+	}
+}
+
+// Returns the encoded public key of the given peer
+func identityOf(peer *Peer) string {
+	return msg.EncodeKey(peer.options.identity.Public().(ed25519.PublicKey))
+}
+
+// Creates two encrypted peers that know each
+// other identities and route every message
+// they receive
+func newSecurePeers() (*Peer, *Peer) {
+	options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1).WithEncryption(nil)
+	alice, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", options)
+	bob, _ := NewPeer("bob", "127.0.0.1:60001", "127.0.0.1:50011", options)
+	alice.identities.set("bob", identityOf(bob))
+	bob.identities.set("alice", identityOf(alice))
+	go pump(alice)
+	go pump(bob)
+	return alice, bob
+}
+
+func TestSessionTable(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_session_table_set_get", func(t *testing.T) {
+		table := newSessionTable()
+		session := noise.NewSession(nil, nil)
+
+		table.set("dog", session)
+
+		assert.Equal(session, table.get("dog"))
+		assert.Nil(table.get("cat"))
+	})
+}
+
+func TestIdentityTable(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_identity_table_set_get", func(t *testing.T) {
+		table := newIdentityTable()
+
+		table.set("dog", "key")
+
+		assert.Equal("key", table.get("dog"))
+		assert.Equal("", table.get("cat"))
+	})
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_verify_identity_success", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions().WithEncryption(nil))
+		defer peer.Close()
+		bound := prologue("cat", "dog")
+
+		proof := peer.proveIdentity(bound)
+
+		assert.NoError(verifyIdentity(proof, bound, peer.options.static.Public, identityOf(peer)))
+	})
+
+	t.Run("test_verify_identity_fail_other_handshake", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions().WithEncryption(nil))
+		defer peer.Close()
+
+		proof := peer.proveIdentity(prologue("cat", "dog"))
+
+		assert.Error(verifyIdentity(proof, prologue("fox", "dog"), peer.options.static.Public, identityOf(peer)))
+	})
+
+	t.Run("test_verify_identity_fail_unexpected_key", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions().WithEncryption(nil))
+		defer peer.Close()
+		other, _, _ := ed25519.GenerateKey(nil)
+		bound := prologue("cat", "dog")
+
+		proof := peer.proveIdentity(bound)
+
+		assert.Error(verifyIdentity(proof, bound, peer.options.static.Public, msg.EncodeKey(other)))
+		assert.Error(verifyIdentity(proof, bound, peer.options.static.Public, ""))
+	})
+
+	t.Run("test_verify_identity_fail_invalid_proof", func(t *testing.T) {
+		assert.Error(verifyIdentity([]byte("proof"), prologue("cat", "dog"), nil, "key"))
+	})
+}
+
+func TestHandshakeTable(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_handshake_table_reply", func(t *testing.T) {
+		table := newHandshakeTable()
+		replies := table.open("dog")
+
+		reply := msg.NewMsgResponse(msg.PEER_ACTION_HANDSHAKE_DONE, false, "dog", "")
+		table.reply(&reply)
+
+		assert.Equal(&reply, <-replies)
+	})
+
+	t.Run("test_handshake_table_reply_unknown_peer", func(t *testing.T) {
+		table := newHandshakeTable()
+		replies := table.open("dog")
+
+		reply := msg.NewMsgResponse(msg.PEER_ACTION_HANDSHAKE_DONE, false, "cat", "")
+		table.reply(&reply)
+
+		assert.Empty(replies)
+	})
+
+	t.Run("test_handshake_table_discard", func(t *testing.T) {
+		table := newHandshakeTable()
+		replies := table.open("dog")
+
+		table.discard("dog", replies)
+
+		assert.Empty(table.initiated)
+	})
+
+	t.Run("test_handshake_table_expire", func(t *testing.T) {
+		table := newHandshakeTable()
+		now := time.Now()
+		table.responding["dog"] = &responderHandshake{expires: now.Add(-time.Second)}
+		table.responding["cat"] = &responderHandshake{expires: now.Add(time.Second)}
+
+		table.expire(now)
+
+		assert.NotContains(table.responding, "dog")
+		assert.Contains(table.responding, "cat")
+	})
+}
+
+func TestPeerHandshake(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_handshake_success", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		err := alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr))
+
+		assert.NoError(err)
+		assert.NotNil(alice.sessions.get("bob"))
+		assert.NotNil(bob.sessions.get("alice"))
+	})
+
+	t.Run("test_handshake_forgets_completed_responder", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr)))
+
+		bob.handshakes.Lock()
+		defer bob.handshakes.Unlock()
+		assert.Empty(bob.handshakes.responding)
+		assert.NotEmpty(bob.handshakes.confirmed["alice"])
+	})
+
+	t.Run("test_handshake_confirms_retransmitted_final", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr)))
+
+		// alice missed the confirmation
+		replies := alice.handshakes.open("bob")
+		bob.handshakes.Lock()
+		final := bob.handshakes.confirmed["alice"]
+		bob.handshakes.Unlock()
+		retransmitted := msg.NewMsgResponse(msg.PEER_ACTION_HANDSHAKE_FINAL, false, "alice", encodeBinary(final))
+		retransmitted.Addr = alice.conn.LocalAddr().(*net.UDPAddr)
+
+		bob.handleHandshakeFinal(&retransmitted)
+
+		select {
+		case reply := <-replies:
+			assert.Equal(msg.PEER_ACTION_HANDSHAKE_DONE, reply.Action)
+		case <-time.After(time.Second):
+			assert.Fail("retransmitted final message not confirmed")
+		}
+	})
+
+	t.Run("test_handshake_ignored_while_responding_table_full", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		bob.handshakes.Lock()
+		for i := 0; i < MAX_RESPONDING_HANDSHAKES; i++ {
+			peername := fmt.Sprintf("peer-%d", i)
+			bob.handshakes.responding[peername] = &responderHandshake{expires: time.Now().Add(time.Minute)}
+		}
+		bob.handshakes.Unlock()
+
+		err := alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr))
+
+		assert.Error(err)
+		bob.handshakes.Lock()
+		defer bob.handshakes.Unlock()
+		assert.NotContains(bob.handshakes.responding, "alice")
+	})
+
+	t.Run("test_handshake_fail_timeout", func(t *testing.T) {
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1).WithEncryption(nil)
+		alice, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", options)
+		defer alice.Close()
+
+		// remote peer does not have encryption enabled
+		bob, _ := NewPeer("bob", "127.0.0.1:60001", "127.0.0.1:50011", DefaultPeerOptions())
+		defer bob.Close()
+		go pump(alice)
+		go pump(bob)
+
+		err := alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr))
+
+		assert.Error(err)
+		assert.Nil(alice.sessions.get("bob"))
+	})
+
+	t.Run("test_handshake_fail_impersonation", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		// the stun server registered another key for bob
+		other, _, _ := ed25519.GenerateKey(nil)
+		alice.identities.set("bob", msg.EncodeKey(other))
+
+		err := alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr))
+
+		assert.Error(err)
+		assert.Nil(alice.sessions.get("bob"))
+	})
+
+	t.Run("test_handshake_fail_unknown_initiator", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		// bob has not been introduced to alice
+		bob.identities.set("alice", "")
+
+		err := alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr))
+
+		assert.Error(err)
+		assert.Nil(bob.sessions.get("alice"))
+	})
+
+	t.Run("test_sealed_messages_are_delivered", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		baddr := bob.conn.LocalAddr().(*net.UDPAddr)
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", baddr))
+
+		writer := NewP2PWriter(alice.name, alice.conn, baddr)
+		writer.seal = alice.sealer("bob")
+		_, err := writer.Write("FakeAction", "FakeMessage")
+		assert.NoError(err)
+
+		select {
+		case response := <-bob.messages:
+			assert.Equal("FakeAction", response.Action)
+			assert.Equal("alice", response.Peername)
+			assert.Equal("FakeMessage", response.Message)
+		case <-time.After(time.Second):
+			assert.Fail("sealed message not delivered")
+		}
+	})
+
+	t.Run("test_plaintext_messages_are_dropped", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		writer := NewP2PWriter(alice.name, alice.conn, bob.conn.LocalAddr().(*net.UDPAddr))
+		_, err := writer.Write("FakeAction", "FakeMessage")
+		assert.NoError(err)
+
+		select {
+		case <-bob.messages:
+			assert.Fail("plaintext message delivered")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("test_open_rejects_replayed_messages", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr)))
+
+		inner, _ := json.Marshal(msg.NewMsgRequest("FakeAction", "alice", "FakeMessage"))
+		frame, _ := alice.sealer("bob")(inner)
+		sealed := msg.NewMsgResponse(msg.PEER_ACTION_SEALED, false, "alice", encodeBinary(frame))
+
+		_, err := bob.open(&sealed)
+		assert.NoError(err)
+
+		_, err = bob.open(&sealed)
+		assert.Error(err)
+	})
+
+	t.Run("test_open_rejects_impersonation", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr)))
+
+		inner, _ := json.Marshal(msg.NewMsgRequest("FakeAction", "mallory", "FakeMessage"))
+		frame, _ := alice.sealer("bob")(inner)
+		sealed := msg.NewMsgResponse(msg.PEER_ACTION_SEALED, false, "alice", encodeBinary(frame))
+
+		_, err := bob.open(&sealed)
+		assert.Error(err)
+	})
+
+	t.Run("test_sealer_fail_no_session", func(t *testing.T) {
+		alice, bob := newSecurePeers()
+		defer alice.Close()
+		defer bob.Close()
+
+		_, err := alice.sealer("bob")([]byte("FakeMessage"))
+		assert.Error(err)
+	})
+}
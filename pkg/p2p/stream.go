@@ -0,0 +1,153 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+const (
+	// Max number of bytes carried by a stream
+	// message, larger writes are split
+	STREAM_CHUNK_SIZE = 1024
+)
+
+// Byte stream with another peer that implements
+// `net.Conn`. It is carried by a channel so writes
+// are delivered reliably, in order and no faster
+// than the remote peer reads them
+type streamConn struct {
+	channel *Channel
+	laddr   net.Addr
+	reading sync.Mutex
+	buffer  bytes.Buffer
+	writing sync.Mutex
+}
+
+// Reads the bytes received from the remote peer.
+// It blocks until there's something to read, the
+// stream is closed or the read deadline is exceeded
+func (conn *streamConn) Read(b []byte) (int, error) {
+	conn.reading.Lock()
+	defer conn.reading.Unlock()
+
+	for conn.buffer.Len() == 0 {
+		response, err := conn.channel.Listen()
+		if err != nil {
+			return 0, err
+		}
+
+		// anything but stream data is ignored
+		if response.Action == msg.PEER_ACTION_STREAM_DATA {
+			conn.buffer.Write(response.Body)
+		}
+	}
+	return conn.buffer.Read(b)
+}
+
+// Writes the given bytes into the stream. They
+// are split into chunks delivered reliably to the
+// remote peer, blocking while he has no room
+// for them
+func (conn *streamConn) Write(b []byte) (int, error) {
+	conn.writing.Lock()
+	defer conn.writing.Unlock()
+
+	written := 0
+	for written < len(b) {
+		end := written + STREAM_CHUNK_SIZE
+		if end > len(b) {
+			end = len(b)
+		}
+
+		if _, err := conn.channel.WriteBody(msg.PEER_ACTION_STREAM_DATA, b[written:end], nil); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Closes the stream, the remote peer reads
+// the pending bytes and then `io.EOF`
+func (conn *streamConn) Close() error {
+	return conn.channel.Close()
+}
+
+// Returns the local address of the peer
+func (conn *streamConn) LocalAddr() net.Addr {
+	return conn.laddr
+}
+
+// Returns the address of the remote peer
+func (conn *streamConn) RemoteAddr() net.Addr {
+	return conn.channel.writer.paddr
+}
+
+// Sets both read and write deadlines
+func (conn *streamConn) SetDeadline(t time.Time) error {
+	conn.channel.Lock()
+	defer conn.channel.Unlock()
+
+	conn.channel.readDeadline = t
+	conn.channel.writeDeadline = t
+	conn.channel.signal()
+	return nil
+}
+
+// Sets the deadline for the pending and
+// following reads
+func (conn *streamConn) SetReadDeadline(t time.Time) error {
+	conn.channel.Lock()
+	defer conn.channel.Unlock()
+
+	conn.channel.readDeadline = t
+	conn.channel.signal()
+	return nil
+}
+
+// Sets the deadline for the pending and
+// following writes
+func (conn *streamConn) SetWriteDeadline(t time.Time) error {
+	conn.channel.Lock()
+	defer conn.channel.Unlock()
+
+	conn.channel.writeDeadline = t
+	conn.channel.signal()
+	return nil
+}
+
+// Connects to the given peer and opens a byte
+// stream with him that can be used as any other
+// `net.Conn`. The remote peer gets the stream
+// through `Accept`
+func (peer *Peer) Dial(ctx context.Context, peername string) (net.Conn, error) {
+	writer, err := peer.Connect(ctx, peername)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := writer.openChannel(msg.PEER_ACTION_STREAM_OPEN)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{channel: channel, laddr: peer.conn.LocalAddr()}, nil
+}
+
+// Waits for the next stream opened by another
+// peer. It fails once the peer is closed
+func (peer *Peer) Accept() (net.Conn, error) {
+	if !peer.isInitialized() {
+		return nil, ErrNotInitialized
+	}
+
+	channel, err := peer.channels.accept(peer.channels.streams)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{channel: channel, laddr: peer.conn.LocalAddr()}, nil
+}
@@ -0,0 +1,289 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates two initialized peers that collect and
+// dispatch every message they receive so large
+// messages are reassembled
+func newStreamPeers(options PeerOptions) (*Peer, *Peer) {
+	alice, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", options)
+	bob, _ := NewPeer("bob", "127.0.0.1:60001", "127.0.0.1:50011", options)
+	alice.identities.set("bob", identityOf(bob))
+	bob.identities.set("alice", identityOf(alice))
+	for _, peer := range []*Peer{alice, bob} {
+		peer.initialized = true
+		go peer.client.Collect()
+		go peer.dispatch()
+	}
+	return alice, bob
+}
+
+// Opens a stream from alice to bob as `Dial`
+// does once both peers are connected
+func openStream(alice *Peer, bob *Peer) (net.Conn, error) {
+	writer, _ := alice.reliableWriterTo(bob.name, bob.conn.LocalAddr().(*net.UDPAddr))
+	channel, err := writer.openChannel(msg.PEER_ACTION_STREAM_OPEN)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{channel: channel, laddr: alice.conn.LocalAddr()}, nil
+}
+
+// Creates a stream carried by a mocked channel
+func newMockedStream() (*streamConn, *reliableSender) {
+	channel, sender := newMockedChannel()
+	return &streamConn{channel: channel, laddr: &net.UDPAddr{}}, sender
+}
+
+// Queues the given bytes into the stream
+// as if the remote peer wrote them
+func receiveStream(conn *streamConn, data []byte) {
+	response := newChannelMessage(conn.channel.Id(), msg.PEER_ACTION_STREAM_DATA, "")
+	response.Body = data
+	conn.channel.receive(response)
+}
+
+func TestStreamConn(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_stream_read_received_bytes", func(t *testing.T) {
+		conn, _ := newMockedStream()
+		receiveStream(conn, []byte("hello"))
+		buff := make([]byte, 16)
+
+		n, err := conn.Read(buff)
+
+		assert.NoError(err)
+		assert.Equal("hello", string(buff[:n]))
+	})
+
+	t.Run("test_stream_read_keeps_unread_bytes", func(t *testing.T) {
+		conn, _ := newMockedStream()
+		receiveStream(conn, []byte("hello"))
+		buff := make([]byte, 2)
+
+		conn.Read(buff)
+		n, err := conn.Read(buff)
+
+		assert.NoError(err)
+		assert.Equal("ll", string(buff[:n]))
+	})
+
+	t.Run("test_stream_read_waits_for_bytes", func(t *testing.T) {
+		conn, _ := newMockedStream()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			receiveStream(conn, []byte("hello"))
+		}()
+		buff := make([]byte, 16)
+
+		n, err := conn.Read(buff)
+
+		assert.NoError(err)
+		assert.Equal("hello", string(buff[:n]))
+	})
+
+	t.Run("test_stream_read_eof_once_drained", func(t *testing.T) {
+		conn, _ := newMockedStream()
+		receiveStream(conn, []byte("hello"))
+		conn.channel.finish()
+
+		data, err := io.ReadAll(conn)
+
+		assert.NoError(err)
+		assert.Equal("hello", string(data))
+	})
+
+	t.Run("test_stream_read_deadline", func(t *testing.T) {
+		conn, _ := newMockedStream()
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+		_, err := conn.Read(make([]byte, 1))
+
+		netErr, ok := err.(net.Error)
+		assert.True(ok)
+		assert.True(netErr.Timeout())
+	})
+
+	t.Run("test_stream_read_deadline_wakes_pending_read", func(t *testing.T) {
+		conn, _ := newMockedStream()
+		result := make(chan error)
+		go func() {
+			_, err := conn.Read(make([]byte, 1))
+			result <- err
+		}()
+
+		conn.SetDeadline(time.Now())
+
+		select {
+		case err := <-result:
+			assert.Error(err)
+		case <-time.After(2 * time.Second):
+			assert.Fail("pending read not woken up")
+		}
+	})
+
+	t.Run("test_stream_write_splits_chunks", func(t *testing.T) {
+		conn, sender := newMockedStream()
+		data := make([]byte, 2*STREAM_CHUNK_SIZE+1)
+
+		n, err := conn.Write(data)
+
+		assert.NoError(err)
+		assert.Equal(len(data), n)
+		assert.Equal(uint64(3), sender.next)
+	})
+
+	t.Run("test_stream_write_deadline_exceeded", func(t *testing.T) {
+		conn, sender := newMockedStream()
+		conn.SetWriteDeadline(time.Now().Add(-time.Second))
+
+		_, err := conn.Write([]byte("hello"))
+
+		netErr, ok := err.(net.Error)
+		assert.True(ok)
+		assert.True(netErr.Timeout())
+		assert.Equal(uint64(0), sender.next)
+	})
+
+	t.Run("test_stream_write_fail_finished", func(t *testing.T) {
+		conn, _ := newMockedStream()
+		conn.channel.finish()
+
+		_, err := conn.Write([]byte("hello"))
+
+		assert.ErrorIs(err, io.ErrClosedPipe)
+	})
+
+	t.Run("test_stream_close", func(t *testing.T) {
+		conn, _ := newMockedStream()
+
+		assert.NoError(conn.Close())
+
+		_, err := conn.Read(make([]byte, 1))
+		assert.ErrorIs(err, net.ErrClosed)
+		_, err = conn.Write([]byte("hello"))
+		assert.ErrorIs(err, net.ErrClosed)
+		assert.Error(conn.Close())
+	})
+}
+
+func TestPeerStream(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_stream_exchange_bytes", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1))
+		defer alice.Close()
+		defer bob.Close()
+
+		dialed, err := openStream(alice, bob)
+		assert.NoError(err)
+
+		accepted, err := bob.Accept()
+		assert.NoError(err)
+		assert.Equal(alice.conn.LocalAddr().String(), accepted.RemoteAddr().String())
+		assert.Equal(bob.conn.LocalAddr().String(), accepted.LocalAddr().String())
+
+		// more chunks than the channel window
+		// so the writer waits for credits
+		data := bytes.Repeat([]byte("fox"), 4*CHANNEL_WINDOW_SIZE*STREAM_CHUNK_SIZE/3)
+		go func() {
+			dialed.Write(data)
+			dialed.Close()
+		}()
+
+		accepted.SetReadDeadline(time.Now().Add(10 * time.Second))
+		received, err := io.ReadAll(accepted)
+		assert.NoError(err)
+		assert.Equal(data, received)
+	})
+
+	t.Run("test_stream_gob_round_trip", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1).WithEncryption(nil))
+		defer alice.Close()
+		defer bob.Close()
+
+		assert.NoError(alice.handshake(timeoutContext(t, alice.options.timeout), "bob", bob.conn.LocalAddr().(*net.UDPAddr)))
+		dialed, err := openStream(alice, bob)
+		assert.NoError(err)
+		accepted, err := bob.Accept()
+		assert.NoError(err)
+
+		type greeting struct {
+			From string
+			Body []byte
+		}
+
+		// bob echoes every greeting he decodes
+		go func() {
+			decoder := gob.NewDecoder(accepted)
+			encoder := gob.NewEncoder(accepted)
+			for {
+				var received greeting
+				if err := decoder.Decode(&received); err != nil {
+					return
+				}
+				encoder.Encode(received)
+			}
+		}()
+
+		sent := greeting{From: "alice", Body: bytes.Repeat([]byte{0, 1, 2}, 1000)}
+		assert.NoError(gob.NewEncoder(dialed).Encode(sent))
+
+		var echoed greeting
+		dialed.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.NoError(gob.NewDecoder(dialed).Decode(&echoed))
+		assert.Equal(sent, echoed)
+	})
+
+	t.Run("test_stream_not_accepted_as_channel", func(t *testing.T) {
+		alice, bob := newStreamPeers(NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1))
+		defer alice.Close()
+		defer bob.Close()
+
+		openStream(alice, bob)
+		bob.Accept()
+
+		assert.Empty(bob.channels.accepts)
+	})
+
+	t.Run("test_stream_accept_fail_closed", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		peer.initialized = true
+		peer.Close()
+
+		_, err := peer.Accept()
+
+		assert.ErrorIs(err, net.ErrClosed)
+	})
+
+	t.Run("test_stream_accept_fail_not_initialized", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+
+		_, err := peer.Accept()
+
+		assert.True(errors.Is(err, ErrNotInitialized))
+	})
+
+	t.Run("test_stream_dial_fail_not_initialized", func(t *testing.T) {
+		peer, _ := NewPeer("dog", "127.0.0.1:60001", "127.0.0.1:50010", DefaultPeerOptions())
+		defer peer.Close()
+
+		_, err := peer.Dial(context.Background(), "cat")
+
+		assert.True(errors.Is(err, ErrNotInitialized))
+	})
+}
@@ -1,8 +1,11 @@
 package p2p
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
 )
@@ -12,26 +15,198 @@ type P2PConn interface {
 	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
 }
 
-// P2P message writer
+// P2P message writer. Messages are written
+// as single datagrams unless the writer is
+// reliable, see `Reliable`
 type P2PWriter struct {
-	name    string
-	conn    P2PConn
-	paddr   *net.UDPAddr
-	marshal func(v interface{}) ([]byte, error)
+	name     string
+	conn     P2PConn
+	paddr    *net.UDPAddr
+	marshal  func(v interface{}) ([]byte, error)
+	seal     func(payload []byte) ([]byte, error)
+	reliable bool
+	sender   *reliableSender
+	peername string
+	channels *channelTable
+	sent     *fragmentTable
 }
 
 // Writes the MsgRequest into the P2P connection
 func (writer P2PWriter) Write(action string, message string) (int, error) {
-	messageRequest := msg.NewMsgRequest(
+	return writer.write(msg.NewMsgRequest(
 		action,
 		writer.name,
 		message,
-	)
-	request, err := writer.marshal(messageRequest)
+	))
+}
+
+// Writes the MsgRequest carrying the given binary
+// body and headers into the P2P connection
+func (writer P2PWriter) WriteBody(action string, body []byte, headers map[string]string) (int, error) {
+	return writer.write(msg.NewMsgRequestBody(
+		action,
+		writer.name,
+		body,
+		headers,
+	))
+}
+
+// Writes the MsgRequest into the P2P connection
+// making sure it is delivered in order. Lost
+// messages are retransmitted until the remote
+// peer acknowledges them
+func (writer P2PWriter) WriteReliable(action string, message string) (int, error) {
+	return writer.writeReliable(msg.NewMsgRequest(
+		action,
+		writer.name,
+		message,
+	))
+}
+
+// Same as `WriteReliable` but the MsgRequest
+// carries the given binary body and headers
+func (writer P2PWriter) WriteBodyReliable(action string, body []byte, headers map[string]string) (int, error) {
+	return writer.writeReliable(msg.NewMsgRequestBody(
+		action,
+		writer.name,
+		body,
+		headers,
+	))
+}
+
+// Writes the given request reliably
+// if the writer is reliable
+func (writer P2PWriter) write(request msg.MsgRequest) (int, error) {
+	if writer.reliable {
+		return writer.writeReliable(request)
+	}
+	return writer.send(request)
+}
+
+// Writes the given request reliably
+func (writer P2PWriter) writeReliable(request msg.MsgRequest) (int, error) {
+	if writer.sender == nil {
+		return 0, fmt.Errorf("writer does not support reliable delivery")
+	}
+	return writer.sender.push(request)
+}
+
+// Returns a copy of the writer whose every message
+// is written with `WriteReliable` or `WriteBodyReliable`
+func (writer P2PWriter) Reliable() *P2PWriter {
+	writer.reliable = true
+	return &writer
+}
+
+// Serializes the given request and writes it
+// into the P2P connection
+func (writer P2PWriter) send(request msg.MsgRequest) (int, error) {
+	datagrams, err := writer.datagrams(request)
 	if err != nil {
 		return 0, err
 	}
-	return writer.conn.WriteToUDP(request, writer.paddr)
+	return writer.transmit(datagrams)
+}
+
+// Serializes the given request into the datagrams
+// that carry it, i.e. his fragments if it does not
+// fit into a single one. The request is sealed
+// first if the writer seals his messages
+func (writer P2PWriter) datagrams(request msg.MsgRequest) ([][]byte, error) {
+	payload, err := writer.marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// wraps the request into a sealed one
+	// so only the connected peer can read it
+	if writer.seal != nil {
+		frame, err := writer.seal(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		payload, err = writer.marshal(msg.NewMsgRequest(
+			msg.PEER_ACTION_SEALED,
+			writer.name,
+			encodeBinary(frame),
+		))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(payload) > msg.MAX_DATAGRAM_SIZE {
+		return writer.fragment(payload)
+	}
+	return [][]byte{payload}, nil
+}
+
+// Splits the given serialized message into
+// the datagrams of his fragments
+func (writer P2PWriter) fragment(payload []byte) ([][]byte, error) {
+	id, err := newFragmentId()
+	if err != nil {
+		return nil, err
+	}
+
+	fragments, err := msg.SplitMessage(id, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	datagrams := make([][]byte, 0, len(fragments))
+	for _, fragment := range fragments {
+		serialized, err := writer.marshal(fragment)
+		if err != nil {
+			return nil, err
+		}
+
+		datagram, err := writer.marshal(msg.NewMsgRequest(
+			msg.PEER_ACTION_FRAGMENT,
+			writer.name,
+			string(serialized),
+		))
+		if err != nil {
+			return nil, err
+		}
+		datagrams = append(datagrams, datagram)
+	}
+
+	// keeps the fragments so the ones lost
+	// can be asked for by the receiver
+	if writer.sent != nil {
+		writer.sent.keep(id, datagrams, writer.paddr, time.Now())
+	}
+	return datagrams, nil
+}
+
+// Writes every given datagram into the P2P
+// connection, pausing `FRAGMENT_PACING` after
+// every `FRAGMENT_BURST` of them
+func (writer P2PWriter) transmit(datagrams [][]byte) (int, error) {
+	written := 0
+	for i, datagram := range datagrams {
+		if i > 0 && i%FRAGMENT_BURST == 0 {
+			time.Sleep(FRAGMENT_PACING)
+		}
+
+		n, err := writer.conn.WriteToUDP(datagram, writer.paddr)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Generates a random fragment id
+func newFragmentId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
 }
 
 // Creates a new P2P writer
@@ -40,6 +215,6 @@ func NewP2PWriter(name string, conn P2PConn, paddr *net.UDPAddr) *P2PWriter {
 		name:    name,
 		conn:    conn,
 		paddr:   paddr,
-		marshal: json.Marshal,
+		marshal: msg.NewEncoder(msg.BinaryCodec{}),
 	}
 }
@@ -1,10 +1,11 @@
 package p2p
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
 	"github.com/stretchr/testify/require"
@@ -17,7 +18,7 @@ func TestP2PWriter(t *testing.T) {
 		name := "fakeP2PWriter"
 		port := "50000"
 		addr, _ := net.ResolveUDPAddr("udp4", port)
-		p2pConn := P2PConnMock{P2PWriteToUDPMock{}}
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
 
 		writer := NewP2PWriter(name, &p2pConn, addr)
 
@@ -32,20 +33,215 @@ func TestP2PWriter(t *testing.T) {
 		addr, _ := net.ResolveUDPAddr("udp4", port)
 
 		returnSend := 5
-		expectedBytes, _ := json.Marshal(msg.NewMsgRequest(
+		expectedBytes, _ := msg.Encode(msg.BinaryCodec{}, msg.NewMsgRequest(
 			action,
 			name,
 			message,
 		))
-		p2pConn := P2PConnMock{P2PWriteToUDPMock{send: returnSend}}
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{send: returnSend}}
 
 		writer := NewP2PWriter(name, &p2pConn, addr)
 
 		send, err := writer.Write(action, message)
 		assert.NoError(err)
 		assert.Equal(returnSend, send)
-		assert.Equal(expectedBytes, p2pConn.writeToUDPMock.b)
-		assert.Equal(addr, p2pConn.writeToUDPMock.addr)
+		assert.Equal(expectedBytes, p2pConn.written().b)
+		assert.Equal(addr, p2pConn.written().addr)
+	})
+
+	t.Run("test_write_sealed", func(t *testing.T) {
+		action := "FakeAction"
+		message := "FakeMessage"
+		name := "fakeP2PWriter"
+		port := "50000"
+		addr, _ := net.ResolveUDPAddr("udp4", port)
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+
+		writer := NewP2PWriter(name, &p2pConn, addr)
+		writer.seal = func(payload []byte) ([]byte, error) {
+			return []byte("sealed"), nil
+		}
+
+		_, err := writer.Write(action, message)
+		assert.NoError(err)
+
+		var request msg.MsgRequest
+		msg.Decode(p2pConn.written().b, &request)
+		assert.Equal(msg.PEER_ACTION_SEALED, request.Action)
+		assert.Equal(name, request.Peername)
+		assert.Equal(encodeBinary([]byte("sealed")), request.Message)
+	})
+
+	t.Run("test_write_fail_seal", func(t *testing.T) {
+		expectedError := fmt.Errorf("Fail")
+		name := "fakeP2PWriter"
+		port := "50000"
+		addr, _ := net.ResolveUDPAddr("udp4", port)
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+
+		writer := NewP2PWriter(name, &p2pConn, addr)
+		writer.seal = func(payload []byte) ([]byte, error) {
+			return nil, expectedError
+		}
+
+		_, err := writer.Write("FakeAction", "FakeMessage")
+		assert.Equal(expectedError, err)
+	})
+
+	t.Run("test_write_body_success", func(t *testing.T) {
+		name := "fakeP2PWriter"
+		addr, _ := net.ResolveUDPAddr("udp4", "50000")
+		body := []byte{0, 1, 255}
+		headers := map[string]string{msg.HEADER_CONTENT_TYPE: "application/octet-stream"}
+		expectedBytes, _ := msg.Encode(msg.BinaryCodec{}, msg.NewMsgRequestBody("FakeAction", name, body, headers))
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+
+		writer := NewP2PWriter(name, &p2pConn, addr)
+
+		_, err := writer.WriteBody("FakeAction", body, headers)
+		assert.NoError(err)
+		assert.Equal(expectedBytes, p2pConn.written().b)
+	})
+
+	t.Run("test_write_body_reliable", func(t *testing.T) {
+		name := "fakeP2PWriter"
+		addr, _ := net.ResolveUDPAddr("udp4", "50000")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+
+		writer := NewP2PWriter(name, &p2pConn, addr)
+		_, err := writer.WriteBodyReliable("FakeAction", []byte{0}, nil)
+		assert.Error(err)
+
+		writer.sender, _ = newReliableSender(writer)
+		_, err = writer.Reliable().WriteBody("FakeAction", []byte{0}, nil)
+		assert.NoError(err)
+
+		var request msg.MsgRequest
+		msg.Decode(p2pConn.written().b, &request)
+		assert.Equal(msg.PEER_ACTION_RELIABLE, request.Action)
+	})
+
+	t.Run("test_write_reliable_fail_unsupported", func(t *testing.T) {
+		name := "fakeP2PWriter"
+		addr, _ := net.ResolveUDPAddr("udp4", "50000")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+
+		writer := NewP2PWriter(name, &p2pConn, addr)
+
+		_, err := writer.WriteReliable("FakeAction", "FakeMessage")
+		assert.Error(err)
+
+		_, err = writer.Reliable().Write("FakeAction", "FakeMessage")
+		assert.Error(err)
+	})
+
+	t.Run("test_reliable_writer", func(t *testing.T) {
+		name := "fakeP2PWriter"
+		addr, _ := net.ResolveUDPAddr("udp4", "50000")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+
+		writer := NewP2PWriter(name, &p2pConn, addr)
+		reliable := writer.Reliable()
+
+		assert.True(reliable.reliable)
+		assert.False(writer.reliable)
+	})
+
+	t.Run("test_write_large_message_in_fragments", func(t *testing.T) {
+		name := "fakeP2PWriter"
+		addr, _ := net.ResolveUDPAddr("udp4", "50000")
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
+
+		writer := NewP2PWriter(name, &p2pConn, addr)
+
+		_, err := writer.Write("FakeAction", strings.Repeat("a", 4*msg.MAX_DATAGRAM_SIZE))
+		assert.NoError(err)
+
+		var request msg.MsgRequest
+		var fragment msg.MsgFragment
+		msg.Decode(p2pConn.written().b, &request)
+		msg.Decode([]byte(request.Message), &fragment)
+
+		assert.LessOrEqual(len(p2pConn.written().b), msg.MAX_DATAGRAM_SIZE)
+		assert.Equal(msg.PEER_ACTION_FRAGMENT, request.Action)
+		assert.Equal(name, request.Peername)
+		assert.Equal(fragment.Count-1, fragment.Index)
+	})
+
+	t.Run("test_write_large_message_is_reassembled", func(t *testing.T) {
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1)
+		alice, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", options)
+		bob, _ := NewPeer("bob", "127.0.0.1:60001", "127.0.0.1:50011", options)
+		defer alice.Close()
+		defer bob.Close()
+		bob.client.Collect()
+		go bob.dispatch()
+
+		message := strings.Repeat("guau", 16*1024)
+		writer := NewP2PWriter(alice.name, alice.conn, bob.conn.LocalAddr().(*net.UDPAddr))
+		_, err := writer.Write("FakeAction", message)
+		assert.NoError(err)
+
+		select {
+		case response := <-bob.messages:
+			assert.Equal("FakeAction", response.Action)
+			assert.Equal(message, response.Message)
+		case <-time.After(2 * time.Second):
+			assert.Fail("large message not delivered")
+		}
+	})
+
+	t.Run("test_write_huge_message_is_reassembled", func(t *testing.T) {
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1)
+		alice, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", options)
+		bob, _ := NewPeer("bob", "127.0.0.1:60001", "127.0.0.1:50011", options)
+		defer alice.Close()
+		defer bob.Close()
+		alice.client.Collect()
+		go alice.dispatch()
+		bob.client.Collect()
+		go bob.dispatch()
+
+		message := strings.Repeat("guau", 50*1024)
+		writer := alice.newWriter(bob.conn.LocalAddr().(*net.UDPAddr))
+		_, err := writer.Write("FakeAction", message)
+		assert.NoError(err)
+
+		select {
+		case response := <-bob.messages:
+			assert.Equal(message, response.Message)
+		case <-time.After(2 * time.Second):
+			assert.Fail("huge message not delivered")
+		}
+	})
+
+	t.Run("test_write_huge_message_recovers_lost_fragments", func(t *testing.T) {
+		options := NewPeerOptions(DEFAULT_MAX_MSG_IN_QUEUE, 1)
+		alice, _ := NewPeer("alice", "127.0.0.1:60001", "127.0.0.1:50010", options)
+		bob, _ := NewPeer("bob", "127.0.0.1:60001", "127.0.0.1:50011", options)
+		defer alice.Close()
+		defer bob.Close()
+		alice.client.Collect()
+		go alice.dispatch()
+		bob.client.Collect()
+		go bob.dispatch()
+
+		// every fifth fragment and the last
+		// ones are lost the first time
+		message := strings.Repeat("guau", 50*1024)
+		writer := alice.newWriter(bob.conn.LocalAddr().(*net.UDPAddr))
+		lossy := &LossyConnMock{conn: alice.conn, drop: func(i int) bool { return i%5 == 0 || i > 250 }}
+		writer.conn = lossy
+		_, err := writer.Write("FakeAction", message)
+		assert.NoError(err)
+		assert.Greater(lossy.dropped(), msg.MAX_FRAGMENT_NACK_SIZE/2)
+
+		select {
+		case response := <-bob.messages:
+			assert.Equal(message, response.Message)
+		case <-time.After(2 * time.Second):
+			assert.Fail("lost fragments not recovered")
+		}
 	})
 
 	t.Run("test_write_fail_marshal", func(t *testing.T) {
@@ -55,7 +251,7 @@ func TestP2PWriter(t *testing.T) {
 		name := "fakeP2PWriter"
 		port := "50000"
 		addr, _ := net.ResolveUDPAddr("udp4", port)
-		p2pConn := P2PConnMock{P2PWriteToUDPMock{}}
+		p2pConn := P2PConnMock{writeToUDPMock: P2PWriteToUDPMock{}}
 
 		writer := NewP2PWriter(name, &p2pConn, addr)
 		writer.marshal = FailMarshal(expectedError)
@@ -1,10 +1,15 @@
 package stun
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
@@ -20,27 +25,244 @@ type UDPStunConn interface {
 // Interface for Stun client
 type StunClient interface {
 	Collect() error
-	Request(peername string, action string, message string, timeout int) (*msg.MsgResponse, error)
+	Request(ctx context.Context, peername string, action string, message string) (*msg.MsgResponse, error)
 	Listen() *msg.MsgResponse
 }
 
+// Stun client whose incoming messages can
+// be waited for along with other events
+type MessageSource interface {
+	Messages() <-chan *msg.MsgResponse
+}
+
+// Requests waiting for their response
+// indexed by the request id
+type pendingRequests struct {
+	sync.Mutex
+	requests map[string]chan *msg.MsgResponse
+}
+
+// Opens a new pending request with the given id
+// and returns the channel where his response
+// will be delivered
+func (pending *pendingRequests) open(id string) chan *msg.MsgResponse {
+	pending.Lock()
+	defer pending.Unlock()
+
+	ch := make(chan *msg.MsgResponse, 1)
+	pending.requests[id] = ch
+	return ch
+}
+
+// Delivers the given response to the request
+// it belongs. It returns false if there's no
+// request waiting for it
+func (pending *pendingRequests) resolve(response *msg.MsgResponse) bool {
+	pending.Lock()
+	defer pending.Unlock()
+
+	ch, exists := pending.requests[response.Id]
+	if !exists {
+		return false
+	}
+	delete(pending.requests, response.Id)
+	ch <- response
+	return true
+}
+
+// Discards the request with the given id
+// so late responses will be ignored
+func (pending *pendingRequests) discard(id string) {
+	pending.Lock()
+	delete(pending.requests, id)
+	pending.Unlock()
+}
+
+// Creates a new pending requests table
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{requests: map[string]chan *msg.MsgResponse{}}
+}
+
+// Generates a random request id
+func newRequestId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Returns whether the given action can
+// be requested to the stun server
+func isStunAction(action string) bool {
+	switch action {
+	case msg.STUN_ACTION_NEW, msg.STUN_ACTION_GET, msg.STUN_ACTION_DISCONNECT, msg.STUN_ACTION_REFRESH, msg.STUN_ACTION_PROBE,
+		msg.STUN_ACTION_WATCH, msg.STUN_ACTION_UNWATCH, msg.STUN_ACTION_LIST:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns whether the given action changes the
+// registration of the peer, or what he watches,
+// so it is sent to every server with
+// `SERVER_STRATEGY_ALL`
+func isRegistrationAction(action string) bool {
+	switch action {
+	case msg.STUN_ACTION_NEW, msg.STUN_ACTION_DISCONNECT, msg.STUN_ACTION_REFRESH, msg.STUN_ACTION_WATCH, msg.STUN_ACTION_UNWATCH:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns whether the given action is bound to
+// the session of the peer, so it is only sent to
+// the servers holding his registration
+func isSessionAction(action string) bool {
+	return action != msg.STUN_ACTION_NEW && action != msg.STUN_ACTION_PROBE
+}
+
+// Session tokens issued by the stun
+// servers to the client peer
+type session struct {
+	sync.RWMutex
+	tokens map[string]string
+}
+
+// Returns the session token issued by the given
+// server. Tokens are never sent to servers that
+// did not issue them, not even to standbys
+func (session *session) get(server *net.UDPAddr) string {
+	session.RLock()
+	defer session.RUnlock()
+	return session.tokens[server.String()]
+}
+
+// Replaces the session token issued by
+// the given server, empty ones are forgotten
+func (session *session) set(server *net.UDPAddr, token string) {
+	session.Lock()
+	defer session.Unlock()
+
+	if token == "" {
+		delete(session.tokens, server.String())
+		return
+	}
+	session.tokens[server.String()] = token
+}
+
+// Forgets every session token
+func (session *session) clear() {
+	session.Lock()
+	session.tokens = map[string]string{}
+	session.Unlock()
+}
+
+// Returns the given servers that issued a
+// token, i.e. the ones holding the registration
+// of the peer, keeping their order. Every server
+// is returned if none of them issued one
+func (session *session) holders(servers []*net.UDPAddr) []*net.UDPAddr {
+	session.RLock()
+	defer session.RUnlock()
+
+	holders := []*net.UDPAddr{}
+	for _, server := range servers {
+		if _, exists := session.tokens[server.String()]; exists {
+			holders = append(holders, server)
+		}
+	}
+	if len(holders) == 0 {
+		return servers
+	}
+	return holders
+}
+
+// Creates a new session without tokens
+func newSession() *session {
+	return &session{tokens: map[string]string{}}
+}
+
+// Returns whether a request that failed with the
+// given error can be sent to the next server,
+// i.e. the server is down or is a standby
+func isFailover(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrStandby)
+}
+
+// Returns the context an attempt to reach one of
+// the given number of remaining servers is bounded
+// by. The time left is split among them, so every
+// server gets his chance before the deadline
+func attemptContext(ctx context.Context, remaining int) (context.Context, context.CancelFunc) {
+	deadline, bounded := ctx.Deadline()
+	if !bounded || remaining <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(remaining))
+}
+
 // Default stun client that handles stun
 // server comunication in the easiest possible way.
+// The session token issued on registration is
+// attached to every request transparently and
+// requests are signed with the client identity
+// if there's one in the options. Requests fail
+// over to the fallback servers, if any, when
+// the current one does not answer, and the
+// health of every server is kept up to date
 type DefaultStunClient struct {
-	conn           UDPStunConn
-	addr           *net.UDPAddr
-	requests       chan *msg.MsgResponse
-	registrations  chan *msg.MsgResponse
-	disconnections chan *msg.MsgResponse
-	peerMsgs       chan *msg.MsgResponse
-	isListening    bool
-	options        ClientStunOptions
+	conn      UDPStunConn
+	servers   *serverList
+	pending   *pendingRequests
+	session   *session
+	fragments *reassembler
+	peerMsgs  chan *msg.MsgResponse
+	listening *listenState
+	options   ClientStunOptions
 
 	// marshaller
 	marshal   func(v interface{}) ([]byte, error)
 	unmarshal func(data []byte, v interface{}) error
 }
 
+// Whether the goroutine that collects the
+// responses is running, shared by every
+// copy of the client
+type listenState struct {
+	sync.Mutex
+	listening bool
+}
+
+// Marks the goroutine as running. Returns
+// false if it was already running
+func (state *listenState) start() bool {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.listening {
+		return false
+	}
+	state.listening = true
+	return true
+}
+
+// Marks the goroutine as stopped
+func (state *listenState) stop() {
+	state.Lock()
+	state.listening = false
+	state.Unlock()
+}
+
+// Checks the goroutine is running
+func (state *listenState) isListening() bool {
+	state.Lock()
+	defer state.Unlock()
+	return state.listening
+}
+
 // Logs the given messages only if logging
 // is enabled for the stun
 func (client DefaultStunClient) log(v ...interface{}) {
@@ -49,87 +271,245 @@ func (client DefaultStunClient) log(v ...interface{}) {
 	}
 }
 
-// Reads message from the given channel
-// without blocking forever due to the
-// given timeout in seconds
-func (client DefaultStunClient) readChannelWithTimeout(ch chan *msg.MsgResponse, timeout int) (*msg.MsgResponse, error) {
+// Reads message from the given channel until
+// the given context is done. Expired contexts
+// return `ErrTimeout`
+func (client DefaultStunClient) readChannel(ctx context.Context, ch chan *msg.MsgResponse) (*msg.MsgResponse, error) {
 	select {
 	case response := <-ch:
 		return response, nil
-	case <-time.After(time.Duration(timeout) * time.Second):
-		return nil, fmt.Errorf("timeout")
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
 	}
 }
 
-// Returns the channel that handles the given action,
-// If there's no channel that handles it, and error
-// will be returned
-func (client DefaultStunClient) getActionChannel(action string) (chan *msg.MsgResponse, error) {
-	switch action {
-	case msg.STUN_ACTION_NEW, msg.PEER_ACTION_NEW:
-		return client.registrations, nil
-	case msg.STUN_ACTION_GET, msg.PEER_ACTION_GET:
-		return client.requests, nil
-	case msg.STUN_ACTION_DISCONNECT, msg.PEER_ACTION_DISCONNECT:
-		return client.disconnections, nil
-	default:
-		return nil, fmt.Errorf("unrecognized Stun action `%s`", action)
+// Handles the given datagram read from the given
+// address and returns whether the client must stop
+// listening. Fragments are kept until the whole
+// message arrives, which is handled afterwards
+func (client *DefaultStunClient) process(data []byte, addr *net.UDPAddr, reassembled bool) bool {
+	var response msg.MsgResponse
+	if err := client.unmarshal(data, &response); err != nil {
+		client.log("Unmarshal server response failed ", err)
+		return false
+	}
+	response.Addr = addr
+
+	if response.Id == "" && response.Action == msg.PEER_ACTION_FRAGMENT {
+		// fragments cannot be nested
+		if reassembled {
+			return false
+		}
+
+		var fragment msg.MsgFragment
+		if err := client.unmarshal([]byte(response.Message), &fragment); err != nil {
+			client.log("Unmarshal fragment failed ", err)
+			return false
+		}
+
+		message, err := client.fragments.add(addr, fragment, time.Now())
+		if err != nil {
+			client.log("Discarding fragment ", err)
+			return false
+		}
+
+		if message == nil {
+			return false
+		}
+		return client.process(message, addr, true)
 	}
+
+	// Messages without id do not answer any
+	// request so they belong to the peer
+	if response.Id == "" {
+		client.peerMsgs <- &response
+		return false
+	}
+
+	// Delivers the response to the request it belongs
+	if !client.pending.resolve(&response) {
+		client.log("Discarding stale response ", response.Id)
+		return false
+	}
+
+	// exit goroutine if disconnect from the P2P network.
+	// Clients registered into every server keep
+	// collecting the answers of the rest of them
+	// until the connection is closed
+	disconnected := response.Action == msg.PEER_ACTION_DISCONNECT && !response.HasError
+	return disconnected && client.options.strategy != SERVER_STRATEGY_ALL
+}
+
+// Asks the senders of the incomplete messages for
+// their missing fragments every `FRAGMENT_NACK_INTERVAL`
+// until the given channel is closed
+func (client *DefaultStunClient) requestMissing(stop chan struct{}) {
+	ticker := time.NewTicker(FRAGMENT_NACK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, gap := range client.fragments.gaps(now, FRAGMENT_NACK_INTERVAL) {
+				if err := client.sendNack(gap); err != nil {
+					client.log("Asking for missing fragments failed ", err)
+				}
+			}
+		}
+	}
+}
+
+// Sends the negative acknowledgement of the
+// given missing fragments to their sender
+func (client *DefaultStunClient) sendNack(gap fragmentGap) error {
+	serialized, err := client.marshal(gap.nack)
+	if err != nil {
+		return err
+	}
+
+	datagram, err := client.marshal(msg.NewMsgRequest(msg.PEER_ACTION_FRAGMENT_NACK, "", string(serialized)))
+	if err != nil {
+		return err
+	}
+
+	_, err = client.conn.WriteToUDP(datagram, gap.source)
+	return err
 }
 
 // Starts a goroutine that handles stun server
-// responses. This goroutine will saves responses
-// into the channels to whom them belongs. This
-// method cannot be invoked twice.
+// responses. This goroutine will deliver every
+// response to the request it belongs by using
+// the response id. Responses whose request is no
+// longer waiting are discarded. Messages sent in
+// fragments are reassembled before they are
+// delivered, the fragments lost on the way are
+// asked for to their sender. It stops once the
+// connection is closed. This method cannot be
+// invoked twice.
 func (client *DefaultStunClient) Collect() error {
-	if client.isListening {
+	if !client.listening.start() {
 		return fmt.Errorf("client is already listening connections")
 	}
 
+	stop := make(chan struct{})
+	go client.requestMissing(stop)
+
 	go func() {
+		defer close(stop)
 		buff := make([]byte, msg.MAX_MESSAGE_SIZE)
 		for {
-			var response msg.MsgResponse
-
 			// Wait until there's something in the socket
 			// that needs to be read
-			bytesRead, _, err := client.conn.ReadFromUDP(buff)
-			if err != nil {
-				client.log("Get response from server failed ", err)
-				continue
+			bytesRead, addr, err := client.conn.ReadFromUDP(buff)
+			if errors.Is(err, net.ErrClosed) {
+				client.listening.stop()
+				break
 			}
-
-			err = client.unmarshal(buff[:bytesRead], &response)
 			if err != nil {
-				client.log("Unmarshal server response failed ", err)
+				client.log("Get response from server failed ", err)
 				continue
 			}
 
-			// Saves the response into the channel to whom it belongs
-			channel, err := client.getActionChannel(response.Action)
-			if err != nil {
-				channel = client.peerMsgs
-			}
-
-			channel <- &response
-
-			// exit goroutine if disconnect from the P2P network
-			if response.Action == msg.PEER_ACTION_DISCONNECT && !response.HasError {
-				client.isListening = false
+			if client.process(buff[:bytesRead], addr, false) {
+				client.listening.stop()
 				break
 			}
 		}
 	}()
-	client.isListening = true
 	return nil
 }
 
 // Request stun server with the given paramenters
-func (client DefaultStunClient) Request(peername string, action string, message string, timeout int) (*msg.MsgResponse, error) {
-	// get the channel that handles the request
-	channel, err := client.getActionChannel(action)
+// and waits for his response until the given
+// context is done. Errors answered by the server
+// are returned as `*ResponseError`. Servers are
+// tried in the order given by the strategy of
+// the options. The ones that do not answer in
+// their share of the context time, or are
+// standbys, are skipped in favour of the next
+// ones, which become the current server once
+// they answer. Actions bound to the session
+// only go to the servers that issued a token
+func (client DefaultStunClient) Request(ctx context.Context, peername string, action string, message string) (*msg.MsgResponse, error) {
+	if !isStunAction(action) {
+		return nil, fmt.Errorf("unrecognized Stun action `%s`", action)
+	}
+
+	if client.options.strategy == SERVER_STRATEGY_ALL && isRegistrationAction(action) {
+		return client.requestAll(ctx, peername, action, message)
+	}
+
+	servers := client.servers.ordered(client.options.strategy)
+	if isSessionAction(action) {
+		servers = client.session.holders(servers)
+	}
+	for i, server := range servers {
+		attempt, cancel := attemptContext(ctx, len(servers)-i)
+		response, err := client.attempt(attempt, peername, action, message, server)
+		cancel()
+
+		if err == nil {
+			client.servers.use(server)
+			return response, nil
+		}
+		if !isFailover(err) || ctx.Err() != nil || i == len(servers)-1 {
+			return nil, err
+		}
+		client.log("Stun server ", server, " failed, trying the next one: ", err)
+	}
+	return nil, fmt.Errorf("there are no stun servers")
+}
+
+// Sends the given request to every server at the
+// same time and returns the answer of the most
+// preferred one that accepted it. It fails once
+// every server failed, with the error answered
+// by the most preferred one if any did
+func (client DefaultStunClient) requestAll(ctx context.Context, peername string, action string, message string) (*msg.MsgResponse, error) {
+	type result struct {
+		response *msg.MsgResponse
+		err      error
+	}
+
+	servers := client.servers.all()
+	results := make([]result, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server *net.UDPAddr) {
+			defer wg.Done()
+			response, err := client.attempt(ctx, peername, action, message, server)
+			results[i] = result{response, err}
+		}(i, server)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.err == nil {
+			return result.response, nil
+		}
+	}
+	for _, result := range results {
+		if !isFailover(result.err) {
+			return nil, result.err
+		}
+	}
+	return nil, results[0].err
+}
+
+// Sends the given request to the given server
+// and waits for his response until the given
+// context is done. The outcome is recorded in
+// the health of the server
+func (client DefaultStunClient) attempt(ctx context.Context, peername string, action string, message string, server *net.UDPAddr) (*msg.MsgResponse, error) {
+	id, err := newRequestId()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot generate request id %s", err)
 	}
 
 	// serializes the request
@@ -138,48 +518,120 @@ func (client DefaultStunClient) Request(peername string, action string, message
 		peername,
 		message,
 	)
+	request.Id = id
+	request.Token = client.session.get(server)
+
+	// every request tells the protocol version
+	// and registrations say hello with the
+	// features the client supports
+	request.Version = msg.PROTOCOL_VERSION
+	if action == msg.STUN_ACTION_NEW {
+		request.Features = client.options.features
+	}
+	if client.options.identity == nil {
+		return nil, fmt.Errorf("stun client has no identity to sign the request with")
+	}
+	request.Sign(client.options.identity)
 
 	payload, err := client.marshal(request)
 	if err != nil {
 		return nil, fmt.Errorf("cannot serialize the request %s", err)
 	}
 
+	sent := time.Now()
+	response, err := client.send(ctx, id, payload, server)
+	client.record(server, time.Since(sent), err)
+	if err != nil {
+		return nil, err
+	}
+
+	if !msg.SupportsVersion(response.Version) {
+		return nil, fmt.Errorf("%w `%d` spoken by the server", ErrUnsupportedVersion, response.Version)
+	}
+
+	// keeps track of the session token. Peers
+	// registered into a single server forget the
+	// sessions of the servers they moved from
+	switch action {
+	case msg.STUN_ACTION_NEW:
+		if client.options.strategy != SERVER_STRATEGY_ALL {
+			client.session.clear()
+		}
+		client.session.set(server, response.Token)
+	case msg.STUN_ACTION_DISCONNECT:
+		client.session.set(server, "")
+	}
+	return response, nil
+}
+
+// Sends the given request payload to the given
+// server and waits for his response until the
+// given context is done
+func (client DefaultStunClient) send(ctx context.Context, id string, payload []byte, server *net.UDPAddr) (*msg.MsgResponse, error) {
+	// waits for the response since the request
+	// is sent until it is read or the context is done
+	channel := client.pending.open(id)
+	defer client.pending.discard(id)
+
 	// send request to the stun server
-	if _, err := client.conn.WriteToUDP(payload, client.addr); err != nil {
+	if _, err := client.conn.WriteToUDP(payload, server); err != nil {
 		return nil, fmt.Errorf("write to UDP failed: %s", err)
 	}
 
 	// read the response from the channel
-	response, err := client.readChannelWithTimeout(channel, timeout)
+	response, err := client.readChannel(ctx, channel)
 	if err != nil {
 		return nil, err
 	}
 
 	if response.HasError {
-		return nil, fmt.Errorf(response.Message)
+		return nil, newResponseError(response)
 	}
 	return response, nil
 }
 
+// Returns the server the client
+// sends his requests to
+func (client DefaultStunClient) Server() *net.UDPAddr {
+	return client.servers.get()
+}
+
 // Listen for incoming P2P messages.
 // This method should be used inside goroutine
 // or infinite loop and handle the returned
 // messages as wanted
-func (client DefaultStunClient) Listen() *msg.MsgResponse {
+func (client *DefaultStunClient) Listen() *msg.MsgResponse {
 	return <-client.peerMsgs
 }
 
-// Creates a new Stun client
+// Returns the queue of the incoming P2P
+// messages `Listen` reads from
+func (client *DefaultStunClient) Messages() <-chan *msg.MsgResponse {
+	return client.peerMsgs
+}
+
+// Creates a new Stun client that talks to the
+// server listening on the given address and
+// to the fallback servers of the options. A
+// random identity is generated if the options
+// carry none
 func NewDefaultStunClient(conn UDPStunConn, addr *net.UDPAddr, options ClientStunOptions) *DefaultStunClient {
+	if options.identity == nil {
+		// requests fail later on if
+		// it cannot be generated
+		_, options.identity, _ = ed25519.GenerateKey(rand.Reader)
+	}
+
 	return &DefaultStunClient{
-		peerMsgs:       make(chan *msg.MsgResponse, options.maxMsgInQueue),
-		conn:           conn,
-		addr:           addr,
-		requests:       make(chan *msg.MsgResponse),
-		registrations:  make(chan *msg.MsgResponse),
-		disconnections: make(chan *msg.MsgResponse),
-		options:        options,
-		marshal:        json.Marshal,
-		unmarshal:      json.Unmarshal,
+		peerMsgs:  make(chan *msg.MsgResponse, options.maxMsgInQueue),
+		listening: &listenState{},
+		conn:      conn,
+		servers:   newServerList(append([]*net.UDPAddr{addr}, options.fallbacks...)...),
+		pending:   newPendingRequests(),
+		session:   newSession(),
+		fragments: newReassembler(options.reassemblyTimeout, options.maxPendingMessages),
+		options:   options,
+		marshal:   msg.NewEncoder(options.codec),
+		unmarshal: msg.Decode,
 	}
 }
@@ -2,10 +2,16 @@ package stun
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
 	"github.com/stretchr/testify/require"
@@ -21,7 +27,7 @@ func TestDefaultStunClientConstructor(t *testing.T) {
 
 		client := NewDefaultStunClient(conn, addr, options)
 
-		assert.Equal(addr, client.addr)
+		assert.Equal(addr, client.Server())
 	})
 
 }
@@ -61,10 +67,10 @@ func TestDefaultStunClientLog(t *testing.T) {
 
 }
 
-func TestDefaultStunClientReadChannelWithTimeout(t *testing.T) {
+func TestDefaultStunClientReadChannel(t *testing.T) {
 	assert := require.New(t)
 
-	t.Run("test_read_channel_with_timeout_success", func(t *testing.T) {
+	t.Run("test_read_channel_success", func(t *testing.T) {
 		conn := &UDPStunConnMock{}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := NewClientStunOptions(false, 10)
@@ -76,7 +82,7 @@ func TestDefaultStunClientReadChannelWithTimeout(t *testing.T) {
 			ch <- &msgResponse
 		}()
 
-		result, err := client.readChannelWithTimeout(ch, 10)
+		result, err := client.readChannel(timeoutContext(t, 10), ch)
 
 		assert.NoError(err)
 		assert.Equal(msgResponse.Action, result.Action)
@@ -85,7 +91,7 @@ func TestDefaultStunClientReadChannelWithTimeout(t *testing.T) {
 		assert.Equal(msgResponse.Message, result.Message)
 	})
 
-	t.Run("test_read_channel_with_timeout_fail", func(t *testing.T) {
+	t.Run("test_read_channel_fail", func(t *testing.T) {
 		conn := &UDPStunConnMock{}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := NewClientStunOptions(false, 10)
@@ -93,64 +99,81 @@ func TestDefaultStunClientReadChannelWithTimeout(t *testing.T) {
 
 		ch := make(chan *msg.MsgResponse)
 
-		_, err := client.readChannelWithTimeout(ch, 1)
+		_, err := client.readChannel(timeoutContext(t, 1), ch)
 		assert.Error(err)
 	})
 
 }
 
-func TestDefaultStunClientGetActionChannel(t *testing.T) {
+func TestPendingRequests(t *testing.T) {
 	assert := require.New(t)
 
-	t.Run("test_get_action_channel_registrations", func(t *testing.T) {
-		conn := &UDPStunConnMock{}
-		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
-		options := NewClientStunOptions(false, 10)
-		client := NewDefaultStunClient(conn, addr, options)
+	t.Run("test_pending_requests_resolve", func(t *testing.T) {
+		pending := newPendingRequests()
+		response := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "dog", "godzilla")
+		response.Id = "fake"
 
-		ch, err := client.getActionChannel(msg.STUN_ACTION_NEW)
+		ch := pending.open(response.Id)
+		resolved := pending.resolve(&response)
 
-		assert.NoError(err)
-		assert.Equal(ch, client.registrations)
+		assert.True(resolved)
+		assert.Equal(&response, <-ch)
+		assert.Empty(pending.requests)
 	})
 
-	t.Run("test_get_action_channel_requests", func(t *testing.T) {
-		conn := &UDPStunConnMock{}
-		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
-		options := NewClientStunOptions(false, 10)
-		client := NewDefaultStunClient(conn, addr, options)
+	t.Run("test_pending_requests_resolve_fail_unknown_id", func(t *testing.T) {
+		pending := newPendingRequests()
+		response := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "dog", "godzilla")
+		response.Id = "fake"
 
-		ch, err := client.getActionChannel(msg.STUN_ACTION_GET)
+		pending.open("another")
+		resolved := pending.resolve(&response)
 
-		assert.NoError(err)
-		assert.Equal(ch, client.requests)
+		assert.False(resolved)
 	})
 
-	t.Run("test_get_action_channel_disconnections", func(t *testing.T) {
-		conn := &UDPStunConnMock{}
-		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
-		options := NewClientStunOptions(false, 10)
-		client := NewDefaultStunClient(conn, addr, options)
+	t.Run("test_pending_requests_discard", func(t *testing.T) {
+		pending := newPendingRequests()
+		response := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "dog", "godzilla")
+		response.Id = "fake"
 
-		ch, err := client.getActionChannel(msg.STUN_ACTION_DISCONNECT)
+		pending.open(response.Id)
+		pending.discard(response.Id)
+		resolved := pending.resolve(&response)
 
-		assert.NoError(err)
-		assert.Equal(ch, client.disconnections)
+		assert.False(resolved)
 	})
 
-	t.Run("test_get_action_channel_fail_unknown_action", func(t *testing.T) {
-		conn := &UDPStunConnMock{}
-		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
-		options := NewClientStunOptions(false, 10)
-		client := NewDefaultStunClient(conn, addr, options)
+}
 
-		_, err := client.getActionChannel("Unchannel action")
+func TestNewRequestId(t *testing.T) {
+	assert := require.New(t)
 
-		assert.Error(err)
+	t.Run("test_new_request_id_unique", func(t *testing.T) {
+		first, err := newRequestId()
+		assert.NoError(err)
+
+		second, err := newRequestId()
+		assert.NoError(err)
+
+		assert.NotEqual(first, second)
 	})
 
 }
 
+// Collects the responses the client reads from
+// the given mock until the test ends. The mock
+// is closed then, so the client stops collecting
+func collect(t *testing.T, client *DefaultStunClient, conn *UDPStunConnMock) {
+	if err := client.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		eventually(t, time.Second, func() bool { return !client.listening.isListening() })
+	})
+}
+
 func TestDefaultStunClientCollect(t *testing.T) {
 	assert := require.New(t)
 
@@ -161,9 +184,9 @@ func TestDefaultStunClientCollect(t *testing.T) {
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
 
-		go client.Collect()
+		collect(t, client, conn)
 
-		result, err := client.readChannelWithTimeout(client.peerMsgs, 1)
+		result, err := client.readChannel(timeoutContext(t, 1), client.peerMsgs)
 
 		assert.NoError(err)
 		assert.Equal(msgResponse.Action, result.Action)
@@ -172,54 +195,140 @@ func TestDefaultStunClientCollect(t *testing.T) {
 		assert.Equal(msgResponse.Message, result.Message)
 	})
 
-	t.Run("test_client_collect_action", func(t *testing.T) {
+	t.Run("test_client_collect_response", func(t *testing.T) {
 		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "dog", "godzilla")
+		msgResponse.Id = "fake"
 		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse}}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
+		ch := client.pending.open(msgResponse.Id)
 
-		go client.Collect()
+		collect(t, client, conn)
 
-		result, err := client.readChannelWithTimeout(client.requests, 1)
+		result, err := client.readChannel(timeoutContext(t, 1), ch)
 
 		assert.NoError(err)
+		assert.Equal(msgResponse.Id, result.Id)
 		assert.Equal(msgResponse.Action, result.Action)
 		assert.Equal(msgResponse.HasError, result.HasError)
 		assert.Equal(msgResponse.Peername, result.Peername)
 		assert.Equal(msgResponse.Message, result.Message)
 	})
 
+	t.Run("test_client_collect_discard_stale_response", func(t *testing.T) {
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "dog", "godzilla")
+		msgResponse.Id = "fake"
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		options := NewClientStunOptions(false, 10)
+		client := NewDefaultStunClient(conn, addr, options)
+
+		collect(t, client, conn)
+
+		_, err := client.readChannel(timeoutContext(t, 1), client.peerMsgs)
+
+		assert.Error(err)
+	})
+
 	t.Run("test_client_collect_disconnect", func(t *testing.T) {
 		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_DISCONNECT, false, "dog", "godzilla")
+		msgResponse.Id = "fake"
 		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse}}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
+		ch := client.pending.open(msgResponse.Id)
 
-		go client.Collect()
+		collect(t, client, conn)
 
-		result, err := client.readChannelWithTimeout(client.disconnections, 10)
+		result, err := client.readChannel(timeoutContext(t, 10), ch)
 
 		assert.NoError(err)
 		assert.Equal(msgResponse.Action, result.Action)
 		assert.Equal(msgResponse.HasError, result.HasError)
 		assert.Equal(msgResponse.Peername, result.Peername)
 		assert.Equal(msgResponse.Message, result.Message)
-		assert.False(client.isListening)
+		time.Sleep(100 * time.Millisecond)
+		assert.False(client.listening.isListening())
+	})
+
+	t.Run("test_client_process_reassembles_fragments", func(t *testing.T) {
+		conn := &UDPStunConnMock{}
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		client := NewDefaultStunClient(conn, addr, DefaultClientStunOptions())
+
+		message := strings.Repeat("guau", msg.FRAGMENT_DATA_SIZE)
+		payload, _ := json.Marshal(msg.NewMsgResponse("FakeAction", false, "dog", message))
+		fragments, _ := msg.SplitMessage("id", payload)
+
+		for _, fragment := range fragments {
+			serialized, _ := json.Marshal(fragment)
+			datagram, _ := json.Marshal(msg.NewMsgResponse(msg.PEER_ACTION_FRAGMENT, false, "dog", string(serialized)))
+			assert.Less(len(datagram), msg.MAX_DATAGRAM_SIZE)
+			assert.False(client.process(datagram, addr, false))
+		}
+
+		response := client.Listen()
+		assert.Equal("FakeAction", response.Action)
+		assert.Equal(message, response.Message)
+		assert.Equal(addr, response.Addr)
+	})
+
+	t.Run("test_client_collect_asks_for_missing_fragments", func(t *testing.T) {
+		sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(err)
+		defer sender.Close()
+		client := newFailoverClient(t, DefaultClientStunOptions(), sender.LocalAddr().(*net.UDPAddr))
+		caddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: client.conn.(*net.UDPConn).LocalAddr().(*net.UDPAddr).Port}
+
+		payload, _ := json.Marshal(msg.NewMsgResponse("FakeAction", false, "dog", strings.Repeat("guau", msg.FRAGMENT_DATA_SIZE)))
+		fragments, _ := msg.SplitMessage("id", payload)
+		for _, fragment := range fragments[:len(fragments)-2] {
+			serialized, _ := json.Marshal(fragment)
+			datagram, _ := json.Marshal(msg.NewMsgResponse(msg.PEER_ACTION_FRAGMENT, false, "dog", string(serialized)))
+			sender.WriteToUDP(datagram, caddr)
+		}
+
+		sender.SetReadDeadline(time.Now().Add(time.Second))
+		buff := make([]byte, msg.MAX_DATAGRAM_SIZE)
+		n, _, err := sender.ReadFromUDP(buff)
+		assert.NoError(err)
+
+		var request msg.MsgRequest
+		assert.NoError(msg.Decode(buff[:n], &request))
+		assert.Equal(msg.PEER_ACTION_FRAGMENT_NACK, request.Action)
+
+		var nack msg.MsgFragmentNack
+		assert.NoError(msg.Decode([]byte(request.Message), &nack))
+		assert.Equal(msg.MsgFragmentNack{Id: "id", Missing: []int{len(fragments) - 2, len(fragments) - 1}}, nack)
+	})
+
+	t.Run("test_client_process_drops_nested_fragments", func(t *testing.T) {
+		conn := &UDPStunConnMock{}
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		client := NewDefaultStunClient(conn, addr, DefaultClientStunOptions())
+
+		serialized, _ := json.Marshal(msg.MsgFragment{Id: "id", Index: 0, Count: 1, Data: []byte("{}")})
+		datagram, _ := json.Marshal(msg.NewMsgResponse(msg.PEER_ACTION_FRAGMENT, false, "dog", string(serialized)))
+
+		assert.False(client.process(datagram, addr, true))
+		assert.Empty(client.peerMsgs)
 	})
 
 	t.Run("test_client_collect_fail_read_from_udp", func(t *testing.T) {
 		rerr := fmt.Errorf("Error")
 		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_DISCONNECT, false, "dog", "godzilla")
+		msgResponse.Id = "fake"
 		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, err: rerr}}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
+		ch := client.pending.open(msgResponse.Id)
 
-		go client.Collect()
+		collect(t, client, conn)
 
-		_, err := client.readChannelWithTimeout(client.disconnections, 1)
+		_, err := client.readChannel(timeoutContext(t, 1), ch)
 
 		assert.Error(err)
 	})
@@ -229,7 +338,7 @@ func TestDefaultStunClientCollect(t *testing.T) {
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
-		client.isListening = true
+		client.listening.start()
 
 		err := client.Collect()
 
@@ -238,15 +347,17 @@ func TestDefaultStunClientCollect(t *testing.T) {
 
 	t.Run("test_client_collect_fail_unmarshal", func(t *testing.T) {
 		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_DISCONNECT, false, "dog", "godzilla")
+		msgResponse.Id = "fake"
 		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse}}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
 		client.unmarshal = FailUnmarshal(fmt.Errorf("Error"))
+		ch := client.pending.open(msgResponse.Id)
 
-		go client.Collect()
+		collect(t, client, conn)
 
-		_, err := client.readChannelWithTimeout(client.disconnections, 1)
+		_, err := client.readChannel(timeoutContext(t, 1), ch)
 
 		assert.Error(err)
 	})
@@ -258,14 +369,14 @@ func TestDefaultStunClientRequest(t *testing.T) {
 
 	t.Run("test_request_success", func(t *testing.T) {
 		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "dog", "godzilla")
-		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse}, writeToUDPMock: &WriteToUDPMock{}}
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
 
-		go client.Collect()
+		collect(t, client, conn)
 
-		result, err := client.Request("dog", msg.STUN_ACTION_GET, "", 1)
+		result, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_GET, "")
 
 		assert.NoError(err)
 		assert.Equal(msgResponse.Action, result.Action)
@@ -274,13 +385,187 @@ func TestDefaultStunClientRequest(t *testing.T) {
 		assert.Equal(msgResponse.Message, result.Message)
 	})
 
-	t.Run("test_request_fail_no_action_channel", func(t *testing.T) {
+	t.Run("test_request_keeps_session_token", func(t *testing.T) {
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_NEW, false, "dog", "godzilla")
+		msgResponse.Token = "token"
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		options := NewClientStunOptions(false, 10)
+		client := NewDefaultStunClient(conn, addr, options)
+
+		collect(t, client, conn)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+		assert.Equal(msgResponse.Token, client.session.get(addr))
+
+		_, err = client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_REFRESH, "")
+		assert.NoError(err)
+
+		var request msg.MsgRequest
+		msg.Decode(conn.writeToUDPMock.b, &request)
+		assert.Equal(msgResponse.Token, request.Token)
+	})
+
+	t.Run("test_request_signs_with_identity", func(t *testing.T) {
+		public, identity, _ := ed25519.GenerateKey(nil)
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_NEW, false, "dog", "godzilla")
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		options := NewClientStunOptions(false, 10).WithIdentity(identity)
+		client := NewDefaultStunClient(conn, addr, options)
+
+		collect(t, client, conn)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+
+		var request msg.MsgRequest
+		msg.Decode(conn.writeToUDPMock.b, &request)
+		assert.Equal(msg.EncodeKey(public), request.Key)
+		assert.NoError(request.Verify(request.Key))
+	})
+
+	t.Run("test_request_signs_with_generated_identity", func(t *testing.T) {
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_NEW, false, "dog", "godzilla")
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		client := NewDefaultStunClient(conn, addr, NewClientStunOptions(false, 10))
+
+		collect(t, client, conn)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+
+		var request msg.MsgRequest
+		msg.Decode(conn.writeToUDPMock.b, &request)
+		assert.NotEmpty(request.Key)
+		assert.NoError(request.Verify(request.Key))
+	})
+
+	t.Run("test_request_registers_with_generated_identity", func(t *testing.T) {
+		_, saddr := startStun(t, NewStunOptions(false))
+		client := newLocalClient(t, saddr, NewClientStunOptions(false, 10))
+
+		response, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_NEW, "")
+
+		assert.NoError(err)
+		assert.False(response.HasError)
+	})
+
+	t.Run("test_request_fail_without_identity", func(t *testing.T) {
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		client := NewDefaultStunClient(conn, addr, NewClientStunOptions(false, 10))
+		client.options.identity = nil
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_NEW, "")
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "no identity")
+		assert.Nil(conn.writeToUDPMock.b)
+	})
+
+	t.Run("test_request_says_hello_on_registration", func(t *testing.T) {
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_NEW, false, "dog", "godzilla")
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		_, identity, _ := ed25519.GenerateKey(nil)
+		options := NewClientStunOptions(false, 10).WithIdentity(identity).WithFeatures(msg.FEATURE_ENCRYPTION)
+		client := NewDefaultStunClient(conn, addr, options)
+
+		collect(t, client, conn)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+
+		var request msg.MsgRequest
+		msg.Decode(conn.writeToUDPMock.b, &request)
+		assert.Equal(msg.PROTOCOL_VERSION, request.Version)
+		assert.Equal([]string{msg.FEATURE_ENCRYPTION}, request.Features)
+		assert.NoError(request.Verify(request.Key))
+
+		_, err = client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_REFRESH, "")
+		assert.NoError(err)
+
+		msg.Decode(conn.writeToUDPMock.b, &request)
+		assert.Equal(msg.PROTOCOL_VERSION, request.Version)
+		assert.Empty(request.Features)
+	})
+
+	t.Run("test_request_forgets_session_token_on_disconnect", func(t *testing.T) {
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_DISCONNECT, false, "dog", "")
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		options := NewClientStunOptions(false, 10)
+		client := NewDefaultStunClient(conn, addr, options)
+		client.session.set(addr, "token")
+
+		collect(t, client, conn)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_DISCONNECT, "")
+
+		assert.NoError(err)
+		assert.Equal("", client.session.get(addr))
+	})
+
+	t.Run("test_session_keeps_a_token_per_server", func(t *testing.T) {
+		first, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60001")
+		second, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60002")
+		standby, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		session := newSession()
+
+		session.set(first, "first")
+		session.set(second, "second")
+
+		assert.Equal("first", session.get(first))
+		assert.Equal("second", session.get(second))
+		assert.Equal("", session.get(standby))
+
+		session.set(second, "")
+		assert.Equal("first", session.get(first))
+		assert.Equal("", session.get(second))
+	})
+
+	t.Run("test_session_holders", func(t *testing.T) {
+		first, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60001")
+		second, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60002")
+		third, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		session := newSession()
+		servers := []*net.UDPAddr{first, second, third}
+
+		assert.Equal(servers, session.holders(servers))
+
+		session.set(third, "third")
+		session.set(second, "second")
+		assert.Equal([]*net.UDPAddr{second, third}, session.holders(servers))
+
+		session.clear()
+		assert.Equal(servers, session.holders(servers))
+	})
+
+	t.Run("test_request_discard_stale_response", func(t *testing.T) {
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "dog", "godzilla")
+		msgResponse.Id = "stale"
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse}, writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		options := NewClientStunOptions(false, 10)
+		client := NewDefaultStunClient(conn, addr, options)
+
+		collect(t, client, conn)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_GET, "")
+
+		assert.Error(err)
+	})
+
+	t.Run("test_request_fail_unknown_action", func(t *testing.T) {
 		conn := &UDPStunConnMock{}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
 
-		_, err := client.Request("dog", "fake action", "", 1)
+		_, err := client.Request(timeoutContext(t, 1), "dog", "fake action", "")
 
 		assert.Error(err)
 	})
@@ -293,7 +578,7 @@ func TestDefaultStunClientRequest(t *testing.T) {
 		rerr := fmt.Errorf("Error")
 		client.marshal = FailMarshal(rerr)
 
-		_, err := client.Request("dog", msg.STUN_ACTION_GET, "", 1)
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_GET, "")
 
 		assert.Error(err, rerr.Error())
 	})
@@ -305,7 +590,7 @@ func TestDefaultStunClientRequest(t *testing.T) {
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
 
-		_, err := client.Request("dog", msg.STUN_ACTION_GET, "", 1)
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_GET, "")
 
 		assert.Error(err)
 	})
@@ -316,21 +601,76 @@ func TestDefaultStunClientRequest(t *testing.T) {
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
 
-		_, err := client.Request("dog", msg.STUN_ACTION_GET, "", 1)
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_GET, "")
 
 		assert.Error(err)
 	})
 
+	t.Run("test_request_fail_unsupported_server_version", func(t *testing.T) {
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, "dog", "godzilla")
+		msgResponse.Version = msg.PROTOCOL_VERSION + 1
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		client := NewDefaultStunClient(conn, addr, DefaultClientStunOptions())
+
+		collect(t, client, conn)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_GET, "")
+
+		assert.True(errors.Is(err, ErrUnsupportedVersion))
+	})
+
+	t.Run("test_request_fail_timeout_typed", func(t *testing.T) {
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		client := NewDefaultStunClient(conn, addr, NewClientStunOptions(false, 10))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := client.Request(ctx, "dog", msg.STUN_ACTION_GET, "")
+
+		assert.True(errors.Is(err, ErrTimeout))
+		assert.True(errors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("test_request_fail_context_cancelled", func(t *testing.T) {
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		client := NewDefaultStunClient(conn, addr, NewClientStunOptions(false, 10))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := client.Request(ctx, "dog", msg.STUN_ACTION_GET, "")
+
+		assert.True(errors.Is(err, context.Canceled))
+		assert.False(errors.Is(err, ErrTimeout))
+	})
+
+	t.Run("test_request_fail_response_error_code", func(t *testing.T) {
+		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_GET, true, "dog", "peer `cat` not found")
+		msgResponse.Code = msg.ERROR_CODE_PEER_NOT_FOUND
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
+		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
+		client := NewDefaultStunClient(conn, addr, NewClientStunOptions(false, 10))
+
+		collect(t, client, conn)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_GET, "cat")
+
+		assert.True(errors.Is(err, ErrPeerNotFound))
+		assert.Equal(msgResponse.Message, err.Error())
+	})
+
 	t.Run("test_request_fail_response_error", func(t *testing.T) {
 		msgResponse := msg.NewMsgResponse(msg.PEER_ACTION_GET, true, "dog", "godzilla")
-		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse}, writeToUDPMock: &WriteToUDPMock{}}
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{response: &msgResponse, echo: make(chan []byte, 1)}, writeToUDPMock: &WriteToUDPMock{}}
 		addr, _ := net.ResolveUDPAddr("udp4", ":50000")
 		options := DefaultClientStunOptions()
 		client := NewDefaultStunClient(conn, addr, options)
 
-		go client.Collect()
+		collect(t, client, conn)
 
-		_, err := client.Request("dog", msg.STUN_ACTION_GET, "", 1)
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_GET, "")
 
 		assert.Error(err)
 	})
@@ -360,3 +700,150 @@ func TestDefaultStunClientListen(t *testing.T) {
 	})
 
 }
+
+// Starts a fake stun server listening on the given
+// address that answers every request with the given
+// error code, or successfully if it is empty
+func startFakeStun(t *testing.T, saddr string, code string) *net.UDPAddr {
+	addr, _ := net.ResolveUDPAddr("udp4", saddr)
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buff := make([]byte, STUN_BUFFER_SIZE)
+		for {
+			n, raddr, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+
+			var request msg.MsgRequest
+			msg.Decode(buff[:n], &request)
+			response := msg.NewMsgResponse(request.Action, code != "", request.Peername, saddr)
+			response.Id = request.Id
+			response.Code = code
+			response.Version = msg.PROTOCOL_VERSION
+			answer, _ := msg.Encode(msg.JSONCodec{}, response)
+			conn.WriteToUDP(answer, raddr)
+		}
+	}()
+	return addr
+}
+
+// Creates a client listening on a random port
+// that talks to the given servers in order
+func newFailoverClient(t *testing.T, options ClientStunOptions, servers ...*net.UDPAddr) *DefaultStunClient {
+	laddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewDefaultStunClient(conn, servers[0], options.WithFallbacks(servers[1:]...))
+	client.Collect()
+	t.Cleanup(func() {
+		// stops collecting before closing
+		client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_DISCONNECT, "")
+		conn.Close()
+	})
+	return client
+}
+
+func TestDefaultStunClientFailover(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_request_fails_over_to_next_server", func(t *testing.T) {
+		dead, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		fallback := startFakeStun(t, "127.0.0.1:60002", "")
+		client := newFailoverClient(t, NewClientStunOptions(false, 10), dead, fallback)
+
+		response, err := client.Request(timeoutContext(t, 2), "dog", msg.STUN_ACTION_REFRESH, "")
+
+		assert.NoError(err)
+		assert.Equal(fallback.String(), response.Message)
+		assert.Equal(fallback, client.Server())
+	})
+
+	t.Run("test_request_sticks_to_the_server_that_answered", func(t *testing.T) {
+		dead, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		fallback := startFakeStun(t, "127.0.0.1:60002", "")
+		client := newFailoverClient(t, NewClientStunOptions(false, 10), dead, fallback)
+
+		_, err := client.Request(timeoutContext(t, 2), "dog", msg.STUN_ACTION_REFRESH, "")
+		assert.NoError(err)
+
+		// the dead server is not waited for anymore
+		start := time.Now()
+		_, err = client.Request(timeoutContext(t, 2), "dog", msg.STUN_ACTION_REFRESH, "")
+		assert.NoError(err)
+		assert.True(time.Since(start) < 500*time.Millisecond)
+	})
+
+	t.Run("test_request_skips_standby_servers", func(t *testing.T) {
+		standby := startFakeStun(t, "127.0.0.1:60001", msg.ERROR_CODE_STANDBY)
+		primary := startFakeStun(t, "127.0.0.1:60002", "")
+		client := newFailoverClient(t, NewClientStunOptions(false, 10), standby, primary)
+
+		response, err := client.Request(timeoutContext(t, 2), "dog", msg.STUN_ACTION_REFRESH, "")
+
+		assert.NoError(err)
+		assert.Equal(primary.String(), response.Message)
+	})
+
+	t.Run("test_request_does_not_fail_over_answered_errors", func(t *testing.T) {
+		primary := startFakeStun(t, "127.0.0.1:60001", msg.ERROR_CODE_PEER_NOT_FOUND)
+		fallback := startFakeStun(t, "127.0.0.1:60002", "")
+		client := newFailoverClient(t, NewClientStunOptions(false, 10), primary, fallback)
+
+		_, err := client.Request(timeoutContext(t, 2), "dog", msg.STUN_ACTION_GET, "cat")
+
+		assert.True(errors.Is(err, ErrPeerNotFound))
+		assert.Equal(primary, client.Server())
+	})
+
+	t.Run("test_request_fails_once_every_server_failed", func(t *testing.T) {
+		first, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		second, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60004")
+		client := newFailoverClient(t, NewClientStunOptions(false, 10), first, second)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_REFRESH, "")
+
+		assert.True(errors.Is(err, ErrTimeout))
+	})
+}
+
+func TestAttemptContext(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_attempt_context_splits_deadline", func(t *testing.T) {
+		ctx := timeoutContext(t, 4)
+
+		attempt, cancel := attemptContext(ctx, 2)
+		defer cancel()
+
+		deadline, _ := attempt.Deadline()
+		assert.WithinDuration(time.Now().Add(2*time.Second), deadline, 100*time.Millisecond)
+	})
+
+	t.Run("test_attempt_context_last_server_gets_the_rest", func(t *testing.T) {
+		ctx := timeoutContext(t, 4)
+		expected, _ := ctx.Deadline()
+
+		attempt, cancel := attemptContext(ctx, 1)
+		defer cancel()
+
+		deadline, _ := attempt.Deadline()
+		assert.Equal(expected, deadline)
+	})
+
+	t.Run("test_attempt_context_without_deadline", func(t *testing.T) {
+		attempt, cancel := attemptContext(context.Background(), 3)
+		defer cancel()
+
+		_, bounded := attempt.Deadline()
+		assert.False(bounded)
+	})
+}
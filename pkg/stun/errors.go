@@ -0,0 +1,77 @@
+package stun
+
+import (
+	"context"
+	"errors"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+// Errors answered by the stun server. Callers
+// can branch on them with `errors.Is`
+var (
+	ErrPeerNotFound       = errors.New("peer not found")
+	ErrNameTaken          = errors.New("peer name already taken")
+	ErrUnauthorized       = errors.New("unauthorized request")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnknownAction      = errors.New("unknown action")
+	ErrStandby            = errors.New("stun server is a standby")
+)
+
+// Error returned when the stun server
+// does not answer a request in time
+var ErrTimeout error = timeoutError{}
+
+// Stun server errors indexed by their code
+var errorsByCode = map[string]error{
+	msg.ERROR_CODE_PEER_NOT_FOUND:      ErrPeerNotFound,
+	msg.ERROR_CODE_NAME_TAKEN:          ErrNameTaken,
+	msg.ERROR_CODE_UNAUTHORIZED:        ErrUnauthorized,
+	msg.ERROR_CODE_UNSUPPORTED_VERSION: ErrUnsupportedVersion,
+	msg.ERROR_CODE_UNKNOWN_ACTION:      ErrUnknownAction,
+	msg.ERROR_CODE_STANDBY:             ErrStandby,
+}
+
+// Timeout waiting for a response. It is
+// a `context.DeadlineExceeded` too so
+// callers can check either of them
+type timeoutError struct{}
+
+// Returns the error description
+func (timeoutError) Error() string {
+	return "stun request timed out"
+}
+
+// Tells the error is a timeout as `net.Error` does
+func (timeoutError) Timeout() bool {
+	return true
+}
+
+// Checks if the target is the context deadline
+func (timeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// Error answered by the stun server. It
+// matches the error of his code, i.e.
+// `errors.Is(err, ErrPeerNotFound)`
+type ResponseError struct {
+	Code    string
+	Message string
+}
+
+// Returns the message sent by the server
+func (err *ResponseError) Error() string {
+	return err.Message
+}
+
+// Checks if the target is the error of his code
+func (err *ResponseError) Is(target error) bool {
+	known, exists := errorsByCode[err.Code]
+	return exists && known == target
+}
+
+// Builds the error carried by the given response
+func newResponseError(response *msg.MsgResponse) error {
+	return &ResponseError{Code: response.Code, Message: response.Message}
+}
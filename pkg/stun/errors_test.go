@@ -0,0 +1,76 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutError(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_timeout_error_is_deadline_exceeded", func(t *testing.T) {
+		assert.True(errors.Is(ErrTimeout, context.DeadlineExceeded))
+		assert.False(errors.Is(ErrTimeout, context.Canceled))
+	})
+
+	t.Run("test_timeout_error_is_net_timeout", func(t *testing.T) {
+		var nerr interface{ Timeout() bool }
+		assert.True(errors.As(ErrTimeout, &nerr))
+		assert.True(nerr.Timeout())
+	})
+
+}
+
+func TestResponseError(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_response_error_matches_code", func(t *testing.T) {
+		cases := map[string]error{
+			msg.ERROR_CODE_PEER_NOT_FOUND:      ErrPeerNotFound,
+			msg.ERROR_CODE_NAME_TAKEN:          ErrNameTaken,
+			msg.ERROR_CODE_UNAUTHORIZED:        ErrUnauthorized,
+			msg.ERROR_CODE_UNSUPPORTED_VERSION: ErrUnsupportedVersion,
+			msg.ERROR_CODE_UNKNOWN_ACTION:      ErrUnknownAction,
+		}
+
+		for code, expected := range cases {
+			err := error(&ResponseError{Code: code, Message: "bonks"})
+			assert.True(errors.Is(err, expected), code)
+			assert.Equal("bonks", err.Error())
+		}
+	})
+
+	t.Run("test_response_error_not_matches_other_code", func(t *testing.T) {
+		err := error(&ResponseError{Code: msg.ERROR_CODE_NAME_TAKEN, Message: "bonks"})
+		assert.False(errors.Is(err, ErrPeerNotFound))
+	})
+
+	t.Run("test_response_error_internal_matches_nothing", func(t *testing.T) {
+		err := error(&ResponseError{Code: msg.ERROR_CODE_INTERNAL, Message: "bonks"})
+		assert.False(errors.Is(err, ErrPeerNotFound))
+		assert.False(errors.Is(err, ErrTimeout))
+
+		var rerr *ResponseError
+		assert.True(errors.As(err, &rerr))
+		assert.Equal(msg.ERROR_CODE_INTERNAL, rerr.Code)
+	})
+
+	t.Run("test_response_error_from_server_reply", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50010")
+		stun, store, conn := newWatchedStun(map[string]string{"dog": addr.String()})
+
+		request := newGetRequest(store, "cat")
+		stun.handleGetRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+		assert.True(response.HasError)
+		assert.True(errors.Is(newResponseError(&response), ErrPeerNotFound))
+	})
+
+}
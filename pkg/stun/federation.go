@@ -0,0 +1,250 @@
+package stun
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+// Lookup forwarded to the sibling servers on
+// behalf of a get request. The requester waits
+// for the first sibling that knows the peer
+type pendingLookup struct {
+	request   msg.MsgRequest
+	addr      *net.UDPAddr
+	reply     func(v interface{}) ([]byte, error)
+	remaining int
+	timer     *time.Timer
+}
+
+// Lookups forwarded to the sibling servers
+// waiting for their answers, indexed by the
+// id of the forwarded request
+type pendingLookups struct {
+	sync.Mutex
+	lookups map[string]*pendingLookup
+}
+
+// Opens a new lookup with the given id that
+// waits for the given number of answers. The
+// given function is called if they are not
+// back before the given timeout
+func (pending *pendingLookups) open(id string, lookup *pendingLookup, answers int, timeout time.Duration, expire func()) {
+	pending.Lock()
+	defer pending.Unlock()
+
+	lookup.remaining = answers
+	lookup.timer = time.AfterFunc(timeout, expire)
+	pending.lookups[id] = lookup
+}
+
+// Delivers the given answer to the lookup it
+// belongs and returns the lookup once it is
+// settled, i.e. the answer found the peer or
+// no sibling knows him. Answers nobody waits
+// for are dropped
+func (pending *pendingLookups) resolve(response msg.MsgResponse) (*pendingLookup, bool) {
+	pending.Lock()
+	defer pending.Unlock()
+
+	lookup, exists := pending.lookups[response.Id]
+	if !exists {
+		return nil, false
+	}
+
+	lookup.remaining--
+	if !response.HasError || lookup.remaining <= 0 {
+		lookup.timer.Stop()
+		delete(pending.lookups, response.Id)
+		return lookup, true
+	}
+	return nil, false
+}
+
+// Removes the lookup with the given id so late
+// answers will be ignored. Returns the lookup
+// if it was still pending
+func (pending *pendingLookups) discard(id string) (*pendingLookup, bool) {
+	pending.Lock()
+	defer pending.Unlock()
+
+	lookup, exists := pending.lookups[id]
+	if exists {
+		lookup.timer.Stop()
+		delete(pending.lookups, id)
+	}
+	return lookup, exists
+}
+
+// Creates a new pending lookups table
+func newPendingLookups() *pendingLookups {
+	return &pendingLookups{lookups: map[string]*pendingLookup{}}
+}
+
+// Resolves the addresses of the given siblings
+func resolveSiblings(siblings []string) ([]*net.UDPAddr, error) {
+	addrs := []*net.UDPAddr{}
+	for _, sibling := range siblings {
+		addr, err := net.ResolveUDPAddr("udp4", sibling)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve sibling `%s`: %s", sibling, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Checks the given address belongs to a sibling
+func (stun Stun) isSibling(addr *net.UDPAddr) bool {
+	if addr == nil {
+		return false
+	}
+	for _, sibling := range stun.siblings {
+		if sibling.IP.Equal(addr.IP) && sibling.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// Asks every sibling for the peer requested by
+// the given request, whose requester is registered
+// with the given address. The requester is answered
+// at the given address once the first sibling knows
+// the peer, every sibling told he doesn't or the
+// sibling timeout expires, so workers never wait
+// for the siblings. The sibling introduces the
+// requester to the peer himself, since the peer
+// NAT only lets his own server in
+func (stun Stun) lookup(request msg.MsgRequest, remoteAddr string, addr *net.UDPAddr) error {
+	peername := request.Message
+	if len(stun.siblings) == 0 {
+		return fmt.Errorf("peer `%s` not found", peername)
+	}
+
+	id, err := newRequestId()
+	if err != nil {
+		return err
+	}
+
+	key, _ := stun.store.GetPeerKey(request.Peername)
+	forward := msg.NewMsgRequest(msg.STUN_ACTION_LOOKUP, request.Peername, peername)
+	forward.Id = id
+	forward.Key = key
+	forward.Version = msg.PROTOCOL_VERSION
+	forward.Headers = map[string]string{msg.HEADER_REMOTE_ADDR: remoteAddr}
+	serialized, err := stun.marshal(forward)
+	if err != nil {
+		return err
+	}
+
+	// siblings that cannot be asked never
+	// answer, the lookup expires instead
+	stun.lookups.open(id, &pendingLookup{request: request, addr: addr, reply: stun.reply}, len(stun.siblings), stun.options.siblingTimeout, func() {
+		if lookup, pending := stun.lookups.discard(id); pending {
+			stun.answerLookup(lookup, nil, fmt.Errorf("lookup of peer `%s` in sibling servers timed out", peername))
+		}
+	})
+
+	asked := 0
+	for _, sibling := range stun.siblings {
+		if _, err := stun.conn.WriteToUDP(serialized, sibling); err != nil {
+			stun.log("Cannot forward lookup to sibling ", sibling, " ", err)
+			continue
+		}
+		asked++
+	}
+
+	if asked == 0 {
+		stun.lookups.discard(id)
+		return fmt.Errorf("no sibling server could be asked for peer `%s`", peername)
+	}
+	return nil
+}
+
+// Answers the get request of the given settled
+// lookup with the peer found by the given sibling
+// answer, or tells the requester the peer was not
+// found if there's none, in the codec he asked with
+func (stun Stun) answerLookup(lookup *pendingLookup, answer *msg.MsgResponse, err error) {
+	stun.reply = lookup.reply
+	if answer != nil {
+		stun.replyPeer(lookup.request, answer.Message, answer.Key, lookup.addr)
+		return
+	}
+
+	stun.log("Lookup of peer ", lookup.request.Message, " failed ", err)
+	stun.ReplyErrorCode(lookup.request, msg.PEER_ACTION_GET, msg.ERROR_CODE_PEER_NOT_FOUND, err.Error(), lookup.addr)
+}
+
+// Handles the lookups forwarded by the siblings
+// by introducing the requester to the requested
+// peer if he is registered into this server.
+// Only the peers registered here are looked up,
+// so lookups are never forwarded twice
+func (stun Stun) handleLookupRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
+	if !stun.isSibling(addr) {
+		err := fmt.Errorf("lookups are only accepted from sibling servers")
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_LOOKUP, msg.ERROR_CODE_UNAUTHORIZED, err.Error(), addr)
+		return err
+	}
+
+	peername := request.Message
+	peerAddr, err := stun.store.GetPeerRemoteAddr(peername)
+	if err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_LOOKUP, msg.ERROR_CODE_PEER_NOT_FOUND, err.Error(), addr)
+		return err
+	}
+
+	peerKey, err := stun.store.GetPeerKey(peername)
+	if err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_LOOKUP, msg.ERROR_CODE_PEER_NOT_FOUND, err.Error(), addr)
+		return err
+	}
+
+	remoteAddr := request.Headers[msg.HEADER_REMOTE_ADDR]
+	if err := stun.sendIntroduction(request.Peername, request.Key, remoteAddr, peerAddr); err != nil {
+		ferr := fmt.Sprintf("Error introducing %s to %s : %s", request.Peername, peername, err)
+		stun.ReplyError(request, msg.PEER_ACTION_LOOKUP, ferr, addr)
+		return err
+	}
+
+	response := msg.NewMsgResponse(msg.PEER_ACTION_LOOKUP, false, request.Peername, peerAddr)
+	response.Id = request.Id
+	response.Key = peerKey
+	if _, err := stun.send(response, addr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delivers the given datagram to the lookup
+// waiting for it if it is a sibling answer,
+// answering the requester once the lookup is
+// settled. Returns whether the datagram was an
+// answer, late ones are consumed too so they
+// are never answered back
+func (stun Stun) resolveLookup(data []byte, addr *net.UDPAddr) bool {
+	if !stun.isSibling(addr) {
+		return false
+	}
+
+	var response msg.MsgResponse
+	if err := stun.unmarshal(data, &response); err != nil || response.Action != msg.PEER_ACTION_LOOKUP {
+		return false
+	}
+	lookup, settled := stun.lookups.resolve(response)
+	if !settled {
+		return true
+	}
+
+	if response.HasError {
+		stun.answerLookup(lookup, nil, fmt.Errorf("peer `%s` not found in sibling servers", lookup.request.Message))
+	} else {
+		stun.answerLookup(lookup, &response, nil)
+	}
+	return true
+}
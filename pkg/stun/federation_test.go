@@ -0,0 +1,284 @@
+package stun
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the address the given
+// connection is bound to
+func localAddr(conn UDPStunConn) *net.UDPAddr {
+	return conn.(*net.UDPConn).LocalAddr().(*net.UDPAddr)
+}
+
+// Creates a stun server listening on
+// a random loopback port
+func newLocalStun(t *testing.T, store PeerConnectionStore, options StunOptions) *Stun {
+	stun, err := NewStun("127.0.0.1:0", store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stun
+}
+
+// Serves the given stun server until the test
+// ends and returns the address it listens on
+func serveStun(t *testing.T, stun *Stun) *net.UDPAddr {
+	result := make(chan error, 1)
+	go func() { result <- stun.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		stun.Shutdown(context.Background())
+		<-result
+	})
+	return localAddr(stun.conn)
+}
+
+// Starts a stun server listening on a random
+// loopback port that is stopped once the test
+// ends and returns it with his address
+func startStun(t *testing.T, options StunOptions) (*Stun, *net.UDPAddr) {
+	stun := newLocalStun(t, NewMemoryPeerConnectionStore(), options)
+	return stun, serveStun(t, stun)
+}
+
+// Creates a new client listening on a random
+// loopback port that talks to the given server.
+// The client is closed once the test ends
+func newLocalClient(t *testing.T, saddr *net.UDPAddr, options ClientStunOptions) *DefaultStunClient {
+	laddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := NewDefaultStunClient(conn, saddr, options)
+	client.Collect()
+	return client
+}
+
+// Registers a new client listening on a random
+// loopback port into the given stun server. The
+// client disconnects once the test ends
+func registerClient(t *testing.T, saddr *net.UDPAddr, peername string) (*DefaultStunClient, ed25519.PublicKey) {
+	public, identity, _ := ed25519.GenerateKey(nil)
+	client := newLocalClient(t, saddr, NewClientStunOptions(false, 10).WithIdentity(identity))
+
+	if _, err := client.Request(timeoutContext(t, 1), peername, msg.STUN_ACTION_NEW, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Request(timeoutContext(t, 1), peername, msg.STUN_ACTION_DISCONNECT, "")
+	})
+	return client, public
+}
+
+// Starts two stun servers listening on random
+// loopback ports that are siblings of each other
+func startSiblings(t *testing.T, timeout time.Duration) (*net.UDPAddr, *net.UDPAddr) {
+	first := newLocalStun(t, NewMemoryPeerConnectionStore(), NewStunOptions(false).WithSiblings(nil, timeout))
+	second := newLocalStun(t, NewMemoryPeerConnectionStore(), NewStunOptions(false).WithSiblings(nil, timeout))
+	first.siblings = []*net.UDPAddr{localAddr(second.conn)}
+	second.siblings = []*net.UDPAddr{localAddr(first.conn)}
+	return serveStun(t, first), serveStun(t, second)
+}
+
+func TestPendingLookups(t *testing.T) {
+	assert := require.New(t)
+	never := func() {}
+
+	t.Run("test_pending_lookups_settled_by_first_found", func(t *testing.T) {
+		pending := newPendingLookups()
+		pending.open("id", &pendingLookup{}, 2, time.Minute, never)
+
+		_, settled := pending.resolve(msg.MsgResponse{Id: "other"})
+		assert.False(settled)
+		lookup, settled := pending.resolve(msg.MsgResponse{Id: "id", Message: "found"})
+		assert.True(settled)
+		assert.NotNil(lookup)
+
+		_, settled = pending.resolve(msg.MsgResponse{Id: "id", Message: "late"})
+		assert.False(settled)
+		assert.Empty(pending.lookups)
+	})
+
+	t.Run("test_pending_lookups_settled_by_last_not_found", func(t *testing.T) {
+		pending := newPendingLookups()
+		pending.open("id", &pendingLookup{}, 2, time.Minute, never)
+
+		_, settled := pending.resolve(msg.MsgResponse{Id: "id", HasError: true})
+		assert.False(settled)
+		_, settled = pending.resolve(msg.MsgResponse{Id: "id", HasError: true})
+		assert.True(settled)
+	})
+
+	t.Run("test_pending_lookups_expire", func(t *testing.T) {
+		pending := newPendingLookups()
+		expired := make(chan struct{})
+		pending.open("id", &pendingLookup{}, 1, time.Millisecond, func() { close(expired) })
+
+		select {
+		case <-expired:
+		case <-time.After(time.Second):
+			t.Fatal("lookup never expired")
+		}
+	})
+
+	t.Run("test_pending_lookups_discard", func(t *testing.T) {
+		pending := newPendingLookups()
+		pending.open("id", &pendingLookup{}, 1, time.Minute, never)
+
+		_, discarded := pending.discard("id")
+		assert.True(discarded)
+		_, discarded = pending.discard("id")
+		assert.False(discarded)
+		_, settled := pending.resolve(msg.MsgResponse{Id: "id"})
+		assert.False(settled)
+	})
+}
+
+func TestStunSiblings(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_new_stun_fail_resolve_siblings", func(t *testing.T) {
+		options := NewStunOptions(false).WithSiblings([]string{"fakeaddr"}, time.Second)
+
+		_, err := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), options)
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "cannot resolve sibling")
+	})
+
+	t.Run("test_is_sibling", func(t *testing.T) {
+		options := NewStunOptions(false).WithSiblings([]string{"127.0.0.1:60002"}, time.Second)
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), options)
+		stun.Close()
+
+		sibling, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60002")
+		stranger, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+
+		assert.True(stun.isSibling(sibling))
+		assert.False(stun.isSibling(stranger))
+		assert.False(stun.isSibling(nil))
+	})
+
+	t.Run("test_lookup_without_siblings", func(t *testing.T) {
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), NewStunOptions(false))
+		stun.Close()
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50010")
+		err := stun.lookup(msg.NewMsgRequest(msg.STUN_ACTION_GET, "alice", "bob"), addr.String(), addr)
+
+		assert.Error(err)
+	})
+
+	t.Run("test_lookup_does_not_wait_for_siblings", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50010")
+		conn := newQueueUDPStunConnMock(addr, 4)
+		options := NewStunOptions(false).WithSiblings([]string{"127.0.0.1:60003"}, 100*time.Millisecond)
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), options)
+		stun.Close()
+		stun.conn = conn
+
+		started := time.Now()
+		err := stun.lookup(msg.NewMsgRequest(msg.STUN_ACTION_GET, "alice", "bob"), addr.String(), addr)
+		assert.NoError(err)
+		assert.Less(int64(time.Since(started)), int64(100*time.Millisecond))
+
+		// the forwarded lookup and, once
+		// it expires, the requester answer
+		<-conn.out
+		var response msg.MsgResponse
+		assert.NoError(msg.Decode(<-conn.out, &response))
+		assert.Equal(msg.PEER_ACTION_GET, response.Action)
+		assert.Equal(msg.ERROR_CODE_PEER_NOT_FOUND, response.Code)
+		assert.Empty(stun.lookups.lookups)
+	})
+
+	t.Run("test_lookup_request_fail_not_sibling", func(t *testing.T) {
+		store := NewMemoryPeerConnectionStore()
+		store.peers["bob"] = "127.0.0.1:50011"
+		store.keys["bob"] = "key"
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		stun, _ := NewStun("127.0.0.1:0", store, NewStunOptions(false))
+		stun.Close()
+		stun.conn = conn
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+
+		err := stun.handleLookupRequest(msg.NewMsgRequest(msg.STUN_ACTION_LOOKUP, "alice", "bob"), addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.PEER_ACTION_LOOKUP, response.Action)
+		assert.Equal(msg.ERROR_CODE_UNAUTHORIZED, response.Code)
+	})
+
+	t.Run("test_lookup_answer_from_stranger_is_refused", func(t *testing.T) {
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), NewStunOptions(false))
+		stun.Close()
+		stun.conn = conn
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		answer, _ := msg.Encode(msg.JSONCodec{}, msg.NewMsgResponse(msg.PEER_ACTION_LOOKUP, false, "alice", "127.0.0.1:50011"))
+
+		assert.False(stun.resolveLookup(answer, addr))
+		_, err := stun.handle(answer, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.ERROR_CODE_UNKNOWN_ACTION, response.Code)
+	})
+}
+
+func TestStunFederation(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_get_request_resolved_by_sibling", func(t *testing.T) {
+		first, second := startSiblings(t, time.Second)
+
+		alice, aliceKey := registerClient(t, first, "alice")
+		bob, bobKey := registerClient(t, second, "bob")
+
+		response, err := alice.Request(timeoutContext(t, 2), "alice", msg.STUN_ACTION_GET, "bob")
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_GET, response.Action)
+		assert.Equal(localAddr(bob.conn).String(), response.Message)
+		assert.Equal(msg.EncodeKey(bobKey), response.Key)
+
+		// bob is introduced to alice by his own server
+		introduction := bob.Listen()
+		assert.Equal(msg.PEER_ACTION_INTRODUCE, introduction.Action)
+		assert.Equal("alice", introduction.Peername)
+		assert.Equal(localAddr(alice.conn).String(), introduction.Message)
+		assert.Equal(msg.EncodeKey(aliceKey), introduction.Key)
+		assert.Equal(second.String(), introduction.Addr.String())
+	})
+
+	t.Run("test_get_request_not_found_in_siblings", func(t *testing.T) {
+		first, _ := startSiblings(t, time.Second)
+
+		alice, _ := registerClient(t, first, "alice")
+
+		_, err := alice.Request(timeoutContext(t, 2), "alice", msg.STUN_ACTION_GET, "bob")
+		assert.True(errors.Is(err, ErrPeerNotFound))
+	})
+
+	t.Run("test_get_request_sibling_timeout", func(t *testing.T) {
+		_, saddr := startStun(t, NewStunOptions(false).WithSiblings([]string{"127.0.0.1:60003"}, 100*time.Millisecond))
+
+		alice, _ := registerClient(t, saddr, "alice")
+
+		_, err := alice.Request(timeoutContext(t, 2), "alice", msg.STUN_ACTION_GET, "bob")
+		assert.True(errors.Is(err, ErrPeerNotFound))
+	})
+}
@@ -0,0 +1,335 @@
+package stun
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Log entries written before the
+	// store is compacted into a snapshot
+	DEFAULT_COMPACTION_THRESHOLD = 1024
+
+	FILE_STORE_SNAPSHOT = "snapshot.json"
+	FILE_STORE_LOG      = "store.log"
+)
+
+// Operations written into the store log
+const (
+	logOpSave    = "save"
+	logOpDelete  = "delete"
+	logOpUpdate  = "update"
+	logOpToken   = "token"
+	logOpKey     = "key"
+	logOpExpire  = "expire"
+	logOpExpired = "expired"
+)
+
+// Change applied to the store as it is
+// appended to the log. The time is the
+// expiration of `expire` entries and the
+// sweep time of `expired` ones
+type logEntry struct {
+	Op    string    `json:"op"`
+	Peer  string    `json:"peer,omitempty"`
+	Value string    `json:"value,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Applies the given log entry to the given store
+func (entry logEntry) apply(store PeerConnectionStore) error {
+	switch entry.Op {
+	case logOpSave:
+		return store.SavePeerRemoteAddr(entry.Peer, entry.Value)
+	case logOpDelete:
+		return store.DeletePeerRemoteAddr(entry.Peer)
+	case logOpUpdate:
+		return store.UpdatePeerRemoteAddr(entry.Peer, entry.Value)
+	case logOpToken:
+		return store.SavePeerToken(entry.Peer, entry.Value)
+	case logOpKey:
+		return store.SavePeerKey(entry.Peer, entry.Value)
+	case logOpExpire:
+		return store.SetPeerExpiration(entry.Peer, entry.Time)
+	case logOpExpired:
+		_, err := store.DeleteExpiredPeers(entry.Time)
+		return err
+	default:
+		return fmt.Errorf("unknown store log operation `%s`", entry.Op)
+	}
+}
+
+// Peer connection store persisted into the given
+// directory, so a restarted server comes back
+// knowing who was registered. Registrations are
+// kept in memory and every change is appended
+// to a log, which is compacted into a snapshot
+// once it grows too much. Changes reach the disk
+// once they are written but they are only synced
+// when the store is compacted or closed
+type filePeerConnectionStore struct {
+	// serializes the changes so they are
+	// logged in the order they are applied
+	sync.Mutex
+	memory       *memoryPeerConnectionStore
+	dir          string
+	log          *os.File
+	entries      int
+	compactEvery int
+}
+
+// Returns the path of the given store file
+func (store *filePeerConnectionStore) path(name string) string {
+	return filepath.Join(store.dir, name)
+}
+
+// Applies the given change and appends it
+// to the log if it succeeds
+func (store *filePeerConnectionStore) apply(entry logEntry) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if err := entry.apply(store.memory); err != nil {
+		return err
+	}
+	return store.append(entry)
+}
+
+// Appends the given entry to the log and compacts
+// it once the threshold is reached. The store
+// lock must be held
+func (store *filePeerConnectionStore) append(entry logEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := store.log.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("cannot write store log: %s", err)
+	}
+
+	store.entries++
+	if store.entries >= store.compactEvery {
+		return store.compact()
+	}
+	return nil
+}
+
+// Writes the current registrations into a new
+// snapshot and empties the log. The snapshot is
+// written aside and renamed, so a crash never
+// leaves a partial one behind. The store lock
+// must be held
+func (store *filePeerConnectionStore) compact() error {
+	tmp, err := os.Create(store.path(FILE_STORE_SNAPSHOT + ".tmp"))
+	if err != nil {
+		return fmt.Errorf("cannot create store snapshot: %s", err)
+	}
+
+	if err := store.memory.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), store.path(FILE_STORE_SNAPSHOT)); err != nil {
+		return fmt.Errorf("cannot save store snapshot: %s", err)
+	}
+
+	// entries already in the snapshot are replayed
+	// harmlessly if the log cannot be emptied
+	if err := store.log.Truncate(0); err != nil {
+		return fmt.Errorf("cannot truncate store log: %s", err)
+	}
+	if _, err := store.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	store.entries = 0
+	return nil
+}
+
+// Loads the last snapshot and replays the log
+// on top of it. A torn entry at the end of the
+// log, i.e. the server crashed while writing it,
+// ends the replay
+func (store *filePeerConnectionStore) load() error {
+	snapshot, err := os.Open(store.path(FILE_STORE_SNAPSHOT))
+	if err == nil {
+		err = store.memory.Restore(snapshot)
+		snapshot.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("cannot open store snapshot: %s", err)
+	}
+
+	scanner := bufio.NewScanner(store.log)
+	for scanner.Scan() {
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break
+		}
+		// changes that did not apply at first
+		// fail again so they can be skipped
+		entry.apply(store.memory)
+	}
+	return nil
+}
+
+// Saves the given addr for the given peer
+func (store *filePeerConnectionStore) SavePeerRemoteAddr(peer string, addr string) error {
+	return store.apply(logEntry{Op: logOpSave, Peer: peer, Value: addr})
+}
+
+// Removes the given peer addr if the peer exists
+func (store *filePeerConnectionStore) DeletePeerRemoteAddr(peer string) error {
+	return store.apply(logEntry{Op: logOpDelete, Peer: peer})
+}
+
+// Retrieves the peer addr by giving his name
+func (store *filePeerConnectionStore) GetPeerRemoteAddr(peer string) (string, error) {
+	return store.memory.GetPeerRemoteAddr(peer)
+}
+
+// Get connected peers to the stun server
+func (store *filePeerConnectionStore) GetConnectedPeers() ([]PeerInfo, error) {
+	return store.memory.GetConnectedPeers()
+}
+
+// Replaces the addr of the given peer
+// if the peer exists
+func (store *filePeerConnectionStore) UpdatePeerRemoteAddr(peer string, addr string) error {
+	return store.apply(logEntry{Op: logOpUpdate, Peer: peer, Value: addr})
+}
+
+// Saves the session token issued to
+// the given peer
+func (store *filePeerConnectionStore) SavePeerToken(peer string, token string) error {
+	return store.apply(logEntry{Op: logOpToken, Peer: peer, Value: token})
+}
+
+// Retrieves the session token issued
+// to the given peer
+func (store *filePeerConnectionStore) GetPeerToken(peer string) (string, error) {
+	return store.memory.GetPeerToken(peer)
+}
+
+// Saves the public key that identifies
+// the given peer
+func (store *filePeerConnectionStore) SavePeerKey(peer string, key string) error {
+	return store.apply(logEntry{Op: logOpKey, Peer: peer, Value: key})
+}
+
+// Retrieves the public key that
+// identifies the given peer
+func (store *filePeerConnectionStore) GetPeerKey(peer string) (string, error) {
+	return store.memory.GetPeerKey(peer)
+}
+
+// Sets the time when the registration
+// of the given peer expires
+func (store *filePeerConnectionStore) SetPeerExpiration(peer string, expiration time.Time) error {
+	return store.apply(logEntry{Op: logOpExpire, Peer: peer, Time: expiration})
+}
+
+// Removes the peers whose registration expired
+// before the given time and returns their names.
+// Sweeps that remove nobody are not logged
+func (store *filePeerConnectionStore) DeleteExpiredPeers(now time.Time) ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	expired, err := store.memory.DeleteExpiredPeers(now)
+	if err != nil || len(expired) == 0 {
+		return expired, err
+	}
+	return expired, store.append(logEntry{Op: logOpExpired, Time: now})
+}
+
+// Writes every registration of the store
+// to the given writer, so it can be loaded
+// back later on by `Restore`
+func (store *filePeerConnectionStore) Snapshot(w io.Writer) error {
+	store.Lock()
+	defer store.Unlock()
+	return store.memory.Snapshot(w)
+}
+
+// Replaces every registration of the store with
+// the ones written by `Snapshot` to the given
+// reader and persists them right away
+func (store *filePeerConnectionStore) Restore(r io.Reader) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if err := store.memory.Restore(r); err != nil {
+		return err
+	}
+	return store.compact()
+}
+
+// Compacts the log into a snapshot and closes
+// it. The store cannot be changed afterwards
+func (store *filePeerConnectionStore) Close() error {
+	store.Lock()
+	defer store.Unlock()
+
+	if err := store.compact(); err != nil {
+		store.log.Close()
+		return err
+	}
+	return store.log.Close()
+}
+
+// Creates a new peer connection store persisted
+// into the given directory, loading the
+// registrations saved there before. The log is
+// compacted every given number of entries, or
+// every `DEFAULT_COMPACTION_THRESHOLD` if it
+// is not positive
+func NewFilePeerConnectionStore(dir string, compactEvery int) (*filePeerConnectionStore, error) {
+	if compactEvery <= 0 {
+		compactEvery = DEFAULT_COMPACTION_THRESHOLD
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create store directory: %s", err)
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, FILE_STORE_LOG), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open store log: %s", err)
+	}
+
+	store := &filePeerConnectionStore{
+		memory:       NewMemoryPeerConnectionStore(),
+		dir:          dir,
+		log:          log,
+		compactEvery: compactEvery,
+	}
+
+	// the recovered registrations are compacted
+	// so torn entries are dropped from the log
+	if err := store.load(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	if err := store.compact(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,189 @@
+package stun
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Registers the given peer into the store
+// the same way the stun server does
+func registerPeer(store PeerConnectionStore, peer string, addr string, expiration time.Time) {
+	store.SavePeerRemoteAddr(peer, addr)
+	store.SavePeerKey(peer, "key-"+peer)
+	store.SavePeerToken(peer, "token-"+peer)
+	store.SetPeerExpiration(peer, expiration)
+}
+
+func TestFilePeerConnectionStore(t *testing.T) {
+	assert := require.New(t)
+	expiration := time.Now().Add(time.Minute).Round(0)
+
+	t.Run("test_file_store_is_peer_connection_store", func(t *testing.T) {
+		store, err := NewFilePeerConnectionStore(t.TempDir(), 0)
+		assert.NoError(err)
+		defer store.Close()
+
+		assert.Implements((*PeerConnectionStore)(nil), store)
+	})
+
+	t.Run("test_file_store_survives_restart", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := NewFilePeerConnectionStore(dir, 0)
+		registerPeer(store, "dog", "127.0.0.1:1000", expiration)
+		registerPeer(store, "cat", "127.0.0.1:1001", expiration)
+		store.UpdatePeerRemoteAddr("dog", "127.0.0.1:2000")
+		store.DeletePeerRemoteAddr("cat")
+
+		// the first store is never closed, as
+		// if the server crashed
+		restarted, err := NewFilePeerConnectionStore(dir, 0)
+		assert.NoError(err)
+		defer restarted.Close()
+
+		addr, err := restarted.GetPeerRemoteAddr("dog")
+		assert.NoError(err)
+		assert.Equal("127.0.0.1:2000", addr)
+		key, _ := restarted.GetPeerKey("dog")
+		assert.Equal("key-dog", key)
+		token, _ := restarted.GetPeerToken("dog")
+		assert.Equal("token-dog", token)
+		assert.True(expiration.Equal(restarted.memory.expirations["dog"]))
+
+		_, err = restarted.GetPeerRemoteAddr("cat")
+		assert.Error(err)
+	})
+
+	t.Run("test_file_store_expired_peers_survive_restart", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := NewFilePeerConnectionStore(dir, 0)
+		registerPeer(store, "dog", "127.0.0.1:1000", expiration)
+		registerPeer(store, "cat", "127.0.0.1:1001", time.Now().Add(-time.Minute))
+
+		expired, err := store.DeleteExpiredPeers(time.Now())
+		assert.NoError(err)
+		assert.Equal([]string{"cat"}, expired)
+
+		restarted, _ := NewFilePeerConnectionStore(dir, 0)
+		defer restarted.Close()
+		peers, _ := restarted.GetConnectedPeers()
+		assert.Equal([]PeerInfo{{"dog", "127.0.0.1:1000", "key-dog"}}, peers)
+	})
+
+	t.Run("test_file_store_failed_changes_not_logged", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := NewFilePeerConnectionStore(dir, 0)
+		defer store.Close()
+		store.SavePeerRemoteAddr("dog", "127.0.0.1:1000")
+
+		assert.Error(store.SavePeerRemoteAddr("dog", "127.0.0.1:2000"))
+		assert.Error(store.SavePeerKey("cat", "key"))
+		_, err := store.DeleteExpiredPeers(time.Now())
+		assert.NoError(err)
+
+		assert.Equal(1, store.entries)
+	})
+
+	t.Run("test_file_store_compacts_log", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := NewFilePeerConnectionStore(dir, 3)
+		defer store.Close()
+
+		registerPeer(store, "dog", "127.0.0.1:1000", expiration)
+
+		assert.Equal(1, store.entries)
+		info, err := os.Stat(filepath.Join(dir, FILE_STORE_SNAPSHOT))
+		assert.NoError(err)
+		assert.NotZero(info.Size())
+
+		restarted, _ := NewFilePeerConnectionStore(dir, 3)
+		defer restarted.Close()
+		token, _ := restarted.GetPeerToken("dog")
+		assert.Equal("token-dog", token)
+	})
+
+	t.Run("test_file_store_close_compacts_log", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := NewFilePeerConnectionStore(dir, 0)
+		registerPeer(store, "dog", "127.0.0.1:1000", expiration)
+
+		assert.NoError(store.Close())
+
+		info, err := os.Stat(filepath.Join(dir, FILE_STORE_LOG))
+		assert.NoError(err)
+		assert.Zero(info.Size())
+		assert.Error(store.SavePeerRemoteAddr("cat", "127.0.0.1:1001"))
+	})
+
+	t.Run("test_file_store_drops_torn_entry", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := NewFilePeerConnectionStore(dir, 0)
+		registerPeer(store, "dog", "127.0.0.1:1000", expiration)
+		store.log.Write([]byte(`{"op":"save","peer":"cat","val`))
+
+		restarted, err := NewFilePeerConnectionStore(dir, 0)
+		assert.NoError(err)
+		defer restarted.Close()
+
+		addr, _ := restarted.GetPeerRemoteAddr("dog")
+		assert.Equal("127.0.0.1:1000", addr)
+		_, err = restarted.GetPeerRemoteAddr("cat")
+		assert.Error(err)
+	})
+
+	t.Run("test_file_store_snapshot_restore", func(t *testing.T) {
+		memory := NewMemoryPeerConnectionStore()
+		registerPeer(memory, "dog", "127.0.0.1:1000", expiration)
+		var snapshot bytes.Buffer
+		assert.NoError(memory.Snapshot(&snapshot))
+
+		dir := t.TempDir()
+		store, _ := NewFilePeerConnectionStore(dir, 0)
+		registerPeer(store, "cat", "127.0.0.1:1001", expiration)
+		assert.NoError(store.Restore(&snapshot))
+
+		restarted, _ := NewFilePeerConnectionStore(dir, 0)
+		defer restarted.Close()
+		peers, _ := restarted.GetConnectedPeers()
+		assert.Equal([]PeerInfo{{"dog", "127.0.0.1:1000", "key-dog"}}, peers)
+
+		var copied bytes.Buffer
+		assert.NoError(restarted.Snapshot(&copied))
+		assert.Contains(copied.String(), "token-dog")
+	})
+
+	t.Run("test_file_store_restore_fail_invalid_snapshot", func(t *testing.T) {
+		store, _ := NewFilePeerConnectionStore(t.TempDir(), 0)
+		defer store.Close()
+		registerPeer(store, "dog", "127.0.0.1:1000", expiration)
+
+		err := store.Restore(bytes.NewBufferString("bonks"))
+
+		assert.Error(err)
+		addr, _ := store.GetPeerRemoteAddr("dog")
+		assert.Equal("127.0.0.1:1000", addr)
+	})
+
+	t.Run("test_file_store_fail_invalid_snapshot_file", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, FILE_STORE_SNAPSHOT), []byte("bonks"), 0600)
+
+		_, err := NewFilePeerConnectionStore(dir, 0)
+
+		assert.Error(err)
+	})
+
+	t.Run("test_file_store_fail_invalid_dir", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "file")
+		os.WriteFile(file, []byte{}, 0600)
+
+		_, err := NewFilePeerConnectionStore(file, 0)
+
+		assert.Error(err)
+	})
+
+}
@@ -0,0 +1,160 @@
+package stun
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+const (
+	// How long an incomplete message waits without
+	// new fragments before his missing ones are
+	// asked for to his sender
+	FRAGMENT_NACK_INTERVAL = 100 * time.Millisecond
+	// Max number of times the missing fragments of
+	// a message are asked for without any of them
+	// arriving, the message expires afterwards
+	MAX_FRAGMENT_NACKS = 10
+)
+
+// Message whose fragments are still arriving
+type partialMessage struct {
+	source     *net.UDPAddr
+	id         string
+	fragments  [][]byte
+	received   int
+	size       int
+	expiration time.Time
+	updated    time.Time
+	nacks      int
+}
+
+// Missing fragments of a message
+// to be asked for to his sender
+type fragmentGap struct {
+	source *net.UDPAddr
+	nack   msg.MsgFragmentNack
+}
+
+// Reassembles the messages split into fragments
+// by their senders. Incomplete messages are
+// dropped once their timeout expires and only a
+// limited number of them are kept at once
+type reassembler struct {
+	sync.Mutex
+	messages   map[string]*partialMessage
+	timeout    time.Duration
+	maxPending int
+}
+
+// Drops the incomplete messages whose
+// timeout expired before the given time
+func (reassembler *reassembler) expire(now time.Time) {
+	for key, message := range reassembler.messages {
+		if message.expiration.Before(now) {
+			delete(reassembler.messages, key)
+		}
+	}
+}
+
+// Adds the given fragment sent from the given source
+// and returns the whole message once every fragment
+// has arrived, otherwise it returns nil
+func (reassembler *reassembler) add(source *net.UDPAddr, fragment msg.MsgFragment, now time.Time) ([]byte, error) {
+	if err := fragment.Validate(); err != nil {
+		return nil, err
+	}
+
+	reassembler.Lock()
+	defer reassembler.Unlock()
+	reassembler.expire(now)
+
+	key := source.String() + "/" + fragment.Id
+	message, exists := reassembler.messages[key]
+	if !exists {
+		if len(reassembler.messages) >= reassembler.maxPending {
+			return nil, fmt.Errorf("too many incomplete messages")
+		}
+
+		message = &partialMessage{
+			source:     source,
+			id:         fragment.Id,
+			fragments:  make([][]byte, fragment.Count),
+			expiration: now.Add(reassembler.timeout),
+		}
+		reassembler.messages[key] = message
+	}
+
+	if len(message.fragments) != fragment.Count {
+		delete(reassembler.messages, key)
+		return nil, fmt.Errorf("fragment count mismatch for message %s", fragment.Id)
+	}
+
+	// duplicated fragments are ignored
+	if message.fragments[fragment.Index] != nil {
+		return nil, nil
+	}
+
+	message.size += len(fragment.Data)
+	if message.size > msg.MAX_MESSAGE_SIZE {
+		delete(reassembler.messages, key)
+		return nil, fmt.Errorf("message %s too large", fragment.Id)
+	}
+
+	message.fragments[fragment.Index] = fragment.Data
+	message.received++
+	message.updated = now
+	message.nacks = 0
+	if message.received < fragment.Count {
+		return nil, nil
+	}
+
+	delete(reassembler.messages, key)
+	return bytes.Join(message.fragments, nil), nil
+}
+
+// Returns the missing fragments of the incomplete
+// messages that got no new fragment during the given
+// interval, at most `msg.MAX_FRAGMENT_NACK_SIZE` of
+// them per message. Every message is asked for at
+// most `MAX_FRAGMENT_NACKS` times in a row
+func (reassembler *reassembler) gaps(now time.Time, interval time.Duration) []fragmentGap {
+	reassembler.Lock()
+	defer reassembler.Unlock()
+	reassembler.expire(now)
+
+	gaps := []fragmentGap{}
+	for _, message := range reassembler.messages {
+		if now.Sub(message.updated) < interval || message.nacks >= MAX_FRAGMENT_NACKS {
+			continue
+		}
+
+		missing := []int{}
+		for index, data := range message.fragments {
+			if data == nil {
+				missing = append(missing, index)
+			}
+			if len(missing) == msg.MAX_FRAGMENT_NACK_SIZE {
+				break
+			}
+		}
+
+		message.updated = now
+		message.nacks++
+		gaps = append(gaps, fragmentGap{message.source, msg.MsgFragmentNack{Id: message.id, Missing: missing}})
+	}
+	return gaps
+}
+
+// Creates a new reassembler
+func newReassembler(timeout time.Duration, maxPending int) *reassembler {
+	return &reassembler{
+		messages:   map[string]*partialMessage{},
+		timeout:    timeout,
+		maxPending: maxPending,
+	}
+}
@@ -0,0 +1,148 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReassembler(t *testing.T) {
+	assert := require.New(t)
+	source, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50000")
+	other, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+
+	t.Run("test_reassemble_out_of_order", func(t *testing.T) {
+		payload := bytes.Repeat([]byte("guau"), msg.FRAGMENT_DATA_SIZE)
+		fragments, _ := msg.SplitMessage("id", payload)
+		reassembler := newReassembler(time.Second, 1)
+		now := time.Now()
+
+		for index := len(fragments) - 1; index > 0; index-- {
+			message, err := reassembler.add(source, fragments[index], now)
+			assert.NoError(err)
+			assert.Nil(message)
+		}
+		message, err := reassembler.add(source, fragments[0], now)
+
+		assert.NoError(err)
+		assert.Equal(payload, message)
+		assert.Empty(reassembler.messages)
+	})
+
+	t.Run("test_reassemble_ignores_duplicates", func(t *testing.T) {
+		fragments, _ := msg.SplitMessage("id", make([]byte, 2*msg.FRAGMENT_DATA_SIZE))
+		reassembler := newReassembler(time.Second, 1)
+		now := time.Now()
+
+		reassembler.add(source, fragments[0], now)
+		message, err := reassembler.add(source, fragments[0], now)
+
+		assert.NoError(err)
+		assert.Nil(message)
+		assert.Equal(1, reassembler.messages[source.String()+"/id"].received)
+	})
+
+	t.Run("test_reassemble_separates_sources", func(t *testing.T) {
+		fragments, _ := msg.SplitMessage("id", make([]byte, 2*msg.FRAGMENT_DATA_SIZE))
+		reassembler := newReassembler(time.Second, 2)
+		now := time.Now()
+
+		reassembler.add(source, fragments[0], now)
+		message, _ := reassembler.add(other, fragments[1], now)
+
+		assert.Nil(message)
+		assert.Len(reassembler.messages, 2)
+	})
+
+	t.Run("test_reassemble_drops_expired", func(t *testing.T) {
+		fragments, _ := msg.SplitMessage("id", make([]byte, 2*msg.FRAGMENT_DATA_SIZE))
+		reassembler := newReassembler(time.Second, 1)
+		now := time.Now()
+
+		reassembler.add(source, fragments[0], now)
+		message, err := reassembler.add(source, fragments[1], now.Add(2*time.Second))
+
+		assert.NoError(err)
+		assert.Nil(message)
+		assert.Equal(1, reassembler.messages[source.String()+"/id"].received)
+	})
+
+	t.Run("test_reassemble_fail_too_many_pending", func(t *testing.T) {
+		first, _ := msg.SplitMessage("first", make([]byte, 2*msg.FRAGMENT_DATA_SIZE))
+		second, _ := msg.SplitMessage("second", make([]byte, 2*msg.FRAGMENT_DATA_SIZE))
+		reassembler := newReassembler(time.Second, 1)
+		now := time.Now()
+
+		reassembler.add(source, first[0], now)
+		_, err := reassembler.add(source, second[0], now)
+
+		assert.Error(err)
+	})
+
+	t.Run("test_reassemble_fail_count_mismatch", func(t *testing.T) {
+		reassembler := newReassembler(time.Second, 1)
+		now := time.Now()
+
+		reassembler.add(source, msg.MsgFragment{Id: "id", Index: 0, Count: 2}, now)
+		_, err := reassembler.add(source, msg.MsgFragment{Id: "id", Index: 1, Count: 3}, now)
+
+		assert.Error(err)
+		assert.Empty(reassembler.messages)
+	})
+
+	t.Run("test_reassemble_fail_invalid_fragment", func(t *testing.T) {
+		reassembler := newReassembler(time.Second, 1)
+
+		_, err := reassembler.add(source, msg.MsgFragment{Id: "id", Index: 2, Count: 2}, time.Now())
+
+		assert.Error(err)
+	})
+
+	t.Run("test_reassemble_gaps", func(t *testing.T) {
+		fragments, _ := msg.SplitMessage("id", make([]byte, 4*msg.FRAGMENT_DATA_SIZE))
+		reassembler := newReassembler(time.Minute, 1)
+		now := time.Now()
+
+		reassembler.add(source, fragments[0], now)
+		reassembler.add(source, fragments[2], now)
+
+		assert.Empty(reassembler.gaps(now.Add(FRAGMENT_NACK_INTERVAL/2), FRAGMENT_NACK_INTERVAL))
+
+		gaps := reassembler.gaps(now.Add(FRAGMENT_NACK_INTERVAL), FRAGMENT_NACK_INTERVAL)
+		assert.Len(gaps, 1)
+		assert.Equal(source, gaps[0].source)
+		assert.Equal(msg.MsgFragmentNack{Id: "id", Missing: []int{1, 3}}, gaps[0].nack)
+		assert.NoError(gaps[0].nack.Validate())
+
+		// the gaps are not asked for again until
+		// another interval passes without fragments
+		assert.Empty(reassembler.gaps(now.Add(FRAGMENT_NACK_INTERVAL), FRAGMENT_NACK_INTERVAL))
+	})
+
+	t.Run("test_reassemble_gaps_bounded", func(t *testing.T) {
+		fragments, _ := msg.SplitMessage("id", make([]byte, 2*msg.MAX_FRAGMENT_NACK_SIZE*msg.FRAGMENT_DATA_SIZE))
+		reassembler := newReassembler(time.Minute, 1)
+		now := time.Now()
+
+		reassembler.add(source, fragments[0], now)
+
+		for i := 1; i <= MAX_FRAGMENT_NACKS; i++ {
+			gaps := reassembler.gaps(now.Add(time.Duration(i)*FRAGMENT_NACK_INTERVAL), FRAGMENT_NACK_INTERVAL)
+			assert.Len(gaps, 1)
+			assert.Len(gaps[0].nack.Missing, msg.MAX_FRAGMENT_NACK_SIZE)
+			assert.Equal(1, gaps[0].nack.Missing[0])
+		}
+		assert.Empty(reassembler.gaps(now.Add(time.Minute/2), FRAGMENT_NACK_INTERVAL))
+
+		// new fragments renew the requests
+		later := now.Add(time.Minute / 2)
+		reassembler.add(source, fragments[1], later)
+		gaps := reassembler.gaps(later.Add(FRAGMENT_NACK_INTERVAL), FRAGMENT_NACK_INTERVAL)
+		assert.Len(gaps, 1)
+		assert.Equal(2, gaps[0].nack.Missing[0])
+	})
+}
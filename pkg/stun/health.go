@@ -0,0 +1,256 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+const (
+	// Requests are sent to the last server that
+	// answered and to the next ones, in the given
+	// order, once it fails
+	SERVER_STRATEGY_FAILOVER = "Failover"
+	// Requests are sent to the healthy server that
+	// answers faster and to the next ones once it fails
+	SERVER_STRATEGY_HEALTHIEST = "Healthiest"
+	// Registrations are sent to every server, so
+	// peers are known by all of them, and lookups
+	// to the healthiest one
+	SERVER_STRATEGY_ALL = "All"
+)
+
+// Health of a stun server as seen by the client
+// from the probes and requests it answered.
+// Servers are assumed healthy until they fail
+type ServerHealth struct {
+	Addr *net.UDPAddr
+	// The server answered the last request
+	// and is not a standby
+	Healthy bool
+	// The server answered he is a standby
+	Standby bool
+	// Round trip time of the last answer
+	RTT time.Duration
+	// Requests that were not answered in a row
+	Failures int
+	// Time of the last answer, zero if the
+	// server never answered
+	LastSeen time.Time
+	// Why the last request failed, if it did
+	Err error
+}
+
+// Updates the health with the outcome of a
+// request answered after the given rtt.
+// Returns whether the server became healthy
+// or unhealthy because of it
+func (health *ServerHealth) update(rtt time.Duration, err error, now time.Time) bool {
+	healthy, standby := health.Healthy, health.Standby
+
+	var answered *ResponseError
+	switch {
+	case errors.Is(err, ErrStandby):
+		health.Healthy, health.Standby = false, true
+	case err == nil || errors.As(err, &answered):
+		// answered errors belong to the
+		// request, the server is alive
+		health.Healthy, health.Standby = true, false
+		err = nil
+	default:
+		health.Healthy = false
+		health.Failures++
+		health.Err = err
+		return healthy != health.Healthy
+	}
+
+	health.RTT = rtt
+	health.Failures = 0
+	health.LastSeen = now
+	health.Err = err
+	return healthy != health.Healthy || standby != health.Standby
+}
+
+// Stun servers a client talks to in order
+// of preference. Requests are sent to the
+// current one, which is the last that
+// answered, and to the next ones if it fails
+type serverList struct {
+	sync.Mutex
+	addrs   []*net.UDPAddr
+	health  []ServerHealth
+	current int
+}
+
+// Returns every server in the order requests
+// must try them with the given strategy
+func (servers *serverList) ordered(strategy string) []*net.UDPAddr {
+	servers.Lock()
+	defer servers.Unlock()
+
+	ordered := make([]*net.UDPAddr, 0, len(servers.addrs))
+	if strategy == SERVER_STRATEGY_FAILOVER {
+		for i := range servers.addrs {
+			ordered = append(ordered, servers.addrs[(servers.current+i)%len(servers.addrs)])
+		}
+		return ordered
+	}
+
+	// healthy servers go first, the faster ones
+	// before, and the rest keep their preference
+	indexes := make([]int, len(servers.addrs))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		a, b := servers.health[indexes[i]], servers.health[indexes[j]]
+		if a.Healthy != b.Healthy {
+			return a.Healthy
+		}
+		if a.RTT == 0 || b.RTT == 0 {
+			return a.RTT != 0 && b.RTT == 0
+		}
+		return a.RTT < b.RTT
+	})
+	for _, i := range indexes {
+		ordered = append(ordered, servers.addrs[i])
+	}
+	return ordered
+}
+
+// Makes the given server the current one
+func (servers *serverList) use(addr *net.UDPAddr) {
+	servers.Lock()
+	defer servers.Unlock()
+
+	for i, server := range servers.addrs {
+		if server == addr {
+			servers.current = i
+			return
+		}
+	}
+}
+
+// Returns the current server
+func (servers *serverList) get() *net.UDPAddr {
+	servers.Lock()
+	defer servers.Unlock()
+	return servers.addrs[servers.current]
+}
+
+// Returns every server in order of preference
+func (servers *serverList) all() []*net.UDPAddr {
+	servers.Lock()
+	defer servers.Unlock()
+	return append([]*net.UDPAddr{}, servers.addrs...)
+}
+
+// Records the outcome of a request sent to the
+// given server. Returns his health and whether
+// he became healthy or unhealthy because of it
+func (servers *serverList) record(addr *net.UDPAddr, rtt time.Duration, err error) (ServerHealth, bool) {
+	servers.Lock()
+	defer servers.Unlock()
+
+	for i, server := range servers.addrs {
+		if server == addr {
+			changed := servers.health[i].update(rtt, err, time.Now())
+			return servers.health[i], changed
+		}
+	}
+	return ServerHealth{}, false
+}
+
+// Returns the health of every server
+// in order of preference
+func (servers *serverList) report() []ServerHealth {
+	servers.Lock()
+	defer servers.Unlock()
+	return append([]ServerHealth{}, servers.health...)
+}
+
+// Creates a new server list whose
+// preferred server is the first one
+func newServerList(addrs ...*net.UDPAddr) *serverList {
+	health := make([]ServerHealth, len(addrs))
+	for i, addr := range addrs {
+		health[i] = ServerHealth{Addr: addr, Healthy: true}
+	}
+	return &serverList{addrs: addrs, health: health}
+}
+
+// Stun client that keeps track of the
+// health of the servers it talks to
+type HealthMonitor interface {
+	Probe(ctx context.Context) []ServerHealth
+	Monitor(ctx context.Context)
+	Health() []ServerHealth
+}
+
+// Records the outcome of a request sent to the
+// given server and tells the health handler, if
+// any, once he becomes healthy or unhealthy.
+// Cancelled requests tell nothing about him
+func (client DefaultStunClient) record(server *net.UDPAddr, rtt time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	health, changed := client.servers.record(server, rtt, err)
+	if changed && client.options.healthHandler != nil {
+		client.options.healthHandler(health)
+	}
+}
+
+// Probes every server at the same time until
+// they answer or the given context is done and
+// returns their health in order of preference
+func (client DefaultStunClient) Probe(ctx context.Context) []ServerHealth {
+	var wg sync.WaitGroup
+	for _, server := range client.servers.all() {
+		wg.Add(1)
+		go func(server *net.UDPAddr) {
+			defer wg.Done()
+			client.attempt(ctx, "", msg.STUN_ACTION_PROBE, "", server)
+		}(server)
+	}
+	wg.Wait()
+	return client.Health()
+}
+
+// Probes every server each probe interval of the
+// options until the given context is done. Every
+// round is bounded by the interval, so rounds
+// never overlap. Nothing is probed if the
+// interval is zero
+func (client DefaultStunClient) Monitor(ctx context.Context) {
+	interval := client.options.probeInterval
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		round, cancel := context.WithTimeout(ctx, interval)
+		client.Probe(round)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the health of every server
+// in order of preference
+func (client DefaultStunClient) Health() []ServerHealth {
+	return client.servers.report()
+}
@@ -0,0 +1,300 @@
+package stun
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerHealth(t *testing.T) {
+	assert := require.New(t)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60001")
+
+	t.Run("test_server_health_answered", func(t *testing.T) {
+		health := ServerHealth{Addr: addr, Healthy: true}
+		now := time.Now()
+
+		changed := health.update(10*time.Millisecond, nil, now)
+
+		assert.False(changed)
+		assert.True(health.Healthy)
+		assert.Equal(10*time.Millisecond, health.RTT)
+		assert.Equal(now, health.LastSeen)
+		assert.NoError(health.Err)
+	})
+
+	t.Run("test_server_health_answered_errors_are_healthy", func(t *testing.T) {
+		health := ServerHealth{Addr: addr, Healthy: false, Failures: 2, Err: ErrTimeout}
+
+		changed := health.update(time.Millisecond, &ResponseError{Code: msg.ERROR_CODE_PEER_NOT_FOUND}, time.Now())
+
+		assert.True(changed)
+		assert.True(health.Healthy)
+		assert.Zero(health.Failures)
+		assert.NoError(health.Err)
+	})
+
+	t.Run("test_server_health_failures", func(t *testing.T) {
+		health := ServerHealth{Addr: addr, Healthy: true, RTT: time.Millisecond}
+
+		assert.True(health.update(time.Second, ErrTimeout, time.Now()))
+		assert.False(health.update(time.Second, ErrTimeout, time.Now()))
+
+		assert.False(health.Healthy)
+		assert.Equal(2, health.Failures)
+		assert.Equal(time.Millisecond, health.RTT)
+		assert.True(health.LastSeen.IsZero())
+		assert.True(errors.Is(health.Err, ErrTimeout))
+	})
+
+	t.Run("test_server_health_standby", func(t *testing.T) {
+		health := ServerHealth{Addr: addr, Healthy: true}
+
+		changed := health.update(time.Millisecond, &ResponseError{Code: msg.ERROR_CODE_STANDBY}, time.Now())
+
+		assert.True(changed)
+		assert.False(health.Healthy)
+		assert.True(health.Standby)
+		assert.Zero(health.Failures)
+	})
+}
+
+func TestServerList(t *testing.T) {
+	assert := require.New(t)
+	first, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60001")
+	second, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60002")
+	third, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+
+	t.Run("test_server_list_failover_starts_by_current", func(t *testing.T) {
+		servers := newServerList(first, second, third)
+		servers.use(second)
+
+		assert.Equal([]*net.UDPAddr{second, third, first}, servers.ordered(SERVER_STRATEGY_FAILOVER))
+		assert.Equal(second, servers.get())
+		assert.Equal([]*net.UDPAddr{first, second, third}, servers.all())
+	})
+
+	t.Run("test_server_list_healthiest_first", func(t *testing.T) {
+		servers := newServerList(first, second, third)
+		servers.record(first, time.Second, ErrTimeout)
+		servers.record(third, time.Millisecond, nil)
+
+		// servers never measured go after the measured ones
+		assert.Equal([]*net.UDPAddr{third, second, first}, servers.ordered(SERVER_STRATEGY_HEALTHIEST))
+
+		servers.record(second, time.Microsecond, nil)
+		assert.Equal([]*net.UDPAddr{second, third, first}, servers.ordered(SERVER_STRATEGY_HEALTHIEST))
+	})
+
+	t.Run("test_server_list_record", func(t *testing.T) {
+		servers := newServerList(first, second)
+		stranger, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60004")
+
+		health, changed := servers.record(second, time.Second, ErrTimeout)
+		assert.True(changed)
+		assert.Equal(second, health.Addr)
+		assert.False(health.Healthy)
+
+		_, changed = servers.record(stranger, time.Second, ErrTimeout)
+		assert.False(changed)
+
+		report := servers.report()
+		assert.Len(report, 2)
+		assert.True(report[0].Healthy)
+		assert.False(report[1].Healthy)
+	})
+}
+
+// Collects the health changes told to a handler
+type healthEvents struct {
+	sync.Mutex
+	events []ServerHealth
+}
+
+// Records the given health change
+func (events *healthEvents) handle(health ServerHealth) {
+	events.Lock()
+	events.events = append(events.events, health)
+	events.Unlock()
+}
+
+// Returns the health changes told so far
+func (events *healthEvents) get() []ServerHealth {
+	events.Lock()
+	defer events.Unlock()
+	return append([]ServerHealth{}, events.events...)
+}
+
+func TestDefaultStunClientHealth(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_probe_reports_every_server", func(t *testing.T) {
+		events := &healthEvents{}
+		alive := startFakeStun(t, "127.0.0.1:60001", "")
+		standby := startFakeStun(t, "127.0.0.1:60002", msg.ERROR_CODE_STANDBY)
+		dead, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		options := NewClientStunOptions(false, 10).WithHealthCheck(time.Second, events.handle)
+		client := newFailoverClient(t, options, alive, standby, dead)
+
+		report := client.Probe(timeoutContext(t, 1))
+
+		assert.Len(report, 3)
+		assert.Equal(alive, report[0].Addr)
+		assert.True(report[0].Healthy)
+		assert.True(report[0].RTT > 0)
+		assert.False(report[1].Healthy)
+		assert.True(report[1].Standby)
+		assert.False(report[2].Healthy)
+		assert.Equal(1, report[2].Failures)
+		assert.True(errors.Is(report[2].Err, ErrTimeout))
+		assert.Equal(report, client.Health())
+
+		// only the servers whose health changed are told
+		assert.Len(events.get(), 2)
+	})
+
+	t.Run("test_requests_record_health", func(t *testing.T) {
+		dead, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		fallback := startFakeStun(t, "127.0.0.1:60002", "")
+		client := newFailoverClient(t, NewClientStunOptions(false, 10), dead, fallback)
+
+		_, err := client.Request(timeoutContext(t, 2), "dog", msg.STUN_ACTION_REFRESH, "")
+		assert.NoError(err)
+
+		report := client.Health()
+		assert.False(report[0].Healthy)
+		assert.True(report[1].Healthy)
+		assert.False(report[1].LastSeen.IsZero())
+	})
+
+	t.Run("test_healthiest_strategy_skips_unhealthy_servers", func(t *testing.T) {
+		dead, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		alive := startFakeStun(t, "127.0.0.1:60001", "")
+		options := NewClientStunOptions(false, 10).WithStrategy(SERVER_STRATEGY_HEALTHIEST)
+		client := newFailoverClient(t, options, dead, alive)
+		client.Probe(timeoutContext(t, 1))
+
+		response, err := client.Request(timeoutContext(t, 2), "dog", msg.STUN_ACTION_GET, "cat")
+
+		// the dead server only missed the probe
+		assert.NoError(err)
+		assert.Equal(alive.String(), response.Message)
+		assert.Equal(1, client.Health()[0].Failures)
+	})
+
+	t.Run("test_healthiest_strategy_sends_session_actions_to_the_registration", func(t *testing.T) {
+		other := startFakeStun(t, "127.0.0.1:60001", "")
+		registered := startFakeStun(t, "127.0.0.1:60002", "")
+		options := NewClientStunOptions(false, 10).WithStrategy(SERVER_STRATEGY_HEALTHIEST)
+		client := newFailoverClient(t, options, other, registered)
+		client.session.set(registered, "token")
+
+		// actions out of the session follow the strategy
+		response, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_PROBE, "")
+		assert.NoError(err)
+		assert.Equal(other.String(), response.Message)
+
+		for _, action := range []string{msg.STUN_ACTION_REFRESH, msg.STUN_ACTION_WATCH, msg.STUN_ACTION_GET} {
+			response, err := client.Request(timeoutContext(t, 1), "dog", action, "cat")
+			assert.NoError(err)
+			assert.Equal(registered.String(), response.Message)
+		}
+	})
+
+	t.Run("test_monitor_probes_until_done", func(t *testing.T) {
+		events := &healthEvents{}
+		alive := startFakeStun(t, "127.0.0.1:60001", "")
+		dead, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		options := NewClientStunOptions(false, 10).WithHealthCheck(500*time.Millisecond, events.handle)
+		client := newFailoverClient(t, options, alive, dead)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			client.Monitor(ctx)
+			close(stopped)
+		}()
+
+		eventually(t, 3*time.Second, func() bool {
+			report := client.Health()
+			return report[0].RTT > 0 && report[1].Failures >= 2
+		})
+		cancel()
+		<-stopped
+
+		assert.Len(events.get(), 1)
+		assert.Equal(dead, events.get()[0].Addr)
+	})
+
+	t.Run("test_monitor_disabled_without_interval", func(t *testing.T) {
+		alive := startFakeStun(t, "127.0.0.1:60001", "")
+		client := newFailoverClient(t, NewClientStunOptions(false, 10), alive)
+
+		client.Monitor(context.Background())
+
+		assert.True(client.Health()[0].LastSeen.IsZero())
+	})
+}
+
+func TestDefaultStunClientAllStrategy(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_all_strategy_registers_into_every_server", func(t *testing.T) {
+		first, faddr := startStun(t, NewStunOptions(false))
+		second, saddr := startStun(t, NewStunOptions(false))
+		_, identity, _ := ed25519.GenerateKey(nil)
+		options := NewClientStunOptions(false, 10).WithIdentity(identity).WithStrategy(SERVER_STRATEGY_ALL)
+		client := newFailoverClient(t, options, faddr, saddr)
+
+		_, err := client.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+
+		// every server issued his own session
+		firstToken, _ := first.store.GetPeerToken("alice")
+		secondToken, _ := second.store.GetPeerToken("alice")
+		assert.NotEmpty(firstToken)
+		assert.NotEmpty(secondToken)
+		assert.NotEqual(firstToken, secondToken)
+
+		_, err = client.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_REFRESH, "")
+		assert.NoError(err)
+
+		_, err = client.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_DISCONNECT, "")
+		assert.NoError(err)
+		_, err = first.store.GetPeerRemoteAddr("alice")
+		assert.Error(err)
+		_, err = second.store.GetPeerRemoteAddr("alice")
+		assert.Error(err)
+	})
+
+	t.Run("test_all_strategy_succeeds_while_a_server_is_down", func(t *testing.T) {
+		dead, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		alive := startFakeStun(t, "127.0.0.1:60001", "")
+		options := NewClientStunOptions(false, 10).WithStrategy(SERVER_STRATEGY_ALL)
+		client := newFailoverClient(t, options, dead, alive)
+
+		response, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_REFRESH, "")
+
+		assert.NoError(err)
+		assert.Equal(alive.String(), response.Message)
+		assert.False(client.Health()[0].Healthy)
+	})
+
+	t.Run("test_all_strategy_fails_with_answered_errors", func(t *testing.T) {
+		dead, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60003")
+		taken := startFakeStun(t, "127.0.0.1:60001", msg.ERROR_CODE_NAME_TAKEN)
+		options := NewClientStunOptions(false, 10).WithStrategy(SERVER_STRATEGY_ALL)
+		client := newFailoverClient(t, options, dead, taken)
+
+		_, err := client.Request(timeoutContext(t, 1), "dog", msg.STUN_ACTION_NEW, "")
+
+		assert.True(errors.Is(err, ErrNameTaken))
+	})
+}
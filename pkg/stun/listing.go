@@ -0,0 +1,183 @@
+package stun
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+// Profiles the peers registered into the server
+// told about themselves, indexed by their names.
+// Profiles are not stored, peers tell them again
+// whenever they register or refresh, so they are
+// back once a restarted server hears from them.
+// Until then the peers are kept private
+type profileTable struct {
+	sync.Mutex
+	profiles map[string]msg.PeerProfile
+}
+
+// Replaces the profile of the given peer
+func (table *profileTable) set(peername string, profile msg.PeerProfile) {
+	table.Lock()
+	table.profiles[peername] = profile
+	table.Unlock()
+}
+
+// Returns the profile of the given peer and
+// whether the server knows it. Peers that told
+// an empty profile are public without metadata
+func (table *profileTable) get(peername string) (msg.PeerProfile, bool) {
+	table.Lock()
+	defer table.Unlock()
+	profile, known := table.profiles[peername]
+	return profile, known
+}
+
+// Checks if the given peer is private, which
+// is also the case while his profile is unknown
+func (table *profileTable) private(peername string) bool {
+	profile, known := table.get(peername)
+	return !known || profile.Private
+}
+
+// Forgets the profile of the given peer
+func (table *profileTable) remove(peername string) {
+	table.Lock()
+	delete(table.profiles, peername)
+	table.Unlock()
+}
+
+// Creates a new profile table without profiles
+func newProfileTable() *profileTable {
+	return &profileTable{profiles: map[string]msg.PeerProfile{}}
+}
+
+// Checks the given metadata has every
+// entry of the wanted one
+func hasMetadata(metadata map[string]string, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if current, found := metadata[key]; !found || current != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the public peers other than the
+// requester that match the given query and
+// come after his cursor, sorted by their names
+func (stun Stun) search(requester string, query msg.PeerQuery) ([]msg.PeerListing, error) {
+	peers, err := stun.store.GetConnectedPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	listings := []msg.PeerListing{}
+	for _, peer := range peers {
+		if peer.Peername == requester || peer.Peername <= query.Cursor || !strings.HasPrefix(peer.Peername, query.Prefix) {
+			continue
+		}
+
+		profile, known := stun.profiles.get(peer.Peername)
+		if !known || profile.Private || !hasMetadata(profile.Metadata, query.Metadata) {
+			continue
+		}
+
+		listings = append(listings, msg.PeerListing{
+			Peername: peer.Peername,
+			Key:      peer.Key,
+			Metadata: profile.Metadata,
+		})
+	}
+
+	sort.Slice(listings, func(i, j int) bool {
+		return listings[i].Peername < listings[j].Peername
+	})
+	return listings, nil
+}
+
+// Builds the answer to the given list request
+// with the first of the given peers, as many as
+// the limit allows and fit into a single datagram.
+// The cursor of the page is only set when some
+// peer was left out for the next one
+func (stun Stun) listResponse(request msg.MsgRequest, peers []msg.PeerListing, limit int) (msg.MsgResponse, error) {
+	if limit > len(peers) {
+		limit = len(peers)
+	}
+
+	for size := limit; ; size-- {
+		page := msg.PeerPage{Peers: peers[:size]}
+		if size > 0 && size < len(peers) {
+			page.Cursor = peers[size-1].Peername
+		}
+
+		message, err := msg.EncodePage(page)
+		if err != nil {
+			return msg.MsgResponse{}, err
+		}
+
+		response := msg.NewMsgResponse(msg.PEER_ACTION_LIST, false, request.Peername, message)
+		response.Id = request.Id
+		response.Version = msg.PROTOCOL_VERSION
+		if size <= 1 {
+			return response, nil
+		}
+
+		serialized, err := stun.reply(response)
+		if err != nil {
+			return msg.MsgResponse{}, err
+		}
+		if len(serialized) <= msg.MAX_DATAGRAM_SIZE {
+			return response, nil
+		}
+	}
+}
+
+// Handles the list requests of registered peers,
+// answering the page of the public peers that
+// match the requested query. Private peers are
+// never listed, nor the requester himself
+func (stun Stun) handleListRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
+	if _, err := stun.store.GetPeerRemoteAddr(request.Peername); err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_LIST, msg.ERROR_CODE_PEER_NOT_FOUND, err.Error(), addr)
+		return err
+	}
+
+	if err := stun.authenticate(request); err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_LIST, msg.ERROR_CODE_UNAUTHORIZED, err.Error(), addr)
+		return err
+	}
+
+	query, err := msg.DecodeQuery(request.Message)
+	if err != nil {
+		stun.ReplyError(request, msg.PEER_ACTION_LIST, err.Error(), addr)
+		return err
+	}
+
+	limit := stun.options.listLimit
+	if query.Limit > 0 && query.Limit < limit {
+		limit = query.Limit
+	}
+
+	peers, err := stun.search(request.Peername, query)
+	if err != nil {
+		stun.ReplyError(request, msg.PEER_ACTION_LIST, err.Error(), addr)
+		return err
+	}
+
+	response, err := stun.listResponse(request, peers, limit)
+	if err != nil {
+		stun.ReplyError(request, msg.PEER_ACTION_LIST, err.Error(), addr)
+		return err
+	}
+
+	if _, err := stun.send(response, addr); err != nil {
+		return err
+	}
+	return nil
+}
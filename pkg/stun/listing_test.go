@@ -0,0 +1,238 @@
+package stun
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Lists the peers matching the given query on
+// behalf of bob and returns the answered page
+func listAsBob(t *testing.T, stun *Stun, store *memoryPeerConnectionStore, conn *UDPStunConnMock, query msg.PeerQuery) msg.PeerPage {
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+	message, _ := msg.EncodeQuery(query)
+	request := msg.NewMsgRequest(msg.STUN_ACTION_LIST, "bob", message)
+	request.Token = "token-bob"
+	store.keys["bob"] = signRequest(&request)
+
+	if err := stun.handleListRequest(request, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	var response msg.MsgResponse
+	msg.Decode(conn.writeToUDPMock.b, &response)
+	page, err := msg.DecodePage(response.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+// Returns the names of the peers of the given page
+func pageNames(page msg.PeerPage) []string {
+	names := []string{}
+	for _, peer := range page.Peers {
+		names = append(names, peer.Peername)
+	}
+	return names
+}
+
+func TestProfileTable(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_profile_table", func(t *testing.T) {
+		table := newProfileTable()
+		profile := msg.PeerProfile{Metadata: map[string]string{"room": "lobby"}, Private: true}
+
+		table.set("alice", profile)
+		current, known := table.get("alice")
+		assert.True(known)
+		assert.Equal(profile, current)
+
+		table.remove("alice")
+		_, known = table.get("alice")
+		assert.False(known)
+	})
+
+	t.Run("test_profile_table_private", func(t *testing.T) {
+		table := newProfileTable()
+		table.set("alice", msg.PeerProfile{Private: true})
+		table.set("bob", msg.PeerProfile{})
+
+		assert.True(table.private("alice"))
+		assert.False(table.private("bob"))
+		assert.True(table.private("carol"))
+	})
+}
+
+func TestStunHandleListRequest(t *testing.T) {
+	assert := require.New(t)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+	peers := map[string]string{
+		"bob":   addr.String(),
+		"alice": "127.0.0.1:50010",
+		"alan":  "127.0.0.1:50012",
+		"carol": "127.0.0.1:50013",
+		"dave":  "127.0.0.1:50014",
+	}
+
+	t.Run("test_list_request_fail_not_registered", func(t *testing.T) {
+		stun, _, conn := newWatchedStun(nil)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_LIST, "bob", "")
+
+		err := stun.handleListRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.PEER_ACTION_LIST, response.Action)
+		assert.Equal(msg.ERROR_CODE_PEER_NOT_FOUND, response.Code)
+	})
+
+	t.Run("test_list_request_fail_invalid_token", func(t *testing.T) {
+		stun, _, conn := newWatchedStun(peers)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_LIST, "bob", "")
+		request.Token = "fake"
+
+		err := stun.handleListRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.ERROR_CODE_UNAUTHORIZED, response.Code)
+	})
+
+	t.Run("test_list_request_fail_malformed_query", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(peers)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_LIST, "bob", "alice")
+		request.Token = "token-bob"
+		store.keys["bob"] = signRequest(&request)
+
+		err := stun.handleListRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.True(response.HasError)
+		assert.Contains(response.Message, "malformed")
+	})
+
+	t.Run("test_list_request_every_public_peer", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(peers)
+		stun.profiles.set("dave", msg.PeerProfile{Private: true})
+
+		page := listAsBob(t, stun, store, conn, msg.PeerQuery{})
+
+		// private peers and the requester are never listed
+		assert.Equal([]string{"alan", "alice", "carol"}, pageNames(page))
+		assert.Equal("key-alan", page.Peers[0].Key)
+		assert.Empty(page.Cursor)
+	})
+
+	t.Run("test_list_request_skips_peers_with_unknown_profiles", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(peers)
+		stun.profiles.remove("alice")
+
+		page := listAsBob(t, stun, store, conn, msg.PeerQuery{})
+
+		assert.Equal([]string{"alan", "carol", "dave"}, pageNames(page))
+	})
+
+	t.Run("test_list_request_prefix_and_metadata", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(peers)
+		stun.profiles.set("alice", msg.PeerProfile{Metadata: map[string]string{"room": "lobby", "lang": "es"}})
+		stun.profiles.set("alan", msg.PeerProfile{Metadata: map[string]string{"room": "kitchen"}})
+		stun.profiles.set("carol", msg.PeerProfile{Metadata: map[string]string{"room": "lobby"}})
+
+		page := listAsBob(t, stun, store, conn, msg.PeerQuery{Prefix: "al", Metadata: map[string]string{"room": "lobby"}})
+
+		assert.Equal([]string{"alice"}, pageNames(page))
+		assert.Equal(map[string]string{"room": "lobby", "lang": "es"}, page.Peers[0].Metadata)
+	})
+
+	t.Run("test_list_request_pages", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(peers)
+
+		first := listAsBob(t, stun, store, conn, msg.PeerQuery{Limit: 2})
+		assert.Equal([]string{"alan", "alice"}, pageNames(first))
+		assert.Equal("alice", first.Cursor)
+
+		second := listAsBob(t, stun, store, conn, msg.PeerQuery{Limit: 2, Cursor: first.Cursor})
+		assert.Equal([]string{"carol", "dave"}, pageNames(second))
+		assert.Empty(second.Cursor)
+	})
+
+	t.Run("test_list_request_limit_is_capped", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(peers)
+		stun.options = stun.options.WithListLimit(1)
+
+		page := listAsBob(t, stun, store, conn, msg.PeerQuery{Limit: 10})
+
+		assert.Equal([]string{"alan"}, pageNames(page))
+		assert.Equal("alan", page.Cursor)
+	})
+
+	t.Run("test_list_request_page_fits_into_a_datagram", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": addr.String()})
+		metadata := map[string]string{"bio": strings.Repeat("a", 200)}
+		for i := 0; i < 20; i++ {
+			peername := fmt.Sprintf("peer%02d", i)
+			registerPeer(store, peername, "127.0.0.1:50020", time.Now().Add(time.Minute))
+			stun.profiles.set(peername, msg.PeerProfile{Metadata: metadata})
+		}
+
+		page := listAsBob(t, stun, store, conn, msg.PeerQuery{})
+
+		assert.True(len(conn.writeToUDPMock.b) <= msg.MAX_DATAGRAM_SIZE)
+		assert.NotEmpty(page.Peers)
+		assert.True(len(page.Peers) < 20)
+		assert.Equal(page.Peers[len(page.Peers)-1].Peername, page.Cursor)
+	})
+}
+
+func TestStunList(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_list_peers_registered_with_profiles", func(t *testing.T) {
+		_, saddr := startStun(t, NewStunOptions(false))
+		bob, _ := registerClient(t, saddr, "bob")
+
+		// alice registers telling her profile
+		public, identity, _ := ed25519.GenerateKey(nil)
+		alice := newLocalClient(t, saddr, NewClientStunOptions(false, 10).WithIdentity(identity))
+		profile, _ := msg.EncodeProfile(msg.PeerProfile{Metadata: map[string]string{"room": "lobby"}})
+		_, err := alice.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_NEW, profile)
+		assert.NoError(err)
+
+		query, _ := msg.EncodeQuery(msg.PeerQuery{Metadata: map[string]string{"room": "lobby"}})
+		response, err := bob.Request(timeoutContext(t, 1), "bob", msg.STUN_ACTION_LIST, query)
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_LIST, response.Action)
+
+		page, err := msg.DecodePage(response.Message)
+		assert.NoError(err)
+		assert.Equal([]msg.PeerListing{{Peername: "alice", Key: msg.EncodeKey(public), Metadata: map[string]string{"room": "lobby"}}}, page.Peers)
+
+		// alice hides herself
+		private, _ := msg.EncodeProfile(msg.PeerProfile{Private: true})
+		_, err = alice.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_REFRESH, private)
+		assert.NoError(err)
+
+		response, err = bob.Request(timeoutContext(t, 1), "bob", msg.STUN_ACTION_LIST, "")
+		assert.NoError(err)
+		page, _ = msg.DecodePage(response.Message)
+		assert.Empty(page.Peers)
+
+		_, err = alice.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_DISCONNECT, "")
+		assert.NoError(err)
+	})
+}
@@ -1,27 +1,91 @@
 package stun
 
 import (
+	"context"
 	"encoding/json"
 	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
 )
 
-// UDP stun connection mock
+// UDP stun connection mock. Servers write
+// and close from their own goroutines, so
+// the state of the mocks is guarded
 type UDPStunConnMock struct {
+	sync.Mutex
 	readFromUDPMock *ReadFromUDPMock
 	writeToUDPMock  *WriteToUDPMock
 	closeMock       *CloseMock
+	closed          chan struct{}
+}
+
+// Returns the channel closed once the connection
+// is closed. The lock of the mock must be held
+func (conn *UDPStunConnMock) done() chan struct{} {
+	if conn.closed == nil {
+		conn.closed = make(chan struct{})
+	}
+	return conn.closed
 }
 
 func (conn *UDPStunConnMock) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	conn.Lock()
+	defer conn.Unlock()
+
 	conn.writeToUDPMock.b = b
 	conn.writeToUDPMock.addr = addr
+	if conn.readFromUDPMock != nil && conn.readFromUDPMock.echo != nil {
+		conn.readFromUDPMock.echo <- b
+	}
 	return conn.writeToUDPMock.send, conn.writeToUDPMock.err
 }
 
+// Reads the scripted datagrams until
+// the connection is closed
 func (conn *UDPStunConnMock) ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error) {
+	conn.Lock()
+	done := conn.done()
+	conn.Unlock()
+
+	select {
+	case <-done:
+		return 0, nil, net.ErrClosed
+	default:
+	}
+
+	// answers the written requests echoing back their ids
+	if conn.readFromUDPMock.echo != nil {
+		var written []byte
+		select {
+		case written = <-conn.readFromUDPMock.echo:
+		case <-done:
+			return 0, nil, net.ErrClosed
+		}
+
+		var request msg.MsgRequest
+		msg.Decode(written, &request)
+
+		response := *conn.readFromUDPMock.response
+		response.Id = request.Id
+		buff, _ := json.Marshal(response)
+
+		copy(b, buff)
+		return len(buff), nil, conn.readFromUDPMock.err
+	}
+
+	// the response is read once, later reads
+	// wait until the connection is closed
 	if conn.readFromUDPMock.response != nil {
+		if conn.readFromUDPMock.served {
+			<-done
+			return 0, nil, net.ErrClosed
+		}
+		conn.readFromUDPMock.served = true
+
 		buff, _ := json.Marshal(conn.readFromUDPMock.response)
 		conn.readFromUDPMock.b = b
 
@@ -38,15 +102,85 @@ func (conn *UDPStunConnMock) ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, er
 }
 
 func (conn *UDPStunConnMock) Close() error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if done := conn.done(); !isClosed(done) {
+		close(done)
+	}
+	if conn.closeMock == nil {
+		return nil
+	}
 	conn.closeMock.hasBeenCalled = true
 	return conn.closeMock.err
 }
 
+// Checks if the given channel is closed
+func isClosed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// UDP stun connection mock that reads the
+// datagrams queued into his input channel
+// and queues every written datagram into
+// his output channel
+type QueueUDPStunConnMock struct {
+	addr     *net.UDPAddr
+	in       chan []byte
+	out      chan []byte
+	deadline chan struct{}
+	once     sync.Once
+	closed   bool
+}
+
+func (conn *QueueUDPStunConnMock) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	conn.out <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (conn *QueueUDPStunConnMock) ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error) {
+	select {
+	case datagram := <-conn.in:
+		return copy(b, datagram), conn.addr, nil
+	case <-conn.deadline:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// Wakes up the blocked reads
+func (conn *QueueUDPStunConnMock) SetReadDeadline(t time.Time) error {
+	conn.once.Do(func() { close(conn.deadline) })
+	return nil
+}
+
+func (conn *QueueUDPStunConnMock) Close() error {
+	conn.closed = true
+	return nil
+}
+
+// Creates a queued connection mock whose
+// datagrams come from the given address
+func newQueueUDPStunConnMock(addr *net.UDPAddr, size int) *QueueUDPStunConnMock {
+	return &QueueUDPStunConnMock{
+		addr:     addr,
+		in:       make(chan []byte, size),
+		out:      make(chan []byte, size),
+		deadline: make(chan struct{}),
+	}
+}
+
 type ReadFromUDPMock struct {
 	b []byte
 
 	bb       []byte
 	response *msg.MsgResponse
+	served   bool
+	echo     chan []byte
 	err      error
 }
 
@@ -82,6 +216,13 @@ type MockPeerConnectionStore struct {
 	deletePeerRemoteAddrMock *DeletePeerRemoteAddrMock
 	getPeerRemoteAddrMock    *GetPeerRemoteAddrMock
 	getConnectedPeersMock    *GetConnectedPeersMock
+	updatePeerRemoteAddrMock *UpdatePeerRemoteAddrMock
+	setPeerExpirationMock    *SetPeerExpirationMock
+	deleteExpiredPeersMock   *DeleteExpiredPeersMock
+	savePeerTokenMock        *SavePeerTokenMock
+	getPeerTokenMock         *GetPeerTokenMock
+	savePeerKeyMock          *SavePeerKeyMock
+	getPeerKeyMock           *GetPeerKeyMock
 }
 
 func (store *MockPeerConnectionStore) SavePeerRemoteAddr(peer string, addr string) error {
@@ -101,6 +242,38 @@ func (store *MockPeerConnectionStore) GetPeerRemoteAddr(peer string) (string, er
 func (store *MockPeerConnectionStore) GetConnectedPeers() ([]PeerInfo, error) {
 	return store.getConnectedPeersMock.info, store.getConnectedPeersMock.err
 }
+func (store *MockPeerConnectionStore) UpdatePeerRemoteAddr(peer string, addr string) error {
+	store.updatePeerRemoteAddrMock.peer = peer
+	store.updatePeerRemoteAddrMock.addr = addr
+	return store.updatePeerRemoteAddrMock.err
+}
+func (store *MockPeerConnectionStore) SavePeerToken(peer string, token string) error {
+	store.savePeerTokenMock.peer = peer
+	store.savePeerTokenMock.token = token
+	return store.savePeerTokenMock.err
+}
+func (store *MockPeerConnectionStore) GetPeerToken(peer string) (string, error) {
+	store.getPeerTokenMock.peer = peer
+	return store.getPeerTokenMock.token, store.getPeerTokenMock.err
+}
+func (store *MockPeerConnectionStore) SavePeerKey(peer string, key string) error {
+	store.savePeerKeyMock.peer = peer
+	store.savePeerKeyMock.key = key
+	return store.savePeerKeyMock.err
+}
+func (store *MockPeerConnectionStore) GetPeerKey(peer string) (string, error) {
+	store.getPeerKeyMock.peer = peer
+	return store.getPeerKeyMock.key, store.getPeerKeyMock.err
+}
+func (store *MockPeerConnectionStore) SetPeerExpiration(peer string, expiration time.Time) error {
+	store.setPeerExpirationMock.peer = peer
+	store.setPeerExpirationMock.expiration = expiration
+	return store.setPeerExpirationMock.err
+}
+func (store *MockPeerConnectionStore) DeleteExpiredPeers(now time.Time) ([]string, error) {
+	store.deleteExpiredPeersMock.now = now
+	return store.deleteExpiredPeersMock.expired, store.deleteExpiredPeersMock.err
+}
 
 type SavePeerRemoteAddrMock struct {
 	peer string
@@ -126,3 +299,71 @@ type GetConnectedPeersMock struct {
 	info []PeerInfo
 	err  error
 }
+
+type UpdatePeerRemoteAddrMock struct {
+	peer string
+	addr string
+
+	err error
+}
+
+type SavePeerTokenMock struct {
+	peer  string
+	token string
+
+	err error
+}
+
+type GetPeerTokenMock struct {
+	peer string
+
+	token string
+	err   error
+}
+
+type SavePeerKeyMock struct {
+	peer string
+	key  string
+
+	err error
+}
+
+type GetPeerKeyMock struct {
+	peer string
+
+	key string
+	err error
+}
+
+type SetPeerExpirationMock struct {
+	peer       string
+	expiration time.Time
+
+	err error
+}
+
+type DeleteExpiredPeersMock struct {
+	now time.Time
+
+	expired []string
+	err     error
+}
+
+// Store whose lookups wait until released
+type blockingPeerConnectionStore struct {
+	PeerConnectionStore
+	release chan struct{}
+}
+
+func (store *blockingPeerConnectionStore) GetPeerRemoteAddr(peer string) (string, error) {
+	<-store.release
+	return store.PeerConnectionStore.GetPeerRemoteAddr(peer)
+}
+
+// Returns a context that expires after the given
+// seconds and is cancelled once the test ends
+func timeoutContext(t *testing.T, seconds int) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(seconds)*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
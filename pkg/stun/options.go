@@ -1,18 +1,178 @@
 package stun
 
+import (
+	"crypto/ed25519"
+	"net"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
 const (
 	DEFAULT_LOGGING          = true
 	DEFAULT_MAX_MSG_IN_QUEUE = 10
+	DEFAULT_LEASE_TTL        = 30 * time.Second
+	DEFAULT_SWEEP_INTERVAL   = 5 * time.Second
+	DEFAULT_WORKERS          = 32
+	DEFAULT_QUEUE_SIZE       = 256
+	DEFAULT_SIBLING_TIMEOUT  = 2 * time.Second
+	DEFAULT_LIST_LIMIT       = 50
+	DEFAULT_REPLAY_WINDOW    = 30 * time.Second
+
+	DEFAULT_REASSEMBLY_TIMEOUT   = 10 * time.Second
+	DEFAULT_MAX_PENDING_MESSAGES = 32
+
+	DEFAULT_REDIS_PREFIX           = "fox:peer:"
+	DEFAULT_REDIS_POOL_SIZE        = 8
+	DEFAULT_REDIS_TIMEOUT          = 5 * time.Second
+	DEFAULT_REDIS_EXPIRATION_GRACE = 5 * time.Minute
 )
 
 // Stun options struct
 type StunOptions struct {
-	logging bool
+	logging        bool
+	leaseTTL       time.Duration
+	sweepInterval  time.Duration
+	codec          msg.Codec
+	minVersion     int
+	workers        int
+	queueSize      int
+	shutdownNotice bool
+	siblings       []string
+	siblingTimeout time.Duration
+	listLimit      int
+	replayWindow   time.Duration
+
+	// replication between a primary
+	// and his standby servers
+	replicationAddr   string
+	replicationSecret string
+	primary           string
+	failoverTimeout   time.Duration
 }
 
 // Creates a new stun options
 func NewStunOptions(logging bool) StunOptions {
-	return StunOptions{logging: logging}
+	return StunOptions{
+		logging:        logging,
+		leaseTTL:       DEFAULT_LEASE_TTL,
+		sweepInterval:  DEFAULT_SWEEP_INTERVAL,
+		codec:          msg.BinaryCodec{},
+		minVersion:     msg.LEGACY_PROTOCOL_VERSION,
+		workers:        DEFAULT_WORKERS,
+		queueSize:      DEFAULT_QUEUE_SIZE,
+		siblingTimeout: DEFAULT_SIBLING_TIMEOUT,
+		listLimit:      DEFAULT_LIST_LIMIT,
+		replayWindow:   DEFAULT_REPLAY_WINDOW,
+	}
+}
+
+// Returns a copy of the options whose server
+// handles at most the given number of requests
+// at the same time. Up to queue size requests
+// wait for a worker, the server stops reading
+// datagrams until one of them is free
+func (options StunOptions) WithWorkers(workers int, queueSize int) StunOptions {
+	options.workers = workers
+	options.queueSize = queueSize
+	return options
+}
+
+// Returns a copy of the options whose server
+// rejects the requests written with a protocol
+// version older than the given one. Legacy peers,
+// which send no version, are accepted by default
+func (options StunOptions) WithMinVersion(version int) StunOptions {
+	options.minVersion = version
+	return options
+}
+
+// Returns a copy of the options whose peer
+// registrations last the given ttl unless they
+// are refreshed. Expired registrations are
+// removed every sweep interval
+func (options StunOptions) WithLease(ttl time.Duration, sweepInterval time.Duration) StunOptions {
+	options.leaseTTL = ttl
+	options.sweepInterval = sweepInterval
+	return options
+}
+
+// Returns a copy of the options whose server writes
+// the messages nobody asked for with the given codec.
+// Requests are read and answered with the codec they
+// were written with
+func (options StunOptions) WithCodec(codec msg.Codec) StunOptions {
+	options.codec = codec
+	return options
+}
+
+// Returns a copy of the options whose server
+// tells every registered peer it is going
+// away with `PEER_ACTION_SHUTDOWN` once it
+// has been shut down
+func (options StunOptions) WithShutdownNotice(notify bool) StunOptions {
+	options.shutdownNotice = notify
+	return options
+}
+
+// Returns a copy of the options whose server
+// asks the sibling servers listening on the
+// given addresses for the peers that are not
+// registered into him. Siblings are waited
+// for up to the given timeout
+func (options StunOptions) WithSiblings(siblings []string, timeout time.Duration) StunOptions {
+	options.siblings = siblings
+	options.siblingTimeout = timeout
+	return options
+}
+
+// Returns a copy of the options whose server
+// lists at most the given number of peers per
+// page, whatever the requester asks for. Pages
+// are cut shorter when they don't fit into a
+// single datagram. Limits below one are ignored
+func (options StunOptions) WithListLimit(limit int) StunOptions {
+	if limit > 0 {
+		options.listLimit = limit
+	}
+	return options
+}
+
+// Returns a copy of the options whose server
+// accepts the signed requests made up to the
+// given window ago, or ahead of his clock.
+// Requests seen within the window are replays
+func (options StunOptions) WithReplayWindow(window time.Duration) StunOptions {
+	options.replayWindow = window
+	return options
+}
+
+// Returns a copy of the options whose server
+// streams every change of his registrations to
+// the standby servers that connect to the given
+// tcp address. Standbys must prove they know
+// the given secret before anything is sent to
+// them. The store must implement
+// `SnapshotPeerConnectionStore`
+func (options StunOptions) WithReplication(addr string, secret string) StunOptions {
+	options.replicationAddr = addr
+	options.replicationSecret = secret
+	return options
+}
+
+// Returns a copy of the options whose server is
+// a standby that replicates the registrations of
+// the primary whose replication address is the
+// given one, both sharing the given secret. It
+// refuses every request until it is promoted, by
+// himself once the primary cannot be reached for
+// the given timeout or by calling `Promote` if
+// the timeout is zero
+func (options StunOptions) WithStandby(primary string, secret string, failoverTimeout time.Duration) StunOptions {
+	options.primary = primary
+	options.replicationSecret = secret
+	options.failoverTimeout = failoverTimeout
+	return options
 }
 
 // Creates a new default stun options
@@ -22,16 +182,156 @@ func DefaultStunOptions() StunOptions {
 
 // Client stun options struct
 type ClientStunOptions struct {
-	logging       bool
-	maxMsgInQueue int
+	logging            bool
+	maxMsgInQueue      int
+	identity           ed25519.PrivateKey
+	reassemblyTimeout  time.Duration
+	maxPendingMessages int
+	codec              msg.Codec
+	features           []string
+	fallbacks          []*net.UDPAddr
+	strategy           string
+	probeInterval      time.Duration
+	healthHandler      func(health ServerHealth)
 }
 
 // Creates a new client stun options
 func NewClientStunOptions(logging bool, maxMsgInQueue int) ClientStunOptions {
-	return ClientStunOptions{logging: logging, maxMsgInQueue: maxMsgInQueue}
+	return ClientStunOptions{
+		logging:            logging,
+		maxMsgInQueue:      maxMsgInQueue,
+		reassemblyTimeout:  DEFAULT_REASSEMBLY_TIMEOUT,
+		maxPendingMessages: DEFAULT_MAX_PENDING_MESSAGES,
+		codec:              msg.BinaryCodec{},
+		strategy:           SERVER_STRATEGY_FAILOVER,
+	}
+}
+
+// Returns a copy of the options whose client
+// signs every request with the given private
+// key. The stun server binds the registered
+// name to his public key. Clients without an
+// identity generate a random one
+func (options ClientStunOptions) WithIdentity(identity ed25519.PrivateKey) ClientStunOptions {
+	options.identity = identity
+	return options
+}
+
+// Returns a copy of the options whose client drops
+// the messages split into fragments that are not
+// complete after the given timeout. At most the
+// given number of incomplete messages are kept
+func (options ClientStunOptions) WithReassembly(timeout time.Duration, maxPending int) ClientStunOptions {
+	options.reassemblyTimeout = timeout
+	options.maxPendingMessages = maxPending
+	return options
+}
+
+// Returns a copy of the options whose client writes
+// his requests with the given codec. Responses are
+// read with the codec they were written with
+func (options ClientStunOptions) WithCodec(codec msg.Codec) ClientStunOptions {
+	options.codec = codec
+	return options
+}
+
+// Returns a copy of the options whose client
+// advertises the given optional features when
+// he registers into the network
+func (options ClientStunOptions) WithFeatures(features ...string) ClientStunOptions {
+	options.features = features
+	return options
+}
+
+// Returns a copy of the options whose client
+// fails over to the given servers, in order,
+// once the preferred one does not answer
+func (options ClientStunOptions) WithFallbacks(addrs ...*net.UDPAddr) ClientStunOptions {
+	options.fallbacks = addrs
+	return options
+}
+
+// Returns a copy of the options whose client
+// chooses the servers his requests are sent
+// to with the given strategy, i.e.
+// `SERVER_STRATEGY_HEALTHIEST`
+func (options ClientStunOptions) WithStrategy(strategy string) ClientStunOptions {
+	options.strategy = strategy
+	return options
+}
+
+// Returns a copy of the options whose client
+// probes every server each given interval when
+// monitored and calls the given handler, if
+// any, once a server becomes healthy or
+// unhealthy, whether a probe or a request
+// found it out
+func (options ClientStunOptions) WithHealthCheck(interval time.Duration, handler func(health ServerHealth)) ClientStunOptions {
+	options.probeInterval = interval
+	options.healthHandler = handler
+	return options
 }
 
 // Creates a new default client stun options
 func DefaultClientStunOptions() ClientStunOptions {
 	return NewClientStunOptions(DEFAULT_LOGGING, DEFAULT_MAX_MSG_IN_QUEUE)
 }
+
+// Redis store options struct
+type RedisStoreOptions struct {
+	prefix   string
+	poolSize int
+	timeout  time.Duration
+	grace    time.Duration
+	password string
+	database int
+}
+
+// Creates a new redis store options whose keys
+// start with the given prefix, so many networks
+// can share a redis server
+func NewRedisStoreOptions(prefix string) RedisStoreOptions {
+	return RedisStoreOptions{
+		prefix:   prefix,
+		poolSize: DEFAULT_REDIS_POOL_SIZE,
+		timeout:  DEFAULT_REDIS_TIMEOUT,
+		grace:    DEFAULT_REDIS_EXPIRATION_GRACE,
+	}
+}
+
+// Returns a copy of the options whose store keeps
+// up to the given idle connections and fails the
+// commands that take longer than the given timeout
+func (options RedisStoreOptions) WithPool(poolSize int, timeout time.Duration) RedisStoreOptions {
+	options.poolSize = poolSize
+	options.timeout = timeout
+	return options
+}
+
+// Returns a copy of the options whose store lets
+// redis drop the registrations the given grace
+// after their lease expired, in case no server
+// sweeps them before
+func (options RedisStoreOptions) WithExpirationGrace(grace time.Duration) RedisStoreOptions {
+	options.grace = grace
+	return options
+}
+
+// Returns a copy of the options whose store
+// authenticates with the given password
+func (options RedisStoreOptions) WithAuth(password string) RedisStoreOptions {
+	options.password = password
+	return options
+}
+
+// Returns a copy of the options whose store
+// saves the registrations in the given database
+func (options RedisStoreOptions) WithDatabase(database int) RedisStoreOptions {
+	options.database = database
+	return options
+}
+
+// Creates a new default redis store options
+func DefaultRedisStoreOptions() RedisStoreOptions {
+	return NewRedisStoreOptions(DEFAULT_REDIS_PREFIX)
+}
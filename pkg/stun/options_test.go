@@ -1,8 +1,12 @@
 package stun
 
 import (
+	"crypto/ed25519"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/alvarogf97/fox/pkg/msg"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,6 +19,8 @@ func TestStunOptions(t *testing.T) {
 		options := NewStunOptions(logging)
 
 		assert.Equal(logging, options.logging)
+		assert.Equal(DEFAULT_LEASE_TTL, options.leaseTTL)
+		assert.Equal(DEFAULT_SWEEP_INTERVAL, options.sweepInterval)
 	})
 
 	t.Run("test_new_stun_default_options", func(t *testing.T) {
@@ -22,6 +28,89 @@ func TestStunOptions(t *testing.T) {
 
 		assert.Equal(DEFAULT_LOGGING, options.logging)
 	})
+
+	t.Run("test_stun_options_with_lease", func(t *testing.T) {
+		ttl := time.Minute
+		sweepInterval := time.Second
+
+		options := DefaultStunOptions().WithLease(ttl, sweepInterval)
+
+		assert.Equal(ttl, options.leaseTTL)
+		assert.Equal(sweepInterval, options.sweepInterval)
+	})
+
+	t.Run("test_stun_options_with_min_version", func(t *testing.T) {
+		options := DefaultStunOptions().WithMinVersion(msg.PROTOCOL_VERSION)
+
+		assert.Equal(msg.PROTOCOL_VERSION, options.minVersion)
+		assert.Equal(msg.LEGACY_PROTOCOL_VERSION, DefaultStunOptions().minVersion)
+	})
+
+	t.Run("test_stun_options_with_workers", func(t *testing.T) {
+		options := DefaultStunOptions().WithWorkers(4, 8)
+
+		assert.Equal(4, options.workers)
+		assert.Equal(8, options.queueSize)
+		assert.Equal(DEFAULT_WORKERS, DefaultStunOptions().workers)
+		assert.Equal(DEFAULT_QUEUE_SIZE, DefaultStunOptions().queueSize)
+	})
+
+	t.Run("test_stun_options_with_shutdown_notice", func(t *testing.T) {
+		options := DefaultStunOptions().WithShutdownNotice(true)
+
+		assert.True(options.shutdownNotice)
+		assert.False(DefaultStunOptions().shutdownNotice)
+	})
+
+	t.Run("test_stun_options_with_siblings", func(t *testing.T) {
+		siblings := []string{"127.0.0.1:60002", "127.0.0.1:60003"}
+
+		options := DefaultStunOptions().WithSiblings(siblings, time.Second)
+
+		assert.Equal(siblings, options.siblings)
+		assert.Equal(time.Second, options.siblingTimeout)
+		assert.Empty(DefaultStunOptions().siblings)
+		assert.Equal(DEFAULT_SIBLING_TIMEOUT, DefaultStunOptions().siblingTimeout)
+	})
+
+	t.Run("test_stun_options_with_list_limit", func(t *testing.T) {
+		options := DefaultStunOptions().WithListLimit(10)
+
+		assert.Equal(10, options.listLimit)
+		assert.Equal(10, options.WithListLimit(0).listLimit)
+		assert.Equal(DEFAULT_LIST_LIMIT, DefaultStunOptions().listLimit)
+	})
+
+	t.Run("test_stun_options_with_replay_window", func(t *testing.T) {
+		options := DefaultStunOptions().WithReplayWindow(time.Minute)
+
+		assert.Equal(time.Minute, options.replayWindow)
+		assert.Equal(DEFAULT_REPLAY_WINDOW, DefaultStunOptions().replayWindow)
+	})
+
+	t.Run("test_stun_options_with_replication", func(t *testing.T) {
+		options := DefaultStunOptions().WithReplication("127.0.0.1:60101", "secret")
+
+		assert.Equal("127.0.0.1:60101", options.replicationAddr)
+		assert.Equal("secret", options.replicationSecret)
+		assert.Empty(DefaultStunOptions().replicationAddr)
+	})
+
+	t.Run("test_stun_options_with_standby", func(t *testing.T) {
+		options := DefaultStunOptions().WithStandby("127.0.0.1:60101", "secret", time.Second)
+
+		assert.Equal("127.0.0.1:60101", options.primary)
+		assert.Equal("secret", options.replicationSecret)
+		assert.Equal(time.Second, options.failoverTimeout)
+		assert.Empty(DefaultStunOptions().primary)
+	})
+
+	t.Run("test_stun_options_with_codec", func(t *testing.T) {
+		options := DefaultStunOptions().WithCodec(msg.JSONCodec{})
+
+		assert.Equal(msg.JSONCodec{}, options.codec)
+		assert.Equal(msg.BinaryCodec{}, DefaultStunOptions().codec)
+	})
 }
 
 func TestClientStunOptions(t *testing.T) {
@@ -35,6 +124,66 @@ func TestClientStunOptions(t *testing.T) {
 
 		assert.Equal(logging, options.logging)
 		assert.Equal(maxMsgInQueue, options.maxMsgInQueue)
+		assert.Equal(DEFAULT_REASSEMBLY_TIMEOUT, options.reassemblyTimeout)
+		assert.Equal(DEFAULT_MAX_PENDING_MESSAGES, options.maxPendingMessages)
+	})
+
+	t.Run("test_client_stun_options_with_identity", func(t *testing.T) {
+		_, identity, _ := ed25519.GenerateKey(nil)
+
+		options := DefaultClientStunOptions().WithIdentity(identity)
+
+		assert.Equal(identity, options.identity)
+	})
+
+	t.Run("test_client_stun_options_with_reassembly", func(t *testing.T) {
+		timeout := time.Second
+		maxPending := 2
+
+		options := DefaultClientStunOptions().WithReassembly(timeout, maxPending)
+
+		assert.Equal(timeout, options.reassemblyTimeout)
+		assert.Equal(maxPending, options.maxPendingMessages)
+	})
+
+	t.Run("test_client_stun_options_with_features", func(t *testing.T) {
+		options := DefaultClientStunOptions().WithFeatures(msg.FEATURE_COMPRESSION)
+
+		assert.Equal([]string{msg.FEATURE_COMPRESSION}, options.features)
+	})
+
+	t.Run("test_client_stun_options_with_fallbacks", func(t *testing.T) {
+		fallback, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:60002")
+
+		options := DefaultClientStunOptions().WithFallbacks(fallback)
+
+		assert.Equal([]*net.UDPAddr{fallback}, options.fallbacks)
+		assert.Empty(DefaultClientStunOptions().fallbacks)
+	})
+
+	t.Run("test_client_stun_options_with_strategy", func(t *testing.T) {
+		options := DefaultClientStunOptions().WithStrategy(SERVER_STRATEGY_ALL)
+
+		assert.Equal(SERVER_STRATEGY_ALL, options.strategy)
+		assert.Equal(SERVER_STRATEGY_FAILOVER, DefaultClientStunOptions().strategy)
+	})
+
+	t.Run("test_client_stun_options_with_health_check", func(t *testing.T) {
+		called := false
+		options := DefaultClientStunOptions().WithHealthCheck(time.Second, func(health ServerHealth) { called = true })
+		options.healthHandler(ServerHealth{})
+
+		assert.Equal(time.Second, options.probeInterval)
+		assert.True(called)
+		assert.Zero(DefaultClientStunOptions().probeInterval)
+		assert.Nil(DefaultClientStunOptions().healthHandler)
+	})
+
+	t.Run("test_client_stun_options_with_codec", func(t *testing.T) {
+		options := DefaultClientStunOptions().WithCodec(msg.JSONCodec{})
+
+		assert.Equal(msg.JSONCodec{}, options.codec)
+		assert.Equal(msg.BinaryCodec{}, DefaultClientStunOptions().codec)
 	})
 
 	t.Run("test_new_client_default_options", func(t *testing.T) {
@@ -44,3 +193,44 @@ func TestClientStunOptions(t *testing.T) {
 		assert.Equal(DEFAULT_MAX_MSG_IN_QUEUE, options.maxMsgInQueue)
 	})
 }
+
+func TestRedisStoreOptions(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_new_redis_store_options", func(t *testing.T) {
+		options := NewRedisStoreOptions("net:")
+
+		assert.Equal("net:", options.prefix)
+		assert.Equal(DEFAULT_REDIS_POOL_SIZE, options.poolSize)
+		assert.Equal(DEFAULT_REDIS_TIMEOUT, options.timeout)
+		assert.Equal(DEFAULT_REDIS_EXPIRATION_GRACE, options.grace)
+		assert.Empty(options.password)
+		assert.Zero(options.database)
+	})
+
+	t.Run("test_redis_store_options_with_pool", func(t *testing.T) {
+		options := DefaultRedisStoreOptions().WithPool(2, time.Second)
+
+		assert.Equal(2, options.poolSize)
+		assert.Equal(time.Second, options.timeout)
+	})
+
+	t.Run("test_redis_store_options_with_expiration_grace", func(t *testing.T) {
+		options := DefaultRedisStoreOptions().WithExpirationGrace(time.Minute)
+
+		assert.Equal(time.Minute, options.grace)
+	})
+
+	t.Run("test_redis_store_options_with_auth_and_database", func(t *testing.T) {
+		options := DefaultRedisStoreOptions().WithAuth("secret").WithDatabase(3)
+
+		assert.Equal("secret", options.password)
+		assert.Equal(3, options.database)
+	})
+
+	t.Run("test_new_redis_store_default_options", func(t *testing.T) {
+		options := DefaultRedisStoreOptions()
+
+		assert.Equal(DEFAULT_REDIS_PREFIX, options.prefix)
+	})
+}
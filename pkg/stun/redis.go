@@ -0,0 +1,241 @@
+package stun
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error reply sent by the redis server
+type RedisError string
+
+// Returns the error sent by the server
+func (err RedisError) Error() string {
+	return string(err)
+}
+
+// Connection to a redis server speaking the
+// RESP protocol. Replies are decoded into
+// strings, integers, byte slices, nil and
+// arrays of them. Connections are broken once
+// a command fails with something else than an
+// error reply, their state is unknown then
+type redisConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	broken  bool
+}
+
+// Sends the given command and reads his reply.
+// Error replies are returned as `RedisError`
+func (conn *redisConn) do(args ...string) (interface{}, error) {
+	reply, err := conn.roundTrip(args)
+	if err != nil {
+		conn.broken = true
+		return nil, err
+	}
+	if rerr, isError := reply.(RedisError); isError {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+// Writes the given command and reads his reply
+func (conn *redisConn) roundTrip(args []string) (interface{}, error) {
+	if conn.timeout > 0 {
+		conn.conn.SetDeadline(time.Now().Add(conn.timeout))
+	}
+
+	buff := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buff = append(buff, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buff = append(buff, arg...)
+		buff = append(buff, '\r', '\n')
+	}
+	if _, err := conn.conn.Write(buff); err != nil {
+		return nil, err
+	}
+	return conn.read()
+}
+
+// Runs the given commands atomically within a
+// transaction. Returns false if it was aborted
+// because a watched key changed
+func (conn *redisConn) transaction(commands ...[]string) (bool, error) {
+	if _, err := conn.do("MULTI"); err != nil {
+		return false, err
+	}
+
+	for _, command := range commands {
+		if _, err := conn.do(command...); err != nil {
+			conn.do("DISCARD")
+			return false, err
+		}
+	}
+
+	reply, err := conn.do("EXEC")
+	return reply != nil, err
+}
+
+// Reads a line without his trailing CRLF
+func (conn *redisConn) line() (string, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed redis reply `%q`", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// Reads the next reply from the connection
+func (conn *redisConn) read() (interface{}, error) {
+	line, err := conn.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return RedisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < -1 {
+			return nil, fmt.Errorf("malformed redis bulk size `%s`", line[1:])
+		}
+		if size == -1 {
+			return nil, nil
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(conn.reader, bulk); err != nil {
+			return nil, err
+		}
+		return bulk[:size], nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < -1 {
+			return nil, fmt.Errorf("malformed redis array size `%s`", line[1:])
+		}
+		if size == -1 {
+			return nil, nil
+		}
+		array := make([]interface{}, size)
+		for i := range array {
+			if array[i], err = conn.read(); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type `%c`", line[0])
+	}
+}
+
+// Closes the connection
+func (conn *redisConn) close() error {
+	return conn.conn.Close()
+}
+
+// Pool of connections to a redis server. Idle
+// connections are reused, the rest of them are
+// closed once they are released
+type redisPool struct {
+	sync.Mutex
+	addr    string
+	options RedisStoreOptions
+	idle    []*redisConn
+	closed  bool
+}
+
+// Returns an idle connection or dials a new one
+func (pool *redisPool) get() (*redisConn, error) {
+	pool.Lock()
+	if pool.closed {
+		pool.Unlock()
+		return nil, errors.New("redis pool is closed")
+	}
+	if n := len(pool.idle); n > 0 {
+		conn := pool.idle[n-1]
+		pool.idle = pool.idle[:n-1]
+		pool.Unlock()
+		return conn, nil
+	}
+	pool.Unlock()
+
+	return pool.dial()
+}
+
+// Dials a new connection, authenticating
+// and selecting the database if required
+func (pool *redisPool) dial() (*redisConn, error) {
+	nconn, err := net.DialTimeout("tcp", pool.addr, pool.options.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to redis: %s", err)
+	}
+
+	conn := &redisConn{conn: nconn, reader: bufio.NewReader(nconn), timeout: pool.options.timeout}
+	if pool.options.password != "" {
+		if _, err := conn.do("AUTH", pool.options.password); err != nil {
+			conn.close()
+			return nil, fmt.Errorf("cannot authenticate to redis: %s", err)
+		}
+	}
+	if pool.options.database != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(pool.options.database)); err != nil {
+			conn.close()
+			return nil, fmt.Errorf("cannot select redis database: %s", err)
+		}
+	}
+	return conn, nil
+}
+
+// Gives the given connection back to the
+// pool. Broken connections are closed instead
+func (pool *redisPool) put(conn *redisConn) {
+	if conn.broken {
+		conn.close()
+		return
+	}
+
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed || len(pool.idle) >= pool.options.poolSize {
+		conn.close()
+		return
+	}
+	pool.idle = append(pool.idle, conn)
+}
+
+// Closes every idle connection. Connections
+// in use are closed once they are released
+func (pool *redisPool) close() error {
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.closed = true
+	for _, conn := range pool.idle {
+		conn.close()
+	}
+	pool.idle = nil
+	return nil
+}
+
+// Creates a new pool of connections to the
+// redis server listening on the given address
+func newRedisPool(addr string, options RedisStoreOptions) *redisPool {
+	return &redisPool{addr: addr, options: options}
+}
@@ -0,0 +1,358 @@
+package stun
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Times a change is retried when the peer
+	// is changed by another server meanwhile
+	REDIS_TRANSACTION_RETRIES = 8
+	// Keys requested at once while scanning
+	REDIS_SCAN_COUNT = 100
+	// Time redis keeps a new registration before
+	// its first lease, so names whose server died
+	// while registering them are released
+	REDIS_REGISTRATION_TIMEOUT = 1 * time.Minute
+)
+
+// Fields of the hash that holds a peer registration
+const (
+	redisFieldAddr       = "addr"
+	redisFieldKey        = "key"
+	redisFieldToken      = "token"
+	redisFieldExpiration = "expiration"
+)
+
+// Peer connection store saved into a redis server,
+// so many stun servers behind a load balancer can
+// share the same registry. Every peer is a hash
+// whose key is his name and expires once his lease
+// is over, plus the expiration grace. Changes to a
+// peer are applied within transactions that are
+// retried if another server changed him meanwhile
+type redisPeerConnectionStore struct {
+	pool    *redisPool
+	options RedisStoreOptions
+}
+
+// Returns the redis key of the given peer
+func (store *redisPeerConnectionStore) key(peer string) string {
+	return store.options.prefix + peer
+}
+
+// Runs the given function with a pooled connection
+func (store *redisPeerConnectionStore) with(fn func(conn *redisConn) error) error {
+	conn, err := store.pool.get()
+	if err != nil {
+		return err
+	}
+	defer store.pool.put(conn)
+	return fn(conn)
+}
+
+// Reads the given field of the given peer
+// or fails if the peer does not have it
+func (store *redisPeerConnectionStore) field(peer string, field string) (string, error) {
+	var value string
+	err := store.with(func(conn *redisConn) error {
+		reply, err := conn.do("HGET", store.key(peer), field)
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			return fmt.Errorf("%s of peer %s not found", field, peer)
+		}
+		value = string(reply.([]byte))
+		return nil
+	})
+	return value, err
+}
+
+// Runs the given commands atomically if the given
+// peer is registered. The transaction is retried
+// if the peer changes before it is committed
+func (store *redisPeerConnectionStore) update(peer string, commands ...[]string) error {
+	key := store.key(peer)
+	return store.with(func(conn *redisConn) error {
+		for attempt := 0; attempt < REDIS_TRANSACTION_RETRIES; attempt++ {
+			if _, err := conn.do("WATCH", key); err != nil {
+				return err
+			}
+
+			exists, err := conn.do("HEXISTS", key, redisFieldAddr)
+			if err != nil {
+				return err
+			}
+			if exists != int64(1) {
+				conn.do("UNWATCH")
+				return fmt.Errorf("peer `%s` does not exist", peer)
+			}
+
+			committed, err := conn.transaction(commands...)
+			if err != nil || committed {
+				return err
+			}
+		}
+		return fmt.Errorf("peer `%s` changed too many times while updating him", peer)
+	})
+}
+
+// Returns the keys of every registered peer
+func (store *redisPeerConnectionStore) scan(conn *redisConn) ([]string, error) {
+	keys := []string{}
+	pattern := escapeRedisPattern(store.options.prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := conn.do("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(REDIS_SCAN_COUNT))
+		if err != nil {
+			return nil, err
+		}
+
+		page, valid := reply.([]interface{})
+		if !valid || len(page) != 2 {
+			return nil, fmt.Errorf("malformed redis scan reply")
+		}
+		next, _ := page[0].([]byte)
+		found, _ := page[1].([]interface{})
+		for _, key := range found {
+			if bulk, valid := key.([]byte); valid {
+				keys = append(keys, string(bulk))
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Saves the given addr for the given peer. Only
+// one of many concurrent registrations of a
+// name succeeds, even from different servers.
+// The registration expires by itself unless it
+// is leased in time, so it is never left behind
+func (store *redisPeerConnectionStore) SavePeerRemoteAddr(peer string, addr string) error {
+	key := store.key(peer)
+	return store.with(func(conn *redisConn) error {
+		for attempt := 0; attempt < REDIS_TRANSACTION_RETRIES; attempt++ {
+			if _, err := conn.do("WATCH", key); err != nil {
+				return err
+			}
+
+			exists, err := conn.do("HEXISTS", key, redisFieldAddr)
+			if err != nil {
+				return err
+			}
+			if exists == int64(1) {
+				conn.do("UNWATCH")
+				return fmt.Errorf("peer `%s` already registered", peer)
+			}
+
+			deadline := time.Now().Add(REDIS_REGISTRATION_TIMEOUT).UnixNano() / int64(time.Millisecond)
+			commands := [][]string{
+				{"HSET", key, redisFieldAddr, addr},
+				{"PEXPIREAT", key, strconv.FormatInt(deadline, 10)},
+			}
+
+			committed, err := conn.transaction(commands...)
+			if err != nil || committed {
+				return err
+			}
+		}
+		return fmt.Errorf("peer `%s` changed too many times while registering him", peer)
+	})
+}
+
+// Removes the given peer addr if the peer exists
+func (store *redisPeerConnectionStore) DeletePeerRemoteAddr(peer string) error {
+	return store.with(func(conn *redisConn) error {
+		deleted, err := conn.do("DEL", store.key(peer))
+		if err != nil {
+			return err
+		}
+		if deleted != int64(1) {
+			return fmt.Errorf("peer `%s` does not exist", peer)
+		}
+		return nil
+	})
+}
+
+// Retrieves the peer addr by giving his name
+func (store *redisPeerConnectionStore) GetPeerRemoteAddr(peer string) (string, error) {
+	return store.field(peer, redisFieldAddr)
+}
+
+// Get connected peers to the stun server.
+// Peers are listed by scanning the keys
+// so it does not block the redis server
+func (store *redisPeerConnectionStore) GetConnectedPeers() ([]PeerInfo, error) {
+	peers := []PeerInfo{}
+	err := store.with(func(conn *redisConn) error {
+		keys, err := store.scan(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			reply, err := conn.do("HGETALL", key)
+			if err != nil {
+				return err
+			}
+
+			fields := redisHash(reply)
+			// peers may leave while scanning
+			if addr, exists := fields[redisFieldAddr]; exists {
+				peername := strings.TrimPrefix(key, store.options.prefix)
+				peers = append(peers, PeerInfo{peername, addr, fields[redisFieldKey]})
+			}
+		}
+		return nil
+	})
+	return peers, err
+}
+
+// Replaces the addr of the given peer
+// if the peer exists
+func (store *redisPeerConnectionStore) UpdatePeerRemoteAddr(peer string, addr string) error {
+	return store.update(peer, []string{"HSET", store.key(peer), redisFieldAddr, addr})
+}
+
+// Saves the session token issued to
+// the given peer
+func (store *redisPeerConnectionStore) SavePeerToken(peer string, token string) error {
+	return store.update(peer, []string{"HSET", store.key(peer), redisFieldToken, token})
+}
+
+// Retrieves the session token issued
+// to the given peer
+func (store *redisPeerConnectionStore) GetPeerToken(peer string) (string, error) {
+	return store.field(peer, redisFieldToken)
+}
+
+// Saves the public key that identifies
+// the given peer
+func (store *redisPeerConnectionStore) SavePeerKey(peer string, key string) error {
+	return store.update(peer, []string{"HSET", store.key(peer), redisFieldKey, key})
+}
+
+// Retrieves the public key that
+// identifies the given peer
+func (store *redisPeerConnectionStore) GetPeerKey(peer string) (string, error) {
+	return store.field(peer, redisFieldKey)
+}
+
+// Sets the time when the registration of the
+// given peer expires. Redis drops the peer by
+// himself once the expiration grace is over too,
+// unless the grace is zero
+func (store *redisPeerConnectionStore) SetPeerExpiration(peer string, expiration time.Time) error {
+	key := store.key(peer)
+	commands := [][]string{{"HSET", key, redisFieldExpiration, strconv.FormatInt(expiration.UnixNano(), 10)}}
+	if store.options.grace > 0 {
+		deadline := expiration.Add(store.options.grace).UnixNano() / int64(time.Millisecond)
+		commands = append(commands, []string{"PEXPIREAT", key, strconv.FormatInt(deadline, 10)})
+	} else {
+		// drops the expiration of the registration
+		commands = append(commands, []string{"PERSIST", key})
+	}
+	return store.update(peer, commands...)
+}
+
+// Removes the peers whose registration expired
+// before the given time and returns their names.
+// Peers whose lease is extended while they are
+// being removed are kept
+func (store *redisPeerConnectionStore) DeleteExpiredPeers(now time.Time) ([]string, error) {
+	expired := []string{}
+	err := store.with(func(conn *redisConn) error {
+		keys, err := store.scan(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if _, err := conn.do("WATCH", key); err != nil {
+				return err
+			}
+
+			reply, err := conn.do("HGET", key, redisFieldExpiration)
+			if err != nil {
+				return err
+			}
+
+			nanos, _ := reply.([]byte)
+			expiration, err := strconv.ParseInt(string(nanos), 10, 64)
+			if reply == nil || err != nil || !time.Unix(0, expiration).Before(now) {
+				if _, err := conn.do("UNWATCH"); err != nil {
+					return err
+				}
+				continue
+			}
+
+			deleted, err := conn.transaction([]string{"DEL", key})
+			if err != nil {
+				return err
+			}
+			if deleted {
+				expired = append(expired, strings.TrimPrefix(key, store.options.prefix))
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// Closes the connections to the redis server
+func (store *redisPeerConnectionStore) Close() error {
+	return store.pool.close()
+}
+
+// Decodes the given HGETALL reply
+func redisHash(reply interface{}) map[string]string {
+	hash := map[string]string{}
+	pairs, _ := reply.([]interface{})
+	for i := 0; i+1 < len(pairs); i += 2 {
+		field, _ := pairs[i].([]byte)
+		value, _ := pairs[i+1].([]byte)
+		hash[string(field)] = string(value)
+	}
+	return hash
+}
+
+// Escapes the glob characters of the given
+// text so it matches itself in a pattern
+func escapeRedisPattern(text string) string {
+	var escaped strings.Builder
+	for _, char := range text {
+		if strings.ContainsRune(`*?[]\`, char) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
+
+// Creates a new peer connection store saved into
+// the redis server listening on the given address
+func NewRedisPeerConnectionStore(addr string, options RedisStoreOptions) (*redisPeerConnectionStore, error) {
+	store := &redisPeerConnectionStore{
+		pool:    newRedisPool(addr, options),
+		options: options,
+	}
+
+	// checks the server is reachable
+	err := store.with(func(conn *redisConn) error {
+		_, err := conn.do("PING")
+		return err
+	})
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,209 @@
+package stun
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/stun/redistest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisPeerConnectionStore(t *testing.T) {
+	assert := require.New(t)
+	expiration := time.Now().Add(time.Minute).Round(0)
+
+	t.Run("test_redis_store_is_peer_connection_store", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		store, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions())
+		assert.NoError(err)
+		defer store.Close()
+
+		var _ PeerConnectionStore = store
+	})
+
+	t.Run("test_redis_stores_share_registry", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		first, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions())
+		assert.NoError(err)
+		defer first.Close()
+		second, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions())
+		assert.NoError(err)
+		defer second.Close()
+
+		registerPeer(first, "alice", "127.0.0.1:50010", expiration)
+
+		addr, err := second.GetPeerRemoteAddr("alice")
+		assert.NoError(err)
+		assert.Equal("127.0.0.1:50010", addr)
+		key, err := second.GetPeerKey("alice")
+		assert.NoError(err)
+		assert.Equal("key-alice", key)
+		assert.Error(second.SavePeerRemoteAddr("alice", "127.0.0.1:50011"))
+
+		peers, err := second.GetConnectedPeers()
+		assert.NoError(err)
+		assert.Equal([]PeerInfo{{"alice", "127.0.0.1:50010", "key-alice"}}, peers)
+
+		assert.NoError(second.DeletePeerRemoteAddr("alice"))
+		_, err = first.GetPeerRemoteAddr("alice")
+		assert.Error(err)
+	})
+
+	t.Run("test_redis_store_prefix_isolation", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		first, err := NewRedisPeerConnectionStore(server.Addr(), NewRedisStoreOptions("first:"))
+		assert.NoError(err)
+		defer first.Close()
+		second, err := NewRedisPeerConnectionStore(server.Addr(), NewRedisStoreOptions("second:"))
+		assert.NoError(err)
+		defer second.Close()
+
+		registerPeer(first, "alice", "127.0.0.1:50010", expiration)
+		registerPeer(second, "bob", "127.0.0.1:50011", expiration)
+
+		peers, err := first.GetConnectedPeers()
+		assert.NoError(err)
+		assert.Len(peers, 1)
+		assert.Equal("alice", peers[0].Peername)
+		assert.Equal([]string{"first:alice", "second:bob"}, server.Keys(0))
+	})
+
+	t.Run("test_redis_store_sets_key_expiration", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		store, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions().WithExpirationGrace(time.Minute))
+		assert.NoError(err)
+		defer store.Close()
+
+		registerPeer(store, "alice", "127.0.0.1:50010", expiration)
+
+		ttl := server.Expiration(0, DEFAULT_REDIS_PREFIX+"alice")
+		assert.WithinDuration(expiration.Add(time.Minute), ttl, time.Millisecond)
+	})
+
+	t.Run("test_redis_store_expires_registrations_never_leased", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		store, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions().WithExpirationGrace(0))
+		assert.NoError(err)
+		defer store.Close()
+
+		before := time.Now().Add(REDIS_REGISTRATION_TIMEOUT)
+		assert.NoError(store.SavePeerRemoteAddr("alice", "127.0.0.1:50010"))
+		after := time.Now().Add(REDIS_REGISTRATION_TIMEOUT)
+
+		ttl := server.Expiration(0, DEFAULT_REDIS_PREFIX+"alice")
+		assert.False(ttl.Before(before.Truncate(time.Millisecond)))
+		assert.False(ttl.After(after))
+	})
+
+	t.Run("test_redis_store_without_grace_does_not_expire_keys", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		store, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions().WithExpirationGrace(0))
+		assert.NoError(err)
+		defer store.Close()
+
+		registerPeer(store, "alice", "127.0.0.1:50010", expiration)
+
+		assert.True(server.Expiration(0, DEFAULT_REDIS_PREFIX+"alice").IsZero())
+	})
+
+	t.Run("test_redis_store_drops_peers_once_grace_is_over", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		store, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions().WithExpirationGrace(time.Millisecond))
+		assert.NoError(err)
+		defer store.Close()
+
+		registerPeer(store, "alice", "127.0.0.1:50010", time.Now())
+
+		eventually(t, time.Second, func() bool {
+			_, err := store.GetPeerRemoteAddr("alice")
+			return err != nil
+		})
+	})
+
+	t.Run("test_redis_store_auth_and_database", func(t *testing.T) {
+		server := redistest.NewServerWithPassword("secret")
+		defer server.Close()
+
+		_, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions())
+		var rerr RedisError
+		assert.True(errors.As(err, &rerr))
+		assert.Contains(err.Error(), "NOAUTH")
+
+		_, err = NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions().WithAuth("wrong"))
+		assert.Contains(err.Error(), "cannot authenticate to redis")
+
+		store, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions().WithAuth("secret").WithDatabase(2))
+		assert.NoError(err)
+		defer store.Close()
+
+		registerPeer(store, "alice", "127.0.0.1:50010", expiration)
+		assert.Empty(server.Keys(0))
+		assert.Equal([]string{DEFAULT_REDIS_PREFIX + "alice"}, server.Keys(2))
+	})
+
+	t.Run("test_redis_store_unreachable_server", func(t *testing.T) {
+		server := redistest.NewServer()
+		addr := server.Addr()
+		server.Close()
+
+		_, err := NewRedisPeerConnectionStore(addr, DefaultRedisStoreOptions().WithPool(1, time.Second))
+		assert.Error(err)
+		assert.Contains(err.Error(), "cannot connect to redis")
+	})
+
+	t.Run("test_redis_store_recovers_from_broken_connections", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		store, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions())
+		assert.NoError(err)
+		defer store.Close()
+
+		// the pooled connection is broken
+		// once the server drops it
+		conn, err := store.pool.get()
+		assert.NoError(err)
+		conn.conn.Close()
+		_, err = conn.do("PING")
+		assert.Error(err)
+		assert.True(conn.broken)
+		store.pool.put(conn)
+
+		assert.NoError(store.SavePeerRemoteAddr("alice", "127.0.0.1:50010"))
+	})
+
+	t.Run("test_redis_store_closed", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+
+		store, err := NewRedisPeerConnectionStore(server.Addr(), DefaultRedisStoreOptions())
+		assert.NoError(err)
+		assert.NoError(store.Close())
+
+		assert.Error(store.SavePeerRemoteAddr("alice", "127.0.0.1:50010"))
+	})
+}
+
+func TestEscapeRedisPattern(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_escape_redis_pattern", func(t *testing.T) {
+		assert.Equal("fox:peer:", escapeRedisPattern("fox:peer:"))
+		assert.Equal(`a\*b\?\[c\]\\`, escapeRedisPattern(`a*b?[c]\`))
+	})
+}
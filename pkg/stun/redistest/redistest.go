@@ -0,0 +1,517 @@
+// Package redistest provides an in-process server
+// speaking the redis protocol, so the stores that
+// save their data into redis can be tested without
+// running a real one:
+//
+//	server := redistest.NewServer()
+//	defer server.Close()
+//	store, err := stun.NewRedisPeerConnectionStore(server.Addr(), stun.DefaultRedisStoreOptions())
+//
+// It keeps hashes in memory and supports the commands
+// the stores use, including key expirations, scans
+// and optimistic transactions
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hash saved under a key. Zero expirations never expire
+type entry struct {
+	hash       map[string]string
+	expiration time.Time
+}
+
+// Key of a database
+type dbKey struct {
+	db  int
+	key string
+}
+
+// In-process redis server
+type Server struct {
+	sync.Mutex
+	listener net.Listener
+	password string
+	data     map[dbKey]*entry
+	// incremented every time a key changes,
+	// so transactions watching it are aborted
+	versions map[dbKey]uint64
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// State of a client connection
+type session struct {
+	db            int
+	authenticated bool
+	watched       map[dbKey]uint64
+	queued        [][]string
+	multi         bool
+}
+
+// Returns the address the server listens on
+func (server *Server) Addr() string {
+	return server.listener.Addr().String()
+}
+
+// Returns the time the given key expires at,
+// zero if it never expires or does not exist
+func (server *Server) Expiration(db int, key string) time.Time {
+	server.Lock()
+	defer server.Unlock()
+
+	if entry := server.get(dbKey{db, key}); entry != nil {
+		return entry.expiration
+	}
+	return time.Time{}
+}
+
+// Returns the keys saved in the given database
+func (server *Server) Keys(db int) []string {
+	server.Lock()
+	defer server.Unlock()
+
+	keys := []string{}
+	for key := range server.data {
+		if key.db == db && server.get(key) != nil {
+			keys = append(keys, key.key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Stops the server and closes every connection
+func (server *Server) Close() error {
+	server.Lock()
+	server.closed = true
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.Unlock()
+
+	err := server.listener.Close()
+	server.wg.Wait()
+	return err
+}
+
+// Accepts connections until the server is closed
+func (server *Server) serve() {
+	defer server.wg.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server.Lock()
+		if server.closed {
+			server.Unlock()
+			conn.Close()
+			return
+		}
+		server.conns[conn] = struct{}{}
+		server.wg.Add(1)
+		server.Unlock()
+
+		go server.handle(conn)
+	}
+}
+
+// Answers the commands sent through the given connection
+func (server *Server) handle(conn net.Conn) {
+	defer server.wg.Done()
+	defer func() {
+		server.Lock()
+		delete(server.conns, conn)
+		server.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	state := &session{authenticated: server.password == "", watched: map[dbKey]uint64{}}
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(server.execute(state, args)); err != nil {
+			return
+		}
+	}
+}
+
+// Reads a command sent as an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected array, got `%s`", line)
+	}
+
+	size, err := strconv.Atoi(line[1:])
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("malformed array size `%s`", line[1:])
+	}
+
+	args := make([]string, size)
+	for i := range args {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected bulk string, got `%s`", line)
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("malformed bulk size `%s`", line[1:])
+		}
+		bulk := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		args[i] = string(bulk[:length])
+	}
+	return args, nil
+}
+
+// Reads a line without his trailing CRLF
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// Encoders of the replies
+func simple(text string) []byte  { return []byte("+" + text + "\r\n") }
+func failure(text string) []byte { return []byte("-" + text + "\r\n") }
+func integer(n int64) []byte     { return []byte(":" + strconv.FormatInt(n, 10) + "\r\n") }
+func bulk(text string) []byte    { return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(text), text)) }
+func null() []byte               { return []byte("$-1\r\n") }
+func array(items ...[]byte) []byte {
+	reply := []byte(fmt.Sprintf("*%d\r\n", len(items)))
+	for _, item := range items {
+		reply = append(reply, item...)
+	}
+	return reply
+}
+
+// Returns the entry saved under the given key,
+// removing it first if it already expired. The
+// server lock must be held
+func (server *Server) get(key dbKey) *entry {
+	entry, exists := server.data[key]
+	if !exists {
+		return nil
+	}
+	if !entry.expiration.IsZero() && !time.Now().Before(entry.expiration) {
+		server.delete(key)
+		return nil
+	}
+	return entry
+}
+
+// Removes the given key. The server lock must be held
+func (server *Server) delete(key dbKey) bool {
+	if _, exists := server.data[key]; !exists {
+		return false
+	}
+	delete(server.data, key)
+	server.versions[key]++
+	return true
+}
+
+// Returns the entry saved under the given key,
+// creating it if it does not exist. The server
+// lock must be held
+func (server *Server) create(key dbKey) *entry {
+	if entry := server.get(key); entry != nil {
+		return entry
+	}
+	entry := &entry{hash: map[string]string{}}
+	server.data[key] = entry
+	return entry
+}
+
+// Executes the given command, queueing it
+// if a transaction is open
+func (server *Server) execute(state *session, args []string) []byte {
+	server.Lock()
+	defer server.Unlock()
+
+	name := strings.ToUpper(args[0])
+	if !state.authenticated && name != "AUTH" {
+		return failure("NOAUTH Authentication required.")
+	}
+
+	if state.multi {
+		switch name {
+		case "EXEC":
+			return server.exec(state)
+		case "DISCARD":
+			state.multi = false
+			state.queued = nil
+			state.watched = map[dbKey]uint64{}
+			return simple("OK")
+		case "MULTI", "WATCH":
+			return failure(fmt.Sprintf("ERR %s inside MULTI is not allowed", name))
+		default:
+			state.queued = append(state.queued, args)
+			return simple("QUEUED")
+		}
+	}
+
+	return server.run(state, name, args[1:])
+}
+
+// Runs the queued commands unless a watched key changed
+func (server *Server) exec(state *session) []byte {
+	defer func() {
+		state.multi = false
+		state.queued = nil
+		state.watched = map[dbKey]uint64{}
+	}()
+
+	for key, version := range state.watched {
+		server.get(key)
+		if server.versions[key] != version {
+			return []byte("*-1\r\n")
+		}
+	}
+
+	replies := [][]byte{}
+	for _, args := range state.queued {
+		replies = append(replies, server.run(state, strings.ToUpper(args[0]), args[1:]))
+	}
+	return array(replies...)
+}
+
+// Runs the given command. The server lock must be held
+func (server *Server) run(state *session, name string, args []string) []byte {
+	arity := map[string]int{
+		"PING": 0, "AUTH": 1, "SELECT": 1, "MULTI": 0, "EXEC": 0, "DISCARD": 0, "UNWATCH": 0,
+		"HGET": 2, "HGETALL": 1, "HEXISTS": 2, "HSETNX": 3, "PEXPIREAT": 2, "PERSIST": 1, "PTTL": 1, "SCAN": 1,
+		"HSET": 3, "DEL": 1, "EXISTS": 1, "WATCH": 1,
+	}
+	minimum, known := arity[name]
+	if !known {
+		return failure(fmt.Sprintf("ERR unknown command `%s`", name))
+	}
+	if len(args) < minimum {
+		return failure(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+
+	switch name {
+	case "PING":
+		return simple("PONG")
+	case "AUTH":
+		if args[0] != server.password {
+			return failure("WRONGPASS invalid username-password pair")
+		}
+		state.authenticated = true
+		return simple("OK")
+	case "SELECT":
+		db, err := strconv.Atoi(args[0])
+		if err != nil || db < 0 || db > 15 {
+			return failure("ERR DB index is out of range")
+		}
+		state.db = db
+		return simple("OK")
+	case "MULTI":
+		state.multi = true
+		return simple("OK")
+	case "EXEC", "DISCARD":
+		return failure(fmt.Sprintf("ERR %s without MULTI", name))
+	case "WATCH":
+		for _, key := range args {
+			key := dbKey{state.db, key}
+			server.get(key)
+			state.watched[key] = server.versions[key]
+		}
+		return simple("OK")
+	case "UNWATCH":
+		state.watched = map[dbKey]uint64{}
+		return simple("OK")
+	case "HGET":
+		if entry := server.get(dbKey{state.db, args[0]}); entry != nil {
+			if value, exists := entry.hash[args[1]]; exists {
+				return bulk(value)
+			}
+		}
+		return null()
+	case "HGETALL":
+		items := [][]byte{}
+		if entry := server.get(dbKey{state.db, args[0]}); entry != nil {
+			for field, value := range entry.hash {
+				items = append(items, bulk(field), bulk(value))
+			}
+		}
+		return array(items...)
+	case "HEXISTS":
+		if entry := server.get(dbKey{state.db, args[0]}); entry != nil {
+			if _, exists := entry.hash[args[1]]; exists {
+				return integer(1)
+			}
+		}
+		return integer(0)
+	case "HSET":
+		if len(args)%2 != 1 {
+			return failure("ERR wrong number of arguments for 'hset' command")
+		}
+		key := dbKey{state.db, args[0]}
+		entry := server.create(key)
+		added := int64(0)
+		for i := 1; i < len(args); i += 2 {
+			if _, exists := entry.hash[args[i]]; !exists {
+				added++
+			}
+			entry.hash[args[i]] = args[i+1]
+		}
+		server.versions[key]++
+		return integer(added)
+	case "HSETNX":
+		key := dbKey{state.db, args[0]}
+		entry := server.create(key)
+		if _, exists := entry.hash[args[1]]; exists {
+			return integer(0)
+		}
+		entry.hash[args[1]] = args[2]
+		server.versions[key]++
+		return integer(1)
+	case "DEL", "EXISTS":
+		count := int64(0)
+		for _, key := range args {
+			key := dbKey{state.db, key}
+			if server.get(key) == nil {
+				continue
+			}
+			if name == "DEL" {
+				server.delete(key)
+			}
+			count++
+		}
+		return integer(count)
+	case "PEXPIREAT":
+		millis, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return failure("ERR value is not an integer or out of range")
+		}
+		key := dbKey{state.db, args[0]}
+		entry := server.get(key)
+		if entry == nil {
+			return integer(0)
+		}
+		entry.expiration = time.Unix(0, millis*int64(time.Millisecond))
+		server.versions[key]++
+		// keys expired in the past are removed right away
+		server.get(key)
+		return integer(1)
+	case "PERSIST":
+		key := dbKey{state.db, args[0]}
+		entry := server.get(key)
+		if entry == nil || entry.expiration.IsZero() {
+			return integer(0)
+		}
+		entry.expiration = time.Time{}
+		server.versions[key]++
+		return integer(1)
+	case "PTTL":
+		entry := server.get(dbKey{state.db, args[0]})
+		if entry == nil {
+			return integer(-2)
+		}
+		if entry.expiration.IsZero() {
+			return integer(-1)
+		}
+		return integer(int64(time.Until(entry.expiration) / time.Millisecond))
+	case "SCAN":
+		return server.scan(state, args)
+	}
+	return failure(fmt.Sprintf("ERR unknown command `%s`", name))
+}
+
+// Returns a page of the keys matching the given
+// pattern. The cursor is the position of the
+// next key in order
+func (server *Server) scan(state *session, args []string) []byte {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return failure("ERR invalid cursor")
+	}
+
+	pattern, count := "*", 10
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return failure("ERR syntax error")
+			}
+		default:
+			return failure("ERR syntax error")
+		}
+	}
+
+	keys := []string{}
+	for key := range server.data {
+		if key.db == state.db && server.get(key) != nil {
+			keys = append(keys, key.key)
+		}
+	}
+	sort.Strings(keys)
+
+	page := [][]byte{}
+	next := cursor
+	for ; next < len(keys) && next < cursor+count; next++ {
+		if matched, _ := path.Match(pattern, keys[next]); matched {
+			page = append(page, bulk(keys[next]))
+		}
+	}
+	if next >= len(keys) {
+		next = 0
+	}
+	return array(bulk(strconv.Itoa(next)), array(page...))
+}
+
+// Starts a new server listening on a random
+// local port. Clients must authenticate with
+// the given password unless it is empty
+func NewServerWithPassword(password string) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("redistest: cannot listen: %s", err))
+	}
+
+	server := &Server{
+		listener: listener,
+		password: password,
+		data:     map[dbKey]*entry{},
+		versions: map[dbKey]uint64{},
+		conns:    map[net.Conn]struct{}{},
+	}
+	server.wg.Add(1)
+	go server.serve()
+	return server
+}
+
+// Starts a new server listening on a random local port
+func NewServer() *Server {
+	return NewServerWithPassword("")
+}
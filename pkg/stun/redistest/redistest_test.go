@@ -0,0 +1,134 @@
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Sends the given command and returns the raw reply
+func send(t *testing.T, conn net.Conn, reader *bufio.Reader, args ...string) string {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(command)); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := ""
+	for pending := 1; pending > 0; pending-- {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply += line
+		var size int
+		if _, err := fmt.Sscanf(line, "*%d", &size); err == nil && size > 0 {
+			pending += size
+		} else if _, err := fmt.Sscanf(line, "$%d", &size); err == nil && size >= 0 {
+			pending++
+		}
+	}
+	return reply
+}
+
+// Connects to the given server
+func connect(t *testing.T, server *Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func TestServer(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_server_hashes", func(t *testing.T) {
+		server := NewServer()
+		defer server.Close()
+		conn, reader := connect(t, server)
+
+		assert.Equal("+PONG\r\n", send(t, conn, reader, "PING"))
+		assert.Equal(":1\r\n", send(t, conn, reader, "HSETNX", "peer", "addr", "a"))
+		assert.Equal(":0\r\n", send(t, conn, reader, "HSETNX", "peer", "addr", "b"))
+		assert.Equal(":1\r\n", send(t, conn, reader, "HSET", "peer", "key", "k"))
+		assert.Equal("$1\r\na\r\n", send(t, conn, reader, "HGET", "peer", "addr"))
+		assert.Equal("$-1\r\n", send(t, conn, reader, "HGET", "peer", "token"))
+		assert.Equal(":1\r\n", send(t, conn, reader, "HEXISTS", "peer", "key"))
+		assert.Equal(":1\r\n", send(t, conn, reader, "DEL", "peer"))
+		assert.Equal("*0\r\n", send(t, conn, reader, "HGETALL", "peer"))
+	})
+
+	t.Run("test_server_scan", func(t *testing.T) {
+		server := NewServer()
+		defer server.Close()
+		conn, reader := connect(t, server)
+
+		send(t, conn, reader, "HSET", "a:1", "f", "v")
+		send(t, conn, reader, "HSET", "a:2", "f", "v")
+		send(t, conn, reader, "HSET", "b:1", "f", "v")
+
+		assert.Equal("*2\r\n$1\r\n2\r\n*2\r\n$3\r\na:1\r\n$3\r\na:2\r\n", send(t, conn, reader, "SCAN", "0", "MATCH", "a:*", "COUNT", "2"))
+		assert.Equal("*2\r\n$1\r\n0\r\n*0\r\n", send(t, conn, reader, "SCAN", "2", "MATCH", "a:*", "COUNT", "2"))
+	})
+
+	t.Run("test_server_aborts_transactions_on_watched_changes", func(t *testing.T) {
+		server := NewServer()
+		defer server.Close()
+		conn, reader := connect(t, server)
+		other, otherReader := connect(t, server)
+
+		send(t, conn, reader, "HSET", "peer", "addr", "a")
+		assert.Equal("+OK\r\n", send(t, conn, reader, "WATCH", "peer"))
+		send(t, other, otherReader, "HSET", "peer", "addr", "b")
+		assert.Equal("+OK\r\n", send(t, conn, reader, "MULTI"))
+		assert.Equal("+QUEUED\r\n", send(t, conn, reader, "DEL", "peer"))
+		assert.Equal("*-1\r\n", send(t, conn, reader, "EXEC"))
+
+		send(t, conn, reader, "WATCH", "peer")
+		send(t, conn, reader, "MULTI")
+		send(t, conn, reader, "DEL", "peer")
+		assert.Equal("*1\r\n:1\r\n", send(t, conn, reader, "EXEC"))
+	})
+
+	t.Run("test_server_expirations", func(t *testing.T) {
+		server := NewServer()
+		defer server.Close()
+		conn, reader := connect(t, server)
+
+		send(t, conn, reader, "HSET", "peer", "addr", "a")
+		assert.Equal(":-1\r\n", send(t, conn, reader, "PTTL", "peer"))
+		assert.Equal(":0\r\n", send(t, conn, reader, "PERSIST", "peer"))
+		send(t, conn, reader, "PEXPIREAT", "peer", "99999999999999")
+		assert.Equal(":1\r\n", send(t, conn, reader, "PERSIST", "peer"))
+		assert.Equal(":-1\r\n", send(t, conn, reader, "PTTL", "peer"))
+		assert.Equal(":1\r\n", send(t, conn, reader, "PEXPIREAT", "peer", "1"))
+		assert.Equal(":-2\r\n", send(t, conn, reader, "PTTL", "peer"))
+		assert.Empty(server.Keys(0))
+	})
+
+	t.Run("test_server_auth", func(t *testing.T) {
+		server := NewServerWithPassword("secret")
+		defer server.Close()
+		conn, reader := connect(t, server)
+
+		assert.Contains(send(t, conn, reader, "PING"), "-NOAUTH")
+		assert.Contains(send(t, conn, reader, "AUTH", "wrong"), "-WRONGPASS")
+		assert.Equal("+OK\r\n", send(t, conn, reader, "AUTH", "secret"))
+		assert.Equal("+PONG\r\n", send(t, conn, reader, "PING"))
+	})
+
+	t.Run("test_server_unknown_command", func(t *testing.T) {
+		server := NewServer()
+		defer server.Close()
+		conn, reader := connect(t, server)
+
+		assert.Contains(send(t, conn, reader, "FLUSHALL"), "-ERR unknown command")
+	})
+}
@@ -0,0 +1,70 @@
+package stun
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+// Ids of the signed requests accepted lately,
+// indexed by the peer that signed them. Ids are
+// kept while the timestamp of their request is
+// fresh, so a captured request cannot be played
+// again. Stale requests are rejected anyway
+type replayTable struct {
+	sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+// Records the given request id of the given peer
+// until the given time. Returns false if it was
+// already recorded, i.e. the request is replayed
+func (table *replayTable) record(peername string, id string, until time.Time, window time.Duration) bool {
+	now := time.Now()
+	key := peername + "/" + id
+
+	table.Lock()
+	defer table.Unlock()
+
+	if expiration, seen := table.seen[key]; seen && now.Before(expiration) {
+		return false
+	}
+
+	// forgets the ids whose requests are stale,
+	// at most once every window
+	if now.Sub(table.swept) >= window {
+		for key, expiration := range table.seen {
+			if !now.Before(expiration) {
+				delete(table.seen, key)
+			}
+		}
+		table.swept = now
+	}
+
+	table.seen[key] = until
+	return true
+}
+
+// Creates a new replay table without ids
+func newReplayTable() *replayTable {
+	return &replayTable{seen: map[string]time.Time{}}
+}
+
+// Checks the given signed request has been
+// made within the replay window and it is the
+// first time this server sees it
+func (stun Stun) fresh(request msg.MsgRequest) error {
+	window := stun.options.replayWindow
+	issued := time.Unix(0, request.Timestamp)
+	if request.Timestamp == 0 || time.Since(issued) > window || time.Until(issued) > window {
+		return fmt.Errorf("stale request for peer `%s`", request.Peername)
+	}
+
+	if request.Id == "" || !stun.replays.record(request.Peername, request.Id, issued.Add(window), window) {
+		return fmt.Errorf("replayed request for peer `%s`", request.Peername)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package stun
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Signs the given request with the given
+// identity as if it was made at the given time
+func signRequestAt(request *msg.MsgRequest, identity ed25519.PrivateKey, at time.Time) {
+	request.Sign(identity)
+	request.Timestamp = at.UnixNano()
+	request.Signature = hex.EncodeToString(ed25519.Sign(identity, request.SigningPayload()))
+}
+
+func TestReplayTable(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_replay_table_record", func(t *testing.T) {
+		table := newReplayTable()
+		until := time.Now().Add(time.Minute)
+
+		assert.True(table.record("dog", "id", until, time.Minute))
+		assert.False(table.record("dog", "id", until, time.Minute))
+		assert.True(table.record("cat", "id", until, time.Minute))
+	})
+
+	t.Run("test_replay_table_forgets_stale_ids", func(t *testing.T) {
+		table := newReplayTable()
+
+		assert.True(table.record("dog", "old", time.Now(), 0))
+		assert.True(table.record("dog", "new", time.Now().Add(time.Minute), 0))
+
+		assert.Len(table.seen, 1)
+		assert.Contains(table.seen, "dog/new")
+	})
+}
+
+func TestStunFresh(t *testing.T) {
+	assert := require.New(t)
+	_, identity, _ := ed25519.GenerateKey(nil)
+
+	newFreshStun := func() *Stun {
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), NewStunOptions(false).WithReplayWindow(time.Minute))
+		stun.Close()
+		return stun
+	}
+
+	t.Run("test_fresh_success", func(t *testing.T) {
+		stun := newFreshStun()
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Id = "id"
+		request.Sign(identity)
+
+		assert.NoError(stun.fresh(request))
+	})
+
+	t.Run("test_fresh_fail_replayed", func(t *testing.T) {
+		stun := newFreshStun()
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Id = "id"
+		request.Sign(identity)
+
+		assert.NoError(stun.fresh(request))
+		assert.Error(stun.fresh(request))
+	})
+
+	t.Run("test_fresh_fail_stale", func(t *testing.T) {
+		stun := newFreshStun()
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Id = "id"
+		signRequestAt(&request, identity, time.Now().Add(-2*time.Minute))
+
+		assert.Error(stun.fresh(request))
+	})
+
+	t.Run("test_fresh_fail_ahead", func(t *testing.T) {
+		stun := newFreshStun()
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Id = "id"
+		signRequestAt(&request, identity, time.Now().Add(2*time.Minute))
+
+		assert.Error(stun.fresh(request))
+	})
+
+	t.Run("test_fresh_fail_without_timestamp", func(t *testing.T) {
+		stun := newFreshStun()
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Id = "id"
+
+		assert.Error(stun.fresh(request))
+	})
+
+	t.Run("test_fresh_fail_without_id", func(t *testing.T) {
+		stun := newFreshStun()
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Sign(identity)
+
+		assert.Error(stun.fresh(request))
+	})
+}
+
+func TestStunRejectsReplays(t *testing.T) {
+	assert := require.New(t)
+	_, identity, _ := ed25519.GenerateKey(nil)
+	owner, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50010")
+	attacker, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+
+	t.Run("test_replayed_new_request_does_not_move_peer", func(t *testing.T) {
+		store := NewMemoryPeerConnectionStore()
+		stun, _ := NewStun("127.0.0.1:0", store, NewStunOptions(false))
+		stun.Close()
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		stun.conn = conn
+
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		request.Id = "id"
+		request.Sign(identity)
+		assert.NoError(stun.handleNewRequest(request, owner))
+		token, _ := store.GetPeerToken("dog")
+
+		err := stun.handleNewRequest(request, attacker)
+
+		assert.Error(err)
+		addr, _ := store.GetPeerRemoteAddr("dog")
+		assert.Equal(owner.String(), addr)
+		current, _ := store.GetPeerToken("dog")
+		assert.Equal(token, current)
+	})
+
+	t.Run("test_replayed_refresh_request_does_not_move_peer", func(t *testing.T) {
+		store := NewMemoryPeerConnectionStore()
+		stun, _ := NewStun("127.0.0.1:0", store, NewStunOptions(false))
+		stun.Close()
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		stun.conn = conn
+		store.SavePeerRemoteAddr("dog", owner.String())
+		store.SavePeerKey("dog", msg.EncodeKey(identity.Public().(ed25519.PublicKey)))
+		store.SavePeerToken("dog", "token-dog")
+
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Id = "id"
+		request.Token = "token-dog"
+		request.Sign(identity)
+		assert.NoError(stun.handleRefreshRequest(request, owner))
+
+		err := stun.handleRefreshRequest(request, attacker)
+
+		assert.Error(err)
+		addr, _ := store.GetPeerRemoteAddr("dog")
+		assert.Equal(owner.String(), addr)
+	})
+}
@@ -0,0 +1,587 @@
+package stun
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Interval the primary tells his standbys
+	// he is alive at when nothing changes
+	REPLICATION_HEARTBEAT = time.Second
+	// Time without news from the other side
+	// after which a replication stream is broken
+	REPLICATION_TIMEOUT = 3 * REPLICATION_HEARTBEAT
+	// Entries queued for a standby, he is
+	// dropped once he falls further behind
+	REPLICATION_QUEUE_SIZE = 1024
+)
+
+// Operations only sent through the replication
+// stream. Snapshots replace every registration
+// of the standby, heartbeats change nothing
+const (
+	logOpSnapshot  = "snapshot"
+	logOpHeartbeat = "heartbeat"
+)
+
+// Peer connection store whose registrations
+// can be copied into another store, so they
+// can be replicated to a standby server
+type SnapshotPeerConnectionStore interface {
+	PeerConnectionStore
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// Standby following a primary. Entries are queued
+// and written by his own goroutine, so a slow
+// standby never holds the store
+type follower struct {
+	conn    net.Conn
+	entries chan logEntry
+}
+
+// Writes the queued entries until the queue is
+// closed or a write fails, which drops him
+func (follower *follower) write(store *replicatedPeerConnectionStore) {
+	encoder := json.NewEncoder(follower.conn)
+	for entry := range follower.entries {
+		follower.conn.SetWriteDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+		if err := encoder.Encode(entry); err != nil {
+			store.drop(follower)
+			return
+		}
+	}
+}
+
+// Peer connection store of a primary server that
+// streams every change to the standby servers
+// following him. Changes are serialized so the
+// standbys apply them in the same order, a
+// standby that cannot keep up is dropped
+type replicatedPeerConnectionStore struct {
+	sync.Mutex
+	store     SnapshotPeerConnectionStore
+	followers map[net.Conn]*follower
+	queueSize int
+	closed    bool
+}
+
+// Applies the given change and streams
+// it to the followers if it succeeds
+func (store *replicatedPeerConnectionStore) apply(entry logEntry) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if err := entry.apply(store.store); err != nil {
+		return err
+	}
+	store.broadcast(entry)
+	return nil
+}
+
+// Queues the given entry for every follower and
+// drops the ones whose queue is full. The store
+// lock must be held
+func (store *replicatedPeerConnectionStore) broadcast(entry logEntry) {
+	for _, follower := range store.followers {
+		select {
+		case follower.entries <- entry:
+		default:
+			store.remove(follower)
+		}
+	}
+}
+
+// Stops streaming to the given follower.
+// The store lock must be held
+func (store *replicatedPeerConnectionStore) remove(follower *follower) {
+	if store.followers[follower.conn] != follower {
+		return
+	}
+	delete(store.followers, follower.conn)
+	close(follower.entries)
+	follower.conn.Close()
+}
+
+// Stops streaming to the given follower
+func (store *replicatedPeerConnectionStore) drop(follower *follower) {
+	store.Lock()
+	defer store.Unlock()
+	store.remove(follower)
+}
+
+// Returns an entry carrying every registration
+// of the store. The store lock must be held
+func (store *replicatedPeerConnectionStore) snapshot() (logEntry, error) {
+	var buff bytes.Buffer
+	if err := store.store.Snapshot(&buff); err != nil {
+		return logEntry{}, err
+	}
+	return logEntry{Op: logOpSnapshot, Value: buff.String(), Time: time.Now()}, nil
+}
+
+// Starts streaming the changes to the standby
+// connected through the given connection. He
+// receives every registration first
+func (store *replicatedPeerConnectionStore) follow(conn net.Conn) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.closed {
+		return fmt.Errorf("replication is closed")
+	}
+
+	entry, err := store.snapshot()
+	if err != nil {
+		return err
+	}
+
+	follower := &follower{conn: conn, entries: make(chan logEntry, store.queueSize)}
+	follower.entries <- entry
+	store.followers[conn] = follower
+	go follower.write(store)
+	return nil
+}
+
+// Tells the followers the primary is alive
+func (store *replicatedPeerConnectionStore) heartbeat() {
+	store.Lock()
+	defer store.Unlock()
+	store.broadcast(logEntry{Op: logOpHeartbeat, Time: time.Now()})
+}
+
+// Returns the number of followers
+func (store *replicatedPeerConnectionStore) following() int {
+	store.Lock()
+	defer store.Unlock()
+	return len(store.followers)
+}
+
+// Stops streaming to every follower
+func (store *replicatedPeerConnectionStore) close() {
+	store.Lock()
+	defer store.Unlock()
+
+	store.closed = true
+	for _, follower := range store.followers {
+		store.remove(follower)
+	}
+}
+
+// Saves the given addr for the given peer
+func (store *replicatedPeerConnectionStore) SavePeerRemoteAddr(peer string, addr string) error {
+	return store.apply(logEntry{Op: logOpSave, Peer: peer, Value: addr})
+}
+
+// Removes the given peer addr if the peer exists
+func (store *replicatedPeerConnectionStore) DeletePeerRemoteAddr(peer string) error {
+	return store.apply(logEntry{Op: logOpDelete, Peer: peer})
+}
+
+// Retrieves the peer addr by giving his name
+func (store *replicatedPeerConnectionStore) GetPeerRemoteAddr(peer string) (string, error) {
+	return store.store.GetPeerRemoteAddr(peer)
+}
+
+// Get connected peers to the stun server
+func (store *replicatedPeerConnectionStore) GetConnectedPeers() ([]PeerInfo, error) {
+	return store.store.GetConnectedPeers()
+}
+
+// Replaces the addr of the given peer
+// if the peer exists
+func (store *replicatedPeerConnectionStore) UpdatePeerRemoteAddr(peer string, addr string) error {
+	return store.apply(logEntry{Op: logOpUpdate, Peer: peer, Value: addr})
+}
+
+// Saves the session token issued to
+// the given peer
+func (store *replicatedPeerConnectionStore) SavePeerToken(peer string, token string) error {
+	return store.apply(logEntry{Op: logOpToken, Peer: peer, Value: token})
+}
+
+// Retrieves the session token issued
+// to the given peer
+func (store *replicatedPeerConnectionStore) GetPeerToken(peer string) (string, error) {
+	return store.store.GetPeerToken(peer)
+}
+
+// Saves the public key that identifies
+// the given peer
+func (store *replicatedPeerConnectionStore) SavePeerKey(peer string, key string) error {
+	return store.apply(logEntry{Op: logOpKey, Peer: peer, Value: key})
+}
+
+// Retrieves the public key that
+// identifies the given peer
+func (store *replicatedPeerConnectionStore) GetPeerKey(peer string) (string, error) {
+	return store.store.GetPeerKey(peer)
+}
+
+// Sets the time when the registration
+// of the given peer expires
+func (store *replicatedPeerConnectionStore) SetPeerExpiration(peer string, expiration time.Time) error {
+	return store.apply(logEntry{Op: logOpExpire, Peer: peer, Time: expiration})
+}
+
+// Removes the peers whose registration expired
+// before the given time and returns their names.
+// Sweeps that remove nobody are not streamed
+func (store *replicatedPeerConnectionStore) DeleteExpiredPeers(now time.Time) ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	expired, err := store.store.DeleteExpiredPeers(now)
+	if err != nil || len(expired) == 0 {
+		return expired, err
+	}
+	store.broadcast(logEntry{Op: logOpExpired, Time: now})
+	return expired, nil
+}
+
+// Writes every registration of the store
+// to the given writer, so it can be loaded
+// back later on by `Restore`
+func (store *replicatedPeerConnectionStore) Snapshot(w io.Writer) error {
+	store.Lock()
+	defer store.Unlock()
+	return store.store.Snapshot(w)
+}
+
+// Replaces every registration of the store with
+// the ones written by `Snapshot` to the given
+// reader and sends them to the followers
+func (store *replicatedPeerConnectionStore) Restore(r io.Reader) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if err := store.store.Restore(r); err != nil {
+		return err
+	}
+
+	entry, err := store.snapshot()
+	if err != nil {
+		return err
+	}
+	store.broadcast(entry)
+	return nil
+}
+
+// Creates a new store that streams the
+// changes of the given one to the followers
+func newReplicatedPeerConnectionStore(store SnapshotPeerConnectionStore) *replicatedPeerConnectionStore {
+	return &replicatedPeerConnectionStore{
+		store:     store,
+		followers: map[net.Conn]*follower{},
+		queueSize: REPLICATION_QUEUE_SIZE,
+	}
+}
+
+// Role of a server in the replication. Standbys
+// replicate the registrations of the primary
+// and refuse every request until promoted
+type replicationState struct {
+	sync.Mutex
+	standby     bool
+	lastContact time.Time
+	promoted    chan struct{}
+}
+
+// Checks if the server is a standby
+func (state *replicationState) isStandby() bool {
+	state.Lock()
+	defer state.Unlock()
+	return state.standby
+}
+
+// Makes the server a primary and returns
+// whether it was a standby
+func (state *replicationState) promote() bool {
+	state.Lock()
+	defer state.Unlock()
+
+	if !state.standby {
+		return false
+	}
+	state.standby = false
+	close(state.promoted)
+	return true
+}
+
+// Records the primary is alive
+func (state *replicationState) touch() {
+	state.Lock()
+	state.lastContact = time.Now()
+	state.Unlock()
+}
+
+// Returns the time since the primary
+// was heard from for the last time
+func (state *replicationState) silence() time.Duration {
+	state.Lock()
+	defer state.Unlock()
+	return time.Since(state.lastContact)
+}
+
+// Creates the replication role of a server
+func newReplicationState(standby bool) *replicationState {
+	return &replicationState{standby: standby, lastContact: time.Now(), promoted: make(chan struct{})}
+}
+
+// Message exchanged by a primary and a standby
+// before any registration is streamed, so each
+// of them proves he knows the replication secret
+type replicationHandshake struct {
+	Challenge string `json:"challenge,omitempty"`
+	Proof     string `json:"proof,omitempty"`
+}
+
+// Roles that sign the replication handshake,
+// so a proof cannot be sent back as is
+const (
+	replicationRolePrimary = "primary"
+	replicationRoleStandby = "standby"
+)
+
+// Returns a new random challenge
+func newReplicationChallenge() (string, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(challenge), nil
+}
+
+// Returns the proof the given role knows
+// the given secret for the given challenge
+func replicationProof(secret string, role string, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(role + "/" + challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the given proof of the given role
+// for the given secret and challenge
+func validReplicationProof(secret string, role string, challenge string, proof string) bool {
+	return hmac.Equal([]byte(replicationProof(secret, role, challenge)), []byte(proof))
+}
+
+// Challenges the standby connected through the
+// given connection and proves the primary knows
+// the secret too. Nothing is streamed to him
+// until he answers with the right proof
+func admitStandby(conn net.Conn, secret string) error {
+	conn.SetDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge, err := newReplicationChallenge()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(conn)
+	if err := encoder.Encode(replicationHandshake{Challenge: challenge}); err != nil {
+		return err
+	}
+
+	var answer replicationHandshake
+	if err := json.NewDecoder(conn).Decode(&answer); err != nil {
+		return err
+	}
+	if answer.Challenge == "" || !validReplicationProof(secret, replicationRoleStandby, challenge, answer.Proof) {
+		return fmt.Errorf("standby does not know the replication secret")
+	}
+	return encoder.Encode(replicationHandshake{Proof: replicationProof(secret, replicationRolePrimary, answer.Challenge)})
+}
+
+// Answers the challenge of the primary connected
+// through the given connection and checks he
+// knows the secret too, so no one else can feed
+// registrations to the standby
+func joinPrimary(conn net.Conn, decoder *json.Decoder, secret string) error {
+	conn.SetDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	var offer replicationHandshake
+	if err := decoder.Decode(&offer); err != nil {
+		return err
+	}
+
+	challenge, err := newReplicationChallenge()
+	if err != nil {
+		return err
+	}
+
+	answer := replicationHandshake{Challenge: challenge, Proof: replicationProof(secret, replicationRoleStandby, offer.Challenge)}
+	if err := json.NewEncoder(conn).Encode(answer); err != nil {
+		return err
+	}
+
+	var proof replicationHandshake
+	if err := decoder.Decode(&proof); err != nil {
+		return err
+	}
+	if !validReplicationProof(secret, replicationRolePrimary, challenge, proof.Proof) {
+		return fmt.Errorf("primary does not know the replication secret")
+	}
+	return nil
+}
+
+// Accepts standbys from the replication
+// listener until it is closed
+func (stun Stun) acceptFollowers() {
+	for {
+		conn, err := stun.replicas.Accept()
+		if err != nil {
+			return
+		}
+		go stun.admit(conn)
+	}
+}
+
+// Streams the changes to the standby connected
+// through the given connection once he proves
+// he knows the replication secret
+func (stun Stun) admit(conn net.Conn) {
+	if err := admitStandby(conn, stun.options.replicationSecret); err != nil {
+		stun.log("Standby ", conn.RemoteAddr(), " refused ", err)
+		conn.Close()
+		return
+	}
+
+	if err := stun.replicated.follow(conn); err != nil {
+		stun.log("Cannot replicate to standby ", conn.RemoteAddr(), " ", err)
+		conn.Close()
+		return
+	}
+	stun.log("Standby ", conn.RemoteAddr(), " is following")
+}
+
+// Tells the followers the primary is alive
+// every heartbeat until stopped
+func (stun Stun) keepReplicating(stop <-chan struct{}) {
+	ticker := time.NewTicker(REPLICATION_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			stun.replicated.heartbeat()
+		}
+	}
+}
+
+// Applies the given entry sent by the primary
+func (stun Stun) applyReplicated(entry logEntry) error {
+	switch entry.Op {
+	case logOpHeartbeat:
+		return nil
+	case logOpSnapshot:
+		return stun.store.(SnapshotPeerConnectionStore).Restore(strings.NewReader(entry.Value))
+	default:
+		return entry.apply(stun.store)
+	}
+}
+
+// Streams the changes of the primary into the
+// store until the stream breaks, the server is
+// stopped or it is promoted
+func (stun Stun) replicate(stop <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", stun.options.primary, REPLICATION_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	// unblocks the reads once there's
+	// nothing else to replicate
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-stun.replication.promoted:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	decoder := json.NewDecoder(conn)
+	if err := joinPrimary(conn, decoder, stun.options.replicationSecret); err != nil {
+		return err
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+		var entry logEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		stun.replication.touch()
+
+		// changes that failed on the primary fail
+		// here too, only broken snapshots matter
+		if err := stun.applyReplicated(entry); err != nil && entry.Op == logOpSnapshot {
+			return err
+		}
+	}
+}
+
+// Follows the primary until the server is
+// stopped or promoted. The standby promotes
+// himself once the primary cannot be reached
+// for the failover timeout, unless it is zero
+func (stun Stun) follow(stop <-chan struct{}) {
+	for stun.replication.isStandby() {
+		err := stun.replicate(stop)
+
+		select {
+		case <-stop:
+			return
+		case <-stun.replication.promoted:
+			return
+		default:
+		}
+
+		stun.log("Replication from primary ", stun.options.primary, " broken ", err)
+		if timeout := stun.options.failoverTimeout; timeout > 0 && stun.replication.silence() >= timeout {
+			stun.Promote()
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(REPLICATION_HEARTBEAT):
+		}
+	}
+}
+
+// Promotes a standby server to primary, so it
+// serves the registrations replicated so far
+// and stops following the old primary
+func (stun Stun) Promote() error {
+	if !stun.replication.promote() {
+		return fmt.Errorf("stun server is not a standby")
+	}
+	stun.log("Server promoted to primary")
+	return nil
+}
+
+// Checks if the server is a standby that
+// has not been promoted yet
+func (stun Stun) IsStandby() bool {
+	return stun.replication.isStandby()
+}
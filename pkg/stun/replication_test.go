@@ -0,0 +1,424 @@
+package stun
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Connects a new follower to the given store
+// and returns the decoder of his stream
+func newFollower(t *testing.T, store *replicatedPeerConnectionStore) (net.Conn, *json.Decoder) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.follow(accepted); err != nil {
+		t.Fatal(err)
+	}
+	return conn, json.NewDecoder(conn)
+}
+
+// Reads the next entry of the given stream
+func nextEntry(t *testing.T, decoder *json.Decoder) logEntry {
+	var entry logEntry
+	if err := decoder.Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// Waits until the given condition holds
+// or fails the test after the given time
+func eventually(t *testing.T, timeout time.Duration, condition func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Checks the given condition holds for the
+// given time or fails the test once it does not
+func consistently(t *testing.T, duration time.Duration, condition func() bool) {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		if !condition() {
+			t.Fatal("condition broken")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicatedPeerConnectionStore(t *testing.T) {
+	assert := require.New(t)
+	expiration := time.Now().Add(time.Minute).Round(0)
+
+	t.Run("test_replicated_store_sends_snapshot_first", func(t *testing.T) {
+		store := newReplicatedPeerConnectionStore(NewMemoryPeerConnectionStore())
+		registerPeer(store, "alice", "127.0.0.1:50010", expiration)
+
+		_, decoder := newFollower(t, store)
+
+		entry := nextEntry(t, decoder)
+		assert.Equal(logOpSnapshot, entry.Op)
+
+		standby := NewMemoryPeerConnectionStore()
+		assert.NoError(standby.Restore(strings.NewReader(entry.Value)))
+		token, err := standby.GetPeerToken("alice")
+		assert.NoError(err)
+		assert.Equal("token-alice", token)
+	})
+
+	t.Run("test_replicated_store_streams_changes_in_order", func(t *testing.T) {
+		store := newReplicatedPeerConnectionStore(NewMemoryPeerConnectionStore())
+		_, decoder := newFollower(t, store)
+		nextEntry(t, decoder)
+
+		registerPeer(store, "alice", "127.0.0.1:50010", expiration)
+		assert.NoError(store.UpdatePeerRemoteAddr("alice", "127.0.0.1:50011"))
+		assert.NoError(store.DeletePeerRemoteAddr("alice"))
+
+		ops := []string{}
+		for i := 0; i < 6; i++ {
+			ops = append(ops, nextEntry(t, decoder).Op)
+		}
+		assert.Equal([]string{logOpSave, logOpKey, logOpToken, logOpExpire, logOpUpdate, logOpDelete}, ops)
+	})
+
+	t.Run("test_replicated_store_skips_failed_changes", func(t *testing.T) {
+		store := newReplicatedPeerConnectionStore(NewMemoryPeerConnectionStore())
+		_, decoder := newFollower(t, store)
+		nextEntry(t, decoder)
+
+		assert.Error(store.DeletePeerRemoteAddr("alice"))
+		expired, err := store.DeleteExpiredPeers(time.Now())
+		assert.NoError(err)
+		assert.Empty(expired)
+		store.heartbeat()
+
+		assert.Equal(logOpHeartbeat, nextEntry(t, decoder).Op)
+	})
+
+	t.Run("test_replicated_store_streams_sweeps", func(t *testing.T) {
+		store := newReplicatedPeerConnectionStore(NewMemoryPeerConnectionStore())
+		registerPeer(store, "alice", "127.0.0.1:50010", time.Now().Add(-time.Minute))
+		_, decoder := newFollower(t, store)
+		nextEntry(t, decoder)
+
+		now := time.Now().Round(0)
+		expired, err := store.DeleteExpiredPeers(now)
+		assert.NoError(err)
+		assert.Equal([]string{"alice"}, expired)
+
+		entry := nextEntry(t, decoder)
+		assert.Equal(logOpExpired, entry.Op)
+		assert.True(now.Equal(entry.Time))
+	})
+
+	t.Run("test_replicated_store_drops_broken_followers", func(t *testing.T) {
+		store := newReplicatedPeerConnectionStore(NewMemoryPeerConnectionStore())
+		conn, _ := newFollower(t, store)
+		assert.Equal(1, store.following())
+
+		conn.Close()
+		eventually(t, 2*time.Second, func() bool {
+			store.heartbeat()
+			return store.following() == 0
+		})
+	})
+
+	t.Run("test_replicated_store_drops_slow_followers", func(t *testing.T) {
+		store := newReplicatedPeerConnectionStore(NewMemoryPeerConnectionStore())
+		store.queueSize = 2
+		standby, primary := net.Pipe()
+		defer standby.Close()
+		assert.NoError(store.follow(primary))
+
+		// the standby never reads, so the store
+		// goes on while his queue fills up
+		for i := 0; i < 4; i++ {
+			store.heartbeat()
+		}
+
+		assert.Zero(store.following())
+	})
+
+	t.Run("test_replicated_store_refuses_followers_once_closed", func(t *testing.T) {
+		store := newReplicatedPeerConnectionStore(NewMemoryPeerConnectionStore())
+		store.close()
+		standby, primary := net.Pipe()
+		defer standby.Close()
+
+		assert.Error(store.follow(primary))
+		assert.Zero(store.following())
+	})
+
+	t.Run("test_replicated_store_close", func(t *testing.T) {
+		store := newReplicatedPeerConnectionStore(NewMemoryPeerConnectionStore())
+		_, decoder := newFollower(t, store)
+		nextEntry(t, decoder)
+
+		store.close()
+
+		var entry logEntry
+		assert.Error(decoder.Decode(&entry))
+		assert.Zero(store.following())
+	})
+}
+
+func TestReplicationHandshake(t *testing.T) {
+	assert := require.New(t)
+
+	handshake := func(primarySecret string, standbySecret string) (error, error) {
+		standby, primary := net.Pipe()
+		defer standby.Close()
+		defer primary.Close()
+
+		admitted := make(chan error, 1)
+		go func() {
+			err := admitStandby(primary, primarySecret)
+			primary.Close()
+			admitted <- err
+		}()
+		joined := joinPrimary(standby, json.NewDecoder(standby), standbySecret)
+		return <-admitted, joined
+	}
+
+	t.Run("test_replication_handshake_success", func(t *testing.T) {
+		admitted, joined := handshake("secret", "secret")
+
+		assert.NoError(admitted)
+		assert.NoError(joined)
+	})
+
+	t.Run("test_replication_handshake_fail_wrong_secret", func(t *testing.T) {
+		admitted, joined := handshake("secret", "guess")
+
+		assert.Error(admitted)
+		assert.Contains(admitted.Error(), "replication secret")
+		assert.Error(joined)
+	})
+
+	t.Run("test_replication_handshake_fail_fake_primary", func(t *testing.T) {
+		standby, primary := net.Pipe()
+		defer standby.Close()
+		defer primary.Close()
+
+		// answers with the proof of the standby,
+		// which cannot be sent back as is
+		go func() {
+			decoder := json.NewDecoder(primary)
+			encoder := json.NewEncoder(primary)
+			encoder.Encode(replicationHandshake{Challenge: "challenge"})
+			var answer replicationHandshake
+			decoder.Decode(&answer)
+			encoder.Encode(replicationHandshake{Proof: answer.Proof})
+		}()
+
+		err := joinPrimary(standby, json.NewDecoder(standby), "secret")
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "replication secret")
+	})
+
+	t.Run("test_replication_proof", func(t *testing.T) {
+		proof := replicationProof("secret", replicationRoleStandby, "challenge")
+
+		assert.True(validReplicationProof("secret", replicationRoleStandby, "challenge", proof))
+		assert.False(validReplicationProof("secret", replicationRolePrimary, "challenge", proof))
+		assert.False(validReplicationProof("guess", replicationRoleStandby, "challenge", proof))
+		assert.False(validReplicationProof("secret", replicationRoleStandby, "other", proof))
+	})
+}
+
+func TestReplicationState(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_replication_state_promote", func(t *testing.T) {
+		state := newReplicationState(true)
+		assert.True(state.isStandby())
+
+		assert.True(state.promote())
+		assert.False(state.isStandby())
+		assert.False(state.promote())
+
+		select {
+		case <-state.promoted:
+		default:
+			t.Fatal("promotion not signaled")
+		}
+	})
+
+	t.Run("test_replication_state_silence", func(t *testing.T) {
+		state := newReplicationState(true)
+		state.lastContact = time.Now().Add(-time.Minute)
+		assert.True(state.silence() >= time.Minute)
+
+		state.touch()
+		assert.True(state.silence() < time.Minute)
+	})
+}
+
+func TestStunReplication(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_new_stun_fail_store_cannot_be_replicated", func(t *testing.T) {
+		options := NewStunOptions(false).WithStandby("127.0.0.1:60101", "secret", 0)
+
+		_, err := NewStun("127.0.0.1:0", &MockPeerConnectionStore{}, options)
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "cannot be replicated")
+	})
+
+	t.Run("test_new_stun_fail_replication_without_secret", func(t *testing.T) {
+		options := NewStunOptions(false).WithReplication("127.0.0.1:60101", "")
+
+		_, err := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), options)
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "requires a secret")
+	})
+
+	t.Run("test_new_stun_fail_listen_replication", func(t *testing.T) {
+		options := NewStunOptions(false).WithReplication("fakeaddr", "secret")
+
+		_, err := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), options)
+
+		assert.Error(err)
+		assert.Contains(err.Error(), "standby servers")
+	})
+
+	t.Run("test_standby_refuses_requests", func(t *testing.T) {
+		options := NewStunOptions(false).WithStandby("127.0.0.1:60101", "secret", 0)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), options)
+		stun.Close()
+		stun.conn = conn
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50010")
+		request, _ := json.Marshal(msg.NewMsgRequest(msg.STUN_ACTION_GET, "alice", "bob"))
+
+		_, err := stun.handle(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.True(errors.Is(err, ErrStandby))
+		assert.Equal(msg.ERROR_CODE_STANDBY, response.Code)
+		assert.True(stun.IsStandby())
+	})
+
+	t.Run("test_standby_does_not_notify_shutdown", func(t *testing.T) {
+		store := NewMemoryPeerConnectionStore()
+		store.SavePeerRemoteAddr("alice", "127.0.0.1:50010")
+		options := NewStunOptions(false).WithStandby("127.0.0.1:60101", "secret", 0)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		stun, _ := NewStun("127.0.0.1:0", store, options)
+		stun.Close()
+		stun.conn = conn
+
+		stun.notifyShutdown()
+
+		assert.Nil(conn.writeToUDPMock.b)
+	})
+
+	t.Run("test_promote", func(t *testing.T) {
+		primary, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), NewStunOptions(false))
+		primary.Close()
+		assert.Error(primary.Promote())
+
+		options := NewStunOptions(false).WithStandby("127.0.0.1:60101", "secret", 0)
+		standby, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), options)
+		standby.Close()
+
+		assert.NoError(standby.Promote())
+		assert.False(standby.IsStandby())
+	})
+
+	t.Run("test_standby_follows_primary_and_takes_over", func(t *testing.T) {
+		primary := newLocalStun(t, NewMemoryPeerConnectionStore(), NewStunOptions(false).WithReplication("127.0.0.1:0", "secret"))
+		saddr := localAddr(primary.conn)
+		stopped := make(chan error, 1)
+		go func() { stopped <- primary.Serve(context.Background()) }()
+
+		standby, fallback := startStun(t, NewStunOptions(false).WithStandby(primary.replicas.Addr().String(), "secret", 0))
+
+		// registrations reach the standby
+		_, identity, _ := ed25519.GenerateKey(nil)
+		client := newLocalClient(t, saddr, NewClientStunOptions(false, 10).WithIdentity(identity).WithFallbacks(fallback))
+
+		_, err := client.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+		eventually(t, 2*time.Second, func() bool {
+			token, _ := standby.store.GetPeerToken("alice")
+			return token != ""
+		})
+
+		// the standby takes over once the primary is gone,
+		// the peer registers again since the session of
+		// the primary is never sent to another server
+		primary.Shutdown(context.Background())
+		<-stopped
+		assert.NoError(standby.Promote())
+
+		_, err = client.Request(timeoutContext(t, 2), "alice", msg.STUN_ACTION_REFRESH, "")
+		assert.True(errors.Is(err, ErrTimeout))
+
+		_, err = client.Request(timeoutContext(t, 2), "alice", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+		assert.Equal(fallback, client.Server())
+
+		response, err := client.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_REFRESH, "")
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_REFRESH, response.Action)
+		assert.Equal(fallback, client.Server())
+
+		_, err = client.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_DISCONNECT, "")
+		assert.NoError(err)
+	})
+
+	t.Run("test_standby_with_wrong_secret_gets_nothing", func(t *testing.T) {
+		store := NewMemoryPeerConnectionStore()
+		registerPeer(store, "alice", "127.0.0.1:50010", time.Now().Add(time.Minute))
+		primary := newLocalStun(t, store, NewStunOptions(false).WithReplication("127.0.0.1:0", "secret"))
+		serveStun(t, primary)
+
+		standby, _ := startStun(t, NewStunOptions(false).WithStandby(primary.replicas.Addr().String(), "guess", 0))
+
+		// the standby keeps knocking without being let in
+		consistently(t, REPLICATION_HEARTBEAT, func() bool {
+			_, err := standby.store.GetPeerToken("alice")
+			return err != nil && primary.replicated.following() == 0
+		})
+		assert.True(standby.IsStandby())
+	})
+
+	t.Run("test_standby_promotes_himself", func(t *testing.T) {
+		standby, _ := startStun(t, NewStunOptions(false).WithStandby("127.0.0.1:60101", "secret", 500*time.Millisecond))
+
+		eventually(t, 3*time.Second, func() bool { return !standby.IsStandby() })
+	})
+}
@@ -1,22 +1,77 @@
 package stun
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/alvarogf97/fox/pkg/msg"
 )
 
+const (
+	// Size of the buffers the stun
+	// server reads datagrams into
+	STUN_BUFFER_SIZE = 2048
+)
+
+// Error returned by `Serve` once the
+// server has been shut down
+var ErrServerClosed = errors.New("stun server closed")
+
+// Datagram read by the stun server that
+// waits to be handled by a worker. The
+// buffer belongs to the server pool
+type packet struct {
+	buff *[]byte
+	n    int
+	addr *net.UDPAddr
+}
+
 type Stun struct {
 	saddr   string
 	conn    UDPStunConn
 	store   PeerConnectionStore
 	options StunOptions
 
-	// marshaller
+	// buffers datagrams are read into, every
+	// datagram owns one until it is handled
+	buffers *sync.Pool
+
+	// lifecycle shared by every copy of the server
+	state *serverState
+
+	// servers asked for the peers that are not
+	// registered here and their pending lookups
+	siblings []*net.UDPAddr
+	lookups  *pendingLookups
+
+	// listener of the standby servers and the store
+	// that streams the changes to them, if this is
+	// a primary, and the replication role
+	replicas    net.Listener
+	replicated  *replicatedPeerConnectionStore
+	replication *replicationState
+
+	// peers told when the peers they watch change
+	// and what every peer told about himself
+	watches  *watchTable
+	profiles *profileTable
+
+	// ids of the signed requests seen lately
+	replays *replayTable
+
+	// marshaller of the messages the peers did not
+	// ask for and of the replies, which speak the
+	// codec of the request they answer
 	marshal   func(v interface{}) ([]byte, error)
+	reply     func(v interface{}) ([]byte, error)
 	unmarshal func(data []byte, v interface{}) error
 }
 
@@ -30,32 +85,94 @@ func (stun Stun) log(v ...interface{}) {
 
 // Response the peer request
 // with the given information
-func (stun Stun) sendResponse(action string, hasError bool, peername string, message string, addr *net.UDPAddr) (int, error) {
+func (stun Stun) sendResponse(id string, action string, hasError bool, peername string, message string, addr *net.UDPAddr) (int, error) {
 	response := msg.NewMsgResponse(
 		action,
 		hasError,
 		peername,
 		message,
 	)
-	serialized, err := stun.marshal(response)
+	response.Id = id
+	return stun.send(response, addr)
+}
+
+// Serializes the given response with the codec
+// of the request it answers and writes it to
+// the given address
+func (stun Stun) send(response msg.MsgResponse, addr *net.UDPAddr) (int, error) {
+	return stun.write(stun.reply, response, addr)
+}
+
+// Serializes the given message the peer did not
+// ask for with the server codec and writes it to
+// the given address
+func (stun Stun) notify(response msg.MsgResponse, addr *net.UDPAddr) (int, error) {
+	return stun.write(stun.marshal, response, addr)
+}
+
+// Serializes the given response with the given
+// marshaller and writes it to the given address.
+// Every response tells the protocol version
+// spoken by the server
+func (stun Stun) write(marshal func(v interface{}) ([]byte, error), response msg.MsgResponse, addr *net.UDPAddr) (int, error) {
+	response.Version = msg.PROTOCOL_VERSION
+	serialized, err := marshal(response)
 	if err != nil {
 		return 0, err
 	}
 	return stun.conn.WriteToUDP(serialized, addr)
 }
 
-// Handles peer disconnect request
+// Generates an unguessable session token
+func newSessionToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Checks the request carries the session
+// token issued to the requester peer and
+// is signed by the owner of his name. The
+// request must be fresh and seen only once
+func (stun Stun) authenticate(request msg.MsgRequest) error {
+	token, err := stun.store.GetPeerToken(request.Peername)
+	if err != nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(request.Token)) != 1 {
+		return fmt.Errorf("invalid session token for peer `%s`", request.Peername)
+	}
+
+	key, err := stun.store.GetPeerKey(request.Peername)
+	if err != nil {
+		return fmt.Errorf("invalid signature for peer `%s`", request.Peername)
+	}
+	if err := request.Verify(key); err != nil {
+		return err
+	}
+	return stun.fresh(request)
+}
+
+// Handles peer disconnect request. Only the
+// peer that holds the session token and the
+// key of his name is allowed to disconnect
+// himself
 func (stun Stun) handleDisconnectRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
+	if err := stun.authenticate(request); err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_DISCONNECT, msg.ERROR_CODE_UNAUTHORIZED, err.Error(), addr)
+		return err
+	}
+
 	if err := stun.store.DeletePeerRemoteAddr(request.Peername); err != nil {
-		stun.Error(msg.PEER_ACTION_DISCONNECT, request.Peername, err.Error(), addr)
+		stun.ReplyError(request, msg.PEER_ACTION_DISCONNECT, err.Error(), addr)
 		return err
 	}
+	stun.leave(request.Peername)
 
 	// Returns the peer that he has been disconnected
 	// successfully
-	if _, err := stun.Response(msg.PEER_ACTION_DISCONNECT, request.Peername, "", addr); err != nil {
-		ferr := fmt.Sprintf("Error sending response with action %s to %s : %s", msg.PEER_ACTION_GET, addr, err)
-		stun.Error(msg.PEER_ACTION_DISCONNECT, request.Peername, ferr, addr)
+	if _, err := stun.Reply(request, msg.PEER_ACTION_DISCONNECT, "", addr); err != nil {
+		ferr := fmt.Sprintf("Error sending response with action %s to %s : %s", msg.PEER_ACTION_DISCONNECT, addr, err)
+		stun.ReplyError(request, msg.PEER_ACTION_DISCONNECT, ferr, addr)
 		return err
 	}
 
@@ -63,55 +180,340 @@ func (stun Stun) handleDisconnectRequest(request msg.MsgRequest, addr *net.UDPAd
 }
 
 // Handles peer registration request by saving
-// the incoming address and peername into the
-// stun store
+// the incoming address, peername and public key
+// into the stun store. A session token is issued
+// to the peer so he can prove his identity later on.
+// The message may carry the profile of the peer,
+// messages that are not profiles are ignored
 func (stun Stun) handleNewRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
 	remoteAddr := fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+
+	// The peer must prove he owns the key
+	// he wants to register his name with,
+	// right now and not in a captured request
+	err := request.Verify(request.Key)
+	if err == nil {
+		err = stun.fresh(request)
+	}
+	if err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_NEW, msg.ERROR_CODE_UNAUTHORIZED, err.Error(), addr)
+		return err
+	}
+
+	profile, profileErr := msg.DecodeProfile(request.Message)
+	if profileErr != nil {
+		stun.log("Ignoring the profile of ", request.Peername, " ", profileErr)
+	}
+
+	presence := msg.PRESENCE_JOINED
+	registered := true
 	if err := stun.store.SavePeerRemoteAddr(request.Peername, remoteAddr); err != nil {
-		// Checks the addressed due to the peer could be down
-		// and tries to recconect, so if the saved address and
-		// the incoming one are the same return as normal
+		registered = false
+		// The peer could be down and tries to reconnect,
+		// maybe from another address. Only the owner of
+		// the name key is allowed to reclaim it
+		key, kerr := stun.store.GetPeerKey(request.Peername)
+		if kerr != nil || key != request.Key {
+			stun.ReplyErrorCode(request, msg.PEER_ACTION_NEW, msg.ERROR_CODE_NAME_TAKEN, err.Error(), addr)
+			return err
+		}
+
+		// his watchers only care if he moved
+		presence = ""
 		savedAddr, _ := stun.store.GetPeerRemoteAddr(request.Peername)
 		if remoteAddr != savedAddr {
-			stun.Error(msg.PEER_ACTION_NEW, request.Peername, err.Error(), addr)
-			return err
+			if err := stun.store.UpdatePeerRemoteAddr(request.Peername, remoteAddr); err != nil {
+				stun.ReplyError(request, msg.PEER_ACTION_NEW, err.Error(), addr)
+				return err
+			}
+			presence = msg.PRESENCE_MOVED
 		}
 	}
 
-	if _, err := stun.Response(msg.PEER_ACTION_NEW, request.Peername, remoteAddr, addr); err != nil {
+	if err := stun.store.SavePeerKey(request.Peername, request.Key); err != nil {
+		return stun.abortRegistration(request, registered, err, addr)
+	}
+
+	// Every registration starts a new session so
+	// tokens issued before are no longer valid
+	token, err := newSessionToken()
+	if err != nil {
+		return stun.abortRegistration(request, registered, err, addr)
+	}
+
+	if err := stun.store.SavePeerToken(request.Peername, token); err != nil {
+		return stun.abortRegistration(request, registered, err, addr)
+	}
+
+	// Leases the registration until the peer
+	// stops refreshing it
+	if err := stun.lease(request.Peername); err != nil {
+		return stun.abortRegistration(request, registered, err, addr)
+	}
+
+	// malformed profiles leave the peer private
+	if profileErr == nil {
+		stun.profiles.set(request.Peername, profile)
+	} else {
+		stun.profiles.remove(request.Peername)
+	}
+	response := msg.NewMsgResponse(msg.PEER_ACTION_NEW, false, request.Peername, remoteAddr)
+	response.Id = request.Id
+	response.Token = token
+	if _, err := stun.send(response, addr); err != nil {
 		ferr := fmt.Sprintf("Error sending response with action %s to %s : %s", msg.PEER_ACTION_NEW, addr, err)
-		stun.Error(msg.PEER_ACTION_NEW, request.Peername, ferr, addr)
+		stun.ReplyError(request, msg.PEER_ACTION_NEW, ferr, addr)
+		return err
+	}
+
+	if presence != "" {
+		stun.notifyPresence(request.Peername, presence, remoteAddr)
+	}
+	return nil
+}
+
+// Replies the given error to the given NEW
+// request. If the request registered the name
+// the registration is removed, so names whose
+// key, token or lease could not be saved are
+// never left behind without an owner
+func (stun Stun) abortRegistration(request msg.MsgRequest, registered bool, err error, addr *net.UDPAddr) error {
+	if registered {
+		if derr := stun.store.DeletePeerRemoteAddr(request.Peername); derr != nil {
+			stun.log("Cannot roll back the registration of ", request.Peername, " ", derr)
+		}
+	}
+	stun.ReplyError(request, msg.PEER_ACTION_NEW, err.Error(), addr)
+	return err
+}
+
+// Handles peer keepalive request by extending
+// the lease of his registration. Only the peer
+// that holds the session token is allowed to
+// refresh it, so the request must be signed
+// with the key of his name. If the peer address changed, i.e.
+// his NAT mapping was renewed, the saved one
+// is replaced by the incoming one. Refreshes
+// carry the profile of the peer again, so
+// servers that lost it get it back
+func (stun Stun) handleRefreshRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
+	remoteAddr := fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+	savedAddr, err := stun.store.GetPeerRemoteAddr(request.Peername)
+	if err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_REFRESH, msg.ERROR_CODE_PEER_NOT_FOUND, err.Error(), addr)
+		return err
+	}
+
+	if err := stun.authenticate(request); err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_REFRESH, msg.ERROR_CODE_UNAUTHORIZED, err.Error(), addr)
 		return err
 	}
 
+	if savedAddr != remoteAddr {
+		if err := stun.store.UpdatePeerRemoteAddr(request.Peername, remoteAddr); err != nil {
+			stun.ReplyError(request, msg.PEER_ACTION_REFRESH, err.Error(), addr)
+			return err
+		}
+	}
+
+	if err := stun.lease(request.Peername); err != nil {
+		stun.ReplyError(request, msg.PEER_ACTION_REFRESH, err.Error(), addr)
+		return err
+	}
+
+	// empty profiles are public, so peers the
+	// server forgot are listed again
+	if profile, err := msg.DecodeProfile(request.Message); err == nil {
+		stun.profiles.set(request.Peername, profile)
+	}
+
+	if _, err := stun.Reply(request, msg.PEER_ACTION_REFRESH, remoteAddr, addr); err != nil {
+		ferr := fmt.Sprintf("Error sending response with action %s to %s : %s", msg.PEER_ACTION_REFRESH, addr, err)
+		stun.ReplyError(request, msg.PEER_ACTION_REFRESH, ferr, addr)
+		return err
+	}
+
+	if savedAddr != remoteAddr {
+		stun.notifyPresence(request.Peername, msg.PRESENCE_MOVED, remoteAddr)
+	}
 	return nil
 }
 
+// Handles the probes clients send to check
+// the server is alive. Anyone can probe the
+// server, the requester address is answered
+func (stun Stun) handleProbeRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
+	remoteAddr := fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+	if _, err := stun.Reply(request, msg.PEER_ACTION_PROBE, remoteAddr, addr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Extends the registration lease of the given
+// peer. Leases are disabled when the ttl is zero
+func (stun Stun) lease(peername string) error {
+	if stun.options.leaseTTL <= 0 {
+		return nil
+	}
+	return stun.store.SetPeerExpiration(peername, time.Now().Add(stun.options.leaseTTL))
+}
+
+// Removes from the store every peer whose
+// lease expired before the given time and
+// tells their watchers they left
+func (stun Stun) sweep(now time.Time) ([]string, error) {
+	expired, err := stun.store.DeleteExpiredPeers(now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peername := range expired {
+		stun.log("Registration of peer ", peername, " expired")
+		stun.leave(peername)
+	}
+	return expired, nil
+}
+
+// Sweeps expired registrations every
+// sweep interval until stopped
+func (stun Stun) keepSweeping(stop <-chan struct{}) {
+	if stun.options.leaseTTL <= 0 || stun.options.sweepInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(stun.options.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			// standbys replicate the sweeps of the primary
+			if stun.replication.isStandby() {
+				continue
+			}
+			if _, err := stun.sweep(now); err != nil {
+				stun.log("Sweep expired peers failed ", err)
+			}
+		}
+	}
+}
+
 // Handles peer connect request by send to the
 // requested peer the addr of the peer he wants
 // to establish a connection. This method will
 // check the peername exists in the network and
-// is online
+// is online. The requested peer is introduced
+// to the requester too, so both of them can
+// start punching their NATs at the same time.
+// The public key of the requested peer is sent
+// back so the requester can verify his identity.
+// Only registered peers can ask for others and
+// they are introduced with the address they are
+// registered with, never the datagram one, so
+// nobody can make a peer punch somebody else.
+// Peers that are not registered here are looked
+// up in the sibling servers, if any
 func (stun Stun) handleGetRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
 	peername := request.Message
 
+	requesterAddr, err := stun.store.GetPeerRemoteAddr(request.Peername)
+	if err != nil {
+		ferr := fmt.Errorf("peer `%s` is not registered", request.Peername)
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_GET, msg.ERROR_CODE_UNAUTHORIZED, ferr.Error(), addr)
+		return ferr
+	}
+
+	if err := stun.authenticate(request); err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_GET, msg.ERROR_CODE_UNAUTHORIZED, err.Error(), addr)
+		return err
+	}
+
 	// checks the requested peer is registered in the network
 	peerAddr, err := stun.store.GetPeerRemoteAddr(peername)
 	if err != nil {
-		stun.Error(msg.PEER_ACTION_GET, request.Peername, err.Error(), addr)
+		// the sibling that knows the peer
+		// introduces the requester to him,
+		// who is answered once he does
+		if lerr := stun.lookup(request, requesterAddr, addr); lerr == nil {
+			return nil
+		} else if len(stun.siblings) > 0 {
+			stun.log("Lookup of peer ", peername, " failed ", lerr)
+		}
+
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_GET, msg.ERROR_CODE_PEER_NOT_FOUND, err.Error(), addr)
+		return err
+	}
+
+	peerKey, err := stun.store.GetPeerKey(peername)
+	if err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_GET, msg.ERROR_CODE_PEER_NOT_FOUND, err.Error(), addr)
 		return err
 	}
 
-	// Returns the requested address to peer
-	if _, err := stun.Response(msg.PEER_ACTION_GET, request.Peername, peerAddr, addr); err != nil {
+	// Introduces the requester to the requested peer
+	if err := stun.introduce(request.Peername, requesterAddr, peerAddr); err != nil {
+		ferr := fmt.Sprintf("Error introducing %s to %s : %s", request.Peername, peername, err)
+		stun.ReplyError(request, msg.PEER_ACTION_GET, ferr, addr)
+		return err
+	}
+
+	return stun.replyPeer(request, peerAddr, peerKey, addr)
+}
+
+// Answers the given get request with the
+// address and key of the requested peer
+func (stun Stun) replyPeer(request msg.MsgRequest, peerAddr string, peerKey string, addr *net.UDPAddr) error {
+	response := msg.NewMsgResponse(msg.PEER_ACTION_GET, false, request.Peername, peerAddr)
+	response.Id = request.Id
+	response.Key = peerKey
+	if _, err := stun.send(response, addr); err != nil {
 		ferr := fmt.Sprintf("Error sending response with action %s to %s : %s", msg.PEER_ACTION_GET, addr, err)
-		stun.Error(msg.PEER_ACTION_GET, request.Peername, ferr, addr)
+		stun.ReplyError(request, msg.PEER_ACTION_GET, ferr, addr)
 		return err
 	}
 
 	return nil
 }
 
+// Sends to the peer registered in the given
+// address the name and the registered address
+// of the peer that wants to connect to him. The
+// key registered by the requester, if any, is
+// sent too so his identity can be verified
+func (stun Stun) introduce(peername string, remoteAddr string, peerAddr string) error {
+	key, _ := stun.store.GetPeerKey(peername)
+	return stun.sendIntroduction(peername, key, remoteAddr, peerAddr)
+}
+
+// Sends to the peer registered in the given
+// address the name, key and public address of
+// the peer that wants to connect to him
+func (stun Stun) sendIntroduction(peername string, key string, remoteAddr string, peerAddr string) error {
+	paddr, err := net.ResolveUDPAddr("udp4", peerAddr)
+	if err != nil {
+		return err
+	}
+
+	introduction := msg.NewMsgResponse(msg.PEER_ACTION_INTRODUCE, false, peername, remoteAddr)
+	introduction.Key = key
+	_, err = stun.notify(introduction, paddr)
+	return err
+}
+
+// Checks the server understands the protocol
+// version the given request was written with
+func (stun Stun) checkVersion(request msg.MsgRequest) error {
+	if request.Version < stun.options.minVersion || !msg.SupportsVersion(request.Version) {
+		return fmt.Errorf(
+			"unsupported protocol version `%d`, the server supports versions `%d` to `%d`",
+			request.Version, stun.options.minVersion, msg.PROTOCOL_VERSION,
+		)
+	}
+	return nil
+}
+
 // Handles incomming request data and
 // returns the handled action name if
 // it can be handled, otherwise returns
@@ -125,6 +527,26 @@ func (stun Stun) handle(data []byte, addr *net.UDPAddr) (string, error) {
 		return "", err
 	}
 
+	// the requester is answered in the
+	// codec he wrote the request with
+	if codec, err := msg.CodecOf(data); err == nil {
+		stun.reply = msg.NewEncoder(codec)
+	}
+
+	// requests written with an unsupported
+	// version cannot be understood
+	if err := stun.checkVersion(request); err != nil {
+		stun.ReplyErrorCode(request, request.Action, msg.ERROR_CODE_UNSUPPORTED_VERSION, err.Error(), addr)
+		return "", err
+	}
+
+	// standbys only follow the primary
+	if stun.replication.isStandby() {
+		message := fmt.Sprintf("stun server is a standby of `%s`", stun.options.primary)
+		stun.ReplyErrorCode(request, request.Action, msg.ERROR_CODE_STANDBY, message, addr)
+		return "", ErrStandby
+	}
+
 	// handle request action
 	switch request.Action {
 	case msg.STUN_ACTION_NEW:
@@ -136,9 +558,27 @@ func (stun Stun) handle(data []byte, addr *net.UDPAddr) (string, error) {
 	case msg.STUN_ACTION_DISCONNECT:
 		err := stun.handleDisconnectRequest(request, addr)
 		return msg.STUN_ACTION_DISCONNECT, err
+	case msg.STUN_ACTION_REFRESH:
+		err := stun.handleRefreshRequest(request, addr)
+		return msg.STUN_ACTION_REFRESH, err
+	case msg.STUN_ACTION_WATCH:
+		err := stun.handleWatchRequest(request, addr)
+		return msg.STUN_ACTION_WATCH, err
+	case msg.STUN_ACTION_UNWATCH:
+		err := stun.handleUnwatchRequest(request, addr)
+		return msg.STUN_ACTION_UNWATCH, err
+	case msg.STUN_ACTION_LIST:
+		err := stun.handleListRequest(request, addr)
+		return msg.STUN_ACTION_LIST, err
+	case msg.STUN_ACTION_PROBE:
+		err := stun.handleProbeRequest(request, addr)
+		return msg.STUN_ACTION_PROBE, err
+	case msg.STUN_ACTION_LOOKUP:
+		err := stun.handleLookupRequest(request, addr)
+		return msg.STUN_ACTION_LOOKUP, err
 	default:
 		message := fmt.Sprintf("unknown action `%s`", request.Action)
-		stun.Error(request.Action, request.Peername, message, addr)
+		stun.ReplyErrorCode(request, request.Action, msg.ERROR_CODE_UNKNOWN_ACTION, message, addr)
 		return "", fmt.Errorf(message)
 	}
 }
@@ -146,13 +586,36 @@ func (stun Stun) handle(data []byte, addr *net.UDPAddr) (string, error) {
 // shortcut for `sendResponse` that not
 // sends the error flag
 func (stun Stun) Response(action string, peername string, message string, addr *net.UDPAddr) (int, error) {
-	return stun.sendResponse(action, false, peername, message, addr)
+	return stun.sendResponse("", action, false, peername, message, addr)
 }
 
 // shortcut for `sendResponse` that
 // sends the error flag
 func (stun Stun) Error(action string, peername string, message string, addr *net.UDPAddr) (int, error) {
-	return stun.sendResponse(action, true, peername, message, addr)
+	return stun.sendResponse("", action, true, peername, message, addr)
+}
+
+// shortcut for `sendResponse` that answers
+// the given request echoing back his id
+func (stun Stun) Reply(request msg.MsgRequest, action string, message string, addr *net.UDPAddr) (int, error) {
+	return stun.sendResponse(request.Id, action, false, request.Peername, message, addr)
+}
+
+// shortcut for `ReplyErrorCode` that answers
+// the given request with an internal error
+func (stun Stun) ReplyError(request msg.MsgRequest, action string, message string, addr *net.UDPAddr) (int, error) {
+	return stun.ReplyErrorCode(request, action, msg.ERROR_CODE_INTERNAL, message, addr)
+}
+
+// Answers the given request with the error
+// flag and the given error code echoing back
+// his id, so clients can tell the error apart
+// without parsing the message
+func (stun Stun) ReplyErrorCode(request msg.MsgRequest, action string, code string, message string, addr *net.UDPAddr) (int, error) {
+	response := msg.NewMsgResponse(action, true, request.Peername, message)
+	response.Id = request.Id
+	response.Code = code
+	return stun.send(response, addr)
 }
 
 // Reads data from the udp connection.
@@ -165,8 +628,12 @@ func (stun Stun) ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error) {
 	return stun.conn.ReadFromUDP(b)
 }
 
-// Closes stun connection
+// Closes stun connection and stops
+// accepting standby servers
 func (stun Stun) Close() error {
+	if stun.replicas != nil {
+		stun.replicas.Close()
+	}
 	return stun.conn.Close()
 }
 
@@ -176,21 +643,229 @@ func (stun Stun) GetConnectedPeers() ([]PeerInfo, error) {
 	return stun.store.GetConnectedPeers()
 }
 
-// Starts server infinite loop
-func (stun Stun) Serve() {
-	var buf [2048]byte
+// Handles the queued datagrams until the
+// queue is closed and gives their buffers
+// back to the pool
+func (stun Stun) work(packets <-chan packet) {
+	for packet := range packets {
+		stun.handle((*packet.buff)[:packet.n], packet.addr)
+		stun.buffers.Put(packet.buff)
+	}
+}
+
+// Lifecycle of a stun server. Shutting down
+// closes the closing channel and the stopped
+// one is closed once `Serve` returns
+type serverState struct {
+	sync.Mutex
+	serving bool
+	closed  bool
+	closing chan struct{}
+	stopped chan struct{}
+}
+
+// Marks the server as serving. A server
+// serves once and only until it is closed
+func (state *serverState) start() error {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.closed {
+		return ErrServerClosed
+	}
+	if state.serving {
+		return fmt.Errorf("stun server is already serving")
+	}
+	state.serving = true
+	return nil
+}
+
+// Marks the server as closed and returns
+// whether it was serving
+func (state *serverState) close() bool {
+	state.Lock()
+	defer state.Unlock()
+
+	if !state.closed {
+		state.closed = true
+		close(state.closing)
+	}
+	return state.serving
+}
+
+// Checks if the server has been closed
+func (state *serverState) isClosed() bool {
+	state.Lock()
+	defer state.Unlock()
+	return state.closed
+}
+
+// Creates the lifecycle of a new server
+func newServerState() *serverState {
+	return &serverState{closing: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+// Wakes up the read loop blocked on the
+// connection. Connections that do not
+// support read deadlines are closed
+func (stun Stun) interruptRead() {
+	type deadliner interface {
+		SetReadDeadline(t time.Time) error
+	}
+
+	if conn, ok := stun.conn.(deadliner); ok && conn.SetReadDeadline(time.Now()) == nil {
+		return
+	}
+	stun.conn.Close()
+}
+
+// Tells every registered peer the server is
+// going away. Standbys tell nobody, the peers
+// are registered into the primary
+func (stun Stun) notifyShutdown() {
+	if stun.replication.isStandby() {
+		return
+	}
+
+	peers, err := stun.store.GetConnectedPeers()
+	if err != nil {
+		stun.log("Cannot notify shutdown to peers ", err)
+		return
+	}
+
+	for _, peer := range peers {
+		addr, err := net.ResolveUDPAddr("udp4", peer.Addr)
+		if err != nil {
+			continue
+		}
+		stun.Response(msg.PEER_ACTION_SHUTDOWN, peer.Peername, "stun server is shutting down", addr)
+	}
+}
+
+// Serves the requests until the given context
+// is done or the server is shut down. Every
+// datagram is read into his own pooled buffer
+// and queued for a bounded number of workers.
+// Reads stop once the queue is full, so bursts
+// are held by the socket buffer instead of
+// piling goroutines up. Queued and in-flight
+// requests are handled before returning and
+// the connection is closed afterwards
+func (stun Stun) Serve(ctx context.Context) error {
+	if err := stun.state.start(); err != nil {
+		return err
+	}
+	defer close(stun.state.stopped)
 	defer stun.Close()
+
 	stun.log("Server is ready to accept UDP connections in ", stun.saddr)
+	go stun.keepSweeping(stun.state.closing)
+
+	if stun.replicas != nil {
+		go stun.acceptFollowers()
+		go stun.keepReplicating(stun.state.closing)
+		defer stun.replicated.close()
+	}
+	if stun.replication.isStandby() {
+		go stun.follow(stun.state.closing)
+	}
+
+	// stops reading once the server
+	// is told to go away
+	go func() {
+		select {
+		case <-ctx.Done():
+			stun.state.close()
+		case <-stun.state.closing:
+		}
+		stun.interruptRead()
+	}()
+
+	packets := make(chan packet, stun.options.queueSize)
+	size := stun.options.workers
+	if size < 1 {
+		size = 1
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < size; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			stun.work(packets)
+		}()
+	}
 
 	for {
-		n, addr, err := stun.ReadFromUDP(buf[0:])
+		// datagrams already read are handled
+		// even if the server is closing. Sibling
+		// answers are delivered right away, so
+		// lookups never wait for a free worker
+		buff := stun.buffers.Get().(*[]byte)
+		n, addr, err := stun.ReadFromUDP(*buff)
+		if err == nil && !stun.resolveLookup((*buff)[:n], addr) {
+			packets <- packet{buff: buff, n: n, addr: addr}
+		} else {
+			stun.buffers.Put(buff)
+		}
+
+		if stun.state.isClosed() {
+			break
+		}
+
+		// the connection was closed without shutting
+		// the server down, e.g. by `Close`, so every
+		// following read would fail straight away
+		if errors.Is(err, net.ErrClosed) {
+			stun.state.close()
+			break
+		}
 		if err != nil {
 			stun.log(err)
-			continue
 		}
+	}
+
+	// drains the requests read so far
+	close(packets)
+	workers.Wait()
+
+	if stun.options.shutdownNotice {
+		stun.notifyShutdown()
+	}
+	stun.log("Server stopped accepting UDP connections in ", stun.saddr)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrServerClosed
+}
 
-		go stun.handle(buf[:n], addr)
+// Shuts the server down gracefully. It stops
+// reading requests and waits until the ones
+// in flight are handled and `Serve` returns or
+// the given context is done. The connection is
+// closed straight away in the latter case
+func (stun Stun) Shutdown(ctx context.Context) error {
+	if !stun.state.close() {
+		return stun.Close()
 	}
+
+	select {
+	case <-stun.state.stopped:
+		return nil
+	case <-ctx.Done():
+		stun.Close()
+		return ctx.Err()
+	}
+}
+
+// Creates the pool of buffers the
+// stun server reads datagrams into
+func newBufferPool() *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		buff := make([]byte, STUN_BUFFER_SIZE)
+		return &buff
+	}}
 }
 
 // Creates a new Stun server
@@ -200,17 +875,59 @@ func NewStun(saddr string, store PeerConnectionStore, options StunOptions) (*Stu
 		return nil, err
 	}
 
+	siblings, err := resolveSiblings(options.siblings)
+	if err != nil {
+		return nil, err
+	}
+
+	// replicated registrations are
+	// copied through snapshots
+	var replicated *replicatedPeerConnectionStore
+	if options.replicationAddr != "" || options.primary != "" {
+		snapshots, valid := store.(SnapshotPeerConnectionStore)
+		if !valid {
+			return nil, fmt.Errorf("store `%T` cannot be replicated", store)
+		}
+		if options.replicationSecret == "" {
+			return nil, fmt.Errorf("replication requires a secret")
+		}
+		if options.replicationAddr != "" {
+			replicated = newReplicatedPeerConnectionStore(snapshots)
+			store = replicated
+		}
+	}
+
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		return nil, err
 	}
 
+	var replicas net.Listener
+	if options.replicationAddr != "" {
+		if replicas, err = net.Listen("tcp", options.replicationAddr); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot listen for standby servers: %s", err)
+		}
+	}
+
 	return &Stun{
-		saddr:     saddr,
-		conn:      conn,
-		store:     store,
-		options:   options,
-		marshal:   json.Marshal,
-		unmarshal: json.Unmarshal,
+		saddr:    saddr,
+		conn:     conn,
+		store:    store,
+		options:  options,
+		buffers:  newBufferPool(),
+		state:    newServerState(),
+		siblings: siblings,
+		lookups:  newPendingLookups(),
+
+		replicas:    replicas,
+		replicated:  replicated,
+		replication: newReplicationState(options.primary != ""),
+		watches:     newWatchTable(),
+		profiles:    newProfileTable(),
+		replays:     newReplayTable(),
+		marshal:     msg.NewEncoder(options.codec),
+		reply:       msg.NewEncoder(options.codec),
+		unmarshal:   msg.Decode,
 	}, nil
 }
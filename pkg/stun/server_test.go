@@ -2,6 +2,8 @@ package stun
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -107,12 +109,29 @@ func TestStunSendResponse(t *testing.T) {
 
 		stun.conn = conn
 
-		rsend, err := stun.sendResponse("fake", false, "dog", "bonks", addr)
+		rsend, err := stun.sendResponse("id", "fake", false, "dog", "bonks", addr)
 
 		assert.NoError(err)
 		assert.Equal(send, rsend)
 	})
 
+	t.Run("test_send_response_tells_version", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		store := NewMemoryPeerConnectionStore()
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, NewStunOptions(true))
+		stun.Close()
+		stun.conn = conn
+
+		stun.sendResponse("id", "fake", false, "dog", "bonks", addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+		assert.Equal(msg.PROTOCOL_VERSION, response.Version)
+	})
+
 	t.Run("test_send_response_fail_marshal", func(t *testing.T) {
 		rerr := fmt.Errorf("error")
 		saddr := ":50000"
@@ -126,15 +145,28 @@ func TestStunSendResponse(t *testing.T) {
 		stun.Close()
 
 		stun.conn = conn
-		stun.marshal = FailMarshal(rerr)
+		stun.reply = FailMarshal(rerr)
 
-		_, err := stun.sendResponse("fake", false, "dog", "bonks", addr)
+		_, err := stun.sendResponse("id", "fake", false, "dog", "bonks", addr)
 
 		assert.Error(err, rerr.Error())
 	})
 
 }
 
+// Signs the given request with a new
+// identity and returns his public key.
+// Requests without id are given one, as
+// clients do
+func signRequest(request *msg.MsgRequest) string {
+	_, identity, _ := ed25519.GenerateKey(nil)
+	if request.Id == "" {
+		request.Id, _ = newRequestId()
+	}
+	request.Sign(identity)
+	return request.Key
+}
+
 func TestStunHandleDisconnectRequest(t *testing.T) {
 	assert := require.New(t)
 
@@ -142,7 +174,13 @@ func TestStunHandleDisconnectRequest(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
 		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "bonks")
-		store := &MockPeerConnectionStore{deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{}}
+		request.Token = "token"
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{},
+			getPeerTokenMock:         &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:           &GetPeerKeyMock{key: key},
+		}
 		options := NewStunOptions(true)
 		send := 10
 		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
@@ -163,7 +201,13 @@ func TestStunHandleDisconnectRequest(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
 		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "bonks")
-		store := &MockPeerConnectionStore{deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{err: rerr}}
+		request.Token = "token"
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{err: rerr},
+			getPeerTokenMock:         &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:           &GetPeerKeyMock{key: key},
+		}
 		options := NewStunOptions(true)
 		send := 10
 		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
@@ -182,7 +226,13 @@ func TestStunHandleDisconnectRequest(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
 		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "bonks")
-		store := &MockPeerConnectionStore{deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{}}
+		request.Token = "token"
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{},
+			getPeerTokenMock:         &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:           &GetPeerKeyMock{key: key},
+		}
 		options := NewStunOptions(true)
 		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{err: rerr}}
 
@@ -194,6 +244,54 @@ func TestStunHandleDisconnectRequest(t *testing.T) {
 
 		assert.Error(err, rerr.Error())
 	})
+
+	t.Run("test_disconnect_fail_invalid_token", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "bonks")
+		request.Token = "forged"
+		store := &MockPeerConnectionStore{
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{},
+			getPeerTokenMock:         &GetPeerTokenMock{token: "token"},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleDisconnectRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.True(response.HasError)
+		assert.Equal(msg.ERROR_CODE_UNAUTHORIZED, response.Code)
+		assert.Equal("", store.deletePeerRemoteAddrMock.peer)
+	})
+
+	t.Run("test_disconnect_fail_missing_token", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "bonks")
+		store := &MockPeerConnectionStore{
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{},
+			getPeerTokenMock:         &GetPeerTokenMock{token: "token"},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleDisconnectRequest(request, addr)
+
+		assert.Error(err)
+		assert.Equal("", store.deletePeerRemoteAddrMock.peer)
+	})
 }
 
 func TestStunHandleNewRequest(t *testing.T) {
@@ -204,32 +302,762 @@ func TestStunHandleNewRequest(t *testing.T) {
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
 		remoteAddr := fmt.Sprintf("%s:%d", addr.IP, addr.Port)
 		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock: &SavePeerRemoteAddrMock{},
+			setPeerExpirationMock:  &SetPeerExpirationMock{},
+			savePeerTokenMock:      &SavePeerTokenMock{},
+			savePeerKeyMock:        &SavePeerKeyMock{},
+		}
+		options := NewStunOptions(true)
+		send := 10
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		assert.NoError(err)
+		assert.Equal(request.Peername, store.savePeerRemoteAddrMock.peer)
+		assert.Equal(remoteAddr, store.savePeerRemoteAddrMock.addr)
+		assert.Equal(request.Key, store.savePeerKeyMock.key)
+		assert.Equal(request.Peername, store.setPeerExpirationMock.peer)
+		assert.True(store.setPeerExpirationMock.expiration.After(time.Now()))
+		assert.Equal(send, conn.writeToUDPMock.send)
+	})
+
+	t.Run("test_new_request_keeps_profile", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50010")
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), NewStunOptions(false))
+		stun.Close()
+		stun.conn = &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		public := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		signRequest(&public)
+		malformed := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "cat", "bonks")
+		signRequest(&malformed)
+
+		assert.NoError(stun.handleNewRequest(public, addr))
+		assert.NoError(stun.handleNewRequest(malformed, addr))
+
+		// malformed profiles leave the peer private
+		assert.False(stun.profiles.private("dog"))
+		assert.True(stun.profiles.private("cat"))
+	})
+
+	t.Run("test_new_request_issues_session_token", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock: &SavePeerRemoteAddrMock{},
+			setPeerExpirationMock:  &SetPeerExpirationMock{},
+			savePeerTokenMock:      &SavePeerTokenMock{},
+			savePeerKeyMock:        &SavePeerKeyMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(request.Peername, store.savePeerTokenMock.peer)
+		assert.Len(response.Token, 64)
+		assert.Equal(store.savePeerTokenMock.token, response.Token)
+	})
+
+	t.Run("test_new_request_reclaim_from_another_address", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock:   &SavePeerRemoteAddrMock{err: rerr},
+			getPeerRemoteAddrMock:    &GetPeerRemoteAddrMock{addr: "127.0.0.1:50002"},
+			getPeerKeyMock:           &GetPeerKeyMock{key: key},
+			updatePeerRemoteAddrMock: &UpdatePeerRemoteAddrMock{},
+			setPeerExpirationMock:    &SetPeerExpirationMock{},
+			savePeerTokenMock:        &SavePeerTokenMock{},
+			savePeerKeyMock:          &SavePeerKeyMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(addr.String(), store.updatePeerRemoteAddrMock.addr)
+		assert.Len(response.Token, 64)
+		assert.Equal(store.savePeerTokenMock.token, response.Token)
+	})
+
+	t.Run("test_new_request_fail_reclaim_with_another_key", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock:   &SavePeerRemoteAddrMock{err: rerr},
+			getPeerRemoteAddrMock:    &GetPeerRemoteAddrMock{addr: addr.String()},
+			getPeerKeyMock:           &GetPeerKeyMock{key: signRequest(&msg.MsgRequest{})},
+			updatePeerRemoteAddrMock: &UpdatePeerRemoteAddrMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err, rerr.Error())
+		assert.True(response.HasError)
+		assert.Equal(msg.ERROR_CODE_NAME_TAKEN, response.Code)
+		assert.Equal("", store.updatePeerRemoteAddrMock.peer)
+	})
+
+	t.Run("test_new_request_fail_unsigned", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
 		store := &MockPeerConnectionStore{savePeerRemoteAddrMock: &SavePeerRemoteAddrMock{}}
 		options := NewStunOptions(true)
-		send := 10
-		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.True(response.HasError)
+		assert.Equal(msg.ERROR_CODE_UNAUTHORIZED, response.Code)
+		assert.Equal("", store.savePeerRemoteAddrMock.peer)
+	})
+
+	t.Run("test_new_request_fail_save_peer_key", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock:   &SavePeerRemoteAddrMock{},
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{},
+			savePeerKeyMock:          &SavePeerKeyMock{err: rerr},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		assert.Error(err, rerr.Error())
+		assert.Equal("dog", store.deletePeerRemoteAddrMock.peer)
+	})
+
+	t.Run("test_new_request_fail_save_peer_token", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock:   &SavePeerRemoteAddrMock{},
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{},
+			savePeerTokenMock:        &SavePeerTokenMock{err: rerr},
+			savePeerKeyMock:          &SavePeerKeyMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		assert.Error(err, rerr.Error())
+		assert.Equal("dog", store.deletePeerRemoteAddrMock.peer)
+	})
+
+	t.Run("test_new_request_fail_lease", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock:   &SavePeerRemoteAddrMock{},
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{},
+			setPeerExpirationMock:    &SetPeerExpirationMock{err: rerr},
+			savePeerTokenMock:        &SavePeerTokenMock{},
+			savePeerKeyMock:          &SavePeerKeyMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		assert.Error(err, rerr.Error())
+		assert.Equal("dog", store.deletePeerRemoteAddrMock.peer)
+	})
+
+	t.Run("test_new_request_fail_reclaim_keeps_registration", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		remoteAddr := fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock:   &SavePeerRemoteAddrMock{err: rerr},
+			deletePeerRemoteAddrMock: &DeletePeerRemoteAddrMock{},
+			getPeerRemoteAddrMock:    &GetPeerRemoteAddrMock{addr: remoteAddr},
+			getPeerKeyMock:           &GetPeerKeyMock{key: key},
+			savePeerTokenMock:        &SavePeerTokenMock{err: rerr},
+			savePeerKeyMock:          &SavePeerKeyMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		// the registration belongs to the session
+		// the peer already has, so it is kept
+		assert.Error(err, rerr.Error())
+		assert.Equal("", store.deletePeerRemoteAddrMock.peer)
+	})
+
+	t.Run("test_new_request_fail_save_peer_remote_addr", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock: &SavePeerRemoteAddrMock{err: rerr},
+			getPeerRemoteAddrMock:  &GetPeerRemoteAddrMock{addr: "fake"},
+			getPeerKeyMock:         &GetPeerKeyMock{key: "other"},
+		}
+		options := NewStunOptions(true)
+		send := 10
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		assert.Equal(request.Peername, store.getPeerKeyMock.peer)
+		assert.Equal(send, conn.writeToUDPMock.send)
+		assert.Error(err, rerr.Error())
+	})
+
+	t.Run("test_new_request_fail_response", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			savePeerRemoteAddrMock: &SavePeerRemoteAddrMock{},
+			setPeerExpirationMock:  &SetPeerExpirationMock{},
+			savePeerTokenMock:      &SavePeerTokenMock{},
+			savePeerKeyMock:        &SavePeerKeyMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{err: rerr}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleNewRequest(request, addr)
+
+		assert.Error(err, rerr.Error())
+	})
+}
+
+func TestStunHandleRefreshRequest(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_refresh_request_success", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Token = "token"
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			getPeerRemoteAddrMock: &GetPeerRemoteAddrMock{addr: addr.String()},
+			getPeerTokenMock:      &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:        &GetPeerKeyMock{key: key},
+			setPeerExpirationMock: &SetPeerExpirationMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleRefreshRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(request.Peername, store.setPeerExpirationMock.peer)
+		assert.True(store.setPeerExpirationMock.expiration.After(time.Now()))
+		assert.Equal(msg.PEER_ACTION_REFRESH, response.Action)
+		assert.False(response.HasError)
+	})
+
+	t.Run("test_refresh_request_fail_not_registered", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		store := &MockPeerConnectionStore{getPeerRemoteAddrMock: &GetPeerRemoteAddrMock{err: rerr}}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleRefreshRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err, rerr.Error())
+		assert.True(response.HasError)
+		assert.Equal(msg.ERROR_CODE_PEER_NOT_FOUND, response.Code)
+	})
+
+	t.Run("test_refresh_request_updates_address", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Token = "token"
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			getPeerRemoteAddrMock:    &GetPeerRemoteAddrMock{addr: "127.0.0.1:50002"},
+			getPeerTokenMock:         &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:           &GetPeerKeyMock{key: key},
+			updatePeerRemoteAddrMock: &UpdatePeerRemoteAddrMock{},
+			setPeerExpirationMock:    &SetPeerExpirationMock{},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleRefreshRequest(request, addr)
+
+		assert.NoError(err)
+		assert.Equal(request.Peername, store.updatePeerRemoteAddrMock.peer)
+		assert.Equal(addr.String(), store.updatePeerRemoteAddrMock.addr)
+	})
+
+	t.Run("test_refresh_request_fail_invalid_token", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Token = "forged"
+		store := &MockPeerConnectionStore{
+			getPeerRemoteAddrMock: &GetPeerRemoteAddrMock{addr: "127.0.0.1:50002"},
+			getPeerTokenMock:      &GetPeerTokenMock{token: "token"},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleRefreshRequest(request, addr)
+
+		assert.Error(err)
+	})
+
+	t.Run("test_refresh_request_fail_lease", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		request.Token = "token"
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			getPeerRemoteAddrMock: &GetPeerRemoteAddrMock{addr: addr.String()},
+			getPeerTokenMock:      &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:        &GetPeerKeyMock{key: key},
+			setPeerExpirationMock: &SetPeerExpirationMock{err: rerr},
+		}
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.handleRefreshRequest(request, addr)
+
+		assert.Error(err, rerr.Error())
+	})
+
+}
+
+func TestStunAuthenticate(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_authenticate_success", func(t *testing.T) {
+		saddr := ":50000"
+		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "")
+		request.Token = "token"
+		key := signRequest(&request)
+		store := &MockPeerConnectionStore{
+			getPeerTokenMock: &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:   &GetPeerKeyMock{key: key},
+		}
+		options := NewStunOptions(true)
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		err := stun.authenticate(request)
+
+		assert.NoError(err)
+		assert.Equal(request.Peername, store.getPeerTokenMock.peer)
+		assert.Equal(request.Peername, store.getPeerKeyMock.peer)
+	})
+
+	t.Run("test_authenticate_fail_invalid_signature", func(t *testing.T) {
+		saddr := ":50000"
+		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "")
+		request.Token = "token"
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			getPeerTokenMock: &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:   &GetPeerKeyMock{key: signRequest(&msg.MsgRequest{})},
+		}
+		options := NewStunOptions(true)
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		err := stun.authenticate(request)
+
+		assert.Error(err)
+	})
+
+	t.Run("test_authenticate_fail_key_not_found", func(t *testing.T) {
+		saddr := ":50000"
+		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "")
+		request.Token = "token"
+		signRequest(&request)
+		store := &MockPeerConnectionStore{
+			getPeerTokenMock: &GetPeerTokenMock{token: request.Token},
+			getPeerKeyMock:   &GetPeerKeyMock{err: fmt.Errorf("Error")},
+		}
+		options := NewStunOptions(true)
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		err := stun.authenticate(request)
+
+		assert.Error(err)
+	})
+
+	t.Run("test_authenticate_fail_token_not_found", func(t *testing.T) {
+		saddr := ":50000"
+		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "")
+		store := &MockPeerConnectionStore{getPeerTokenMock: &GetPeerTokenMock{err: fmt.Errorf("Error")}}
+		options := NewStunOptions(true)
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		err := stun.authenticate(request)
+
+		assert.Error(err)
+	})
+
+}
+
+func TestStunLease(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_lease_disabled", func(t *testing.T) {
+		saddr := ":50000"
+		store := &MockPeerConnectionStore{}
+		options := NewStunOptions(true).WithLease(0, 0)
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		err := stun.lease("dog")
+
+		assert.NoError(err)
+	})
+
+}
+
+func TestStunSweep(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_sweep_success", func(t *testing.T) {
+		saddr := ":50000"
+		now := time.Now()
+		store := &MockPeerConnectionStore{deleteExpiredPeersMock: &DeleteExpiredPeersMock{expired: []string{"dog"}}}
+		options := NewStunOptions(false)
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		expired, err := stun.sweep(now)
+
+		assert.NoError(err)
+		assert.Equal([]string{"dog"}, expired)
+		assert.Equal(now, store.deleteExpiredPeersMock.now)
+	})
+
+	t.Run("test_sweep_fail_delete_expired_peers", func(t *testing.T) {
+		rerr := fmt.Errorf("Error")
+		saddr := ":50000"
+		store := &MockPeerConnectionStore{deleteExpiredPeersMock: &DeleteExpiredPeersMock{err: rerr}}
+		options := NewStunOptions(false)
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		_, err := stun.sweep(time.Now())
+
+		assert.Error(err, rerr.Error())
+	})
+
+	t.Run("test_sweep_removes_expired_registrations", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		store := NewMemoryPeerConnectionStore()
+		options := NewStunOptions(false).WithLease(time.Second, time.Second)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		signRequest(&request)
+		stun.handleNewRequest(request, addr)
+
+		expired, _ := stun.sweep(time.Now())
+		assert.Empty(expired)
+
+		expired, _ = stun.sweep(time.Now().Add(2 * time.Second))
+		assert.Equal([]string{"dog"}, expired)
+	})
+
+}
+
+// Builds the get request of dog asking for the
+// given peer signed with the key he registered
+func newGetRequest(store *memoryPeerConnectionStore, peername string) msg.MsgRequest {
+	request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", peername)
+	request.Token = "token-dog"
+	store.keys["dog"] = signRequest(&request)
+	return request
+}
+
+func TestStunHandleGetRequest(t *testing.T) {
+	assert := require.New(t)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+
+	t.Run("test_get_request_success", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"dog": "127.0.0.1:50010", "bonks": "127.0.0.1:50012"})
+		request := newGetRequest(store, "bonks")
+
+		err := stun.handleGetRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_GET, response.Action)
+		assert.Equal("127.0.0.1:50012", response.Message)
+		assert.Equal("key-bonks", response.Key)
+		assert.Equal(addr, conn.writeToUDPMock.addr)
+	})
+
+	t.Run("test_get_request_introduces_registered_address", func(t *testing.T) {
+		stun, store, _ := newWatchedStun(map[string]string{"dog": "127.0.0.1:50010", "bonks": "127.0.0.1:50012"})
+		conn := newQueueUDPStunConnMock(addr, 2)
+		stun.conn = conn
+		request := newGetRequest(store, "bonks")
+
+		assert.NoError(stun.handleGetRequest(request, addr))
+
+		// bonks is told the address dog registered
+		// with, not the one the request came from
+		var introduction msg.MsgResponse
+		msg.Decode(<-conn.out, &introduction)
+		assert.Equal(msg.PEER_ACTION_INTRODUCE, introduction.Action)
+		assert.Equal("dog", introduction.Peername)
+		assert.Equal("127.0.0.1:50010", introduction.Message)
+	})
+
+	t.Run("test_get_request_fail_requester_not_registered", func(t *testing.T) {
+		stun, _, conn := newWatchedStun(map[string]string{"bonks": "127.0.0.1:50012"})
+		request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks")
+
+		err := stun.handleGetRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.ERROR_CODE_UNAUTHORIZED, response.Code)
+		assert.Equal(addr, conn.writeToUDPMock.addr)
+	})
+
+	t.Run("test_get_request_fail_invalid_token", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"dog": "127.0.0.1:50010", "bonks": "127.0.0.1:50012"})
+		request := newGetRequest(store, "bonks")
+		request.Token = "fake"
+
+		err := stun.handleGetRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.ERROR_CODE_UNAUTHORIZED, response.Code)
+		assert.Equal(addr, conn.writeToUDPMock.addr)
+	})
+
+	t.Run("test_get_request_fail_get_peer_remote_addr", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"dog": "127.0.0.1:50010"})
+		request := newGetRequest(store, "bonks")
+
+		err := stun.handleGetRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.ERROR_CODE_PEER_NOT_FOUND, response.Code)
+	})
+
+	t.Run("test_get_request_fail_response", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"dog": "127.0.0.1:50010", "bonks": "127.0.0.1:50012"})
+		request := newGetRequest(store, "bonks")
+		conn.writeToUDPMock.err = fmt.Errorf("Error")
+
+		err := stun.handleGetRequest(request, addr)
+
+		assert.Error(err)
+	})
+
+}
+
+func TestStunIntroduce(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_introduce_success", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		peerAddr := "127.0.0.1:50002"
+		store := NewMemoryPeerConnectionStore()
+		store.peers["dog"] = addr.String()
+		store.keys["dog"] = "key"
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+		stun.conn = conn
+
+		err := stun.introduce("dog", addr.String(), peerAddr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(peerAddr, conn.writeToUDPMock.addr.String())
+		assert.Equal(msg.PEER_ACTION_INTRODUCE, response.Action)
+		assert.Equal("dog", response.Peername)
+		assert.Equal(addr.String(), response.Message)
+		assert.Equal("key", response.Key)
+	})
+
+	t.Run("test_introduce_fail_resolve_peer_addr", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		store := NewMemoryPeerConnectionStore()
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
 
 		stun, _ := NewStun(saddr, store, options)
 		stun.Close()
 		stun.conn = conn
 
-		err := stun.handleNewRequest(request, addr)
+		err := stun.introduce("dog", addr.String(), "fakeaddr")
 
-		assert.NoError(err)
-		assert.Equal(request.Peername, store.savePeerRemoteAddrMock.peer)
-		assert.Equal(remoteAddr, store.savePeerRemoteAddrMock.addr)
-		assert.Equal(send, conn.writeToUDPMock.send)
+		assert.Error(err)
 	})
 
-	t.Run("test_new_request_fail_save_peer_remote_addr", func(t *testing.T) {
-		rerr := fmt.Errorf("Error")
+}
+
+func TestStunHandle(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_handle_action_new", func(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
-		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
-		store := &MockPeerConnectionStore{
-			savePeerRemoteAddrMock: &SavePeerRemoteAddrMock{err: rerr},
-			getPeerRemoteAddrMock:  &GetPeerRemoteAddrMock{addr: "fake"},
-		}
+		store := NewMemoryPeerConnectionStore()
 		options := NewStunOptions(true)
 		send := 10
 		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
@@ -238,40 +1066,38 @@ func TestStunHandleNewRequest(t *testing.T) {
 		stun.Close()
 		stun.conn = conn
 
-		err := stun.handleNewRequest(request, addr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
+		brequest, _ := json.Marshal(&request)
 
-		assert.Equal(request.Peername, store.getPeerRemoteAddrMock.peer)
-		assert.Equal(send, conn.writeToUDPMock.send)
-		assert.Error(err, rerr.Error())
+		action, _ := stun.handle(brequest, addr)
+
+		assert.Equal(msg.STUN_ACTION_NEW, action)
 	})
 
-	t.Run("test_new_request_fail_response", func(t *testing.T) {
-		rerr := fmt.Errorf("Error")
+	t.Run("test_handle_action_get", func(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
-		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
-		store := &MockPeerConnectionStore{savePeerRemoteAddrMock: &SavePeerRemoteAddrMock{}}
+		store := NewMemoryPeerConnectionStore()
 		options := NewStunOptions(true)
-		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{err: rerr}}
+		send := 10
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
 
 		stun, _ := NewStun(saddr, store, options)
 		stun.Close()
 		stun.conn = conn
 
-		err := stun.handleNewRequest(request, addr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks")
+		brequest, _ := json.Marshal(&request)
 
-		assert.Error(err, rerr.Error())
-	})
-}
+		action, _ := stun.handle(brequest, addr)
 
-func TestStunHandleGetRequest(t *testing.T) {
-	assert := require.New(t)
+		assert.Equal(msg.STUN_ACTION_GET, action)
+	})
 
-	t.Run("test_get_request_success", func(t *testing.T) {
+	t.Run("test_handle_action_disconnect", func(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
-		request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks")
-		store := &MockPeerConnectionStore{getPeerRemoteAddrMock: &GetPeerRemoteAddrMock{}}
+		store := NewMemoryPeerConnectionStore()
 		options := NewStunOptions(true)
 		send := 10
 		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
@@ -280,20 +1106,18 @@ func TestStunHandleGetRequest(t *testing.T) {
 		stun.Close()
 		stun.conn = conn
 
-		err := stun.handleGetRequest(request, addr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "bonks")
+		brequest, _ := json.Marshal(&request)
 
-		assert.NoError(err)
-		assert.Equal(request.Message, store.getPeerRemoteAddrMock.peer)
-		assert.Equal(send, conn.writeToUDPMock.send)
+		action, _ := stun.handle(brequest, addr)
+
+		assert.Equal(msg.STUN_ACTION_DISCONNECT, action)
 	})
 
-	t.Run("test_get_request_fail_get_peer_remote_addr", func(t *testing.T) {
-		rerr := fmt.Errorf("Error")
-		assert := require.New(t)
+	t.Run("test_handle_action_refresh", func(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
-		request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks")
-		store := &MockPeerConnectionStore{getPeerRemoteAddrMock: &GetPeerRemoteAddrMock{err: rerr}}
+		store := NewMemoryPeerConnectionStore()
 		options := NewStunOptions(true)
 		send := 10
 		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
@@ -302,37 +1126,41 @@ func TestStunHandleGetRequest(t *testing.T) {
 		stun.Close()
 		stun.conn = conn
 
-		err := stun.handleGetRequest(request, addr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "dog", "")
+		brequest, _ := json.Marshal(&request)
 
-		assert.Equal(request.Message, store.getPeerRemoteAddrMock.peer)
-		assert.Equal(send, conn.writeToUDPMock.send)
-		assert.Error(err, rerr.Error())
+		action, _ := stun.handle(brequest, addr)
+
+		assert.Equal(msg.STUN_ACTION_REFRESH, action)
 	})
 
-	t.Run("test_get_request_fail_response", func(t *testing.T) {
-		rerr := fmt.Errorf("Error")
+	t.Run("test_handle_action_probe", func(t *testing.T) {
 		saddr := ":50000"
-		addr, _ := net.ResolveUDPAddr("udp4", saddr)
-		request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks")
-		store := &MockPeerConnectionStore{getPeerRemoteAddrMock: &GetPeerRemoteAddrMock{}}
-		options := NewStunOptions(true)
-		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{err: rerr}}
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50001")
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
 
-		stun, _ := NewStun(saddr, store, options)
+		stun, _ := NewStun(saddr, NewMemoryPeerConnectionStore(), NewStunOptions(true))
 		stun.Close()
 		stun.conn = conn
 
-		err := stun.handleGetRequest(request, addr)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_PROBE, "", "")
+		request.Id = "id"
+		brequest, _ := json.Marshal(&request)
 
-		assert.Error(err, rerr.Error())
-	})
+		action, err := stun.handle(brequest, addr)
 
-}
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
 
-func TestStunHandle(t *testing.T) {
-	assert := require.New(t)
+		assert.NoError(err)
+		assert.Equal(msg.STUN_ACTION_PROBE, action)
+		assert.Equal(msg.PEER_ACTION_PROBE, response.Action)
+		assert.Equal("id", response.Id)
+		assert.Equal("127.0.0.1:50001", response.Message)
+		assert.False(response.HasError)
+	})
 
-	t.Run("test_handle_action_new", func(t *testing.T) {
+	t.Run("test_handle_action_fail_unknown", func(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
 		store := NewMemoryPeerConnectionStore()
@@ -344,72 +1172,105 @@ func TestStunHandle(t *testing.T) {
 		stun.Close()
 		stun.conn = conn
 
-		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
+		request := msg.NewMsgRequest("fake action", "dog", "bonks")
 		brequest, _ := json.Marshal(&request)
 
-		action, _ := stun.handle(brequest, addr)
+		_, err := stun.handle(brequest, addr)
 
-		assert.Equal(msg.STUN_ACTION_NEW, action)
+		assert.Error(err)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+		assert.Equal(msg.ERROR_CODE_UNKNOWN_ACTION, response.Code)
 	})
 
-	t.Run("test_handle_action_get", func(t *testing.T) {
+	t.Run("test_handle_fail_unsupported_version", func(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
 		store := NewMemoryPeerConnectionStore()
-		options := NewStunOptions(true)
-		send := 10
-		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
 
-		stun, _ := NewStun(saddr, store, options)
+		stun, _ := NewStun(saddr, store, NewStunOptions(true))
 		stun.Close()
 		stun.conn = conn
 
-		request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks")
-		brequest, _ := json.Marshal(&request)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "bonks")
+		request.Version = msg.PROTOCOL_VERSION + 1
+		brequest, _ := msg.Encode(msg.BinaryCodec{}, request)
 
-		action, _ := stun.handle(brequest, addr)
+		action, err := stun.handle(brequest, addr)
 
-		assert.Equal(msg.STUN_ACTION_GET, action)
+		assert.Error(err)
+		assert.Empty(action)
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+		assert.True(response.HasError)
+		assert.Contains(response.Message, "unsupported protocol version")
+		assert.Equal(msg.ERROR_CODE_UNSUPPORTED_VERSION, response.Code)
+		_, err = store.GetPeerRemoteAddr("dog")
+		assert.Error(err)
 	})
 
-	t.Run("test_handle_action_disconnect", func(t *testing.T) {
+	t.Run("test_handle_fail_below_min_version", func(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
 		store := NewMemoryPeerConnectionStore()
-		options := NewStunOptions(true)
-		send := 10
-		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
+		options := NewStunOptions(true).WithMinVersion(msg.PROTOCOL_VERSION)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
 
 		stun, _ := NewStun(saddr, store, options)
 		stun.Close()
 		stun.conn = conn
 
-		request := msg.NewMsgRequest(msg.STUN_ACTION_DISCONNECT, "dog", "bonks")
-		brequest, _ := json.Marshal(&request)
+		legacy, _ := json.Marshal(msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks"))
 
-		action, _ := stun.handle(brequest, addr)
+		_, err := stun.handle(legacy, addr)
 
-		assert.Equal(msg.STUN_ACTION_DISCONNECT, action)
+		assert.Error(err)
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+		assert.True(response.HasError)
 	})
 
-	t.Run("test_handle_action_fail_unknown", func(t *testing.T) {
+	t.Run("test_handle_hello_registers_peer", func(t *testing.T) {
 		saddr := ":50000"
 		addr, _ := net.ResolveUDPAddr("udp4", saddr)
 		store := NewMemoryPeerConnectionStore()
-		options := NewStunOptions(true)
-		send := 10
-		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{send: send}}
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
 
-		stun, _ := NewStun(saddr, store, options)
+		stun, _ := NewStun(saddr, store, NewStunOptions(true))
 		stun.Close()
 		stun.conn = conn
 
-		request := msg.NewMsgRequest("fake action", "dog", "bonks")
-		brequest, _ := json.Marshal(&request)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, "dog", "")
+		request.Hello([]string{msg.FEATURE_ENCRYPTION})
+		signRequest(&request)
+		brequest, _ := msg.Encode(msg.BinaryCodec{}, request)
 
 		_, err := stun.handle(brequest, addr)
 
-		assert.Error(err)
+		assert.NoError(err)
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+		assert.False(response.HasError)
+		assert.Equal(msg.PROTOCOL_VERSION, response.Version)
+	})
+
+	t.Run("test_handle_replies_in_request_codec", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+		stun, store, _ := newWatchedStun(map[string]string{"dog": "127.0.0.1:50010", "bonks": "127.0.0.1:50012"})
+		conn := newQueueUDPStunConnMock(addr, 2)
+		stun.conn = conn
+		request, _ := msg.Encode(msg.JSONCodec{}, newGetRequest(store, "bonks"))
+
+		_, err := stun.handle(request, addr)
+
+		// bonks did not ask for the introduction,
+		// it is written with the server codec
+		assert.NoError(err)
+		introduction, response := <-conn.out, <-conn.out
+		assert.Equal(byte(msg.WIRE_VERSION<<4|msg.CODEC_BINARY), introduction[0])
+		assert.Equal(byte(msg.WIRE_VERSION<<4|msg.CODEC_JSON), response[0])
 	})
 }
 
@@ -461,6 +1322,60 @@ func TestStunError(t *testing.T) {
 
 }
 
+func TestStunReply(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_reply_echoes_request_id", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		store := NewMemoryPeerConnectionStore()
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks")
+		request.Id = "fake"
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		stun.conn = conn
+
+		_, err := stun.Reply(request, msg.PEER_ACTION_GET, "godzilla", addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(request.Id, response.Id)
+		assert.Equal(request.Peername, response.Peername)
+		assert.False(response.HasError)
+	})
+
+	t.Run("test_reply_error_echoes_request_id", func(t *testing.T) {
+		saddr := ":50000"
+		addr, _ := net.ResolveUDPAddr("udp4", saddr)
+		store := NewMemoryPeerConnectionStore()
+		options := NewStunOptions(true)
+		conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+		request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "dog", "bonks")
+		request.Id = "fake"
+
+		stun, _ := NewStun(saddr, store, options)
+		stun.Close()
+
+		stun.conn = conn
+
+		_, err := stun.ReplyError(request, msg.PEER_ACTION_GET, "godzilla", addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(request.Id, response.Id)
+		assert.True(response.HasError)
+	})
+
+}
+
 func TestStunReadFromUDP(t *testing.T) {
 	assert := require.New(t)
 
@@ -509,7 +1424,7 @@ func TestStunGetConnectedPeers(t *testing.T) {
 	assert := require.New(t)
 
 	t.Run("test_get_connected_peers", func(t *testing.T) {
-		expected := []PeerInfo{{"Fake", "FakeAddr"}}
+		expected := []PeerInfo{{"Fake", "FakeAddr", "FakeKey"}}
 		saddr := ":50000"
 		store := &MockPeerConnectionStore{getConnectedPeersMock: &GetConnectedPeersMock{info: expected}}
 		options := NewStunOptions(true)
@@ -533,7 +1448,7 @@ func TestStunServe(t *testing.T) {
 		store := NewMemoryPeerConnectionStore()
 		options := NewStunOptions(true)
 		request, _ := json.Marshal(msg.NewMsgRequest("bonks", "dog", "godzilla"))
-		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{bb: request}, writeToUDPMock: &WriteToUDPMock{}}
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{bb: request}, writeToUDPMock: &WriteToUDPMock{}, closeMock: &CloseMock{}}
 
 		var str bytes.Buffer
 		log.SetOutput(&str)
@@ -542,10 +1457,16 @@ func TestStunServe(t *testing.T) {
 		stun.Close()
 		stun.conn = conn
 
-		go stun.Serve()
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error)
+		go func() { result <- stun.Serve(ctx) }()
 
 		time.Sleep(1 * time.Second)
+		cancel()
+
+		assert.ErrorIs(<-result, context.Canceled)
 		assert.Contains(str.String(), "Server is ready")
+		assert.True(conn.closeMock.hasBeenCalled)
 	})
 
 	t.Run("test_serve_fail_read_from_udp", func(t *testing.T) {
@@ -553,7 +1474,7 @@ func TestStunServe(t *testing.T) {
 		rerr := fmt.Errorf("Error")
 		store := NewMemoryPeerConnectionStore()
 		options := NewStunOptions(true)
-		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{err: rerr}}
+		conn := &UDPStunConnMock{readFromUDPMock: &ReadFromUDPMock{err: rerr}, closeMock: &CloseMock{}}
 
 		var str bytes.Buffer
 		log.SetOutput(&str)
@@ -562,10 +1483,291 @@ func TestStunServe(t *testing.T) {
 		stun.Close()
 		stun.conn = conn
 
-		go stun.Serve()
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error)
+		go func() { result <- stun.Serve(ctx) }()
 
 		time.Sleep(1 * time.Second)
+		cancel()
+
+		<-result
 		assert.Contains(str.String(), rerr.Error())
 	})
 
+	t.Run("test_serve_returns_once_closed", func(t *testing.T) {
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), NewStunOptions(false))
+
+		result := make(chan error)
+		go func() { result <- stun.Serve(context.Background()) }()
+		time.Sleep(100 * time.Millisecond)
+		stun.Close()
+
+		select {
+		case err := <-result:
+			assert.ErrorIs(err, ErrServerClosed)
+		case <-time.After(time.Second):
+			t.Fatal("serve kept reading from a closed connection")
+		}
+	})
+
+	t.Run("test_serve_handles_every_datagram_with_his_own_buffer", func(t *testing.T) {
+		peers := 50
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50000")
+		store := newRegisteredStore(peers)
+		conn := newQueueUDPStunConnMock(addr, 2*peers)
+
+		stun, _ := NewStun("127.0.0.1:0", store, NewStunOptions(false).WithWorkers(4, 1))
+		stun.Close()
+		stun.conn = conn
+
+		go stun.Serve(context.Background())
+		defer stun.Shutdown(context.Background())
+
+		for i := 0; i < peers; i++ {
+			conn.in <- newLookup(i, i)
+		}
+
+		// every lookup is answered and introduced
+		answered := map[string]string{}
+		for i := 0; i < 2*peers; i++ {
+			select {
+			case datagram := <-conn.out:
+				var response msg.MsgResponse
+				assert.NoError(msg.Decode(datagram, &response))
+				if response.Action == msg.PEER_ACTION_GET {
+					assert.False(response.HasError)
+					answered[response.Id] = response.Message
+				}
+			case <-time.After(5 * time.Second):
+				assert.Fail("lookup not answered")
+			}
+		}
+
+		assert.Len(answered, peers)
+		for i := 0; i < peers; i++ {
+			assert.Equal(fmt.Sprintf("127.0.0.1:%d", 1000+i), answered[fmt.Sprint(i)])
+		}
+	})
+
+	t.Run("test_shutdown_drains_requests", func(t *testing.T) {
+		peers := 20
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50000")
+		conn := newQueueUDPStunConnMock(addr, 2*peers)
+
+		stun, _ := NewStun("127.0.0.1:0", newRegisteredStore(peers), NewStunOptions(false).WithWorkers(1, peers))
+		stun.Close()
+		stun.conn = conn
+
+		result := make(chan error)
+		go func() { result <- stun.Serve(context.Background()) }()
+
+		for i := 0; i < peers; i++ {
+			conn.in <- newLookup(i, i)
+		}
+		assert.Eventually(func() bool { return len(conn.in) == 0 }, 5*time.Second, time.Millisecond)
+
+		assert.NoError(stun.Shutdown(context.Background()))
+
+		assert.ErrorIs(<-result, ErrServerClosed)
+		assert.Len(conn.out, 2*peers)
+		assert.True(conn.closed)
+	})
+
+	t.Run("test_shutdown_notifies_peers", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50000")
+		conn := newQueueUDPStunConnMock(addr, 4)
+
+		stun, _ := NewStun("127.0.0.1:0", newRegisteredStore(2), NewStunOptions(false).WithShutdownNotice(true))
+		stun.Close()
+		stun.conn = conn
+
+		result := make(chan error)
+		go func() { result <- stun.Serve(context.Background()) }()
+		assert.Eventually(func() bool { return isServing(stun) }, time.Second, time.Millisecond)
+		assert.NoError(stun.Shutdown(context.Background()))
+		<-result
+
+		notified := []string{}
+		for len(conn.out) > 0 {
+			var response msg.MsgResponse
+			msg.Decode(<-conn.out, &response)
+			assert.Equal(msg.PEER_ACTION_SHUTDOWN, response.Action)
+			notified = append(notified, response.Peername)
+		}
+		assert.ElementsMatch([]string{"dog0", "dog1", "cat"}, notified)
+	})
+
+	t.Run("test_shutdown_fail_context_done", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50000")
+		conn := newQueueUDPStunConnMock(addr, 2)
+		release := make(chan struct{})
+		store := &blockingPeerConnectionStore{newRegisteredStore(1), release}
+
+		stun, _ := NewStun("127.0.0.1:0", store, NewStunOptions(false))
+		stun.Close()
+		stun.conn = conn
+
+		result := make(chan error)
+		go func() { result <- stun.Serve(context.Background()) }()
+		conn.in <- newLookup(0, 0)
+		assert.Eventually(func() bool { return len(conn.in) == 0 }, 5*time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := stun.Shutdown(ctx)
+
+		assert.ErrorIs(err, context.DeadlineExceeded)
+		assert.True(conn.closed)
+		close(release)
+		assert.ErrorIs(<-result, ErrServerClosed)
+	})
+
+	t.Run("test_shutdown_not_serving", func(t *testing.T) {
+		conn := &UDPStunConnMock{closeMock: &CloseMock{}}
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), NewStunOptions(false))
+		stun.Close()
+		stun.conn = conn
+
+		assert.NoError(stun.Shutdown(context.Background()))
+
+		assert.True(conn.closeMock.hasBeenCalled)
+		assert.ErrorIs(stun.Serve(context.Background()), ErrServerClosed)
+	})
+
+	t.Run("test_serve_fail_already_serving", func(t *testing.T) {
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50000")
+		conn := newQueueUDPStunConnMock(addr, 1)
+		stun, _ := NewStun("127.0.0.1:0", NewMemoryPeerConnectionStore(), NewStunOptions(false))
+		stun.Close()
+		stun.conn = conn
+
+		go stun.Serve(context.Background())
+		defer stun.Shutdown(context.Background())
+		assert.Eventually(func() bool { return isServing(stun) }, time.Second, time.Millisecond)
+
+		assert.Error(stun.Serve(context.Background()))
+	})
+
+	t.Run("test_serve_answers_json_clients_of_binary_server", func(t *testing.T) {
+		_, saddr := startStun(t, NewStunOptions(false))
+		_, identity, _ := ed25519.GenerateKey(nil)
+		client := newLocalClient(t, saddr, NewClientStunOptions(false, 10).WithCodec(msg.JSONCodec{}).WithIdentity(identity))
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(err)
+		defer conn.Close()
+
+		request := msg.NewMsgRequest(msg.STUN_ACTION_PROBE, "dog", "")
+		request.Version = msg.PROTOCOL_VERSION
+		jrequest, _ := msg.Encode(msg.JSONCodec{}, request)
+		_, err = conn.WriteToUDP(jrequest, saddr)
+		assert.NoError(err)
+
+		buff := make([]byte, STUN_BUFFER_SIZE)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUDP(buff)
+		assert.NoError(err)
+		assert.Equal(byte(msg.WIRE_VERSION<<4|msg.CODEC_JSON), buff[0])
+
+		var response msg.MsgResponse
+		assert.NoError(json.Unmarshal(buff[1:n], &response))
+		assert.False(response.HasError)
+		assert.Equal(localAddr(conn).String(), response.Message)
+
+		_, err = client.Request(timeoutContext(t, 1), "cat", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+	})
+}
+
+// Checks if the given server is serving
+func isServing(stun *Stun) bool {
+	stun.state.Lock()
+	defer stun.state.Unlock()
+	return stun.state.serving
+}
+
+// Identity of cat, the peer that looks up the
+// peers of the stores built by `newRegisteredStore`
+var lookupKey, lookupIdentity, _ = ed25519.GenerateKey(nil)
+
+// Creates a memory store with the given number
+// of registered peers and cat, who looks them up
+func newRegisteredStore(peers int) PeerConnectionStore {
+	store := NewMemoryPeerConnectionStore()
+	for i := 0; i < peers; i++ {
+		store.SavePeerRemoteAddr(fmt.Sprintf("dog%d", i), fmt.Sprintf("127.0.0.1:%d", 1000+i))
+		store.SavePeerKey(fmt.Sprintf("dog%d", i), "key")
+	}
+	store.SavePeerRemoteAddr("cat", "127.0.0.1:999")
+	store.SavePeerKey("cat", msg.EncodeKey(lookupKey))
+	store.SavePeerToken("cat", "token-cat")
+	return store
+}
+
+// Builds the lookup with the given id of
+// the registered peer with the given number
+func newLookup(id int, i int) []byte {
+	request := msg.NewMsgRequest(msg.STUN_ACTION_GET, "cat", fmt.Sprintf("dog%d", i))
+	request.Id = fmt.Sprint(id)
+	request.Token = "token-cat"
+	request.Hello(nil)
+	request.Sign(lookupIdentity)
+	datagram, _ := msg.Encode(msg.BinaryCodec{}, request)
+	return datagram
+}
+
+// Serves the given requests with the given
+// number of workers and waits until they
+// are answered with the given number of
+// datagrams each
+func benchmarkServe(b *testing.B, store PeerConnectionStore, workers int, requests [][]byte, answers int) {
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50000")
+	conn := newQueueUDPStunConnMock(addr, 1024)
+
+	stun, _ := NewStun("127.0.0.1:0", store, NewStunOptions(false).WithWorkers(workers, DEFAULT_QUEUE_SIZE))
+	stun.Close()
+	stun.conn = conn
+	go stun.Serve(context.Background())
+	defer stun.Shutdown(context.Background())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for _, request := range requests {
+			conn.in <- request
+		}
+	}()
+	for i := 0; i < len(requests)*answers; i++ {
+		<-conn.out
+	}
+	b.StopTimer()
+}
+
+func BenchmarkStunServe(b *testing.B) {
+	for _, workers := range []int{1, 8, DEFAULT_WORKERS} {
+		b.Run(fmt.Sprintf("registrations_%d_workers", workers), func(b *testing.B) {
+			_, identity, _ := ed25519.GenerateKey(nil)
+			requests := make([][]byte, b.N)
+			for i := range requests {
+				request := msg.NewMsgRequest(msg.STUN_ACTION_NEW, fmt.Sprintf("dog%d", i), "")
+				request.Id = fmt.Sprint(i)
+				request.Hello(nil)
+				request.Sign(identity)
+				requests[i], _ = msg.Encode(msg.BinaryCodec{}, request)
+			}
+
+			benchmarkServe(b, NewMemoryPeerConnectionStore(), workers, requests, 1)
+		})
+
+		b.Run(fmt.Sprintf("lookups_%d_workers", workers), func(b *testing.B) {
+			store := newRegisteredStore(1000)
+			requests := make([][]byte, b.N)
+			for i := range requests {
+				requests[i] = newLookup(i, i%1000)
+			}
+
+			// lookups are answered and introduced
+			benchmarkServe(b, store, workers, requests, 2)
+		})
+	}
 }
@@ -1,22 +1,38 @@
 package stun
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"sync"
+	"time"
 )
 
 type PeerInfo struct {
 	Peername string
 	Addr     string
+	Key      string
 }
 
 // Interface for structs that allow to store
-// Peers information about their addresses
+// Peers information about their addresses.
+// Every registration is leased until his
+// expiration time, once it is reached the
+// peer is removed by `DeleteExpiredPeers`.
+// Every peer owns his name through the public
+// key saved by `SavePeerKey`
 type PeerConnectionStore interface {
 	SavePeerRemoteAddr(peer string, addr string) error
 	DeletePeerRemoteAddr(peer string) error
 	GetPeerRemoteAddr(peer string) (string, error)
 	GetConnectedPeers() ([]PeerInfo, error)
+	UpdatePeerRemoteAddr(peer string, addr string) error
+	SetPeerExpiration(peer string, expiration time.Time) error
+	DeleteExpiredPeers(now time.Time) ([]string, error)
+	SavePeerToken(peer string, token string) error
+	GetPeerToken(peer string) (string, error)
+	SavePeerKey(peer string, key string) error
+	GetPeerKey(peer string) (string, error)
 }
 
 // Peer connection store in memory.
@@ -26,35 +42,40 @@ type PeerConnectionStore interface {
 // implementation
 type memoryPeerConnectionStore struct {
 	sync.RWMutex
-	peers map[string]string
+	peers       map[string]string
+	expirations map[string]time.Time
+	tokens      map[string]string
+	keys        map[string]string
 }
 
 // Saves the given addr for the given peer
 func (store *memoryPeerConnectionStore) SavePeerRemoteAddr(peer string, addr string) error {
-	// checks that the given peer does not exist in the network
-	_, err := store.GetPeerRemoteAddr(peer)
-	if err == nil {
+	store.Lock()
+	defer store.Unlock()
+
+	// checks that the given peer does not exist in the
+	// network while holding the lock, so only one of
+	// many concurrent registrations of a name succeeds
+	if _, exists := store.peers[peer]; exists {
 		return fmt.Errorf("peer `%s` already registered", peer)
 	}
-
-	store.Lock()
 	store.peers[peer] = addr
-	store.Unlock()
-
 	return nil
 }
 
 // Removes the given peer addr if the peer exists
 func (store *memoryPeerConnectionStore) DeletePeerRemoteAddr(peer string) error {
+	store.Lock()
+	defer store.Unlock()
+
 	// checks that the given peer exists in the network
-	_, err := store.GetPeerRemoteAddr(peer)
-	if err != nil {
+	if _, exists := store.peers[peer]; !exists {
 		return fmt.Errorf("peer `%s` does not exist", peer)
 	}
-
-	store.Lock()
 	delete(store.peers, peer)
-	store.Unlock()
+	delete(store.expirations, peer)
+	delete(store.tokens, peer)
+	delete(store.keys, peer)
 	return nil
 }
 
@@ -76,15 +97,183 @@ func (store *memoryPeerConnectionStore) GetConnectedPeers() ([]PeerInfo, error)
 	peernames := []PeerInfo{}
 	store.RLock()
 	for peername, addr := range store.peers {
-		peernames = append(peernames, PeerInfo{peername, addr})
+		peernames = append(peernames, PeerInfo{peername, addr, store.keys[peername]})
 	}
 	store.RUnlock()
 	return peernames, nil
 }
 
+// Replaces the addr of the given peer
+// if the peer exists
+func (store *memoryPeerConnectionStore) UpdatePeerRemoteAddr(peer string, addr string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, exists := store.peers[peer]; !exists {
+		return fmt.Errorf("peer `%s` does not exist", peer)
+	}
+	store.peers[peer] = addr
+	return nil
+}
+
+// Saves the session token issued to
+// the given peer
+func (store *memoryPeerConnectionStore) SavePeerToken(peer string, token string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, exists := store.peers[peer]; !exists {
+		return fmt.Errorf("peer `%s` does not exist", peer)
+	}
+	store.tokens[peer] = token
+	return nil
+}
+
+// Retrieves the session token issued
+// to the given peer
+func (store *memoryPeerConnectionStore) GetPeerToken(peer string) (string, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	token, exists := store.tokens[peer]
+	if !exists {
+		return "", fmt.Errorf("token of peer %s not found", peer)
+	}
+	return token, nil
+}
+
+// Saves the public key that identifies
+// the given peer
+func (store *memoryPeerConnectionStore) SavePeerKey(peer string, key string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, exists := store.peers[peer]; !exists {
+		return fmt.Errorf("peer `%s` does not exist", peer)
+	}
+	store.keys[peer] = key
+	return nil
+}
+
+// Retrieves the public key that
+// identifies the given peer
+func (store *memoryPeerConnectionStore) GetPeerKey(peer string) (string, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	key, exists := store.keys[peer]
+	if !exists {
+		return "", fmt.Errorf("key of peer %s not found", peer)
+	}
+	return key, nil
+}
+
+// Sets the time when the registration
+// of the given peer expires
+func (store *memoryPeerConnectionStore) SetPeerExpiration(peer string, expiration time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, exists := store.peers[peer]; !exists {
+		return fmt.Errorf("peer `%s` does not exist", peer)
+	}
+	store.expirations[peer] = expiration
+	return nil
+}
+
+// Removes the peers whose registration expired
+// before the given time and returns their names
+func (store *memoryPeerConnectionStore) DeleteExpiredPeers(now time.Time) ([]string, error) {
+	expired := []string{}
+	store.Lock()
+	for peer, expiration := range store.expirations {
+		if expiration.Before(now) {
+			delete(store.peers, peer)
+			delete(store.expirations, peer)
+			delete(store.tokens, peer)
+			delete(store.keys, peer)
+			expired = append(expired, peer)
+		}
+	}
+	store.Unlock()
+	return expired, nil
+}
+
+// Registration of a peer as it is
+// written into the store snapshots.
+// Zero expirations are never leased
+type peerRecord struct {
+	Peername   string    `json:"peername"`
+	Addr       string    `json:"addr"`
+	Key        string    `json:"key,omitempty"`
+	Token      string    `json:"token,omitempty"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// State of a store at some point in time
+type storeSnapshot struct {
+	Peers []peerRecord `json:"peers"`
+}
+
+// Writes every registration of the store
+// to the given writer, so it can be loaded
+// back later on by `Restore`
+func (store *memoryPeerConnectionStore) Snapshot(w io.Writer) error {
+	snapshot := storeSnapshot{Peers: []peerRecord{}}
+	store.RLock()
+	for peer, addr := range store.peers {
+		snapshot.Peers = append(snapshot.Peers, peerRecord{
+			Peername:   peer,
+			Addr:       addr,
+			Key:        store.keys[peer],
+			Token:      store.tokens[peer],
+			Expiration: store.expirations[peer],
+		})
+	}
+	store.RUnlock()
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// Replaces every registration of the store with
+// the ones written by `Snapshot` to the given
+// reader. Expired registrations are restored
+// too, they are removed by the next sweep
+func (store *memoryPeerConnectionStore) Restore(r io.Reader) error {
+	var snapshot storeSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return fmt.Errorf("cannot read store snapshot: %s", err)
+	}
+
+	restored := NewMemoryPeerConnectionStore()
+	for _, record := range snapshot.Peers {
+		restored.peers[record.Peername] = record.Addr
+		if record.Key != "" {
+			restored.keys[record.Peername] = record.Key
+		}
+		if record.Token != "" {
+			restored.tokens[record.Peername] = record.Token
+		}
+		if !record.Expiration.IsZero() {
+			restored.expirations[record.Peername] = record.Expiration
+		}
+	}
+
+	store.Lock()
+	store.peers = restored.peers
+	store.expirations = restored.expirations
+	store.tokens = restored.tokens
+	store.keys = restored.keys
+	store.Unlock()
+	return nil
+}
+
 // Creates a new memory peer connection store
 func NewMemoryPeerConnectionStore() *memoryPeerConnectionStore {
 	return &memoryPeerConnectionStore{
-		peers: map[string]string{},
+		peers:       map[string]string{},
+		expirations: map[string]time.Time{},
+		tokens:      map[string]string{},
+		keys:        map[string]string{},
 	}
 }
@@ -1,7 +1,9 @@
 package stun
 
 import (
+	"bytes"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -47,7 +49,25 @@ func TestMemoryPeerConnectionStoreDeletePeerRemoteAddr(t *testing.T) {
 
 		err := store.DeletePeerRemoteAddr(peer)
 
+		_, exists := store.peers[peer]
+
+		assert.NoError(err)
+		assert.False(exists)
+	})
+
+	t.Run("test_delete_peer_remote_addr_removes_expiration", func(t *testing.T) {
+		peer := "dog"
+		addr := "127.0.0.1:50000"
+		store := NewMemoryPeerConnectionStore()
+		store.peers[peer] = addr
+		store.expirations[peer] = time.Now()
+
+		err := store.DeletePeerRemoteAddr(peer)
+
+		_, exists := store.expirations[peer]
+
 		assert.NoError(err)
+		assert.False(exists)
 	})
 
 	t.Run("test_delete_peer_remote_addr_fail_not_exists", func(t *testing.T) {
@@ -93,9 +113,11 @@ func TestMemoryPeerConnectionStoreGetConnectedPeers(t *testing.T) {
 	t.Run("test_get_connected_peers_success", func(t *testing.T) {
 		peer := "dog"
 		addr := "127.0.0.1:50000"
-		expected := []PeerInfo{{peer, addr}}
+		key := "key"
+		expected := []PeerInfo{{peer, addr, key}}
 		store := NewMemoryPeerConnectionStore()
 		store.peers[peer] = addr
+		store.keys[peer] = key
 
 		result, err := store.GetConnectedPeers()
 
@@ -104,3 +126,236 @@ func TestMemoryPeerConnectionStoreGetConnectedPeers(t *testing.T) {
 	})
 
 }
+
+func TestMemoryPeerConnectionStoreUpdatePeerRemoteAddr(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_update_peer_remote_addr_success", func(t *testing.T) {
+		peer := "dog"
+		addr := "127.0.0.1:50001"
+		store := NewMemoryPeerConnectionStore()
+		store.peers[peer] = "127.0.0.1:50000"
+
+		err := store.UpdatePeerRemoteAddr(peer, addr)
+
+		assert.NoError(err)
+		assert.Equal(addr, store.peers[peer])
+	})
+
+	t.Run("test_update_peer_remote_addr_fail_not_exists", func(t *testing.T) {
+		peer := "dog"
+		store := NewMemoryPeerConnectionStore()
+
+		err := store.UpdatePeerRemoteAddr(peer, "127.0.0.1:50001")
+
+		assert.Error(err)
+	})
+
+}
+
+func TestMemoryPeerConnectionStoreSavePeerToken(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_save_peer_token_success", func(t *testing.T) {
+		peer := "dog"
+		token := "token"
+		store := NewMemoryPeerConnectionStore()
+		store.peers[peer] = "127.0.0.1:50000"
+
+		err := store.SavePeerToken(peer, token)
+
+		assert.NoError(err)
+		assert.Equal(token, store.tokens[peer])
+	})
+
+	t.Run("test_save_peer_token_fail_not_exists", func(t *testing.T) {
+		peer := "dog"
+		store := NewMemoryPeerConnectionStore()
+
+		err := store.SavePeerToken(peer, "token")
+
+		assert.Error(err)
+	})
+
+}
+
+func TestMemoryPeerConnectionStoreGetPeerToken(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_get_peer_token_success", func(t *testing.T) {
+		peer := "dog"
+		token := "token"
+		store := NewMemoryPeerConnectionStore()
+		store.tokens[peer] = token
+
+		result, err := store.GetPeerToken(peer)
+
+		assert.NoError(err)
+		assert.Equal(token, result)
+	})
+
+	t.Run("test_get_peer_token_fail_not_exists", func(t *testing.T) {
+		peer := "dog"
+		store := NewMemoryPeerConnectionStore()
+
+		_, err := store.GetPeerToken(peer)
+
+		assert.Error(err)
+	})
+
+}
+
+func TestMemoryPeerConnectionStoreSavePeerKey(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_save_peer_key_success", func(t *testing.T) {
+		peer := "dog"
+		key := "key"
+		store := NewMemoryPeerConnectionStore()
+		store.peers[peer] = "127.0.0.1:50000"
+
+		err := store.SavePeerKey(peer, key)
+
+		assert.NoError(err)
+		assert.Equal(key, store.keys[peer])
+	})
+
+	t.Run("test_save_peer_key_fail_not_exists", func(t *testing.T) {
+		peer := "dog"
+		store := NewMemoryPeerConnectionStore()
+
+		err := store.SavePeerKey(peer, "key")
+
+		assert.Error(err)
+	})
+
+	t.Run("test_delete_peer_remote_addr_removes_key", func(t *testing.T) {
+		peer := "dog"
+		store := NewMemoryPeerConnectionStore()
+		store.peers[peer] = "127.0.0.1:50000"
+		store.keys[peer] = "key"
+
+		err := store.DeletePeerRemoteAddr(peer)
+
+		assert.NoError(err)
+		assert.Empty(store.keys)
+	})
+
+}
+
+func TestMemoryPeerConnectionStoreGetPeerKey(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_get_peer_key_success", func(t *testing.T) {
+		peer := "dog"
+		key := "key"
+		store := NewMemoryPeerConnectionStore()
+		store.keys[peer] = key
+
+		result, err := store.GetPeerKey(peer)
+
+		assert.NoError(err)
+		assert.Equal(key, result)
+	})
+
+	t.Run("test_get_peer_key_fail_not_exists", func(t *testing.T) {
+		peer := "dog"
+		store := NewMemoryPeerConnectionStore()
+
+		_, err := store.GetPeerKey(peer)
+
+		assert.Error(err)
+	})
+
+}
+
+func TestMemoryPeerConnectionStoreSetPeerExpiration(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_set_peer_expiration_success", func(t *testing.T) {
+		peer := "dog"
+		addr := "127.0.0.1:50000"
+		expiration := time.Now().Add(time.Minute)
+		store := NewMemoryPeerConnectionStore()
+		store.peers[peer] = addr
+
+		err := store.SetPeerExpiration(peer, expiration)
+
+		assert.NoError(err)
+		assert.Equal(expiration, store.expirations[peer])
+	})
+
+	t.Run("test_set_peer_expiration_fail_not_exists", func(t *testing.T) {
+		peer := "dog"
+		store := NewMemoryPeerConnectionStore()
+
+		err := store.SetPeerExpiration(peer, time.Now())
+
+		assert.Error(err)
+	})
+
+}
+
+func TestMemoryPeerConnectionStoreDeleteExpiredPeers(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_delete_expired_peers_success", func(t *testing.T) {
+		now := time.Now()
+		store := NewMemoryPeerConnectionStore()
+		store.peers["dog"] = "127.0.0.1:50000"
+		store.expirations["dog"] = now.Add(-time.Second)
+		store.peers["cat"] = "127.0.0.1:50001"
+		store.expirations["cat"] = now.Add(time.Second)
+		store.peers["fox"] = "127.0.0.1:50002"
+
+		expired, err := store.DeleteExpiredPeers(now)
+
+		_, exists := store.peers["dog"]
+
+		assert.NoError(err)
+		assert.Equal([]string{"dog"}, expired)
+		assert.False(exists)
+		assert.Len(store.peers, 2)
+	})
+
+}
+
+func TestMemoryPeerConnectionStoreSnapshot(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_snapshot_restore_success", func(t *testing.T) {
+		expiration := time.Now().Add(time.Minute).Round(0)
+		store := NewMemoryPeerConnectionStore()
+		store.SavePeerRemoteAddr("dog", "127.0.0.1:50000")
+		store.SavePeerKey("dog", "key")
+		store.SavePeerToken("dog", "token")
+		store.SetPeerExpiration("dog", expiration)
+		store.SavePeerRemoteAddr("cat", "127.0.0.1:50001")
+
+		var snapshot bytes.Buffer
+		err := store.Snapshot(&snapshot)
+		assert.NoError(err)
+
+		restored := NewMemoryPeerConnectionStore()
+		restored.SavePeerRemoteAddr("bird", "127.0.0.1:50002")
+		err = restored.Restore(&snapshot)
+
+		assert.NoError(err)
+		assert.Equal(store.peers, restored.peers)
+		assert.Equal(store.keys, restored.keys)
+		assert.Equal(store.tokens, restored.tokens)
+		assert.True(expiration.Equal(restored.expirations["dog"]))
+		assert.NotContains(restored.expirations, "cat")
+	})
+
+	t.Run("test_restore_fail_invalid_snapshot", func(t *testing.T) {
+		store := NewMemoryPeerConnectionStore()
+		store.SavePeerRemoteAddr("dog", "127.0.0.1:50000")
+
+		err := store.Restore(bytes.NewBufferString("bonks"))
+
+		assert.Error(err)
+		assert.Contains(store.peers, "dog")
+	})
+
+}
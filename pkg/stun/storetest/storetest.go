@@ -0,0 +1,426 @@
+// Package storetest checks the semantics the stun
+// server relies on from a `stun.PeerConnectionStore`,
+// so every store implementation can run the same
+// conformance suite from his own tests:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) stun.PeerConnectionStore {
+//			return NewMyStore()
+//		})
+//	}
+//
+// Run it with `go test -race` to check the store
+// can be used by many server workers at once
+package storetest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/stun"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// Goroutines used by the concurrency tests
+	CONCURRENCY = 32
+)
+
+// Creates a new empty store for every test. Stores
+// that hold resources should release them with
+// `t.Cleanup`
+type Factory func(t *testing.T) stun.PeerConnectionStore
+
+// Registers the given peer the way the stun
+// server does when he sends `STUN_ACTION_NEW`
+func save(store stun.PeerConnectionStore, peer string, addr string, expiration time.Time) error {
+	if err := store.SavePeerRemoteAddr(peer, addr); err != nil {
+		return err
+	}
+	if err := store.SavePeerKey(peer, "key-"+peer); err != nil {
+		return err
+	}
+	if err := store.SavePeerToken(peer, "token-"+peer); err != nil {
+		return err
+	}
+	return store.SetPeerExpiration(peer, expiration)
+}
+
+// Registers the given peer failing the test
+// if the store cannot save it
+func register(t *testing.T, store stun.PeerConnectionStore, peer string, addr string, expiration time.Time) {
+	require.NoError(t, save(store, peer, addr, expiration))
+}
+
+// Returns the names of the connected peers sorted
+func connected(t *testing.T, store stun.PeerConnectionStore) []string {
+	peers, err := store.GetConnectedPeers()
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, peer := range peers {
+		names = append(names, peer.Peername)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Runs the whole conformance suite against
+// stores created by the given factory
+func Run(t *testing.T, factory Factory) {
+	t.Run("registration", func(t *testing.T) { RunRegistration(t, factory) })
+	t.Run("session", func(t *testing.T) { RunSession(t, factory) })
+	t.Run("expiration", func(t *testing.T) { RunExpiration(t, factory) })
+	t.Run("concurrency", func(t *testing.T) { RunConcurrency(t, factory) })
+}
+
+// Checks peer addresses are saved, updated and
+// deleted. Names can only be registered once, even
+// from the same address, until they are deleted
+func RunRegistration(t *testing.T, factory Factory) {
+	t.Run("test_save_peer_remote_addr", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+
+		assert.NoError(store.SavePeerRemoteAddr("dog", "127.0.0.1:1000"))
+
+		addr, err := store.GetPeerRemoteAddr("dog")
+		assert.NoError(err)
+		assert.Equal("127.0.0.1:1000", addr)
+	})
+
+	t.Run("test_save_peer_remote_addr_fail_duplicated", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		assert.NoError(store.SavePeerRemoteAddr("dog", "127.0.0.1:1000"))
+
+		assert.Error(store.SavePeerRemoteAddr("dog", "127.0.0.1:2000"))
+
+		addr, _ := store.GetPeerRemoteAddr("dog")
+		assert.Equal("127.0.0.1:1000", addr)
+	})
+
+	t.Run("test_save_peer_remote_addr_fail_same_address", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		assert.NoError(store.SavePeerRemoteAddr("dog", "127.0.0.1:1000"))
+
+		// the server tells reclaims apart by this error
+		assert.Error(store.SavePeerRemoteAddr("dog", "127.0.0.1:1000"))
+	})
+
+	t.Run("test_get_peer_remote_addr_fail_missing", func(t *testing.T) {
+		store := factory(t)
+
+		_, err := store.GetPeerRemoteAddr("dog")
+
+		require.Error(t, err)
+	})
+
+	t.Run("test_update_peer_remote_addr", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		register(t, store, "dog", "127.0.0.1:1000", time.Now().Add(time.Hour))
+
+		assert.NoError(store.UpdatePeerRemoteAddr("dog", "127.0.0.1:2000"))
+
+		addr, _ := store.GetPeerRemoteAddr("dog")
+		assert.Equal("127.0.0.1:2000", addr)
+		key, _ := store.GetPeerKey("dog")
+		assert.Equal("key-dog", key)
+	})
+
+	t.Run("test_update_peer_remote_addr_fail_missing", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+
+		assert.Error(store.UpdatePeerRemoteAddr("dog", "127.0.0.1:2000"))
+
+		_, err := store.GetPeerRemoteAddr("dog")
+		assert.Error(err)
+	})
+
+	t.Run("test_delete_peer_remote_addr", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		register(t, store, "dog", "127.0.0.1:1000", time.Now().Add(time.Hour))
+
+		assert.NoError(store.DeletePeerRemoteAddr("dog"))
+
+		_, err := store.GetPeerRemoteAddr("dog")
+		assert.Error(err)
+		_, err = store.GetPeerKey("dog")
+		assert.Error(err)
+		_, err = store.GetPeerToken("dog")
+		assert.Error(err)
+		assert.Empty(connected(t, store))
+	})
+
+	t.Run("test_delete_peer_remote_addr_fail_missing", func(t *testing.T) {
+		store := factory(t)
+
+		require.Error(t, store.DeletePeerRemoteAddr("dog"))
+	})
+
+	t.Run("test_save_peer_remote_addr_after_delete", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		register(t, store, "dog", "127.0.0.1:1000", time.Now().Add(time.Hour))
+		assert.NoError(store.DeletePeerRemoteAddr("dog"))
+
+		assert.NoError(store.SavePeerRemoteAddr("dog", "127.0.0.1:2000"))
+
+		addr, _ := store.GetPeerRemoteAddr("dog")
+		assert.Equal("127.0.0.1:2000", addr)
+		_, err := store.GetPeerKey("dog")
+		assert.Error(err)
+	})
+
+	t.Run("test_get_connected_peers", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		assert.Empty(connected(t, store))
+
+		register(t, store, "dog", "127.0.0.1:1000", time.Now().Add(time.Hour))
+		register(t, store, "cat", "127.0.0.1:1001", time.Now().Add(time.Hour))
+
+		peers, err := store.GetConnectedPeers()
+		assert.NoError(err)
+		sort.Slice(peers, func(i, j int) bool { return peers[i].Peername < peers[j].Peername })
+		assert.Equal([]stun.PeerInfo{
+			{Peername: "cat", Addr: "127.0.0.1:1001", Key: "key-cat"},
+			{Peername: "dog", Addr: "127.0.0.1:1000", Key: "key-dog"},
+		}, peers)
+	})
+}
+
+// Checks keys and session tokens belong to
+// registered peers and are replaced by newer ones
+func RunSession(t *testing.T, factory Factory) {
+	t.Run("test_save_peer_key", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		assert.NoError(store.SavePeerRemoteAddr("dog", "127.0.0.1:1000"))
+
+		assert.NoError(store.SavePeerKey("dog", "key"))
+		assert.NoError(store.SavePeerKey("dog", "another key"))
+
+		key, err := store.GetPeerKey("dog")
+		assert.NoError(err)
+		assert.Equal("another key", key)
+	})
+
+	t.Run("test_save_peer_key_fail_missing", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+
+		assert.Error(store.SavePeerKey("dog", "key"))
+
+		_, err := store.GetPeerKey("dog")
+		assert.Error(err)
+	})
+
+	t.Run("test_save_peer_token", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		assert.NoError(store.SavePeerRemoteAddr("dog", "127.0.0.1:1000"))
+
+		assert.NoError(store.SavePeerToken("dog", "token"))
+		assert.NoError(store.SavePeerToken("dog", "another token"))
+
+		token, err := store.GetPeerToken("dog")
+		assert.NoError(err)
+		assert.Equal("another token", token)
+	})
+
+	t.Run("test_save_peer_token_fail_missing", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+
+		assert.Error(store.SavePeerToken("dog", "token"))
+
+		_, err := store.GetPeerToken("dog")
+		assert.Error(err)
+	})
+}
+
+// Checks registrations are removed once their
+// lease expires and never before
+func RunExpiration(t *testing.T, factory Factory) {
+	t.Run("test_delete_expired_peers", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		now := time.Now()
+		register(t, store, "dog", "127.0.0.1:1000", now.Add(-time.Minute))
+		register(t, store, "cat", "127.0.0.1:1001", now.Add(time.Hour))
+
+		expired, err := store.DeleteExpiredPeers(now)
+
+		assert.NoError(err)
+		assert.Equal([]string{"dog"}, expired)
+		assert.Equal([]string{"cat"}, connected(t, store))
+		_, err = store.GetPeerKey("dog")
+		assert.Error(err)
+		_, err = store.GetPeerToken("dog")
+		assert.Error(err)
+	})
+
+	t.Run("test_delete_expired_peers_none", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		register(t, store, "dog", "127.0.0.1:1000", time.Now().Add(time.Hour))
+
+		expired, err := store.DeleteExpiredPeers(time.Now())
+
+		assert.NoError(err)
+		assert.Empty(expired)
+		assert.Equal([]string{"dog"}, connected(t, store))
+	})
+
+	t.Run("test_set_peer_expiration_extends_lease", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		now := time.Now()
+		register(t, store, "dog", "127.0.0.1:1000", now.Add(-time.Minute))
+
+		assert.NoError(store.SetPeerExpiration("dog", now.Add(time.Hour)))
+		expired, err := store.DeleteExpiredPeers(now)
+
+		assert.NoError(err)
+		assert.Empty(expired)
+	})
+
+	t.Run("test_set_peer_expiration_fail_missing", func(t *testing.T) {
+		store := factory(t)
+
+		require.Error(t, store.SetPeerExpiration("dog", time.Now()))
+	})
+
+	t.Run("test_unleased_peers_never_expire", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		assert.NoError(store.SavePeerRemoteAddr("dog", "127.0.0.1:1000"))
+
+		expired, err := store.DeleteExpiredPeers(time.Now().Add(time.Hour))
+
+		assert.NoError(err)
+		assert.Empty(expired)
+		assert.Equal([]string{"dog"}, connected(t, store))
+	})
+
+	t.Run("test_deleted_peers_never_expire", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+		now := time.Now()
+		register(t, store, "dog", "127.0.0.1:1000", now.Add(-time.Minute))
+		assert.NoError(store.DeletePeerRemoteAddr("dog"))
+		assert.NoError(store.SavePeerRemoteAddr("dog", "127.0.0.1:2000"))
+
+		// the lease of the deleted registration
+		// does not apply to the new one
+		expired, err := store.DeleteExpiredPeers(now)
+
+		assert.NoError(err)
+		assert.Empty(expired)
+	})
+}
+
+// Checks the store can be used by many server
+// workers at once. Names must be registered
+// atomically, so only one of many concurrent
+// registrations of the same name succeeds
+func RunConcurrency(t *testing.T, factory Factory) {
+	t.Run("test_concurrent_save_same_peer", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, CONCURRENCY)
+		for i := 0; i < CONCURRENCY; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- store.SavePeerRemoteAddr("dog", fmt.Sprintf("127.0.0.1:%d", 1000+i))
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		saved := 0
+		for err := range errs {
+			if err == nil {
+				saved++
+			}
+		}
+		assert.Equal(1, saved)
+		assert.Equal([]string{"dog"}, connected(t, store))
+	})
+
+	t.Run("test_concurrent_register_different_peers", func(t *testing.T) {
+		assert := require.New(t)
+		store := factory(t)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, CONCURRENCY)
+		for i := 0; i < CONCURRENCY; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- save(store, fmt.Sprintf("dog%d", i), fmt.Sprintf("127.0.0.1:%d", 1000+i), time.Now().Add(time.Hour))
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			assert.NoError(err)
+		}
+
+		assert.Len(connected(t, store), CONCURRENCY)
+		for i := 0; i < CONCURRENCY; i++ {
+			token, err := store.GetPeerToken(fmt.Sprintf("dog%d", i))
+			assert.NoError(err)
+			assert.Equal(fmt.Sprintf("token-dog%d", i), token)
+		}
+	})
+
+	t.Run("test_concurrent_reads_and_writes", func(t *testing.T) {
+		store := factory(t)
+		now := time.Now()
+
+		var wg sync.WaitGroup
+		for i := 0; i < CONCURRENCY; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				peer := fmt.Sprintf("dog%d", i)
+				store.SavePeerRemoteAddr(peer, "127.0.0.1:1000")
+				store.SavePeerKey(peer, "key")
+				store.SetPeerExpiration(peer, now.Add(time.Duration(i%2*2-1)*time.Minute))
+				store.UpdatePeerRemoteAddr(peer, "127.0.0.1:2000")
+				store.GetPeerRemoteAddr(peer)
+				store.GetPeerKey(peer)
+				store.GetConnectedPeers()
+				store.DeleteExpiredPeers(now)
+				if i%4 == 0 {
+					store.DeletePeerRemoteAddr(peer)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// peers whose lease was in the future and
+		// were not deleted are still registered
+		expected := []string{}
+		for i := 0; i < CONCURRENCY; i++ {
+			if i%2 == 1 {
+				expected = append(expected, fmt.Sprintf("dog%d", i))
+			}
+		}
+		sort.Strings(expected)
+		require.Equal(t, expected, connected(t, store))
+	})
+}
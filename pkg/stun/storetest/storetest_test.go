@@ -0,0 +1,44 @@
+package storetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alvarogf97/fox/pkg/stun"
+	"github.com/alvarogf97/fox/pkg/stun/redistest"
+)
+
+func TestMemoryPeerConnectionStore(t *testing.T) {
+	Run(t, func(t *testing.T) stun.PeerConnectionStore {
+		return stun.NewMemoryPeerConnectionStore()
+	})
+}
+
+func TestFilePeerConnectionStore(t *testing.T) {
+	Run(t, func(t *testing.T) stun.PeerConnectionStore {
+		store, err := stun.NewFilePeerConnectionStore(t.TempDir(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestRedisPeerConnectionStore(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+
+	prefixes := 0
+	Run(t, func(t *testing.T) stun.PeerConnectionStore {
+		// every test gets its own registry
+		prefixes++
+		options := stun.NewRedisStoreOptions(fmt.Sprintf("test%d:", prefixes))
+		store, err := stun.NewRedisPeerConnectionStore(server.Addr(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
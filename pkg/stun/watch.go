@@ -0,0 +1,192 @@
+package stun
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+)
+
+// Names a peer watches. Peers that watch
+// no names in particular watch every peer
+// but the private ones
+type watch struct {
+	all   bool
+	names map[string]bool
+}
+
+// Checks the given peer is watched, private
+// peers only when they are watched by name
+func (watch watch) watches(peername string, private bool) bool {
+	return watch.names[peername] || (watch.all && !private)
+}
+
+// Peers registered into the server that are
+// told when the peers they watch join, leave
+// or move, indexed by their names. Watches
+// are not stored, they are lost once the
+// watcher leaves or the server restarts
+type watchTable struct {
+	sync.Mutex
+	watches map[string]watch
+}
+
+// Replaces the names the given peer watches.
+// No names means every peer
+func (table *watchTable) watch(watcher string, names []string) watch {
+	table.Lock()
+	defer table.Unlock()
+
+	watch := watch{all: len(names) == 0, names: map[string]bool{}}
+	for _, name := range names {
+		watch.names[name] = true
+	}
+	table.watches[watcher] = watch
+	return watch
+}
+
+// Stops telling the given peer about anybody
+func (table *watchTable) unwatch(watcher string) {
+	table.Lock()
+	delete(table.watches, watcher)
+	table.Unlock()
+}
+
+// Returns the peers that watch the given one,
+// peers are never told about themselves
+func (table *watchTable) watchers(peername string, private bool) []string {
+	table.Lock()
+	defer table.Unlock()
+
+	watchers := []string{}
+	for watcher, watch := range table.watches {
+		if watcher != peername && watch.watches(peername, private) {
+			watchers = append(watchers, watcher)
+		}
+	}
+	return watchers
+}
+
+// Creates a new watch table without watchers
+func newWatchTable() *watchTable {
+	return &watchTable{watches: map[string]watch{}}
+}
+
+// Builds the notification telling the
+// given change of the given peer
+func newPresence(peername string, presence string, peerAddr string, peerKey string) msg.MsgResponse {
+	notification := msg.NewMsgResponse(msg.PEER_ACTION_PRESENCE, false, peername, peerAddr)
+	notification.Key = peerKey
+	notification.Headers = map[string]string{msg.HEADER_PRESENCE: presence}
+	return notification
+}
+
+// Sends the given notification to the given
+// watcher through his registered address
+func (stun Stun) sendPresence(watcher string, notification msg.MsgResponse) error {
+	watcherAddr, err := stun.store.GetPeerRemoteAddr(watcher)
+	if err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", watcherAddr)
+	if err != nil {
+		return err
+	}
+
+	_, err = stun.notify(notification, addr)
+	return err
+}
+
+// Tells every peer watching the given one that
+// he changed. Peers that left carry no address
+func (stun Stun) notifyPresence(peername string, presence string, peerAddr string) {
+	watchers := stun.watches.watchers(peername, stun.profiles.private(peername))
+	if len(watchers) == 0 {
+		return
+	}
+
+	peerKey := ""
+	if presence != msg.PRESENCE_LEFT {
+		peerKey, _ = stun.store.GetPeerKey(peername)
+	}
+
+	notification := newPresence(peername, presence, peerAddr, peerKey)
+	for _, watcher := range watchers {
+		if err := stun.sendPresence(watcher, notification); err != nil {
+			stun.log("Cannot tell ", watcher, " about ", peername, " ", err)
+		}
+	}
+}
+
+// Forgets the watches and the profile of the
+// given peer and tells his watchers he left
+func (stun Stun) leave(peername string) {
+	stun.watches.unwatch(peername)
+	stun.notifyPresence(peername, msg.PRESENCE_LEFT, "")
+	stun.profiles.remove(peername)
+}
+
+// Handles the watch requests of registered
+// peers. The requested names, or every public
+// name if there's none, replace the ones watched
+// before and the watcher is told about the
+// watched peers already registered as if
+// they had just joined
+func (stun Stun) handleWatchRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
+	if _, err := stun.store.GetPeerRemoteAddr(request.Peername); err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_WATCH, msg.ERROR_CODE_PEER_NOT_FOUND, err.Error(), addr)
+		return err
+	}
+
+	if err := stun.authenticate(request); err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_WATCH, msg.ERROR_CODE_UNAUTHORIZED, err.Error(), addr)
+		return err
+	}
+
+	names, err := msg.DecodeNames(request.Message)
+	if err != nil {
+		stun.ReplyError(request, msg.PEER_ACTION_WATCH, err.Error(), addr)
+		return err
+	}
+
+	peers, err := stun.store.GetConnectedPeers()
+	if err != nil {
+		stun.ReplyError(request, msg.PEER_ACTION_WATCH, err.Error(), addr)
+		return err
+	}
+
+	watch := stun.watches.watch(request.Peername, names)
+	if _, err := stun.Reply(request, msg.PEER_ACTION_WATCH, "", addr); err != nil {
+		return err
+	}
+
+	for _, peer := range peers {
+		private := stun.profiles.private(peer.Peername)
+		if peer.Peername == request.Peername || !watch.watches(peer.Peername, private) {
+			continue
+		}
+
+		notification := newPresence(peer.Peername, msg.PRESENCE_JOINED, peer.Addr, peer.Key)
+		if _, err := stun.send(notification, addr); err != nil {
+			return fmt.Errorf("cannot tell %s about %s: %s", request.Peername, peer.Peername, err)
+		}
+	}
+	return nil
+}
+
+// Handles the requests of the peers that
+// no longer want to watch anybody
+func (stun Stun) handleUnwatchRequest(request msg.MsgRequest, addr *net.UDPAddr) error {
+	if err := stun.authenticate(request); err != nil {
+		stun.ReplyErrorCode(request, msg.PEER_ACTION_UNWATCH, msg.ERROR_CODE_UNAUTHORIZED, err.Error(), addr)
+		return err
+	}
+
+	stun.watches.unwatch(request.Peername)
+	if _, err := stun.Reply(request, msg.PEER_ACTION_UNWATCH, "", addr); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package stun
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alvarogf97/fox/pkg/msg"
+	"github.com/stretchr/testify/require"
+)
+
+// Reads the next presence notification
+// received by the given client
+func nextPresence(t *testing.T, client *DefaultStunClient) *msg.MsgResponse {
+	received := make(chan *msg.MsgResponse, 1)
+	go func() {
+		for {
+			if message := client.Listen(); message.Action == msg.PEER_ACTION_PRESENCE {
+				received <- message
+				return
+			}
+		}
+	}()
+
+	select {
+	case message := <-received:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("presence not received in time")
+		return nil
+	}
+}
+
+// Creates a stun server that writes to a mock
+// connection whose store registers the given
+// peers with their names as keys and tokens
+func newWatchedStun(peers map[string]string) (*Stun, *memoryPeerConnectionStore, *UDPStunConnMock) {
+	store := NewMemoryPeerConnectionStore()
+	for peername, addr := range peers {
+		registerPeer(store, peername, addr, time.Now().Add(time.Minute))
+	}
+
+	conn := &UDPStunConnMock{writeToUDPMock: &WriteToUDPMock{}}
+	stun, _ := NewStun("127.0.0.1:0", store, NewStunOptions(false))
+	stun.Close()
+	stun.conn = conn
+
+	// the peers told a public profile
+	for peername := range peers {
+		stun.profiles.set(peername, msg.PeerProfile{})
+	}
+	return stun, store, conn
+}
+
+func TestWatchTable(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_watch_table_watchers", func(t *testing.T) {
+		table := newWatchTable()
+		table.watch("bob", []string{"alice"})
+		table.watch("carol", nil)
+
+		assert.ElementsMatch([]string{"bob", "carol"}, table.watchers("alice", false))
+		assert.Equal([]string{"carol"}, table.watchers("dave", false))
+		assert.Empty(table.watchers("carol", false))
+	})
+
+	t.Run("test_watch_table_replaces_names", func(t *testing.T) {
+		table := newWatchTable()
+		table.watch("bob", []string{"alice"})
+
+		watch := table.watch("bob", []string{"dave"})
+
+		assert.False(watch.all)
+		assert.True(watch.watches("dave", false))
+		assert.Empty(table.watchers("alice", false))
+	})
+
+	t.Run("test_watch_table_private_peers_only_watched_by_name", func(t *testing.T) {
+		table := newWatchTable()
+		table.watch("bob", []string{"alice"})
+		table.watch("carol", nil)
+
+		assert.Equal([]string{"bob"}, table.watchers("alice", true))
+		assert.Empty(table.watchers("dave", true))
+	})
+
+	t.Run("test_watch_table_unwatch", func(t *testing.T) {
+		table := newWatchTable()
+		table.watch("bob", nil)
+
+		table.unwatch("bob")
+
+		assert.Empty(table.watchers("alice", false))
+	})
+}
+
+func TestStunHandleWatchRequest(t *testing.T) {
+	assert := require.New(t)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50011")
+
+	t.Run("test_watch_request_fail_not_registered", func(t *testing.T) {
+		stun, _, conn := newWatchedStun(nil)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_WATCH, "bob", "")
+
+		err := stun.handleWatchRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.ERROR_CODE_PEER_NOT_FOUND, response.Code)
+		assert.Empty(stun.watches.watchers("alice", false))
+	})
+
+	t.Run("test_watch_request_fail_invalid_token", func(t *testing.T) {
+		stun, _, conn := newWatchedStun(map[string]string{"bob": addr.String()})
+		request := msg.NewMsgRequest(msg.STUN_ACTION_WATCH, "bob", "")
+		request.Token = "fake"
+
+		err := stun.handleWatchRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.PEER_ACTION_WATCH, response.Action)
+		assert.Equal(msg.ERROR_CODE_UNAUTHORIZED, response.Code)
+	})
+
+	t.Run("test_watch_request_fail_malformed_names", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": addr.String()})
+		request := msg.NewMsgRequest(msg.STUN_ACTION_WATCH, "bob", "alice")
+		request.Token = "token-bob"
+		store.keys["bob"] = signRequest(&request)
+
+		err := stun.handleWatchRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.True(response.HasError)
+		assert.Contains(response.Message, "malformed")
+	})
+
+	t.Run("test_watch_request_tells_registered_peers", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": addr.String(), "alice": "127.0.0.1:50010"})
+		names, _ := msg.EncodeNames([]string{"alice"})
+		request := msg.NewMsgRequest(msg.STUN_ACTION_WATCH, "bob", names)
+		request.Token = "token-bob"
+		store.keys["bob"] = signRequest(&request)
+
+		err := stun.handleWatchRequest(request, addr)
+
+		var notification msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &notification)
+
+		assert.NoError(err)
+		assert.Equal([]string{"bob"}, stun.watches.watchers("alice", false))
+		assert.Equal(msg.PEER_ACTION_PRESENCE, notification.Action)
+		assert.Equal("alice", notification.Peername)
+		assert.Equal("127.0.0.1:50010", notification.Message)
+		assert.Equal("key-alice", notification.Key)
+		assert.Equal(msg.PRESENCE_JOINED, notification.Header(msg.HEADER_PRESENCE))
+		assert.Equal(addr, conn.writeToUDPMock.addr)
+	})
+
+	t.Run("test_watch_request_skips_private_peers_for_everybody", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": addr.String(), "alice": "127.0.0.1:50010"})
+		stun.profiles.set("alice", msg.PeerProfile{Private: true})
+		request := msg.NewMsgRequest(msg.STUN_ACTION_WATCH, "bob", "")
+		request.Token = "token-bob"
+		store.keys["bob"] = signRequest(&request)
+
+		err := stun.handleWatchRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_WATCH, response.Action)
+		assert.Empty(stun.watches.watchers("alice", true))
+	})
+
+	t.Run("test_watch_request_skips_peers_with_unknown_profiles", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": addr.String(), "alice": "127.0.0.1:50010"})
+		stun.profiles.remove("alice")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_WATCH, "bob", "")
+		request.Token = "token-bob"
+		store.keys["bob"] = signRequest(&request)
+
+		err := stun.handleWatchRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_WATCH, response.Action)
+	})
+
+	t.Run("test_unwatch_request", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": addr.String()})
+		stun.watches.watch("bob", nil)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_UNWATCH, "bob", "")
+		request.Token = "token-bob"
+		store.keys["bob"] = signRequest(&request)
+
+		err := stun.handleUnwatchRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_UNWATCH, response.Action)
+		assert.Empty(stun.watches.watchers("alice", false))
+	})
+
+	t.Run("test_unwatch_request_fail_invalid_token", func(t *testing.T) {
+		stun, _, conn := newWatchedStun(map[string]string{"bob": addr.String()})
+		stun.watches.watch("bob", nil)
+		request := msg.NewMsgRequest(msg.STUN_ACTION_UNWATCH, "bob", "")
+
+		err := stun.handleUnwatchRequest(request, addr)
+
+		var response msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &response)
+
+		assert.Error(err)
+		assert.Equal(msg.ERROR_CODE_UNAUTHORIZED, response.Code)
+		assert.Equal([]string{"bob"}, stun.watches.watchers("alice", false))
+	})
+}
+
+func TestStunNotifyPresence(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_refresh_from_another_address_tells_moved", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": "127.0.0.1:50011", "alice": "127.0.0.1:50010"})
+		stun.watches.watch("bob", nil)
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50012")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "alice", "")
+		request.Token = "token-alice"
+		store.keys["alice"] = signRequest(&request)
+
+		assert.NoError(stun.handleRefreshRequest(request, addr))
+
+		var notification msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &notification)
+
+		assert.Equal(msg.PRESENCE_MOVED, notification.Header(msg.HEADER_PRESENCE))
+		assert.Equal("alice", notification.Peername)
+		assert.Equal("127.0.0.1:50012", notification.Message)
+		assert.Equal("127.0.0.1:50011", conn.writeToUDPMock.addr.String())
+	})
+
+	t.Run("test_sweep_tells_left", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": "127.0.0.1:50011"})
+		registerPeer(store, "alice", "127.0.0.1:50010", time.Now().Add(-time.Minute))
+		stun.watches.watch("bob", []string{"alice"})
+		stun.watches.watch("alice", nil)
+
+		_, err := stun.sweep(time.Now())
+		assert.NoError(err)
+
+		var notification msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &notification)
+
+		assert.Equal(msg.PRESENCE_LEFT, notification.Header(msg.HEADER_PRESENCE))
+		assert.Equal("alice", notification.Peername)
+		assert.Empty(notification.Message)
+		assert.Empty(notification.Key)
+		assert.Equal("127.0.0.1:50011", conn.writeToUDPMock.addr.String())
+
+		// watchers that left are forgotten
+		assert.Empty(stun.watches.watchers("bob", false))
+	})
+
+	t.Run("test_peers_with_unknown_profiles_are_private", func(t *testing.T) {
+		stun, store, conn := newWatchedStun(map[string]string{"bob": "127.0.0.1:50011", "alice": "127.0.0.1:50010"})
+		stun.profiles.remove("alice")
+		stun.watches.watch("bob", nil)
+
+		stun.notifyPresence("alice", msg.PRESENCE_MOVED, "127.0.0.1:50012")
+		assert.Nil(conn.writeToUDPMock.b)
+
+		// the profile told on refresh makes her public again
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:50012")
+		request := msg.NewMsgRequest(msg.STUN_ACTION_REFRESH, "alice", "")
+		request.Token = "token-alice"
+		store.keys["alice"] = signRequest(&request)
+		assert.NoError(stun.handleRefreshRequest(request, addr))
+
+		var notification msg.MsgResponse
+		msg.Decode(conn.writeToUDPMock.b, &notification)
+		assert.Equal(msg.PRESENCE_MOVED, notification.Header(msg.HEADER_PRESENCE))
+		assert.Equal("127.0.0.1:50011", conn.writeToUDPMock.addr.String())
+	})
+
+	t.Run("test_watchers_that_are_gone_are_skipped", func(t *testing.T) {
+		stun, _, conn := newWatchedStun(map[string]string{"alice": "127.0.0.1:50010"})
+		stun.watches.watch("bob", nil)
+
+		stun.notifyPresence("alice", msg.PRESENCE_MOVED, "127.0.0.1:50012")
+
+		assert.Nil(conn.writeToUDPMock.b)
+	})
+}
+
+func TestStunPresence(t *testing.T) {
+	assert := require.New(t)
+
+	t.Run("test_watchers_are_told_about_joins_and_leaves", func(t *testing.T) {
+		_, saddr := startStun(t, NewStunOptions(false))
+		bob, _ := registerClient(t, saddr, "bob")
+
+		names, _ := msg.EncodeNames([]string{"alice"})
+		response, err := bob.Request(timeoutContext(t, 1), "bob", msg.STUN_ACTION_WATCH, names)
+		assert.NoError(err)
+		assert.Equal(msg.PEER_ACTION_WATCH, response.Action)
+
+		// alice joins
+		public, identity, _ := ed25519.GenerateKey(nil)
+		alice := newLocalClient(t, saddr, NewClientStunOptions(false, 10).WithIdentity(identity))
+		_, err = alice.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_NEW, "")
+		assert.NoError(err)
+
+		joined := nextPresence(t, bob)
+		assert.Equal("alice", joined.Peername)
+		assert.Equal(msg.PRESENCE_JOINED, joined.Header(msg.HEADER_PRESENCE))
+		assert.Equal(localAddr(alice.conn).String(), joined.Message)
+		assert.Equal(msg.EncodeKey(public), joined.Key)
+		assert.Equal(saddr.String(), joined.Addr.String())
+
+		// alice leaves
+		_, err = alice.Request(timeoutContext(t, 1), "alice", msg.STUN_ACTION_DISCONNECT, "")
+		assert.NoError(err)
+
+		left := nextPresence(t, bob)
+		assert.Equal("alice", left.Peername)
+		assert.Equal(msg.PRESENCE_LEFT, left.Header(msg.HEADER_PRESENCE))
+	})
+
+	t.Run("test_watchers_of_everybody_are_told_about_registered_peers", func(t *testing.T) {
+		stun, saddr := startStun(t, NewStunOptions(false))
+		registerClient(t, saddr, "alice")
+		bob, _ := registerClient(t, saddr, "bob")
+
+		_, err := bob.Request(timeoutContext(t, 1), "bob", msg.STUN_ACTION_WATCH, "")
+		assert.NoError(err)
+
+		joined := nextPresence(t, bob)
+		assert.Equal("alice", joined.Peername)
+		assert.Equal(msg.PRESENCE_JOINED, joined.Header(msg.HEADER_PRESENCE))
+
+		_, err = bob.Request(timeoutContext(t, 1), "bob", msg.STUN_ACTION_UNWATCH, "")
+		assert.NoError(err)
+		assert.Empty(stun.watches.watchers("alice", false))
+	})
+}